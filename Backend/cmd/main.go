@@ -1,38 +1,96 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"backend/internal/config"
 	"backend/internal/handler"
+	"backend/internal/logging"
 	"backend/internal/model"
 
 	"github.com/gin-gonic/gin"
 )
 
+// usage lists the commands; the flags are listed after it
+const usage = `Usage: server [flags] [command]
+
+Without a command the HTTP server is started. Commands:
+  migrate status|up
+  integrity check|repair
+  copy-to-postgres [DATABASE_URL]`
+
 func main() {
+	cfg, args, err := config.Load(os.Args[1:], usage)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(2)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	cfg.Apply()
+
+	// Maintenance commands run instead of the server
+	if len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+
 	log.Println("🚀 Starting Notes App...")
+	if cfg.File != "" {
+		log.Printf("⚙️  Configuration (read %s):", cfg.File)
+	} else {
+		log.Println("⚙️  Configuration (no config file):")
+	}
+	cfg.Print(log.Writer())
 
-	// Initialize database
-	model.InitDB()
-	log.Println("✅ Database initialized")
+	// Every endpoint goes through the stores
+	stores := openStores()
+	startJobs(stores, cfg)
+	h := handler.New(stores)
 
-	// Setup HTTP routes
-	router := gin.Default()
+	// Setup HTTP routes. debug adds gin's own output; warn and error leave
+	// out the request log.
+	if cfg.LogLevel == config.LogDebug {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	router := gin.New()
+	if cfg.LogRequests() {
+		router.Use(gin.Logger())
+	}
+	router.Use(gin.Recovery())
 
-	// CORS middleware
+	// CORS middleware. Without configured origins, local origins are echoed
+	// and any other gets "*".
 	router.Use(func(c *gin.Context) {
 		origin := c.Request.Header.Get("Origin")
 
-		if strings.Contains(origin, "localhost") || strings.Contains(origin, "127.0.0.1") {
+		if len(cfg.CORSOrigins) > 0 {
+			if origin != "" && cfg.AllowsOrigin(origin) {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+			c.Header("Vary", "Origin")
+		} else if strings.Contains(origin, "localhost") || strings.Contains(origin, "127.0.0.1") {
 			c.Header("Access-Control-Allow-Origin", origin)
 		} else {
 			c.Header("Access-Control-Allow-Origin", "*")
 		}
 
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Upload-Offset, Range, If-Range, If-None-Match")
+		c.Header("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Expires, ETag, Content-Range, Content-Disposition")
 		c.Header("Access-Control-Allow-Credentials", "true")
 
 		if c.Request.Method == "OPTIONS" {
@@ -51,32 +109,330 @@ func main() {
 		})
 	})
 
+	registerRoutes(router, h)
+	if cfg.Sync.Enabled {
+		registerSyncRoutes(router, h)
+	}
+
+	logging.Infof("🌐 Starting HTTP server on %s...", cfg.Listen)
+	logging.Infof("✅ Notes app is running!")
+	logging.Infof("🔗 Test: http://%s/health", healthHost(cfg.Listen))
+
+	if err := router.Run(cfg.Listen); err != nil {
+		log.Fatal("❌ Failed to start HTTP server:", err)
+	}
+}
+
+// healthHost returns an address to reach the server on, for the log
+func healthHost(listen string) string {
+	host, port, _ := net.SplitHostPort(listen)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// openStores opens the configured database, bringing its schema up to
+// date, and returns the stores on it
+func openStores() model.Stores {
+	if model.Storage.Backend == model.StoragePostgres {
+		return openPostgres()
+	}
+	return openSQLite()
+}
+
+// openSQLite opens the SQLite database and returns the stores on it
+func openSQLite() model.Stores {
+	// Initialize database
+	model.InitDB()
+	logging.Infof("✅ Database initialized")
+
+	return model.NewSQLiteStore(model.DB).Stores()
+}
+
+// openPostgres connects to database_url and returns the stores on it
+func openPostgres() model.Stores {
+	db, err := model.OpenPostgres(model.Storage.PostgresURL)
+	if err != nil {
+		log.Fatalf("❌ Failed to open PostgreSQL database: %v", err)
+	}
+	if err := model.CreateDefaultPostgresFolders(db); err != nil {
+		logging.Errorf("Error creating default folders: %v", err)
+	}
+	logging.Infof("✅ PostgreSQL database initialized")
+
+	return model.NewPostgresStore(db).Stores()
+}
+
+// startJobs starts the background jobs of the stores that have them
+func startJobs(stores model.Stores, cfg config.Config) {
+	// Apply revision retention to notes that are no longer being edited
+	if stores.Revisions != nil {
+		model.StartRevisionPruner(stores.Revisions, time.Hour)
+	}
+
+	// Permanently remove items that have been in the trash too long
+	if stores.Trash != nil {
+		model.StartTrashPurger(stores.Trash, time.Hour)
+	}
+	if stores.Sync != nil {
+		model.StartTombstoneCollector(stores.Sync, cfg.Sync.TombstoneInterval)
+	}
+
+	// Remove resumable uploads that were abandoned
+	model.StartUploadCleaner(stores.Uploads, time.Hour)
+
+	// Index the text of attachments for search
+	if stores.Text != nil {
+		model.StartTextExtractor(stores.Text)
+	}
+}
+
+// registerRoutes adds every endpoint but those of device sync
+func registerRoutes(router *gin.Engine, h *handler.Handler) {
 	// Note operations
-	router.GET("/folders", handler.HandleGetFolders)
-	router.POST("/folders", handler.HandleCreateFolder)
-	router.PUT("/folders/:id", handler.HandleUpdateFolder)
-	router.DELETE("/folders/:id", handler.HandleDeleteFolder)
-	router.GET("/folders/:id/notes", handler.HandleGetFolderNotes)
-	router.POST("/folders/:id/notes", handler.HandleCreateFolderNote)
-	router.PUT("/update", handler.HandleUpdate)
-	router.DELETE("/delete", handler.HandleDelete)
+	router.GET("/notes", h.HandleGet)
+	router.GET("/folders", h.HandleGetFolders)
+	router.POST("/folders", h.HandleCreateFolder)
+	router.PUT("/folders/:id", h.HandleUpdateFolder)
+	router.DELETE("/folders/:id", h.HandleDeleteFolder)
+	router.GET("/folders/:id/notes", h.HandleGetFolderNotes)
+	router.POST("/folders/:id/notes", h.HandleCreateFolderNote)
+	router.PUT("/update", h.HandleUpdate)
+	router.DELETE("/delete", h.HandleDelete)
+
+	// Folder tree
+	router.POST("/folders/:id/move", h.HandleMoveFolder)
+	router.GET("/folders/tree", h.HandleGetFolderTree)
+	router.GET("/folders/by-path/*path", h.HandleGetFolderByPath)
+
+	// Search
+	router.GET("/search", h.HandleSearch)
+
+	// Revision history
+	router.GET("/notes/:noteId/revisions", h.HandleGetRevisions)
+	router.GET("/notes/:noteId/revisions/:rev", h.HandleGetRevision)
+	router.GET("/notes/:noteId/revisions/:rev/diff", h.HandleDiffRevisions)
+	router.POST("/notes/:noteId/revisions/:rev/restore", h.HandleRestoreRevision)
+
+	// Tags
+	router.GET("/tags", h.HandleGetTags)
+	router.PUT("/tags/:name", h.HandleRenameTag)
+	router.DELETE("/tags/:name", h.HandleDeleteTag)
+	router.POST("/tags/merge", h.HandleMergeTags)
+	router.POST("/notes/:noteId/tags", h.HandleAddNoteTag)
+	router.DELETE("/notes/:noteId/tags/:name", h.HandleRemoveNoteTag)
+
+	// Trash
+	router.GET("/trash", h.HandleGetTrash)
+	router.POST("/trash/:type/:id/restore", h.HandleRestoreTrash)
+	router.DELETE("/trash", h.HandleEmptyTrash)
+
+	// Maintenance
+	router.GET("/admin/integrity", h.HandleCheckIntegrity)
+	router.POST("/admin/integrity/repair", h.HandleRepairIntegrity)
+	router.GET("/usage", h.HandleGetUsage)
 
 	// File operations
-	router.POST("/files/:noteId", handler.HandleFileUpload)
-	router.GET("/files/:id", handler.HandleServeFile)
-	router.GET("/notes/:noteId/attachments", handler.HandleGetAttachments)
+	router.POST("/files/:noteId", h.HandleFileUpload)
+	router.GET("/files/:id", h.HandleServeFile)
+	router.PATCH("/files/:id", h.HandleUpdateFile)
+	router.DELETE("/files/:id", h.HandleDeleteFile)
+	router.GET("/files/:id/thumbnail", h.HandleGetThumbnail)
+	router.GET("/notes/:noteId/attachments", h.HandleGetAttachments)
+	router.HEAD("/blobs/:sha256", h.HandleHeadBlob)
+
+	// Resumable uploads
+	router.POST("/uploads", h.HandleCreateUpload)
+	router.HEAD("/uploads/:id", h.HandleGetUpload)
+	router.GET("/uploads/:id", h.HandleGetUpload)
+	router.PATCH("/uploads/:id", h.HandlePatchUpload)
+	router.POST("/uploads/:id/complete", h.HandleCompleteUpload)
+	router.DELETE("/uploads/:id", h.HandleCancelUpload)
+}
 
-	// Sync endpoints
+// registerSyncRoutes adds the endpoints for device sync, unless sync is
+// disabled in the configuration
+func registerSyncRoutes(router *gin.Engine, h *handler.Handler) {
 	router.GET("/sync/health", handler.HandleSyncHealth)
-	router.POST("/sync", handler.HandleSync)
-	router.GET("/sync/attachment/:id", handler.HandleSyncAttachment)
+	router.POST("/sync", h.HandleSync)
+	router.GET("/sync/attachment/:id", h.HandleSyncAttachment)
+	router.GET("/conflicts", h.HandleGetConflicts)
+	router.POST("/conflicts/:id/resolve", h.HandleResolveConflict)
+	router.GET("/devices", h.HandleGetDevices)
+	router.PUT("/devices/:id", h.HandleRenameDevice)
+	router.POST("/devices/:id/revoke", h.HandleRevokeDevice)
+}
+
+// runCommand dispatches command line subcommands and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(args[1:])
+	case "integrity":
+		return runIntegrity(args[1:])
+	case "copy-to-postgres":
+		return runCopyToPostgres(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
 
-	log.Println("🌐 Starting HTTP server on :8080...")
-	log.Println("✅ Notes app is running!")
-	log.Println("🔗 Test: http://192.168.0.32:8080/health")
+// runMigrate handles `migrate status` and `migrate up`
+func runMigrate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: server migrate status|up")
+		return 2
+	}
 
-	// Start HTTP server on all interfaces
-	if err := router.Run("0.0.0.0:8080"); err != nil {
-		log.Fatal("❌ Failed to start HTTP server:", err)
+	// Open the configured database without migrating it
+	status, migrate, version := model.GetMigrationStatus, model.Migrate, model.SchemaVersion
+	if model.Storage.Backend == model.StoragePostgres {
+		db, err := model.ConnectPostgres(model.Storage.PostgresURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer db.Close()
+		status = func() ([]model.MigrationStatus, error) { return model.GetPostgresMigrationStatus(db) }
+		migrate = func() error { return model.MigratePostgres(db) }
+		version = func() (int, error) { return model.PostgresSchemaVersion(db) }
+	} else {
+		model.OpenDB()
+		defer model.DB.Close()
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read migration status: %v\n", err)
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			name := status.Name
+			if name == "" {
+				name = "(unknown to this binary)"
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, name, state)
+		}
+		w.Flush()
+		return 0
+	case "up":
+		if err := migrate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+		current, err := version()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("Database is at schema version %d\n", current)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown migrate command: %s\n", args[0])
+		return 2
+	}
+}
+
+// runIntegrity handles `integrity check`, a dry run that exits with 1 if
+// problems are found, and `integrity repair`
+func runIntegrity(args []string) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "repair") {
+		fmt.Fprintln(os.Stderr, "Usage: server integrity check|repair")
+		return 2
+	}
+
+	report, err := openStores().Integrity.CheckIntegrity(args[0] == "repair")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Integrity check failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Checked %d attachments and %d files\n", report.Attachments, report.Files)
+	if len(report.Issues) == 0 {
+		fmt.Println("No problems found")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tATTACHMENT\tFILE\tDETAILS\tSTATUS")
+	for _, issue := range report.Issues {
+		attachment := "-"
+		if issue.AttachmentID != nil {
+			attachment = fmt.Sprintf("%d", *issue.AttachmentID)
+		}
+		status := "not repairable"
+		if issue.Repaired {
+			status = "repaired"
+		} else if issue.Repairable {
+			status = "repairable"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", issue.Kind, attachment, issue.Filename, issue.Details, status)
+	}
+	w.Flush()
+
+	if !report.Repair {
+		fmt.Println("Dry run; run `integrity repair` to fix repairable problems")
+		return 1
+	}
+	fmt.Printf("Repaired %d problems, freed %d bytes\n", report.Repaired, report.FreedBytes)
+	if !report.DatabaseOK {
+		return 1
+	}
+	return 0
+}
+
+// runCopyToPostgres handles `copy-to-postgres`, which copies the SQLite
+// database into the PostgreSQL database given as argument or in
+// database_url
+func runCopyToPostgres(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: server copy-to-postgres [DATABASE_URL]")
+		return 2
+	}
+	url := model.Storage.PostgresURL
+	if len(args) == 1 {
+		url = args[0]
+	}
+
+	// Bring the SQLite database up to date first, as the server would
+	model.OpenDB()
+	defer model.DB.Close()
+	if err := model.Migrate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Migration of %s failed: %v\n", model.DatabasePath, err)
+		return 1
+	}
+
+	db, err := model.OpenPostgres(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	copied, err := model.CopyToPostgres(model.DB, db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Copy failed: %v\n", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tROWS\tSKIPPED")
+	for _, table := range copied {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", table.Table, table.Rows, table.Skipped)
 	}
+	w.Flush()
+	fmt.Printf("Copied %s; attachment files stay in %s\n", model.DatabasePath, model.AttachmentDir)
+	return 0
 }
@@ -0,0 +1,544 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"backend/internal/logging"
+	"backend/internal/model"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from, in increasing precedence: the defaults, a YAML
+// config file, environment variables and command line flags. The config
+// file is given with -config or CONFIG_FILE; otherwise DefaultFile is read
+// if it exists. Nested keys in the file are written with dots here, e.g.
+// uploads.max_attachment_mb.
+
+// DefaultFile is the config file read when none is given
+const DefaultFile = "config.yaml"
+
+// Log levels, from most to least verbose. Each one logs the messages of
+// its logging.Level and above.
+const (
+	LogDebug = "debug" // Also gin's debug output
+	LogInfo  = "info"  // Also the request log
+	LogWarn  = "warn"  // No request log
+	LogError = "error" // No request log
+)
+
+// logLevels maps the log levels to the logging package's
+var logLevels = map[string]logging.Level{
+	LogDebug: logging.Debug,
+	LogInfo:  logging.Info,
+	LogWarn:  logging.Warn,
+	LogError: logging.Error,
+}
+
+// Config is the configuration of the backend
+type Config struct {
+	Listen      string   // Address the HTTP server listens on
+	DataDir     string   // Holds the database, attachments and uploads
+	Database    string   // SQLite database file; notes.db in DataDir if empty
+	Storage     string   // model.StorageSQLite or model.StoragePostgres
+	DatabaseURL string   // PostgreSQL database, for the postgres storage
+	CORSOrigins []string // Origins allowed to call the API, "*" for any
+	LogLevel    string   // One of the Log constants
+
+	Uploads   UploadConfig
+	Sync      SyncConfig
+	Revisions RevisionConfig
+	Trash     TrashConfig
+
+	File    string            // Config file that was read, empty if none
+	sources map[string]string // Where each setting not left at its default came from
+}
+
+// UploadConfig limits what may be uploaded. Zero limits are unlimited,
+// except for MaxAttachmentMB.
+type UploadConfig struct {
+	MaxAttachmentMB       int64         // Largest attachment
+	MaxNoteKB             int64         // Largest note content
+	MaxStorageMB          int64         // All attachment files together
+	MaxAttachmentsPerNote int64         // Attachments on one note
+	Expiry                time.Duration // Resumable uploads idle this long are removed
+	StripEXIF             bool          // Remove metadata from JPEG and PNG images
+	ThumbnailSizes        []int         // Thumbnail sizes in pixels
+}
+
+// SyncConfig controls device sync
+type SyncConfig struct {
+	Enabled           bool          // Serve the sync, conflict and device endpoints
+	TombstoneInterval time.Duration // How often tombstones all devices have seen are removed
+}
+
+// RevisionConfig is the note revision retention; see model.RevisionPolicy
+type RevisionConfig struct {
+	KeepLast  int
+	ThinAfter time.Duration
+}
+
+// TrashConfig controls the trash
+type TrashConfig struct {
+	Retention time.Duration // Zero disables automatic purging
+}
+
+// setting is one configurable value
+type setting struct {
+	key   string                      // Key in the config file
+	env   string                      // Environment variable
+	flag  string                      // Command line flag
+	usage string                      // Description for -help
+	field func(c *Config) interface{} // Pointer to the field holding the value
+}
+
+var settings = []setting{
+	{"listen", "LISTEN_ADDR", "listen", "`address` the HTTP server listens on",
+		func(c *Config) interface{} { return &c.Listen }},
+	{"data_dir", "DATA_DIR", "data-dir", "`directory` holding the database, attachments and uploads",
+		func(c *Config) interface{} { return &c.DataDir }},
+	{"database", "DATABASE_PATH", "database", "SQLite database `file` (default notes.db in the data directory)",
+		func(c *Config) interface{} { return &c.Database }},
+	{"storage", "STORAGE", "storage", "storage `backend`: sqlite or postgres",
+		func(c *Config) interface{} { return &c.Storage }},
+	{"database_url", "DATABASE_URL", "database-url", "PostgreSQL database `url`",
+		func(c *Config) interface{} { return &c.DatabaseURL }},
+	{"cors_origins", "CORS_ORIGIN", "cors-origins", "comma-separated `origins` allowed to call the API, * for any",
+		func(c *Config) interface{} { return &c.CORSOrigins }},
+	{"log_level", "LOG_LEVEL", "log-level", "`level`: debug, info, warn or error",
+		func(c *Config) interface{} { return &c.LogLevel }},
+
+	{"uploads.max_attachment_mb", "MAX_ATTACHMENT_MB", "max-attachment-mb", "largest attachment in `MB`",
+		func(c *Config) interface{} { return &c.Uploads.MaxAttachmentMB }},
+	{"uploads.max_note_kb", "MAX_NOTE_KB", "max-note-kb", "largest note content in `KB`, 0 for unlimited",
+		func(c *Config) interface{} { return &c.Uploads.MaxNoteKB }},
+	{"uploads.max_storage_mb", "MAX_STORAGE_MB", "max-storage-mb", "all attachment files together in `MB`, 0 for unlimited",
+		func(c *Config) interface{} { return &c.Uploads.MaxStorageMB }},
+	{"uploads.max_attachments_per_note", "MAX_ATTACHMENTS_PER_NOTE", "max-attachments-per-note", "`number` of attachments on one note, 0 for unlimited",
+		func(c *Config) interface{} { return &c.Uploads.MaxAttachmentsPerNote }},
+	{"uploads.expiry", "UPLOAD_EXPIRY", "upload-expiry", "`duration` after which idle resumable uploads are removed",
+		func(c *Config) interface{} { return &c.Uploads.Expiry }},
+	{"uploads.strip_exif", "STRIP_EXIF", "strip-exif", "remove EXIF, XMP and GPS metadata from uploaded images",
+		func(c *Config) interface{} { return &c.Uploads.StripEXIF }},
+	{"uploads.thumbnail_sizes", "THUMBNAIL_SIZES", "thumbnail-sizes", "comma-separated thumbnail `sizes` in pixels",
+		func(c *Config) interface{} { return &c.Uploads.ThumbnailSizes }},
+
+	{"sync.enabled", "SYNC_ENABLED", "sync", "serve the sync, conflict and device endpoints",
+		func(c *Config) interface{} { return &c.Sync.Enabled }},
+	{"sync.tombstone_interval", "TOMBSTONE_INTERVAL", "tombstone-interval", "`duration` between removals of tombstones all devices have seen",
+		func(c *Config) interface{} { return &c.Sync.TombstoneInterval }},
+
+	{"revisions.keep_last", "REVISION_KEEP_LAST", "revision-keep-last", "`number` of revisions kept per note, 0 for all",
+		func(c *Config) interface{} { return &c.Revisions.KeepLast }},
+	{"revisions.thin_after", "REVISION_THIN_AFTER", "revision-thin-after", "`age` after which revisions are thinned to one a day, 0 for never",
+		func(c *Config) interface{} { return &c.Revisions.ThinAfter }},
+
+	{"trash.retention", "TRASH_RETENTION", "trash-retention", "`duration` items stay in the trash, 0 to keep them",
+		func(c *Config) interface{} { return &c.Trash.Retention }},
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		Listen:   "0.0.0.0:8080",
+		DataDir:  "data",
+		Storage:  model.StorageSQLite,
+		LogLevel: LogInfo,
+		Uploads: UploadConfig{
+			MaxAttachmentMB: model.MaxAttachmentSize >> 20,
+			Expiry:          model.UploadExpiry,
+			StripEXIF:       model.StripEXIF,
+			ThumbnailSizes:  model.ThumbnailSizes,
+		},
+		Sync: SyncConfig{
+			Enabled:           true,
+			TombstoneInterval: time.Hour,
+		},
+		Revisions: RevisionConfig{
+			KeepLast:  model.Revisions.KeepLast,
+			ThinAfter: model.Revisions.ThinAfter,
+		},
+		Trash: TrashConfig{
+			Retention: model.TrashRetention,
+		},
+	}
+}
+
+// Load reads the configuration for the command line args and returns it
+// with the arguments left after the flags. usage is printed above the
+// flags for -help, in which case the error is flag.ErrHelp.
+func Load(args []string, usage string) (Config, []string, error) {
+	c := Default()
+	c.sources = map[string]string{}
+
+	// Flags are parsed first, since they may name the config file, and
+	// applied last
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagged []flagValue
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	file := fs.String("config", "", "YAML config `file` (CONFIG_FILE, default "+DefaultFile+" if it exists)")
+	for _, s := range settings {
+		s := s
+		record := func(value string) error {
+			flagged = append(flagged, flagValue{s, value})
+			return nil
+		}
+		text := fmt.Sprintf("%s (%s, %s)", s.usage, s.env, s.key)
+		if _, ok := s.field(&c).(*bool); ok {
+			fs.BoolFunc(s.flag, text, record)
+		} else {
+			fs.Func(s.flag, text, record)
+		}
+	}
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintln(out, usage)
+		fmt.Fprintln(out, "\nSettings come from, in increasing precedence: defaults, the config file,")
+		fmt.Fprintln(out, "environment variables and flags. Each flag lists its variable and file key.")
+		fmt.Fprintln(out, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	path, required := *file, true
+	if path == "" {
+		path = strings.TrimSpace(os.Getenv("CONFIG_FILE"))
+	}
+	if path == "" {
+		path, required = DefaultFile, false
+	}
+	if err := c.readFile(path, required); err != nil {
+		return c, nil, err
+	}
+
+	for _, s := range settings {
+		value := os.Getenv(s.env)
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if err := c.set(s, value, "env "+s.env); err != nil {
+			return c, nil, err
+		}
+	}
+
+	for _, f := range flagged {
+		if err := c.set(f.setting, f.value, "flag -"+f.setting.flag); err != nil {
+			return c, nil, err
+		}
+	}
+
+	c.normalize()
+	return c, fs.Args(), nil
+}
+
+// readFile applies the settings in a YAML config file. A missing file is
+// only an error if it is required.
+func (c *Config) readFile(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	values := map[string]string{}
+	flatten("", tree, values)
+
+	for _, s := range settings {
+		value, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		delete(values, s.key)
+		if err := c.set(s, value, path); err != nil {
+			return err
+		}
+	}
+
+	// Anything left over is a typo or a setting this version does not have
+	var unknown []string
+	for key := range values {
+		unknown = append(unknown, key)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings: %s", path, strings.Join(unknown, ", "))
+	}
+
+	c.File = path
+	return nil
+}
+
+// flatten turns nested YAML mappings into dotted keys and values into the
+// text they would have in an environment variable
+func flatten(prefix string, tree map[string]interface{}, values map[string]string) {
+	for key, value := range tree {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(key, value, values)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+}
+
+// set parses value into a setting and records where it came from
+func (c *Config) set(s setting, value, source string) error {
+	value = strings.TrimSpace(value)
+	var err error
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *[]string:
+		*field = splitList(value)
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *int64:
+		*field, err = strconv.ParseInt(value, 10, 64)
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	case *[]int:
+		var sizes []int
+		for _, item := range splitList(value) {
+			var size int
+			if size, err = strconv.Atoi(item); err != nil {
+				break
+			}
+			sizes = append(sizes, size)
+		}
+		*field = sizes
+	}
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok {
+			err = numErr.Err
+		}
+		return fmt.Errorf("invalid %s %q from %s: %v", s.key, value, source, err)
+	}
+	c.sources[s.key] = source
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// normalize puts values in the form the rest of the backend expects
+func (c *Config) normalize() {
+	if c.Database == "" {
+		c.Database = filepath.Join(c.DataDir, "notes.db")
+	}
+
+	c.Storage = strings.ToLower(c.Storage)
+	if c.Storage == "postgresql" {
+		c.Storage = model.StoragePostgres
+	}
+
+	c.LogLevel = strings.ToLower(c.LogLevel)
+	if c.LogLevel == "warning" {
+		c.LogLevel = LogWarn
+	}
+
+	for i, origin := range c.CORSOrigins {
+		c.CORSOrigins[i] = strings.TrimSuffix(origin, "/")
+	}
+
+	sizes := append([]int(nil), c.Uploads.ThumbnailSizes...)
+	sort.Ints(sizes)
+	c.Uploads.ThumbnailSizes = sizes
+}
+
+// Validate checks that the settings are usable and returns all problems
+// found
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	_, port, err := net.SplitHostPort(c.Listen)
+	check(err == nil && port != "", "listen: %q is not a host:port address", c.Listen)
+	check(c.DataDir != "", "data_dir: must not be empty")
+
+	switch c.Storage {
+	case model.StorageSQLite:
+	case model.StoragePostgres:
+		check(c.DatabaseURL != "", "database_url: must be set for the postgres storage")
+	default:
+		check(false, "storage: %q is not sqlite or postgres", c.Storage)
+	}
+
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "" && u.RawQuery == "",
+			"cors_origins: %q is not an origin such as http://localhost:5173", origin)
+	}
+
+	_, ok := logLevels[c.LogLevel]
+	check(ok, "log_level: %q is not debug, info, warn or error", c.LogLevel)
+
+	check(c.Uploads.MaxAttachmentMB > 0, "uploads.max_attachment_mb: must be positive")
+	check(c.Uploads.MaxNoteKB >= 0, "uploads.max_note_kb: must not be negative")
+	check(c.Uploads.MaxStorageMB >= 0, "uploads.max_storage_mb: must not be negative")
+	check(c.Uploads.MaxAttachmentsPerNote >= 0, "uploads.max_attachments_per_note: must not be negative")
+	check(c.Uploads.Expiry > 0, "uploads.expiry: must be positive")
+	check(len(c.Uploads.ThumbnailSizes) > 0, "uploads.thumbnail_sizes: must list at least one size")
+	for _, size := range c.Uploads.ThumbnailSizes {
+		check(size >= 16 && size <= 2048, "uploads.thumbnail_sizes: %d is not between 16 and 2048", size)
+	}
+
+	check(c.Sync.TombstoneInterval > 0, "sync.tombstone_interval: must be positive")
+	check(c.Revisions.KeepLast >= 0, "revisions.keep_last: must not be negative")
+	check(c.Revisions.ThinAfter >= 0, "revisions.thin_after: must not be negative")
+	check(c.Trash.Retention >= 0, "trash.retention: must not be negative")
+
+	return errors.Join(errs...)
+}
+
+// Apply sets the model's settings and the log level from the configuration
+func (c Config) Apply() {
+	logging.SetLevel(logLevels[c.LogLevel])
+
+	model.DatabasePath = c.Database
+	model.AttachmentDir = filepath.Join(c.DataDir, "attachments")
+	model.UploadDir = filepath.Join(c.DataDir, "uploads")
+	model.Storage = model.StorageConfig{Backend: c.Storage, PostgresURL: c.DatabaseURL}
+
+	model.MaxAttachmentSize = c.Uploads.MaxAttachmentMB << 20
+	model.Quotas = model.QuotaLimits{
+		MaxNoteBytes:          c.Uploads.MaxNoteKB << 10,
+		MaxAttachmentBytes:    model.MaxAttachmentSize,
+		MaxStorageBytes:       c.Uploads.MaxStorageMB << 20,
+		MaxAttachmentsPerNote: c.Uploads.MaxAttachmentsPerNote,
+	}
+	model.UploadExpiry = c.Uploads.Expiry
+	model.StripEXIF = c.Uploads.StripEXIF
+	model.ThumbnailSizes = c.Uploads.ThumbnailSizes
+
+	model.Revisions = model.RevisionPolicy{KeepLast: c.Revisions.KeepLast, ThinAfter: c.Revisions.ThinAfter}
+	model.TrashRetention = c.Trash.Retention
+}
+
+// LogRequests reports whether each HTTP request is logged
+func (c Config) LogRequests() bool {
+	return c.LogLevel == LogDebug || c.LogLevel == LogInfo
+}
+
+// AllowsOrigin reports whether cors_origins allows origin
+func (c Config) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Source returns where a setting's value came from: "default", the config
+// file, "env NAME" or "flag -name"
+func (c Config) Source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return "default"
+}
+
+// Print writes the effective configuration, one setting per line with the
+// source of its value. The password in database_url is not shown.
+func (c Config) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, s := range settings {
+		value := c.format(s)
+		if s.key == "database_url" && value != "" {
+			value = redactURL(value)
+		}
+		if value == "" {
+			value = "-"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t(%s)\n", s.key, value, c.Source(s.key))
+	}
+	tw.Flush()
+}
+
+// format returns a setting's value as it would be written in the
+// environment
+func (c Config) format(s setting) string {
+	switch field := s.field(&c).(type) {
+	case *[]string:
+		return strings.Join(*field, ",")
+	case *[]int:
+		items := make([]string, len(*field))
+		for i, size := range *field {
+			items[i] = strconv.Itoa(size)
+		}
+		return strings.Join(items, ",")
+	case *time.Duration:
+		return field.String()
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *int64:
+		return strconv.FormatInt(*field, 10)
+	case *bool:
+		return strconv.FormatBool(*field)
+	}
+	return ""
+}
+
+// redactURL hides the password of a database URL. Connection strings that
+// are not URLs are hidden completely, since they may hold one too.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return "(set)"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/model"
+)
+
+// isolate runs a test in an empty directory with none of the settings'
+// environment variables set
+func isolate(t *testing.T) string {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+	return tmp
+}
+
+// writeFile writes a config file in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	isolate(t)
+
+	c, args, err := Load([]string{"migrate", "status"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"migrate", "status"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args: got %q, want %q", args, want)
+	}
+	if c.File != "" {
+		t.Errorf("File: got %q without a config file", c.File)
+	}
+
+	want := Default()
+	want.Database = filepath.Join("data", "notes.db")
+	want.sources = c.sources
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Load without settings:\n got %+v\nwant %+v", c, want)
+	}
+	if source := c.Source("listen"); source != "default" {
+		t.Errorf("Source(listen): got %q, want default", source)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate of the defaults: %v", err)
+	}
+}
+
+// TestLoadPrecedence sets values in every place: flags win over
+// environment variables, which win over the config file
+func TestLoadPrecedence(t *testing.T) {
+	dir := isolate(t)
+	path := writeFile(t, dir, "server.yaml", `
+listen: 127.0.0.1:9000
+data_dir: /srv/file
+log_level: debug
+cors_origins:
+  - http://localhost:5173/
+  - https://notes.example.com
+uploads:
+  max_attachment_mb: 5
+  thumbnail_sizes: [640, 128]
+sync:
+  enabled: false
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("DATA_DIR", "/srv/env")
+	t.Setenv("LOG_LEVEL", "WARNING")
+	t.Setenv("MAX_ATTACHMENT_MB", "20")
+
+	c, _, err := Load([]string{"-max-attachment-mb", "50", "-sync"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key       string
+		got, want interface{}
+		source    string
+	}{
+		{"listen", c.Listen, "127.0.0.1:9000", path},
+		{"data_dir", c.DataDir, "/srv/env", "env DATA_DIR"},
+		{"database", c.Database, filepath.Join("/srv/env", "notes.db"), "default"},
+		{"log_level", c.LogLevel, LogWarn, "env LOG_LEVEL"},
+		{"cors_origins", c.CORSOrigins, []string{"http://localhost:5173", "https://notes.example.com"}, path},
+		{"uploads.max_attachment_mb", c.Uploads.MaxAttachmentMB, int64(50), "flag -max-attachment-mb"},
+		{"uploads.thumbnail_sizes", c.Uploads.ThumbnailSizes, []int{128, 640}, path},
+		{"sync.enabled", c.Sync.Enabled, true, "flag -sync"},
+		{"trash.retention", c.Trash.Retention, model.TrashRetention, "default"},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.key, tt.got, tt.want)
+		}
+		if source := c.Source(tt.key); source != tt.source {
+			t.Errorf("Source(%s): got %q, want %q", tt.key, source, tt.source)
+		}
+	}
+	if c.File != path {
+		t.Errorf("File: got %q, want %q", c.File, path)
+	}
+
+	// The -config flag wins over CONFIG_FILE
+	other := writeFile(t, dir, "other.yaml", "listen: 127.0.0.1:9001\n")
+	if c, _, err := Load([]string{"-config", other}, ""); err != nil || c.Listen != "127.0.0.1:9001" {
+		t.Errorf("Load with -config: got listen %q, %v; want 127.0.0.1:9001", c.Listen, err)
+	}
+}
+
+func TestLoadDefaultFile(t *testing.T) {
+	dir := isolate(t)
+	writeFile(t, dir, DefaultFile, "trash:\n  retention: 72h\n")
+
+	c, _, err := Load(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.File != DefaultFile || c.Trash.Retention != 72*time.Hour {
+		t.Errorf("got File %q and trash.retention %v, want %s and 72h", c.File, c.Trash.Retention, DefaultFile)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // Content of a config file, if any
+		env  map[string]string
+		args []string
+		want string // Part of the error
+	}{
+		{"missing config file", "", nil, []string{"-config", "missing.yaml"}, "reading config file"},
+		{"invalid YAML", "listen: [", nil, nil, "server.yaml"},
+		{"unknown setting", "listen: :8080\nupload:\n  max_attachment_mb: 5\n", nil, nil, "unknown settings: upload.max_attachment_mb"},
+		{"number in the file", "uploads:\n  max_note_kb: lots\n", nil, nil, `invalid uploads.max_note_kb "lots" from`},
+		{"duration in the environment", "", map[string]string{"TRASH_RETENTION": "30"}, nil, `invalid trash.retention "30" from env TRASH_RETENTION`},
+		{"list in the environment", "", map[string]string{"THUMBNAIL_SIZES": "128,big"}, nil, "invalid uploads.thumbnail_sizes"},
+		{"bool flag", "", nil, []string{"-strip-exif=maybe"}, "strip-exif"},
+		{"number flag", "", nil, []string{"-revision-keep-last", "x"}, `invalid revisions.keep_last "x" from flag -revision-keep-last`},
+		{"unknown flag", "", nil, []string{"-port", "80"}, "-port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := isolate(t)
+			if tt.file != "" {
+				t.Setenv("CONFIG_FILE", writeFile(t, dir, "server.yaml", tt.file))
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, _, err := Load(tt.args, "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // Part of the error, empty for none
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"postgres", func(c *Config) { c.Storage, c.DatabaseURL = model.StoragePostgres, "postgres://db/notes" }, ""},
+		{"postgres without a URL", func(c *Config) { c.Storage = model.StoragePostgres }, "database_url"},
+		{"unknown storage", func(c *Config) { c.Storage = "mysql" }, "storage"},
+		{"listen without a port", func(c *Config) { c.Listen = "localhost" }, "listen"},
+		{"origin with a path", func(c *Config) { c.CORSOrigins = []string{"http://localhost:5173/app"} }, "cors_origins"},
+		{"any origin", func(c *Config) { c.CORSOrigins = []string{"*"} }, ""},
+		{"log level", func(c *Config) { c.LogLevel = "verbose" }, "log_level"},
+		{"attachment size", func(c *Config) { c.Uploads.MaxAttachmentMB = 0 }, "uploads.max_attachment_mb"},
+		{"negative retention", func(c *Config) { c.Trash.Retention = -time.Hour }, "trash.retention"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.change(&c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Validate: got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	c := Default()
+	c.Listen, c.DataDir = "", ""
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "listen") || !strings.Contains(err.Error(), "data_dir") {
+		t.Errorf("Validate with two problems: got %v", err)
+	}
+}
+
+func TestPrintRedactsPassword(t *testing.T) {
+	c := Default()
+	c.DatabaseURL = "postgres://notes:secret@db:5432/notes"
+	var out bytes.Buffer
+	c.Print(&out)
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), "database_url") {
+		t.Errorf("Print shows the password or leaves out database_url:\n%s", out.String())
+	}
+}
@@ -0,0 +1,241 @@
+// Package diff computes line-based differences between two texts.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the kind of change a line represents
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// Line is a single line of a diff. OldLine and NewLine are 1-based line
+// numbers in the old and new text, or 0 if the line is absent there.
+type Line struct {
+	Op      Op     `json:"op"`
+	Text    string `json:"text"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+// SplitLines splits text into lines without their trailing newlines
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Lines returns the line-by-line diff that turns oldText into newText
+func Lines(oldText, newText string) []Line {
+	a := SplitLines(oldText)
+	b := SplitLines(newText)
+
+	var result []Line
+	oldLine, newLine := 0, 0
+	for _, op := range Compute(a, b) {
+		switch op {
+		case Equal:
+			result = append(result, Line{Op: Equal, Text: a[oldLine], OldLine: oldLine + 1, NewLine: newLine + 1})
+			oldLine++
+			newLine++
+		case Delete:
+			result = append(result, Line{Op: Delete, Text: a[oldLine], OldLine: oldLine + 1})
+			oldLine++
+		case Insert:
+			result = append(result, Line{Op: Insert, Text: b[newLine], NewLine: newLine + 1})
+			newLine++
+		}
+	}
+	return result
+}
+
+// Compute returns the shortest edit script turning a into b, one Op per
+// line of output, using the linear-space variant of Myers' O(ND) algorithm:
+// it finds the middle snake of the edit path and recurses on both halves, so
+// memory stays proportional to len(a)+len(b) however different they are.
+func Compute(a, b []string) []Op {
+	n, m := len(a), len(b)
+	if n+m == 0 {
+		return nil
+	}
+
+	// v[k+offset] holds the furthest x reached on diagonal k; one pair of
+	// frontiers is shared by every level of the recursion
+	size := 2*((n+m+1)/2) + 3
+	c := &compare{
+		a:   a,
+		b:   b,
+		ops: make([]Op, 0, max(n, m)),
+		vf:  make([]int, size),
+		vb:  make([]int, size),
+	}
+	c.run(0, n, 0, m)
+	return c.ops
+}
+
+type compare struct {
+	a, b   []string
+	ops    []Op
+	vf, vb []int
+}
+
+// run appends the script turning a[aLo:aHi] into b[bLo:bHi]
+func (c *compare) run(aLo, aHi, bLo, bHi int) {
+	// Common lines at either end are never part of the shortest script
+	for aLo < aHi && bLo < bHi && c.a[aLo] == c.b[bLo] {
+		c.ops = append(c.ops, Equal)
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi && bLo < bHi && c.a[aHi-1] == c.b[bHi-1] {
+		aHi--
+		bHi--
+		suffix++
+	}
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			c.ops = append(c.ops, Insert)
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			c.ops = append(c.ops, Delete)
+		}
+	default:
+		x, y, u, v := c.middleSnake(aLo, aHi, bLo, bHi)
+		c.run(aLo, x, bLo, y)
+		for ; x < u; x++ {
+			c.ops = append(c.ops, Equal)
+		}
+		c.run(u, aHi, v, bHi)
+	}
+
+	for ; suffix > 0; suffix-- {
+		c.ops = append(c.ops, Equal)
+	}
+}
+
+// middleSnake runs the search forward from the start and backward from the
+// end at the same time until the two meet, and returns the snake where they
+// do, from (x, y) to (u, v). The parts before and after it each need about
+// half of the edits. Both ranges must be non-empty.
+func (c *compare) middleSnake(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	offset := len(c.vf) / 2
+
+	// The backward search works on the reversed ranges: vb holds how far
+	// from the end it got, and its diagonal k is the forward diagonal delta-k
+	c.vf[offset+1], c.vb[offset+1] = 0, 0
+	for d := 0; d <= (n+m+1)/2; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && c.vf[offset+k-1] < c.vf[offset+k+1]) {
+				x = c.vf[offset+k+1] // move down: insertion
+			} else {
+				x = c.vf[offset+k-1] + 1 // move right: deletion
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && c.a[aLo+x] == c.b[bLo+y] {
+				x++
+				y++
+			}
+			c.vf[offset+k] = x
+			if back := delta - k; odd && back >= -(d-1) && back <= d-1 && x+c.vb[offset+back] >= n {
+				return aLo + x0, bLo + y0, aLo + x, bLo + y
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && c.vb[offset+k-1] < c.vb[offset+k+1]) {
+				x = c.vb[offset+k+1]
+			} else {
+				x = c.vb[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && c.a[aHi-1-x] == c.b[bHi-1-y] {
+				x++
+				y++
+			}
+			c.vb[offset+k] = x
+			if forward := delta - k; !odd && forward >= -d && forward <= d && x+c.vf[offset+forward] >= n {
+				return aHi - x, bHi - y, aHi - x0, bHi - y0
+			}
+		}
+	}
+	panic("diff: no middle snake")
+}
+
+// Unified renders a diff in unified format with the given number of
+// context lines around each change
+func Unified(lines []Line, oldName, newName string, context int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+
+	for start := 0; start < len(lines); {
+		// Find the next change
+		for start < len(lines) && lines[start].Op == Equal {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Extend the hunk while changes are within 2*context lines
+		end := start
+		for i := start; i < len(lines); i++ {
+			if lines[i].Op != Equal {
+				end = i + 1
+			} else if i-end >= 2*context {
+				break
+			}
+		}
+
+		from := max(start-context, 0)
+		to := min(end+context, len(lines))
+
+		oldStart, oldCount, newStart, newCount := 0, 0, 0, 0
+		for _, l := range lines[from:to] {
+			if l.Op != Insert {
+				if oldStart == 0 {
+					oldStart = l.OldLine
+				}
+				oldCount++
+			}
+			if l.Op != Delete {
+				if newStart == 0 {
+					newStart = l.NewLine
+				}
+				newCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, l := range lines[from:to] {
+			switch l.Op {
+			case Equal:
+				sb.WriteString(" ")
+			case Insert:
+				sb.WriteString("+")
+			case Delete:
+				sb.WriteString("-")
+			}
+			sb.WriteString(l.Text)
+			sb.WriteString("\n")
+		}
+		start = to
+	}
+	return sb.String()
+}
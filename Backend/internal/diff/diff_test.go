@@ -0,0 +1,164 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     []Line
+	}{
+		{"both empty", "", "", nil},
+		{"added to empty", "", "a\nb\n", []Line{
+			{Op: Insert, Text: "a", NewLine: 1},
+			{Op: Insert, Text: "b", NewLine: 2},
+		}},
+		{"emptied", "a\n", "", []Line{
+			{Op: Delete, Text: "a", OldLine: 1},
+		}},
+		{"unchanged", "a\nb", "a\nb\n", []Line{
+			{Op: Equal, Text: "a", OldLine: 1, NewLine: 1},
+			{Op: Equal, Text: "b", OldLine: 2, NewLine: 2},
+		}},
+		{"line changed", "a\nb\nc\n", "a\nB\nc\n", []Line{
+			{Op: Equal, Text: "a", OldLine: 1, NewLine: 1},
+			{Op: Delete, Text: "b", OldLine: 2},
+			{Op: Insert, Text: "B", NewLine: 2},
+			{Op: Equal, Text: "c", OldLine: 3, NewLine: 3},
+		}},
+		{"line inserted and removed", "a\nb\nc\n", "x\na\nc\n", []Line{
+			{Op: Insert, Text: "x", NewLine: 1},
+			{Op: Equal, Text: "a", OldLine: 1, NewLine: 2},
+			{Op: Delete, Text: "b", OldLine: 2},
+			{Op: Equal, Text: "c", OldLine: 3, NewLine: 3},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Lines(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lines(%q, %q):\n got %+v\nwant %+v", tt.old, tt.new, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompute(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a := randomLines(rng, rng.Intn(12))
+		b := randomLines(rng, rng.Intn(12))
+		ops := Compute(a, b)
+
+		got, edits := replay(t, a, b, ops)
+		if strings.Join(got, ",") != strings.Join(b, ",") {
+			t.Fatalf("Compute(%q, %q) = %v turns a into %q", a, b, ops, got)
+		}
+		if want := len(a) + len(b) - 2*lcs(a, b); edits != want {
+			t.Fatalf("Compute(%q, %q) = %v has %d edits, want %d", a, b, ops, edits, want)
+		}
+	}
+}
+
+// TestComputeMemory diffs two large texts with nothing in common, the worst
+// case, and checks memory stays proportional to their size
+func TestComputeMemory(t *testing.T) {
+	a, b := make([]string, 4000), make([]string, 4000)
+	for i := range a {
+		a[i], b[i] = fmt.Sprintf("old line %d", i), fmt.Sprintf("new line %d", i)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ops := Compute(a, b)
+	runtime.ReadMemStats(&after)
+
+	if len(ops) != 8000 {
+		t.Errorf("got %d ops, want 8000", len(ops))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes, want under 1 MiB", allocated)
+	}
+}
+
+func randomLines(rng *rand.Rand, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a' + rng.Intn(4)))
+	}
+	return lines
+}
+
+// replay follows ops over a and b, checking every Equal pairs equal lines,
+// and returns the text it produces and the number of inserts and deletes
+func replay(t *testing.T, a, b []string, ops []Op) ([]string, int) {
+	t.Helper()
+	var out []string
+	x, y, edits := 0, 0, 0
+	for _, op := range ops {
+		switch op {
+		case Equal:
+			if x >= len(a) || y >= len(b) || a[x] != b[y] {
+				t.Fatalf("Compute(%q, %q) = %v: Equal at %d, %d does not match", a, b, ops, x, y)
+			}
+			out = append(out, a[x])
+			x++
+			y++
+		case Delete:
+			x++
+			edits++
+		case Insert:
+			if y >= len(b) {
+				t.Fatalf("Compute(%q, %q) = %v inserts past the end", a, b, ops)
+			}
+			out = append(out, b[y])
+			y++
+			edits++
+		}
+	}
+	if x != len(a) || y != len(b) {
+		t.Fatalf("Compute(%q, %q) = %v stops at %d, %d", a, b, ops, x, y)
+	}
+	return out, edits
+}
+
+// lcs is the length of the longest common subsequence, by dynamic programming
+func lcs(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table[0][0]
+}
+
+func TestUnified(t *testing.T) {
+	got := Unified(Lines("a\nb\nc\nd\n", "a\nB\nc\nd\n"), "old", "new", 1)
+	want := strings.Join([]string{
+		"--- old",
+		"+++ new",
+		"@@ -1,3 +1,3 @@",
+		" a",
+		"-b",
+		"+B",
+		" c",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("Unified:\n%s\nwant:\n%s", got, want)
+	}
+}
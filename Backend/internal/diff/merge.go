@@ -0,0 +1,146 @@
+package diff
+
+import "strings"
+
+// hunk replaces the base lines [start, end) with lines
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+// Merge performs a line-based three-way merge of ours and theirs, which were
+// both edited from base. Changes to different lines merge, even when the
+// lines are next to each other; lines both sides insert at the same place
+// are kept, ours first. It reports false if both sides changed the same
+// lines differently; the merged text is then meaningless.
+func Merge(base, ours, theirs string) (string, bool) {
+	switch {
+	case ours == theirs, base == theirs:
+		return ours, true
+	case base == ours:
+		return theirs, true
+	}
+
+	baseLines := SplitLines(base)
+	a := hunks(baseLines, SplitLines(ours))
+	b := hunks(baseLines, SplitLines(theirs))
+
+	var out []string
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Start a group with the earliest hunk, then pull in every hunk from
+		// either side that overlaps it
+		var groupA, groupB []hunk
+		var span hunk
+		if len(b) == 0 || (len(a) > 0 && before(a[0], b[0])) {
+			span = hunk{start: a[0].start, end: a[0].end}
+			groupA, a = a[:1], a[1:]
+		} else {
+			span = hunk{start: b[0].start, end: b[0].end}
+			groupB, b = b[:1], b[1:]
+		}
+		for {
+			if len(a) > 0 && overlaps(a[0], span) {
+				groupA, a = append(groupA, a[0]), a[1:]
+				span.end = max(span.end, groupA[len(groupA)-1].end)
+			} else if len(b) > 0 && overlaps(b[0], span) {
+				groupB, b = append(groupB, b[0]), b[1:]
+				span.end = max(span.end, groupB[len(groupB)-1].end)
+			} else {
+				break
+			}
+		}
+
+		out = append(out, baseLines[pos:span.start]...)
+		oursText := apply(baseLines, span.start, span.end, groupA)
+		theirsText := apply(baseLines, span.start, span.end, groupB)
+		switch {
+		case len(groupB) == 0:
+			out = append(out, oursText...)
+		case len(groupA) == 0:
+			out = append(out, theirsText...)
+		case strings.Join(oursText, "\n") == strings.Join(theirsText, "\n"):
+			out = append(out, oursText...)
+		case span.start == span.end:
+			// Both sides only inserted lines here
+			out = append(append(out, oursText...), theirsText...)
+		default:
+			return "", false
+		}
+		pos = span.end
+	}
+	out = append(out, baseLines[pos:]...)
+
+	merged := strings.Join(out, "\n")
+	if len(out) > 0 && (strings.HasSuffix(ours, "\n") || strings.HasSuffix(theirs, "\n")) {
+		merged += "\n"
+	}
+	return merged, true
+}
+
+// before orders hunks by where they start in base, an insertion before a
+// change to the lines that follow it
+func before(x, y hunk) bool {
+	return x.start < y.start || (x.start == y.start && x.end <= y.end)
+}
+
+// overlaps reports whether two hunks touch the same base lines. A hunk that
+// only inserts overlaps a change to the lines around it, and another
+// insertion at the same place; it does not overlap a change that starts or
+// ends where it inserts.
+func overlaps(x, y hunk) bool {
+	switch {
+	case x.start == x.end && y.start == y.end:
+		return x.start == y.start
+	case x.start == x.end:
+		return y.start < x.start && x.start < y.end
+	case y.start == y.end:
+		return x.start < y.start && y.start < x.end
+	}
+	return x.start < y.end && y.start < x.end
+}
+
+// hunks lists the changes that turn base into other
+func hunks(base, other []string) []hunk {
+	var result []hunk
+	var current *hunk
+	i, j := 0, 0
+	for _, op := range Compute(base, other) {
+		if op == Equal {
+			if current != nil {
+				result = append(result, *current)
+				current = nil
+			}
+			i++
+			j++
+			continue
+		}
+
+		if current == nil {
+			current = &hunk{start: i, end: i}
+		}
+		if op == Delete {
+			current.end++
+			i++
+		} else {
+			current.lines = append(current.lines, other[j])
+			j++
+		}
+	}
+	if current != nil {
+		result = append(result, *current)
+	}
+	return result
+}
+
+// apply returns base[start:end] with the given hunks applied
+func apply(base []string, start, end int, changes []hunk) []string {
+	var out []string
+	pos := start
+	for _, h := range changes {
+		out = append(out, base[pos:h.start]...)
+		out = append(out, h.lines...)
+		pos = h.end
+	}
+	return append(out, base[pos:end]...)
+}
@@ -0,0 +1,38 @@
+package diff
+
+import "testing"
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		ok                 bool
+	}{
+		{"only ours changed", "a\nb\n", "a\nB\n", "a\nb\n", "a\nB\n", true},
+		{"only theirs changed", "a\nb\n", "a\nb\n", "A\nb\n", "A\nb\n", true},
+		{"same change", "a\nb\n", "a\nB\n", "a\nB\n", "a\nB\n", true},
+		{"distant lines", "a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"adjacent lines", "a\nb\nc\n", "A\nb\nc\n", "a\nB\nc\n", "A\nB\nc\n", true},
+		{"adjacent lines reversed", "a\nb\nc\n", "a\nB\nc\n", "A\nb\nc\n", "A\nB\nc\n", true},
+		{"line deleted next to a changed line", "a\nb\nc\n", "a\nc\n", "a\nb\nC\n", "a\nC\n", true},
+		{"both appended", "a\n", "a\nb\n", "a\nc\n", "a\nb\nc\n", true},
+		{"both prepended", "a\n", "b\na\n", "c\na\n", "b\nc\na\n", true},
+		{"empty base", "", "ours\n", "theirs\n", "ours\ntheirs\n", true},
+		{"inserted before a changed line", "a\nb\n", "a\nx\nb\n", "a\nB\n", "a\nx\nB\n", true},
+		{"inserted after a changed line", "a\nb\n", "a\nx\nb\n", "A\nb\n", "A\nx\nb\n", true},
+		{"same line changed", "a\nb\nc\n", "a\nB\nc\n", "a\nX\nc\n", "", false},
+		{"changed and deleted", "a\nb\nc\n", "a\nB\nc\n", "a\nc\n", "", false},
+		{"overlapping ranges", "a\nb\nc\n", "A\nB\nc\n", "a\nX\nY\n", "", false},
+		{"inserted inside a changed range", "a\nb\nc\n", "a\nx\nb\nc\n", "A\nB\nc\n", "", false},
+		{"no trailing newline", "a\nb", "A\nb", "a\nB", "A\nB", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Merge(tt.base, tt.ours, tt.theirs)
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Errorf("Merge(%q, %q, %q) = %q, %v; want %q, %v", tt.base, tt.ours, tt.theirs, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// ADMIN HANDLERS
+// ============================================================================
+
+// HandleCheckIntegrity checks the database and attachment storage without
+// changing anything
+func (h *Handler) HandleCheckIntegrity(c *gin.Context) {
+	h.runIntegrityCheck(c, false)
+}
+
+// HandleRepairIntegrity checks the database and attachment storage and
+// repairs what it can; see model.IntegrityReport
+func (h *Handler) HandleRepairIntegrity(c *gin.Context) {
+	h.runIntegrityCheck(c, true)
+}
+
+func (h *Handler) runIntegrityCheck(c *gin.Context, repair bool) {
+	if h.stores.Integrity == nil {
+		unavailable(c, "Integrity checking")
+		return
+	}
+
+	report, err := h.stores.Integrity.CheckIntegrity(repair)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Integrity check failed",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// HandleGetUsage reports how much the vault stores against its quotas
+func (h *Handler) HandleGetUsage(c *gin.Context) {
+	usage, err := h.stores.Usage.Usage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to compute usage",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// BLOB HANDLERS
+// ============================================================================
+
+// HandleHeadBlob reports whether the server already stores a file with the
+// given SHA-256, so a client can attach it by hash instead of uploading it.
+// Responds 200 with the blob's size and reference count, or 404.
+func (h *Handler) HandleHeadBlob(c *gin.Context) {
+	sum := strings.ToLower(c.Param("sha256"))
+	if !model.ValidSHA256(sum) {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	blob, err := h.stores.Blobs.FindBlob(sum)
+	if err != nil && err != model.ErrNotFound {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	info, statErr := os.Stat(filepath.Join(model.AttachmentDir, model.BlobFilename(sum)))
+	if err != nil || statErr != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(info.Size(), 10))
+	c.Header("X-Ref-Count", strconv.Itoa(blob.Refs))
+	c.Status(http.StatusOK)
+}
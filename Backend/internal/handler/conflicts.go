@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"backend/internal/diff"
+	"backend/internal/logging"
+	"backend/internal/model"
+	"backend/internal/service"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// CONFLICT HANDLERS
+// ============================================================================
+
+// HandleGetConflicts lists unresolved sync conflicts, newest first. A conflict
+// disappears from the list once either of its notes is deleted.
+func (h *Handler) HandleGetConflicts(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
+
+	conflicts, err := h.stores.Sync.ListConflicts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch conflicts",
+			"details": err.Error(),
+		})
+		return
+	}
+	if conflicts == nil {
+		conflicts = []model.NoteConflict{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conflicts": conflicts,
+		"count":     len(conflicts),
+	})
+}
+
+// HandleResolveConflict marks a conflict as resolved. The "keep" field picks
+// the outcome: "original" moves the copy to the trash, "copy" puts the copy's
+// content into the original note and trashes the copy, and "both" (the
+// default) keeps both notes.
+func (h *Handler) HandleResolveConflict(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
+
+	conflictID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid conflict ID",
+		})
+		return
+	}
+
+	var req struct {
+		Keep string `json:"keep"`
+	}
+	// The body is optional
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if req.Keep == "" {
+		req.Keep = "both"
+	}
+	if req.Keep != "original" && req.Keep != "copy" && req.Keep != "both" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid keep value. Must be original, copy or both",
+		})
+		return
+	}
+
+	var conflict model.NoteConflict
+	err = h.stores.InTx(func(stores model.Stores) error {
+		var err error
+		if conflict, err = stores.Sync.GetConflict(conflictID); err != nil {
+			return err
+		}
+		notes := service.NewNotesService(stores, service.FromAPI)
+		if req.Keep == "copy" {
+			if err := keepConflictCopy(stores, notes, conflict); err != nil {
+				return err
+			}
+		}
+		if req.Keep != "both" {
+			if err := notes.Delete(conflict.CopyNoteID); err != nil && err != service.ErrNoteNotFound {
+				return err
+			}
+		}
+		return stores.Sync.ResolveConflict(conflictID)
+	})
+	if quotaExceeded(c, err) {
+		return
+	} else if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Conflict not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to resolve conflict",
+			"details": err.Error(),
+		})
+		return
+	}
+	noteID, copyNoteID := conflict.NoteID, conflict.CopyNoteID
+
+	c.JSON(http.StatusOK, gin.H{
+		"note_id":      noteID,
+		"copy_note_id": copyNoteID,
+		"kept":         req.Keep,
+		"message":      "Conflict resolved",
+	})
+}
+
+// ============================================================================
+// CONFLICT HELPER FUNCTIONS
+// ============================================================================
+
+// keepConflictCopy puts the content of a conflict's copy into the original
+// note, unless the original is in the trash
+func keepConflictCopy(stores model.Stores, notes *service.NotesService, conflict model.NoteConflict) error {
+	copied, _, err := stores.Sync.SyncedNote(conflict.CopyNoteID)
+	if err != nil {
+		return err
+	}
+	note, err := notes.Get(strconv.Itoa(conflict.NoteID))
+	if err == service.ErrNoteNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	note.Content = copied.Content
+	note.Tags = nil // Keep the manual tags
+	note.UpdatedAt = time.Time{}
+	return notes.Update(&note)
+}
+
+// mergeSyncedNote applies a device's edit that was based on an earlier
+// revision of the note. If the note has changed on the server since then,
+// title and content are merged three-way against the base revision; when
+// that fails the device's version is saved as a conflicted copy instead.
+func mergeSyncedNote(stores model.Stores, notes *service.NotesService, noteID int, note model.Note, folderID *int, deviceID string) (*model.NoteConflict, error) {
+	current, deleted, err := stores.Sync.SyncedNote(noteID)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		// The deletion wins; the device receives a tombstone
+		return nil, nil
+	}
+
+	title, content, orderIndex := note.Title, note.Content, note.OrderIndex
+	tags := note.Tags
+	if *note.BaseRevision != current.Revision {
+		base, err := stores.Revisions.GetRevision(noteID, *note.BaseRevision)
+
+		// Without the base revision (it may have been pruned) only an
+		// identical edit can be applied
+		titleOK, contentOK := note.Title == current.Title, note.Content == current.Content
+		requestedFolderID := folderID
+		folderID = current.FolderID
+		if err == nil {
+			title, titleOK = diff.Merge(base.Title, current.Title, note.Title)
+			content, contentOK = diff.Merge(base.Content, current.Content, note.Content)
+			if !sameFolder(base.FolderID, requestedFolderID) {
+				folderID = requestedFolderID // Moved on the device
+			}
+		} else if err != model.ErrNotFound {
+			return nil, err
+		}
+
+		if !titleOK || !contentOK {
+			return createConflictCopy(stores, notes, current, note, deviceID)
+		}
+
+		// Keep the server's order and manual tags; hashtags follow the merged content
+		orderIndex = current.OrderIndex
+		tags = nil
+		logging.Infof("🔀 Merged concurrent edits to note: %s", title)
+	}
+
+	// Stamp with the server time so every device, including this one,
+	// picks up the new revision number
+	current.Title, current.Content = title, content
+	current.FolderID, current.OrderIndex = folderID, orderIndex
+	current.Tags = tags
+	current.UpdatedAt = time.Now().UTC()
+	err = notes.Update(&current)
+	if err == service.ErrNoteNotFound {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// createConflictCopy saves a device's version of a note as a new note next
+// to the original and records the conflict
+func createConflictCopy(stores model.Stores, notes *service.NotesService, original, note model.Note, deviceID string) (*model.NoteConflict, error) {
+	now := time.Now().UTC()
+	suffix := "conflicted copy " + now.Format("2006-01-02")
+	if deviceID != "" {
+		suffix = fmt.Sprintf("conflicted copy from %s, %s", deviceID, now.Format("2006-01-02"))
+	}
+
+	copied := model.Note{
+		Title:      fmt.Sprintf("%s (%s)", note.Title, suffix),
+		Content:    note.Content,
+		FolderID:   original.FolderID,
+		OrderIndex: note.OrderIndex,
+		Tags:       note.Tags,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := notes.Create(&copied); err != nil {
+		return nil, err
+	}
+
+	conflict := model.NoteConflict{
+		NoteID:       original.ID,
+		NoteUID:      original.UID,
+		NoteTitle:    original.Title,
+		CopyNoteID:   copied.ID,
+		CopyNoteUID:  copied.UID,
+		BaseRevision: *note.BaseRevision,
+		CreatedAt:    now,
+	}
+	if deviceID != "" {
+		conflict.DeviceID = &deviceID
+	}
+	if err := stores.Sync.CreateConflict(&conflict); err != nil {
+		return nil, err
+	}
+
+	logging.Warnf("⚠️ Conflicting edits to note %d saved as note %d", original.ID, conflict.CopyNoteID)
+	return &conflict, nil
+}
+
+// sameFolder reports whether two nullable folder IDs are equal
+func sameFolder(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
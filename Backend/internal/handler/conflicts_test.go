@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createConflict has a device edit a note that was edited on the server
+// since the device last synced, and returns the conflict that records it
+func createConflict(t *testing.T, router *gin.Engine, stores model.Stores) model.NoteConflict {
+	t.Helper()
+
+	id := createNote(t, router, "Shared", "first draft")
+	note, _, err := stores.Sync.SyncedNote(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response := request(t, router, "PUT", "/update", gin.H{"id": id, "title": "Shared", "content": "server draft"})
+	if status != http.StatusOK {
+		t.Fatalf("update: status %d, %v", status, response)
+	}
+
+	base := note.Revision
+	note.Content, note.BaseRevision = "device draft", &base
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", LocalNotes: []model.Note{note}})
+	syncCursor(t, status, response)
+	conflicts, _ := response["conflicts"].([]interface{})
+	if len(conflicts) != 1 {
+		t.Fatalf("sync of a conflicting edit: got conflicts %v, want one", response["conflicts"])
+	}
+	conflict, err := stores.Sync.GetConflict(int(conflicts[0].(map[string]interface{})["id"].(float64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conflict
+}
+
+func TestResolveConflict(t *testing.T) {
+	tests := []struct {
+		keep     string // Empty sends no body
+		original string // Content of the original note afterwards
+		copyKept bool
+	}{
+		{"original", "server draft", false},
+		{"copy", "device draft", false},
+		{"both", "server draft", true},
+		{"", "server draft", true},
+	}
+	for _, tt := range tests {
+		t.Run("keep="+tt.keep, func(t *testing.T) {
+			router, stores := newSQLiteTestRouter(t)
+			conflict := createConflict(t, router, stores)
+			if copied, err := stores.Notes.GetNote(strconv.Itoa(conflict.CopyNoteID)); err != nil || copied.Content != "device draft" {
+				t.Fatalf("conflicted copy: got %+v, %v; want the device's draft", copied, err)
+			}
+
+			var body interface{}
+			if tt.keep != "" {
+				body = gin.H{"keep": tt.keep}
+			}
+			path := fmt.Sprintf("/conflicts/%d/resolve", conflict.ID)
+			if status, response := request(t, router, "POST", path, body); status != http.StatusOK {
+				t.Fatalf("resolve: status %d, %v", status, response)
+			}
+
+			if note, err := stores.Notes.GetNote(strconv.Itoa(conflict.NoteID)); err != nil || note.Content != tt.original {
+				t.Errorf("original note: got %+v, %v; want content %q", note, err, tt.original)
+			}
+			_, err := stores.Notes.GetNote(strconv.Itoa(conflict.CopyNoteID))
+			if tt.copyKept && err != nil || !tt.copyKept && err != model.ErrNotFound {
+				t.Errorf("conflicted copy: got %v, want it kept %v", err, tt.copyKept)
+			}
+
+			status, response := request(t, router, "GET", "/conflicts", nil)
+			if status != http.StatusOK || response["count"] != float64(0) {
+				t.Errorf("conflicts after resolving: status %d, %v; want none", status, response)
+			}
+			if status, response := request(t, router, "POST", path, body); status != http.StatusNotFound {
+				t.Errorf("resolving again: status %d, %v; want 404", status, response)
+			}
+		})
+	}
+}
+
+func TestResolveConflictErrors(t *testing.T) {
+	router, stores := newSQLiteTestRouter(t)
+	conflict := createConflict(t, router, stores)
+
+	status, response := request(t, router, "GET", "/conflicts", nil)
+	if status != http.StatusOK || response["count"] != float64(1) {
+		t.Errorf("conflicts: status %d, %v; want one", status, response)
+	}
+
+	tests := []struct {
+		path string
+		body interface{}
+		want int
+	}{
+		{fmt.Sprintf("/conflicts/%d/resolve", conflict.ID), gin.H{"keep": "newest"}, http.StatusBadRequest},
+		{"/conflicts/abc/resolve", nil, http.StatusBadRequest},
+		{fmt.Sprintf("/conflicts/%d/resolve", conflict.ID+1), nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status, response := request(t, router, "POST", tt.path, tt.body); status != tt.want {
+			t.Errorf("POST %s with %v: status %d, %v; want %d", tt.path, tt.body, status, response, tt.want)
+		}
+	}
+
+	// Nothing was changed by the failed requests
+	if _, err := stores.Notes.GetNote(strconv.Itoa(conflict.CopyNoteID)); err != nil {
+		t.Errorf("conflicted copy: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// DEVICE HANDLERS
+// ============================================================================
+
+// HandleGetDevices lists every device that has synced, most recently seen first
+func (h *Handler) HandleGetDevices(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
+
+	devices, err := h.stores.Sync.ListDevices()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch devices",
+			"details": err.Error(),
+		})
+		return
+	}
+	if devices == nil {
+		devices = []model.Device{}
+	}
+
+	cursor, err := h.stores.Sync.ChangeSeq()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get sync cursor",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"devices": devices,
+		"count":   len(devices),
+		"cursor":  cursor,
+	})
+}
+
+// HandleRenameDevice sets a device's friendly name
+func (h *Handler) HandleRenameDevice(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Device name cannot be empty",
+		})
+		return
+	}
+
+	err := h.stores.Sync.RenameDevice(c.Param("id"), name)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Device not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to rename device",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      c.Param("id"),
+		"name":    name,
+		"message": "Device renamed",
+	})
+}
+
+// HandleRevokeDevice revokes a device. Its sync requests are refused from
+// then on, and tombstones are no longer kept around for it.
+func (h *Handler) HandleRevokeDevice(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
+
+	err := h.stores.Sync.RevokeDevice(c.Param("id"))
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Device not found or already revoked",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to revoke device",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      c.Param("id"),
+		"message": "Device revoked",
+	})
+}
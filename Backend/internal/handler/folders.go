@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// FOLDER HIERARCHY HANDLERS
+// ============================================================================
+
+// HandleGetFolderTree returns all folders nested under their parents
+func (h *Handler) HandleGetFolderTree(c *gin.Context) {
+	folders, err := h.stores.Folders.ListFolders()
+	if err == nil {
+		var counts map[int]int
+		if counts, err = h.stores.Folders.CountFolderNotes(); err == nil {
+			c.JSON(http.StatusOK, folderTree(folders, counts))
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   "Failed to fetch folders",
+		"details": err.Error(),
+	})
+}
+
+// HandleGetFolderByPath looks up a folder by its slash-separated path,
+// e.g. GET /folders/by-path/Work/Clients
+func (h *Handler) HandleGetFolderByPath(c *gin.Context) {
+	path := strings.Trim(c.Param("path"), "/")
+	if path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Folder path is required",
+		})
+		return
+	}
+
+	folders, err := h.stores.Folders.ListFolders()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to look up folder",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	var folder model.Folder
+	for _, name := range strings.Split(path, "/") {
+		found := false
+		for _, child := range folders {
+			if child.Name == name && sameParent(child.ParentID, folder.ID) {
+				folder, found = child, true
+				break
+			}
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Folder not found",
+				"path":  path,
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"folder": folder,
+		"path":   path,
+	})
+}
+
+// HandleMoveFolder moves a folder under a new parent, or to the top level
+// when parent_id is null. A folder cannot be moved into its own subtree.
+func (h *Handler) HandleMoveFolder(c *gin.Context) {
+	folderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid folder ID",
+		})
+		return
+	}
+
+	var req struct {
+		ParentID *int `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	var folder model.Folder
+	err = h.stores.InTx(func(stores model.Stores) error {
+		current, err := stores.Folders.GetFolder(folderID)
+		if err != nil {
+			return err
+		}
+		if req.ParentID != nil {
+			if _, err := stores.Folders.GetFolder(*req.ParentID); err == model.ErrNotFound {
+				return errParentNotFound
+			} else if err != nil {
+				return err
+			}
+		}
+		folder, err = stores.Folders.MoveFolder(folderID, req.ParentID, current.Name)
+		return err
+	})
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{
+			"folder":  folder,
+			"message": "Folder moved successfully",
+		})
+	case model.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Folder not found",
+		})
+	case errParentNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Parent folder not found",
+		})
+	case model.ErrFolderCycle:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Cannot move a folder into itself or one of its subfolders",
+		})
+	case model.ErrNameTaken:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A folder with this name already exists in the destination",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to move folder",
+			"details": err.Error(),
+		})
+	}
+}
+
+// ============================================================================
+// FOLDER HIERARCHY HELPER FUNCTIONS
+// ============================================================================
+
+// errParentNotFound is returned inside HandleMoveFolder's transaction when
+// the destination folder does not exist
+var errParentNotFound = errors.New("parent folder not found")
+
+// folderTree nests folders under their parents, by name at each level
+func folderTree(folders []model.Folder, counts map[int]int) gin.H {
+	sort.SliceStable(folders, func(i, j int) bool {
+		return strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name)
+	})
+
+	nodes := make([]*model.FolderNode, len(folders))
+	byID := make(map[int]*model.FolderNode)
+	for i, folder := range folders {
+		nodes[i] = &model.FolderNode{
+			Folder:    folder,
+			NoteCount: counts[folder.ID],
+			Children:  []*model.FolderNode{},
+		}
+		byID[folder.ID] = nodes[i]
+	}
+
+	// Folders whose parent is missing are shown at the top level
+	roots := []*model.FolderNode{}
+	for _, node := range nodes {
+		if node.ParentID != nil {
+			if parent, ok := byID[*node.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+
+	var setPaths func(nodes []*model.FolderNode, prefix string)
+	setPaths = func(nodes []*model.FolderNode, prefix string) {
+		for _, node := range nodes {
+			node.Path = prefix + node.Name
+			setPaths(node.Children, node.Path+"/")
+		}
+	}
+	setPaths(roots, "")
+
+	return gin.H{
+		"folders": roots,
+		"count":   len(nodes),
+	}
+}
+
+// sameParent reports whether a folder's parent_id is parentID, where 0
+// stands for the top level
+func sameParent(parentID *int, id int) bool {
+	if parentID == nil {
+		return id == 0
+	}
+	return *parentID == id
+}
@@ -1,52 +1,56 @@
 package handler
 
 import (
+	"backend/internal/logging"
+	"backend/internal/media"
 	"backend/internal/model"
-	"crypto/rand"
-	"database/sql"
-	"encoding/hex"
+	"backend/internal/service"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Handler serves every endpoint from the stores it is given, so the backend
+// can run on SQLite, PostgreSQL, or MemoryStore in tests or inside another
+// program. Notes are changed through service.NotesService, which holds the
+// rules. Endpoints whose store is missing answer 503.
+type Handler struct {
+	stores model.Stores
+	notes  *service.NotesService
+}
+
+// New returns a Handler working on the given stores
+func New(stores model.Stores) *Handler {
+	return &Handler{
+		stores: stores,
+		notes:  service.NewNotesService(stores, service.FromAPI),
+	}
+}
+
 // ============================================================================
 // NOTE HANDLERS
 // ============================================================================
 
-// HandleGet processes GET requests and returns all notes
-func HandleGet(c *gin.Context) {
-	rows, err := model.DB.Query("SELECT id, title, content, folder_id, order_index, created_at, updated_at FROM notes ORDER BY order_index ASC, created_at DESC")
+// HandleGet processes GET requests and returns all notes.
+// Repeat ?tag= to only return notes carrying all of the given tags.
+func (h *Handler) HandleGet(c *gin.Context) {
+	notes, err := h.notes.List(model.NoteFilter{Tags: c.QueryArray("tag")})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to fetch notes",
-			"details": err.Error(),
-		})
+		noteError(c, err, "Failed to fetch notes")
 		return
 	}
-	defer rows.Close()
-
-	var notes []model.Note
-	for rows.Next() {
-		var note model.Note
-		err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Failed to parse notes",
-				"details": err.Error(),
-			})
-			return
-		}
-		notes = append(notes, note)
-	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"notes": notes,
@@ -55,7 +59,7 @@ func HandleGet(c *gin.Context) {
 }
 
 // HandlePost processes POST requests
-func HandlePost(c *gin.Context) {
+func (h *Handler) HandlePost(c *gin.Context) {
 	var note model.Note
 
 	if err := c.ShouldBindJSON(&note); err != nil {
@@ -66,32 +70,11 @@ func HandlePost(c *gin.Context) {
 		return
 	}
 
-	// Get max order for proper ordering
-	var maxOrder int
-	err := model.DB.QueryRow("SELECT COALESCE(MAX(order_index), 0) FROM notes WHERE folder_id = ? OR (folder_id IS NULL AND ? IS NULL)", note.FolderID, note.FolderID).Scan(&maxOrder)
-	if err != nil {
-		maxOrder = 0
-	}
-
-	note.OrderIndex = maxOrder + 1
-	note.CreatedAt = time.Now()
-	note.UpdatedAt = time.Now()
-
-	res, err := model.DB.Exec(
-		"INSERT INTO notes (title, content, folder_id, order_index, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to create note",
-			"details": err.Error(),
-		})
+	if err := h.notes.Create(&note); err != nil {
+		noteError(c, err, "Failed to create note")
 		return
 	}
 
-	id, _ := res.LastInsertId()
-	note.ID = int(id)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"note":    note,
 		"message": "Note created successfully",
@@ -99,7 +82,7 @@ func HandlePost(c *gin.Context) {
 }
 
 // HandleUpdate processes PUT requests to update a note
-func HandleUpdate(c *gin.Context) {
+func (h *Handler) HandleUpdate(c *gin.Context) {
 	var note model.Note
 
 	if err := c.ShouldBindJSON(&note); err != nil {
@@ -116,26 +99,8 @@ func HandleUpdate(c *gin.Context) {
 		})
 		return
 	}
-
-	note.UpdatedAt = time.Now()
-
-	result, err := model.DB.Exec(
-		"UPDATE notes SET title = ?, content = ?, folder_id = ?, updated_at = ? WHERE id = ?",
-		note.Title, note.Content, note.FolderID, note.UpdatedAt, note.ID,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to update note",
-			"details": err.Error(),
-		})
-		return
-	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Note not found",
-		})
+	if err := h.notes.Update(&note); err != nil {
+		noteError(c, err, "Failed to update note")
 		return
 	}
 
@@ -146,7 +111,7 @@ func HandleUpdate(c *gin.Context) {
 }
 
 // HandleDelete processes DELETE requests to remove a note by ID
-func HandleDelete(c *gin.Context) {
+func (h *Handler) HandleDelete(c *gin.Context) {
 	var noteID int
 	var err error
 
@@ -174,25 +139,14 @@ func HandleDelete(c *gin.Context) {
 		noteID = req.ID
 	}
 
-	result, err := model.DB.Exec("DELETE FROM notes WHERE id = ?", noteID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to delete note",
-			"details": err.Error(),
-		})
-		return
-	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Note not found",
-		})
+	// Move to trash; the note is permanently removed when the trash is purged
+	if err := h.notes.Delete(noteID); err != nil {
+		noteError(c, err, "Failed to delete note")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Note deleted successfully",
+		"message": "Note moved to trash",
 	})
 }
 
@@ -201,8 +155,8 @@ func HandleDelete(c *gin.Context) {
 // ============================================================================
 
 // HandleGetFolders returns all folders
-func HandleGetFolders(c *gin.Context) {
-	rows, err := model.DB.Query("SELECT id, name, created_at FROM folders ORDER BY created_at ASC")
+func (h *Handler) HandleGetFolders(c *gin.Context) {
+	folders, err := h.stores.Folders.ListFolders()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to fetch folders",
@@ -210,21 +164,6 @@ func HandleGetFolders(c *gin.Context) {
 		})
 		return
 	}
-	defer rows.Close()
-
-	var folders []model.Folder
-	for rows.Next() {
-		var folder model.Folder
-		err := rows.Scan(&folder.ID, &folder.Name, &folder.CreatedAt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Failed to parse folders",
-				"details": err.Error(),
-			})
-			return
-		}
-		folders = append(folders, folder)
-	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"folders": folders,
@@ -232,8 +171,8 @@ func HandleGetFolders(c *gin.Context) {
 	})
 }
 
-// HandleCreateFolder creates a new folder
-func HandleCreateFolder(c *gin.Context) {
+// HandleCreateFolder creates a new folder, optionally inside parent_id
+func (h *Handler) HandleCreateFolder(c *gin.Context) {
 	var folder model.Folder
 
 	if err := c.ShouldBindJSON(&folder); err != nil {
@@ -251,13 +190,27 @@ func HandleCreateFolder(c *gin.Context) {
 		return
 	}
 
-	folder.CreatedAt = time.Now()
+	if strings.Contains(folder.Name, "/") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Folder name cannot contain /",
+		})
+		return
+	}
 
-	res, err := model.DB.Exec(
-		"INSERT INTO folders (name, created_at) VALUES (?, ?)",
-		folder.Name, folder.CreatedAt,
-	)
-	if err != nil {
+	// The store keeps IDs it is given; those are for sync only
+	folder = model.Folder{Name: folder.Name, ParentID: folder.ParentID}
+	err := h.stores.Folders.CreateFolder(&folder)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Parent folder not found",
+		})
+		return
+	} else if err == model.ErrNameTaken {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A folder with this name already exists here",
+		})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to create folder",
 			"details": err.Error(),
@@ -265,17 +218,14 @@ func HandleCreateFolder(c *gin.Context) {
 		return
 	}
 
-	id, _ := res.LastInsertId()
-	folder.ID = int(id)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"folder":  folder,
 		"message": "Folder created successfully",
 	})
 }
 
-// HandleUpdateFolder updates a folder name
-func HandleUpdateFolder(c *gin.Context) {
+// HandleUpdateFolder updates a folder name. Use HandleMoveFolder to change its parent.
+func (h *Handler) HandleUpdateFolder(c *gin.Context) {
 	folderIDStr := c.Param("id")
 	folderID, err := strconv.Atoi(folderIDStr)
 	if err != nil {
@@ -285,8 +235,8 @@ func HandleUpdateFolder(c *gin.Context) {
 		return
 	}
 
-	var folder model.Folder
-	if err := c.ShouldBindJSON(&folder); err != nil {
+	var req model.Folder
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid request body",
 			"details": err.Error(),
@@ -294,42 +244,49 @@ func HandleUpdateFolder(c *gin.Context) {
 		return
 	}
 
-	if folder.Name == "" {
+	if req.Name == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Folder name is required",
 		})
 		return
 	}
 
-	result, err := model.DB.Exec(
-		"UPDATE folders SET name = ? WHERE id = ?",
-		folder.Name, folderID,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to update folder",
-			"details": err.Error(),
+	if strings.Contains(req.Name, "/") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Folder name cannot contain /",
 		})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	folder, err := h.stores.Folders.RenameFolder(folderID, req.Name)
+	if err == model.ErrNotFound {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Folder not found",
 		})
 		return
+	} else if err == model.ErrNameTaken {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A folder with this name already exists here",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to update folder",
+			"details": err.Error(),
+		})
+		return
 	}
 
-	folder.ID = folderID
 	c.JSON(http.StatusOK, gin.H{
 		"folder":  folder,
 		"message": "Folder updated successfully",
 	})
 }
 
-// HandleDeleteFolder deletes a folder
-func HandleDeleteFolder(c *gin.Context) {
+// HandleDeleteFolder deletes a folder. With ?recursive=true its subfolders
+// and notes are moved to the trash along with it; otherwise the folder
+// must be empty.
+func (h *Handler) HandleDeleteFolder(c *gin.Context) {
 	folderIDStr := c.Param("id")
 	folderID, err := strconv.Atoi(folderIDStr)
 	if err != nil {
@@ -339,26 +296,29 @@ func HandleDeleteFolder(c *gin.Context) {
 		return
 	}
 
-	// Check if folder has notes
-	var noteCount int
-	err = model.DB.QueryRow("SELECT COUNT(*) FROM notes WHERE folder_id = ?", folderID).Scan(&noteCount)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to check folder notes",
-		})
-		return
-	}
+	recursive := c.Query("recursive") == "true"
 
-	if noteCount > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Cannot delete folder with notes",
-			"message": fmt.Sprintf("Folder contains %d notes. Move or delete notes first.", noteCount),
+	folders, notes, err := h.stores.Folders.TrashFolder(folderID, recursive)
+	var notEmpty *model.FolderNotEmptyError
+	if errors.As(err, &notEmpty) {
+		if notEmpty.Notes > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Cannot delete folder with notes",
+				"message": fmt.Sprintf("Folder contains %d notes. Move or delete notes first, or delete recursively.", notEmpty.Notes),
+			})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Cannot delete folder with subfolders",
+				"message": fmt.Sprintf("Folder contains %d subfolders. Move or delete them first, or delete recursively.", notEmpty.Subfolders),
+			})
+		}
+		return
+	} else if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Folder not found",
 		})
 		return
-	}
-
-	result, err := model.DB.Exec("DELETE FROM folders WHERE id = ?", folderID)
-	if err != nil {
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to delete folder",
 			"details": err.Error(),
@@ -366,67 +326,26 @@ func HandleDeleteFolder(c *gin.Context) {
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Folder not found",
-		})
-		return
-	}
-
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Folder deleted successfully",
+		"folders_deleted": folders,
+		"notes_deleted":   notes,
+		"message":         "Folder moved to trash",
 	})
 }
 
-// HandleGetFolderNotes returns all notes in a specific folder
-func HandleGetFolderNotes(c *gin.Context) {
-	folderIDStr := c.Param("id")
-	folderID, err := strconv.Atoi(folderIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid folder ID",
-		})
-		return
-	}
-
-	// Check if folder exists
-	var exists bool
-	err = model.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE id = ?)", folderID).Scan(&exists)
-	if err != nil || !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Folder not found",
-		})
+// HandleGetFolderNotes returns all notes in a specific folder.
+// Repeat ?tag= to only return notes carrying all of the given tags.
+func (h *Handler) HandleGetFolderNotes(c *gin.Context) {
+	folderID, ok := folderIDParam(c)
+	if !ok {
 		return
 	}
 
-	rows, err := model.DB.Query(
-		"SELECT id, title, content, folder_id, order_index, created_at, updated_at FROM notes WHERE folder_id = ? ORDER BY order_index DESC, created_at ASC",
-		folderID,
-	)
+	notes, err := h.notes.List(model.NoteFilter{FolderID: &folderID, Tags: c.QueryArray("tag")})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to fetch notes",
-			"details": err.Error(),
-		})
+		noteError(c, err, "Failed to fetch notes")
 		return
 	}
-	defer rows.Close()
-
-	var notes []model.Note
-	for rows.Next() {
-		var note model.Note
-		// FIXED: Added order_index to the scan
-		err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Failed to parse notes",
-				"details": err.Error(),
-			})
-			return
-		}
-		notes = append(notes, note)
-	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"notes": notes,
@@ -435,23 +354,9 @@ func HandleGetFolderNotes(c *gin.Context) {
 }
 
 // HandleCreateFolderNote creates a new note in a specific folder
-func HandleCreateFolderNote(c *gin.Context) {
-	folderIDStr := c.Param("id")
-	folderID, err := strconv.Atoi(folderIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid folder ID",
-		})
-		return
-	}
-
-	// Check if folder exists
-	var exists bool
-	err = model.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE id = ?)", folderID).Scan(&exists)
-	if err != nil || !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Folder not found",
-		})
+func (h *Handler) HandleCreateFolderNote(c *gin.Context) {
+	folderID, ok := folderIDParam(c)
+	if !ok {
 		return
 	}
 
@@ -464,33 +369,12 @@ func HandleCreateFolderNote(c *gin.Context) {
 		return
 	}
 
-	// Get max order for this folder to set proper order_index
-	var maxOrder int
-	err = model.DB.QueryRow("SELECT COALESCE(MAX(order_index), 0) FROM notes WHERE folder_id = ?", folderID).Scan(&maxOrder)
-	if err != nil {
-		maxOrder = 0
-	}
-
 	note.FolderID = &folderID
-	note.OrderIndex = maxOrder + 1
-	note.CreatedAt = time.Now()
-	note.UpdatedAt = time.Now()
-
-	res, err := model.DB.Exec(
-		"INSERT INTO notes (title, content, folder_id, order_index, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to create note",
-			"details": err.Error(),
-		})
+	if err := h.notes.Create(&note); err != nil {
+		noteError(c, err, "Failed to create note")
 		return
 	}
 
-	id, _ := res.LastInsertId()
-	note.ID = int(id)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"note":    note,
 		"message": "Note created successfully",
@@ -498,23 +382,9 @@ func HandleCreateFolderNote(c *gin.Context) {
 }
 
 // HandleReorderNotes handles reordering notes within a folder
-func HandleReorderNotes(c *gin.Context) {
-	folderIDStr := c.Param("id")
-	folderID, err := strconv.Atoi(folderIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid folder ID",
-		})
-		return
-	}
-
-	// Check if folder exists
-	var exists bool
-	err = model.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE id = ?)", folderID).Scan(&exists)
-	if err != nil || !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Folder not found",
-		})
+func (h *Handler) HandleReorderNotes(c *gin.Context) {
+	folderID, ok := folderIDParam(c)
+	if !ok {
 		return
 	}
 
@@ -533,37 +403,14 @@ func HandleReorderNotes(c *gin.Context) {
 		return
 	}
 
-	// Start a transaction to ensure all updates happen together
-	tx, err := model.DB.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to start transaction",
-		})
-		return
-	}
-	defer tx.Rollback()
-
-	// Update each note's order
+	order := make(map[int]int, len(orderData.NoteOrder))
 	for _, note := range orderData.NoteOrder {
-		_, err := tx.Exec(`
-			UPDATE notes 
-			SET order_index = ? 
-			WHERE id = ? AND folder_id = ?
-		`, note.Order, note.ID, folderID)
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   "Failed to update note order",
-				"details": err.Error(),
-			})
-			return
-		}
+		order[note.ID] = note.Order
 	}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to commit transaction",
-		})
+	// All updates happen together
+	if err := h.notes.Reorder(folderID, order); err != nil {
+		noteError(c, err, "Failed to update note order")
 		return
 	}
 
@@ -576,8 +423,10 @@ func HandleReorderNotes(c *gin.Context) {
 // FILE ATTACHMENT HANDLERS
 // ============================================================================
 
-// HandleFileUpload handles file uploads for notes
-func HandleFileUpload(c *gin.Context) {
+// HandleFileUpload handles file uploads for notes. Instead of a file, the
+// form can carry the sha256 and filename of content the server already
+// stores (see HEAD /blobs/:sha256), which is attached without re-uploading.
+func (h *Handler) HandleFileUpload(c *gin.Context) {
 	// Get note ID from URL
 	noteIDStr := c.Param("noteId")
 	noteID, err := strconv.Atoi(noteIDStr)
@@ -589,75 +438,117 @@ func HandleFileUpload(c *gin.Context) {
 	}
 
 	// Check if note exists
-	var exists bool
-	err = model.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE id = ?)", noteID).Scan(&exists)
-	if err != nil || !exists {
+	if _, err := h.notes.Get(noteIDStr); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Note not found",
 		})
 		return
 	}
 
-	// Get uploaded file
+	// Get uploaded file, or the hash of a file the server already has
+	var sum, originalName, mimeType string
+	var size int64
+	var unlock func()
 	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "No file uploaded",
-		})
-		return
-	}
-	defer file.Close()
+	if err == nil {
+		defer file.Close()
 
-	// Check file size (max 10MB)
-	if header.Size > 10*1024*1024 {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "File too large. Maximum size is 10MB",
-		})
-		return
-	}
+		// Check file size (MAX_ATTACHMENT_MB)
+		if header.Size > model.MaxAttachmentSize {
+			quotaExceeded(c, &model.QuotaError{Quota: model.QuotaAttachmentSize, Limit: model.MaxAttachmentSize, Asked: header.Size})
+			return
+		}
+
+		received, err := spoolUpload(file, "")
+		if err == errBlockedType {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":     "File type not allowed",
+				"mime_type": received.mimeType,
+			})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to read file",
+			})
+			return
+		}
+		defer os.Remove(received.path)
 
-	// Generate secure filename
-	filename := generateSecureFilename(header.Filename)
-	filePath := fmt.Sprintf("./data/attachments/%s", filename)
+		err = model.CheckAttachmentQuota(h.stores, noteID, received.sum, received.size)
+		if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to check quota",
+				"details": err.Error(),
+			})
+			return
+		}
 
-	// Save file
-	if err := saveFile(file, filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to save file",
+		// Identical files are stored once
+		unlock = model.LockBlobs()
+		defer unlock()
+		if _, err := model.AddBlob(received.path, received.sum); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to save file",
+			})
+			return
+		}
+		sum, size = received.sum, received.size
+		originalName, mimeType = header.Filename, received.mimeType
+	} else if sum = strings.ToLower(c.PostForm("sha256")); sum != "" {
+		var ok bool
+		originalName, ok = cleanFileName(c.PostForm("filename"))
+		if !model.ValidSHA256(sum) || !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "A sha256 upload needs a valid sha256 and a filename",
+			})
+			return
+		}
+		unlock = model.LockBlobs()
+		defer unlock()
+		known, err := h.stores.Blobs.FindBlob(sum)
+		if err != nil || !model.BlobExists(sum) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Blob not found, upload the file instead",
+			})
+			return
+		}
+		size, mimeType = known.Size, known.MimeType
+
+		err = model.CheckAttachmentQuota(h.stores, noteID, sum, size)
+		if quotaExceeded(c, err) {
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to check quota",
+				"details": err.Error(),
+			})
+			return
+		}
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "No file uploaded",
 		})
 		return
 	}
 
-	// Store in database
-	result, err := model.DB.Exec(
-		"INSERT INTO attachments (note_id, filename, original_name, mime_type, size, created_at) VALUES (?, ?, ?, ?, ?, ?)",
-		noteID, filename, header.Filename, header.Header.Get("Content-Type"), header.Size, time.Now(),
-	)
+	attachment, err := h.insertAttachment(unlock, noteID, sum, originalName, mimeType, size)
 	if err != nil {
-		// Clean up file if database fails
-		os.Remove(filePath)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to store file info",
 		})
 		return
 	}
 
-	attachmentID, _ := result.LastInsertId()
-
 	c.JSON(http.StatusCreated, gin.H{
-		"attachment": gin.H{
-			"id":            attachmentID,
-			"note_id":       noteID,
-			"filename":      filename,
-			"original_name": header.Filename,
-			"size":          header.Size,
-		},
-		"message": "File uploaded successfully",
+		"attachment": attachment,
+		"message":    "File uploaded successfully",
 	})
 }
 
 // HandleGetAttachments returns all attachments for a specific note
-func HandleGetAttachments(c *gin.Context) {
+func (h *Handler) HandleGetAttachments(c *gin.Context) {
 	noteIDStr := c.Param("noteId")
 	noteID, err := strconv.Atoi(noteIDStr)
 	if err != nil {
@@ -667,43 +558,13 @@ func HandleGetAttachments(c *gin.Context) {
 		return
 	}
 
-	// Get all attachments for this note
-	rows, err := model.DB.Query(
-		"SELECT id, filename, original_name, mime_type, size, created_at FROM attachments WHERE note_id = ? ORDER BY created_at DESC",
-		noteID,
-	)
+	attachments, err := h.stores.Attachments.ListAttachments(noteID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to fetch attachments",
 		})
 		return
 	}
-	defer rows.Close()
-
-	var attachments []gin.H
-	for rows.Next() {
-		var id int
-		var filename, originalName, mimeType string
-		var size int64
-		var createdAt time.Time
-
-		err := rows.Scan(&id, &filename, &originalName, &mimeType, &size, &createdAt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to parse attachments",
-			})
-			return
-		}
-
-		attachments = append(attachments, gin.H{
-			"id":            id,
-			"filename":      filename,
-			"original_name": originalName,
-			"mime_type":     mimeType,
-			"size":          size,
-			"created_at":    createdAt,
-		})
-	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"attachments": attachments,
@@ -711,70 +572,370 @@ func HandleGetAttachments(c *gin.Context) {
 	})
 }
 
-// HandleServeFile serves the actual file to the browser
-func HandleServeFile(c *gin.Context) {
-	attachmentIDStr := c.Param("id")
-	attachmentID, err := strconv.Atoi(attachmentIDStr)
+// HandleServeFile serves the actual file to the browser. The attachment
+// can be given by its integer ID or its global ID.
+func (h *Handler) HandleServeFile(c *gin.Context) {
+	attachment, err := h.stores.Attachments.GetAttachment(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid attachment ID",
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Attachment not found",
 		})
 		return
 	}
 
-	// Get file info from database
-	var filename, originalName, mimeType string
-	err = model.DB.QueryRow(
-		"SELECT filename, original_name, mime_type FROM attachments WHERE id = ?",
-		attachmentID,
-	).Scan(&filename, &originalName, &mimeType)
+	file, ok := openAttachmentFile(c, attachment.Filename)
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	// Only types that cannot run script are displayed; the rest, such as
+	// HTML and SVG, are downloaded. nosniff stops the browser from
+	// second-guessing the type.
+	disposition := "attachment"
+	if media.Inline(attachment.MimeType) {
+		disposition = "inline"
+	}
+	c.Header("Content-Type", attachment.MimeType)
+	c.Header("Content-Disposition", media.ContentDisposition(disposition, attachment.OriginalName))
+	c.Header("X-Content-Type-Options", "nosniff")
+	serveAttachmentFile(c, file, attachment.SHA256)
+}
 
-	if err != nil {
+// HandleDeleteFile moves an attachment to the trash. Other devices remove
+// it on their next sync.
+func (h *Handler) HandleDeleteFile(c *gin.Context) {
+	attachment, err := h.stores.Attachments.GetAttachment(c.Param("id"))
+	if err == nil {
+		err = h.stores.Attachments.TrashAttachment(attachment.ID)
+	}
+	if err == model.ErrNotFound {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Attachment not found",
 		})
 		return
-	}
-
-	// Check if file exists on disk
-	filePath := fmt.Sprintf("./data/attachments/%s", filename)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "File not found on disk",
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to delete attachment",
+			"details": err.Error(),
 		})
 		return
 	}
 
-	// Set headers and serve file
-	c.Header("Content-Type", mimeType)
-	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", originalName))
-	c.File(filePath)
+	c.JSON(http.StatusOK, gin.H{
+		"id":      attachment.ID,
+		"message": "Attachment moved to trash",
+	})
+}
+
+// HandleUpdateFile renames an attachment and/or moves it to another note.
+// The note can be given as note_id or note_uid. Other devices pick up the
+// change on their next sync.
+func (h *Handler) HandleUpdateFile(c *gin.Context) {
+	attachment, err := h.stores.Attachments.GetAttachment(c.Param("id"))
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Attachment not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch attachment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	var req struct {
+		OriginalName *string `json:"original_name"`
+		NoteID       *int    `json:"note_id"`
+		NoteUID      *string `json:"note_uid"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+	if req.OriginalName == nil && req.NoteID == nil && req.NoteUID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Nothing to update. Provide original_name, note_id or note_uid",
+		})
+		return
+	}
+
+	if req.OriginalName != nil {
+		name, ok := cleanFileName(*req.OriginalName)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid file name",
+			})
+			return
+		}
+		attachment.OriginalName = name
+	}
+
+	if req.NoteID != nil || req.NoteUID != nil {
+		var ref string
+		if req.NoteUID != nil {
+			// Only a global ID; an integer here is not taken as a note ID
+			if !model.ValidUID(*req.NoteUID) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "Note not found",
+				})
+				return
+			}
+			ref = *req.NoteUID
+		} else {
+			ref = strconv.Itoa(*req.NoteID)
+		}
+		note, err := h.notes.Get(ref)
+		if err == service.ErrNoteNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Note not found",
+			})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to fetch note",
+				"details": err.Error(),
+			})
+			return
+		}
+		attachment.NoteID = note.ID
+		attachment.NoteUID = note.UID
+	}
+
+	if err := h.stores.Attachments.UpdateAttachment(&attachment); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to update attachment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"attachment": attachment,
+		"message":    "Attachment updated successfully",
+	})
 }
 
 // ============================================================================
 // HELPER FUNCTIONS
 // ============================================================================
 
-// generateSecureFilename creates a unique filename
-func generateSecureFilename(originalName string) string {
-	ext := filepath.Ext(originalName)
-	randomBytes := make([]byte, 16)
-	rand.Read(randomBytes)
-	randomString := hex.EncodeToString(randomBytes)
-	timestamp := time.Now().Unix()
-	return fmt.Sprintf("%d_%s%s", timestamp, randomString, ext)
+// errChecksumMismatch is returned when an upload does not match its declared hash
+var errChecksumMismatch = errors.New("file does not match its sha256")
+
+// errBlockedType is returned for uploads of a type that is never accepted
+var errBlockedType = errors.New("file type not allowed")
+
+// upload is a file received from a client, waiting in a temporary file
+// until it is added to the blob store with model.AddBlob
+type upload struct {
+	path     string
+	sum      string // SHA-256 of the content to store
+	size     int64
+	mimeType string // Detected from the content
+}
+
+// spoolUpload streams an uploaded file to a temporary file, checks it
+// against the SHA-256 the client declared, if any, and strips image
+// metadata when model.StripEXIF is set. The declared hash is of the file as
+// sent. It also detects the MIME type from the content, refusing
+// executables; the type is returned with errBlockedType too. Only images
+// with metadata to strip are read into memory. The caller removes the file
+// if it does not add it.
+func spoolUpload(file io.Reader, declaredSHA256 string) (upload, error) {
+	path, sum, size, err := model.SpoolBlob(io.LimitReader(file, model.MaxAttachmentSize+1))
+	if err != nil {
+		return upload{}, err
+	}
+	u := upload{path: path, sum: sum, size: size}
+	fail := func(err error) (upload, error) {
+		os.Remove(path)
+		return upload{mimeType: u.mimeType}, err
+	}
+
+	if size > model.MaxAttachmentSize {
+		return fail(errors.New("file too large"))
+	}
+	if declaredSHA256 != "" && !strings.EqualFold(sum, declaredSHA256) {
+		return fail(errChecksumMismatch)
+	}
+
+	if u.mimeType, err = detectFileMIME(path); err != nil {
+		return fail(err)
+	}
+	if media.Blocked(u.mimeType) {
+		return fail(errBlockedType)
+	}
+	if !model.StripEXIF || !media.IsImage(u.mimeType) {
+		return u, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fail(err)
+	}
+	stripped, err := media.StripMetadata(data)
+	if err != nil {
+		return fail(err)
+	}
+	if bytes.Equal(stripped, data) {
+		return u, nil
+	}
+	os.Remove(path)
+	u.path, u.sum, u.size, err = model.SpoolBlob(bytes.NewReader(stripped))
+	return u, err
+}
+
+// detectFileMIME returns the MIME type of a file from its first bytes,
+// which are all media.DetectMIME looks at
+func detectFileMIME(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 3072)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return media.DetectMIME(head[:n]), nil
+}
+
+// openAttachmentFile opens an attachment file, responding with 404 and
+// returning false if it is missing
+func openAttachmentFile(c *gin.Context, filename string) (*os.File, bool) {
+	file, err := os.Open(filepath.Join(model.AttachmentDir, filename))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "File not found on disk",
+		})
+		return nil, false
+	}
+	return file, true
+}
+
+// serveAttachmentFile sends an attachment file, with its size taken from
+// disk. Range and If-Range requests let interrupted downloads resume and
+// media players seek. Since a file's content never changes, its SHA-256 is
+// a strong ETag, If-None-Match is answered with 304 and clients may cache
+// it for good.
+func serveAttachmentFile(c *gin.Context, file *os.File, sum string) {
+	info, err := file.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to read file",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if sum != "" {
+		c.Header("ETag", `"`+sum+`"`)
+	}
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
 }
 
-// saveFile saves uploaded file to disk
-func saveFile(file multipart.File, filePath string) error {
-	dst, err := os.Create(filePath)
+// quotaExceeded responds with 413 or 507 if err is a model.QuotaError and
+// reports whether it was one
+func quotaExceeded(c *gin.Context, err error) bool {
+	var quotaErr *model.QuotaError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	c.JSON(quotaErr.Status(), gin.H{
+		"error":   "Quota exceeded",
+		"details": err.Error(),
+		"quota":   quotaErr,
+	})
+	return true
+}
+
+// insertAttachment records a stored blob as an attachment of a note,
+// queues it for text extraction and returns the attachment as sent to
+// clients. The caller holds model.LockBlobs and passes its unlock function,
+// which is called first if the insert fails, so the blob can be removed
+// again if nothing else uses it.
+func (h *Handler) insertAttachment(unlock func(), noteID int, sum, originalName, mimeType string, size int64) (model.Attachment, error) {
+	attachment := model.Attachment{
+		NoteID:       noteID,
+		Filename:     model.BlobFilename(sum),
+		OriginalName: originalName,
+		MimeType:     mimeType,
+		Size:         size,
+		SHA256:       sum,
+	}
+	if err := h.stores.Attachments.CreateAttachment(&attachment); err != nil {
+		unlock()
+		model.RemoveUnusedFiles(h.stores.Blobs, []string{attachment.Filename})
+		return attachment, err
+	}
+
+	model.QueueTextExtraction(attachment.ID)
+	return attachment, nil
+}
+
+// cleanFileName trims a file name sent by a client and reports whether it
+// can be stored: it must not be empty or contain path separators or
+// control characters
+func cleanFileName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.ContainsFunc(name, unicode.IsControl) {
+		return "", false
+	}
+	return name, true
+}
+
+// folderIDParam parses the folder ID in the URL, responding with an error
+// and returning false if it is invalid
+func folderIDParam(c *gin.Context) (int, bool) {
+	folderID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return err
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid folder ID",
+		})
+		return 0, false
+	}
+	return folderID, true
+}
+
+// noteError responds to an error from the notes service: 404 for a missing
+// note or folder, the quota response for content over a quota, and 500
+// with message otherwise
+func noteError(c *gin.Context, err error, message string) {
+	if quotaExceeded(c, err) {
+		return
 	}
-	defer dst.Close()
+	switch {
+	case errors.Is(err, service.ErrNoteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Note not found",
+		})
+	case errors.Is(err, service.ErrFolderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Folder not found",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   message,
+			"details": err.Error(),
+		})
+	}
+}
 
-	_, err = io.Copy(dst, file)
-	return err
+// unavailable responds with 503 for a feature whose store the server does
+// not have
+func unavailable(c *gin.Context, feature string) {
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": feature + " is not available on this server",
+	})
 }
 
 // ============================================================================
@@ -782,22 +943,47 @@ func saveFile(file multipart.File, filePath string) error {
 // Add these to the end of your existing handler.go file
 // ============================================================================
 
-// SyncRequest represents a sync request from a device
+// SyncRequest represents a sync request from a device. Notes and folders are
+// matched by uid; items without one are matched by their integer id, as
+// older clients expect, and get a uid assigned. Cursor is the value returned
+// by the previous sync, or 0 for a full sync.
+//
+// To upload attachments, send the request as multipart/form-data with this
+// JSON in the "sync" field and each file in a field named "file:" followed by
+// the attachment's uid (or its id if it has none).
 type SyncRequest struct {
-	DeviceID     string         `json:"device_id"`
-	LastSync     time.Time      `json:"last_sync"`
-	LocalNotes   []model.Note   `json:"local_notes"`
-	LocalFolders []model.Folder `json:"local_folders"`
+	DeviceID         string             `json:"device_id"`
+	DeviceName       string             `json:"device_name"`
+	Cursor           int64              `json:"cursor"`
+	LocalNotes       []model.Note       `json:"local_notes"`
+	LocalFolders     []model.Folder     `json:"local_folders"`
+	LocalAttachments []model.Attachment `json:"local_attachments"` // Files created on the device
+	Tombstones       []model.Tombstone  `json:"tombstones"`        // Deletions made on the device
 }
 
 // SyncResponse represents the response to a sync request
 type SyncResponse struct {
-	Notes       []model.Note       `json:"notes"`
-	Folders     []model.Folder     `json:"folders"`
-	Attachments []model.Attachment `json:"attachments"`
-	ServerTime  time.Time          `json:"server_time"`
-	Success     bool               `json:"success"`
-	Message     string             `json:"message"`
+	Notes       []model.Note           `json:"notes"`
+	Folders     []model.Folder         `json:"folders"`
+	Attachments []model.Attachment     `json:"attachments"`
+	Tombstones  []model.Tombstone      `json:"tombstones"` // Deletions the device should apply
+	IDs         []SyncedID             `json:"ids"`        // Server IDs of new items sent without a uid
+	Conflicts   []model.NoteConflict   `json:"conflicts"`  // Edits saved as conflicted copies
+	Uploads     []AttachmentSyncResult `json:"uploads"`    // One per uploaded attachment
+	Cursor      int64                  `json:"cursor"`     // Send with the next sync
+	ServerTime  time.Time              `json:"server_time"`
+	Success     bool                   `json:"success"`
+	Message     string                 `json:"message"`
+}
+
+// SyncedID tells a client that predates global IDs which server ID and uid
+// a folder or note it created were given, as two devices may have created
+// items with the same ID offline. Attachments are reported in Uploads.
+type SyncedID struct {
+	Type     string `json:"type"` // "folder" or "note"
+	ClientID int    `json:"client_id"`
+	ID       int    `json:"id"`
+	UID      string `json:"uid"`
 }
 
 // HandleSyncHealth checks if sync endpoint is reachable
@@ -812,10 +998,33 @@ func HandleSyncHealth(c *gin.Context) {
 }
 
 // HandleSync processes sync requests from devices
-func HandleSync(c *gin.Context) {
-	var syncReq SyncRequest
+func (h *Handler) HandleSync(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
+		return
+	}
 
-	if err := c.ShouldBindJSON(&syncReq); err != nil {
+	var syncReq SyncRequest
+	var files map[string][]*multipart.FileHeader
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		form, err := c.MultipartForm()
+		if err == nil {
+			files = form.File
+			if len(form.Value["sync"]) == 0 {
+				err = fmt.Errorf("missing sync field")
+			} else {
+				err = json.Unmarshal([]byte(form.Value["sync"][0]), &syncReq)
+			}
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid sync request",
+				"details": err.Error(),
+			})
+			return
+		}
+	} else if err := c.ShouldBindJSON(&syncReq); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error":   "Invalid sync request",
 			"details": err.Error(),
@@ -823,260 +1032,576 @@ func HandleSync(c *gin.Context) {
 		return
 	}
 
-	// Log sync attempt
-	log.Printf("📱 Sync request from device: %s, last sync: %v", syncReq.DeviceID, syncReq.LastSync)
-
-	// Start transaction for atomic sync
-	tx, err := model.DB.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to start sync transaction",
-		})
-		return
-	}
-	defer tx.Rollback()
-
-	// 1. SYNC FOLDERS FIRST (dependencies)
-	if err := syncFolders(tx, syncReq.LocalFolders, syncReq.LastSync); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to sync folders",
+	if err := validateSyncRequest(&syncReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid sync request",
 			"details": err.Error(),
 		})
 		return
 	}
 
-	// 2. SYNC NOTES
-	if err := syncNotes(tx, syncReq.LocalNotes, syncReq.LastSync); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to sync notes",
-			"details": err.Error(),
-		})
-		return
+	// An oversized note fails the whole sync before anything is written
+	for _, note := range syncReq.LocalNotes {
+		if err := service.ValidateNote(note); err != nil {
+			ref := note.UID
+			if ref == "" {
+				ref = strconv.Itoa(note.ID)
+			}
+			quotaExceeded(c, fmt.Errorf("note %s: %w", ref, err))
+			return
+		}
 	}
 
-	// 3. GET UPDATED DATA FOR RESPONSE
-	folders, err := getFoldersModifiedSince(tx, syncReq.LastSync)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get updated folders",
-		})
-		return
-	}
+	// Log sync attempt
+	logging.Debugf("📱 Sync request from device: %s, cursor: %d", syncReq.DeviceID, syncReq.Cursor)
+
+	// Blobs this sync stores or reuses must outlive the transaction
+	unlockBlobs := model.LockBlobs()
+	defer unlockBlobs()
+
+	// Everything is applied in one transaction. Failures respond inside it
+	// and return errResponded, so it is rolled back.
+	var response SyncResponse
+	var written []string
+	var expired bool
+	err := h.stores.InTx(func(stores model.Stores) error {
+		// Tombstones older than the cursor may have been collected, so the
+		// device cannot be told about every deletion it missed and must sync
+		// again from scratch. What it sent is applied first, so its offline
+		// edits are not lost, but nothing it had before its last sync may
+		// come back; without a device ID that is everything it sent.
+		horizon, err := stores.Sync.TombstoneHorizon()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to check sync cursor",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+		expired = syncReq.Cursor > 0 && syncReq.Cursor < horizon
+		var lastSync *time.Time
+		if syncReq.DeviceID != "" {
+			device, err := stores.Sync.GetDevice(syncReq.DeviceID)
+			if err != nil && err != model.ErrNotFound {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to check device",
+					"details": err.Error(),
+				})
+				return errResponded
+			}
+
+			// A full sync skips the cursor check, but the device may still
+			// hold items purged since it last synced
+			acked := syncReq.Cursor
+			if acked == 0 {
+				acked = device.LastAckSeq
+			}
+			if err == nil && acked < horizon {
+				lastSync = &device.LastSeenAt
+			}
+		} else if expired {
+			now := time.Now()
+			lastSync = &now
+		}
 
-	notes, err := getNotesModifiedSince(tx, syncReq.LastSync)
+		// Record that the device has received every change up to its cursor
+		if syncReq.DeviceID != "" {
+			err := stores.Sync.RecordDeviceSync(syncReq.DeviceID, syncReq.DeviceName, syncReq.Cursor)
+			if err == model.ErrDeviceRevoked {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "Device has been revoked",
+				})
+				return errResponded
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to record device",
+					"details": err.Error(),
+				})
+				return errResponded
+			}
+		}
+
+		// 1. SYNC FOLDERS FIRST (dependencies)
+		folderIDs, err := syncFolders(stores, syncReq.LocalFolders, lastSync)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to sync folders",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+
+		// 2. SYNC NOTES, under the same rules as the REST API
+		noteService := service.NewNotesService(stores, service.FromSync)
+		noteIDs, conflicts, err := syncNotes(stores, noteService, syncReq.LocalNotes, clientIDMap(folderIDs), syncReq.DeviceID, lastSync)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to sync notes",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+
+		// 3. APPLY DELETIONS
+		if err := applyTombstones(stores, syncReq.Tombstones); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to apply deletions",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+
+		// 4. STORE UPLOADED ATTACHMENTS, now that their notes exist
+		uploads, created, err := syncAttachments(stores, syncReq.LocalAttachments, files, clientIDMap(noteIDs), lastSync)
+		written = created
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to store attachments",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+
+		response.IDs = append(folderIDs, noteIDs...)
+		response.Conflicts, response.Uploads = conflicts, uploads
+		if expired {
+			return nil
+		}
+
+		// 5. GET UPDATED DATA FOR RESPONSE. The cursor is read first: a
+		// change committed in between is then sent again next time rather
+		// than missed.
+		cursor, err := stores.Sync.ChangeSeq()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to get sync cursor",
+			})
+			return errResponded
+		}
+
+		changes, err := stores.Sync.ChangesSince(syncReq.Cursor)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to get changes",
+				"details": err.Error(),
+			})
+			return errResponded
+		}
+
+		response.Notes, response.Folders = changes.Notes, changes.Folders
+		response.Attachments, response.Tombstones = changes.Attachments, changes.Tombstones
+		response.Cursor = cursor
+		return nil
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get updated notes",
-		})
+		unlockBlobs()
+		model.RemoveUnusedFiles(h.stores.Blobs, written)
+		if err != errResponded {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to commit sync",
+			})
+		}
 		return
 	}
 
-	attachments, err := getAttachmentsModifiedSince(tx, syncReq.LastSync)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get updated attachments",
-		})
-		return
+	uploads := response.Uploads
+	for _, upload := range uploads {
+		if upload.Status == AttachmentCreated {
+			model.QueueTextExtraction(upload.ID)
+		}
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to commit sync",
+	if expired {
+		logging.Warnf("⚠️ Sync cursor %d of device %s has expired", syncReq.Cursor, syncReq.DeviceID)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     "Sync cursor has expired",
+			"details":   "the changes sent were applied; discard local data and sync again with cursor 0",
+			"resync":    true,
+			"ids":       response.IDs,
+			"conflicts": response.Conflicts,
+			"uploads":   uploads,
 		})
 		return
 	}
 
-	response := SyncResponse{
-		Notes:       notes,
-		Folders:     folders,
-		Attachments: attachments,
-		ServerTime:  time.Now(),
-		Success:     true,
-		Message:     fmt.Sprintf("Synced %d notes, %d folders, %d attachments", len(notes), len(folders), len(attachments)),
-	}
+	response.ServerTime = time.Now()
+	response.Success = true
+	response.Message = fmt.Sprintf("Synced %d notes, %d folders, %d attachments, %d deletions, %d conflicts, %d uploads",
+		len(response.Notes), len(response.Folders), len(response.Attachments), len(response.Tombstones),
+		len(response.Conflicts), len(uploads))
 
-	log.Printf("✅ Sync completed for device: %s - %s", syncReq.DeviceID, response.Message)
+	logging.Infof("✅ Sync completed for device: %s - %s", syncReq.DeviceID, response.Message)
 	c.JSON(http.StatusOK, response)
 }
 
-// HandleSyncAttachment serves attachment files for sync
-func HandleSyncAttachment(c *gin.Context) {
-	attachmentIDStr := c.Param("id")
-	attachmentID, err := strconv.Atoi(attachmentIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid attachment ID",
-		})
+// HandleSyncAttachment serves attachment files for sync, by integer or global
+// ID. The device is identified by the X-Device-ID header or device_id query
+// parameter; revoked devices are refused.
+func (h *Handler) HandleSyncAttachment(c *gin.Context) {
+	if h.stores.Sync == nil {
+		unavailable(c, "Device sync")
 		return
 	}
 
-	// Get file info from database
-	var filename, originalName, mimeType string
-	var size int64
-	err = model.DB.QueryRow(
-		"SELECT filename, original_name, mime_type, size FROM attachments WHERE id = ?",
-		attachmentID,
-	).Scan(&filename, &originalName, &mimeType, &size)
+	deviceID := c.GetHeader("X-Device-ID")
+	if deviceID == "" {
+		deviceID = c.Query("device_id")
+	}
+	if deviceID != "" {
+		err := h.stores.Sync.CheckDevice(deviceID)
+		if err == model.ErrDeviceRevoked {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Device has been revoked",
+			})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to check device",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
 
-	if err != nil {
+	attachment, err := h.stores.Attachments.GetAttachment(c.Param("id"))
+	if err == model.ErrNotFound {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Attachment not found",
 		})
 		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch attachment",
+			"details": err.Error(),
+		})
+		return
 	}
 
-	// Check if file exists
-	filePath := fmt.Sprintf("./data/attachments/%s", filename)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "File not found on disk",
-		})
+	file, ok := openAttachmentFile(c, attachment.Filename)
+	if !ok {
 		return
 	}
+	defer file.Close()
 
 	// Set headers for download
 	c.Header("Content-Type", "application/octet-stream")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", originalName))
-	c.Header("Content-Length", fmt.Sprintf("%d", size))
-
-	c.File(filePath)
+	c.Header("Content-Disposition", media.ContentDisposition("attachment", attachment.OriginalName))
+	c.Header("X-Content-Type-Options", "nosniff")
+	serveAttachmentFile(c, file, attachment.SHA256)
 }
 
 // ============================================================================
 // SYNC HELPER FUNCTIONS
 // ============================================================================
 
-// syncFolders handles folder synchronization
-func syncFolders(tx *sql.Tx, localFolders []model.Folder, lastSync time.Time) error {
+// validateSyncRequest checks the types and global IDs a device sent
+func validateSyncRequest(req *SyncRequest) error {
+	for _, folder := range req.LocalFolders {
+		if folder.UID != "" && !model.ValidUID(folder.UID) {
+			return fmt.Errorf("invalid folder uid %q", folder.UID)
+		}
+	}
+	for _, note := range req.LocalNotes {
+		if note.UID != "" && !model.ValidUID(note.UID) {
+			return fmt.Errorf("invalid note uid %q", note.UID)
+		}
+	}
+	for _, attachment := range req.LocalAttachments {
+		if attachment.UID != "" && !model.ValidUID(attachment.UID) {
+			return fmt.Errorf("invalid attachment uid %q", attachment.UID)
+		}
+		if attachment.NoteUID != "" && !model.ValidUID(attachment.NoteUID) {
+			return fmt.Errorf("invalid attachment note_uid %q", attachment.NoteUID)
+		}
+	}
+	for _, tombstone := range req.Tombstones {
+		if !model.ValidTombstoneType(tombstone.Type) {
+			return fmt.Errorf("invalid tombstone type %q, must be note, folder or attachment", tombstone.Type)
+		}
+	}
+	return nil
+}
+
+// errResponded is returned inside HandleSync's transaction once an error
+// response has been written, to roll it back
+var errResponded = errors.New("sync failed")
+
+// syncFolders handles folder synchronization. Folders are matched by global
+// ID; new ones get a server-assigned integer ID. Folders from clients that
+// predate global IDs are matched by integer ID and creation time, as
+// another device may have used the same ID offline, and new ones are
+// reported in the returned IDs. Unknown folders the device had before lastSync are not created;
+// see purgedWhileAway.
+func syncFolders(stores model.Stores, localFolders []model.Folder, lastSync *time.Time) ([]SyncedID, error) {
+	// Parents are linked after all folders exist, so their order does not
+	// matter. A folder from an old client names its parent by client ID.
+	type parentRef struct {
+		uid      *string
+		clientID *int
+	}
+	inserted := make(map[int]parentRef)
+	ids := []SyncedID{}
+
 	for _, folder := range localFolders {
 		// Check if folder exists on server
-		var existingCreatedAt time.Time
-		err := tx.QueryRow("SELECT created_at FROM folders WHERE id = ?", folder.ID).Scan(&existingCreatedAt)
-
-		if err == sql.ErrNoRows {
-			// Folder doesn't exist on server, insert it
-			_, err = tx.Exec(
-				"INSERT INTO folders (id, name, created_at) VALUES (?, ?, ?)",
-				folder.ID, folder.Name, folder.CreatedAt,
-			)
-			if err != nil {
-				return fmt.Errorf("failed to insert folder: %v", err)
+		var err error
+		if folder.UID != "" {
+			_, err = stores.Sync.FindID("folder", folder.UID, 0)
+		} else {
+			_, err = stores.Sync.FindLegacyID("folder", folder.ID, folder.CreatedAt)
+		}
+		if err == nil {
+			// For folders, we typically don't update name often
+			// If needed, add update logic here based on created_at comparison
+			continue
+		} else if err != model.ErrNotFound {
+			return nil, fmt.Errorf("failed to check folder existence: %v", err)
+		}
+
+		// A folder that was deleted and purged must not come back
+		var deleted bool
+		if folder.UID != "" {
+			deleted, err = stores.Sync.HasTombstone("folder", 0, folder.UID)
+		} else {
+			deleted, err = stores.Sync.HasLegacyTombstone("folder", folder.ID, folder.CreatedAt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check folder tombstone: %v", err)
+		}
+		if deleted || purgedWhileAway(folder.CreatedAt, lastSync) {
+			continue
+		}
+
+		created := model.Folder{UID: folder.UID, Name: folder.Name, CreatedAt: folder.CreatedAt}
+		parent := parentRef{uid: folder.ParentUID}
+		if folder.UID == "" {
+			parent = parentRef{clientID: folder.ParentID}
+		}
+
+		// Folder doesn't exist on server, insert it. Two devices may have
+		// created a folder with the same name.
+		for i := 2; ; i++ {
+			err = stores.Folders.CreateFolder(&created)
+			if err != model.ErrNameTaken {
+				break
+			}
+			created.Name = fmt.Sprintf("%s (%d)", folder.Name, i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert folder: %v", err)
+		}
+		inserted[created.ID] = parent
+		if folder.UID == "" {
+			ids = append(ids, SyncedID{Type: "folder", ClientID: folder.ID, ID: created.ID, UID: created.UID})
+		}
+		logging.Debugf("📁 Inserted new folder: %s", created.Name)
+	}
+
+	clientIDs := clientIDMap(ids)
+	for id, parent := range inserted {
+		var parentID *int
+		var err error
+		if parent.uid != nil {
+			parentID, err = syncFolderID(stores, parent.uid)
+		} else if parentID = clientFolderID(parent.clientID, clientIDs); parentID != nil {
+			_, err = stores.Folders.GetFolder(*parentID)
+			if err == model.ErrNotFound {
+				parentID, err = nil, nil
 			}
-			log.Printf("📁 Inserted new folder: %s", folder.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up parent folder: %v", err)
+		}
+		if parentID == nil {
+			continue // Parent is gone; keep the folder at the top level
+		}
+
+		folder, err := stores.Folders.GetFolder(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch folder: %v", err)
+		}
+		name := folder.Name
+		for i := 2; ; i++ {
+			_, err = stores.Folders.MoveFolder(id, parentID, name)
+			if err != model.ErrNameTaken {
+				break
+			}
+			name = fmt.Sprintf("%s (%d)", folder.Name, i)
+		}
+		if err == model.ErrFolderCycle {
+			continue // The device sent a loop; keep the folder at the top level
 		} else if err != nil {
-			return fmt.Errorf("failed to check folder existence: %v", err)
+			return nil, fmt.Errorf("failed to set parent folder: %v", err)
 		}
-		// For folders, we typically don't update name often
-		// If needed, add update logic here based on created_at comparison
 	}
-	return nil
+	return ids, nil
+}
+
+// clientIDMap maps the client IDs of new items from a client without global
+// IDs to their server IDs
+func clientIDMap(ids []SyncedID) map[int]int {
+	clientIDs := make(map[int]int, len(ids))
+	for _, id := range ids {
+		clientIDs[id.ClientID] = id.ID
+	}
+	return clientIDs
+}
+
+// clientFolderID turns the folder ID a client without global IDs sent into
+// the server's: folders it created in this sync got new IDs, the others
+// are the server's already
+func clientFolderID(folderID *int, clientIDs map[int]int) *int {
+	if folderID == nil {
+		return nil
+	}
+	if id, ok := clientIDs[*folderID]; ok {
+		return &id
+	}
+	return folderID
 }
 
-// syncNotes handles note synchronization with conflict resolution
-func syncNotes(tx *sql.Tx, localNotes []model.Note, lastSync time.Time) error {
+// syncNotes handles note synchronization with conflict resolution. Notes are
+// matched by global ID, or for clients that predate them, by integer ID and
+// creation time as syncFolders does; new notes from those clients are
+// reported in the returned IDs, and their folder IDs go through
+// clientFolderIDs. Edits that carry a base revision are merged; the others
+// use last-write-wins. Edits to a note in the trash are dropped, and so are
+// unknown notes the device had before lastSync; see purgedWhileAway.
+func syncNotes(stores model.Stores, notes *service.NotesService, localNotes []model.Note, clientFolderIDs map[int]int, deviceID string, lastSync *time.Time) ([]SyncedID, []model.NoteConflict, error) {
+	ids := []SyncedID{}
+	conflicts := []model.NoteConflict{}
 	for _, note := range localNotes {
 		// Check if note exists on server
-		var existingUpdatedAt time.Time
-		err := tx.QueryRow("SELECT updated_at FROM notes WHERE id = ?", note.ID).Scan(&existingUpdatedAt)
+		var existingID int
+		var err error
+		if note.UID != "" {
+			existingID, err = stores.Sync.FindID("note", note.UID, 0)
+		} else {
+			existingID, err = stores.Sync.FindLegacyID("note", note.ID, note.CreatedAt)
+		}
+		if err == model.ErrNotFound {
+			existingID = 0
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to check note existence: %v", err)
+		}
+
+		folderID := clientFolderID(note.FolderID, clientFolderIDs)
+		if note.UID != "" {
+			folderID, err = syncFolderID(stores, note.FolderUID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to look up note folder: %v", err)
+			}
+		}
+
+		if existingID == 0 {
+			// A note that was deleted and purged must not come back
+			var deleted bool
+			if note.UID != "" {
+				deleted, err = stores.Sync.HasTombstone("note", 0, note.UID)
+			} else {
+				deleted, err = stores.Sync.HasLegacyTombstone("note", note.ID, note.CreatedAt)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to check note tombstone: %v", err)
+			}
+			if deleted || purgedWhileAway(note.CreatedAt, lastSync) {
+				continue
+			}
 
-		if err == sql.ErrNoRows {
 			// Note doesn't exist on server, insert it
-			_, err = tx.Exec(`
-				INSERT INTO notes (id, title, content, folder_id, order_index, created_at, updated_at) 
-				VALUES (?, ?, ?, ?, ?, ?, ?)`,
-				note.ID, note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
-			)
+			legacy, clientID := note.UID == "", note.ID
+			note.FolderID = folderID
+			if err := notes.Create(&note); err != nil {
+				return nil, nil, fmt.Errorf("failed to insert note: %v", err)
+			}
+			if legacy {
+				ids = append(ids, SyncedID{Type: "note", ClientID: clientID, ID: note.ID, UID: note.UID})
+			}
+			logging.Debugf("📝 Inserted new note: %s", note.Title)
+		} else if note.BaseRevision != nil {
+			conflict, err := mergeSyncedNote(stores, notes, existingID, note, folderID, deviceID)
 			if err != nil {
-				return fmt.Errorf("failed to insert note: %v", err)
+				return nil, nil, fmt.Errorf("failed to merge note: %v", err)
+			}
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
 			}
-			log.Printf("📝 Inserted new note: %s", note.Title)
-		} else if err != nil {
-			return fmt.Errorf("failed to check note existence: %v", err)
 		} else {
+			existing, _, err := stores.Sync.SyncedNote(existingID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to check note existence: %v", err)
+			}
+
 			// Note exists, check for conflicts (last-write-wins)
-			if note.UpdatedAt.After(existingUpdatedAt) {
-				_, err = tx.Exec(`
-					UPDATE notes 
-					SET title = ?, content = ?, folder_id = ?, order_index = ?, updated_at = ? 
-					WHERE id = ?`,
-					note.Title, note.Content, note.FolderID, note.OrderIndex, note.UpdatedAt, note.ID,
-				)
-				if err != nil {
-					return fmt.Errorf("failed to update note: %v", err)
+			if note.UpdatedAt.After(existing.UpdatedAt) {
+				note.ID, note.FolderID = existingID, folderID
+				err := notes.Update(&note)
+				if err == service.ErrNoteNotFound {
+					continue
+				} else if err != nil {
+					return nil, nil, fmt.Errorf("failed to update note: %v", err)
 				}
-				log.Printf("📝 Updated note: %s", note.Title)
+				logging.Debugf("📝 Updated note: %s", note.Title)
 			}
 		}
 	}
-	return nil
+	return ids, conflicts, nil
 }
 
-// getFoldersModifiedSince returns folders modified since the given time
-func getFoldersModifiedSince(tx *sql.Tx, since time.Time) ([]model.Folder, error) {
-	rows, err := tx.Query("SELECT id, name, created_at FROM folders WHERE created_at > ? ORDER BY created_at", since)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+// applyTombstones moves items deleted on a device to the trash. A note
+// edited on the server after the device deleted it is kept.
+func applyTombstones(stores model.Stores, tombstones []model.Tombstone) error {
+	for _, tombstone := range tombstones {
+		uid := ""
+		if tombstone.UID != nil {
+			uid = *tombstone.UID
+		}
+		id, err := stores.Sync.FindID(tombstone.Type, uid, tombstone.ID)
+		if err == model.ErrNotFound {
+			continue // Never reached the server
+		} else if err != nil {
+			return fmt.Errorf("failed to look up %s %s: %v", tombstone.Type, uid, err)
+		}
 
-	var folders []model.Folder
-	for rows.Next() {
-		var folder model.Folder
-		err := rows.Scan(&folder.ID, &folder.Name, &folder.CreatedAt)
-		if err != nil {
-			return nil, err
+		switch tombstone.Type {
+		case "note":
+			err = stores.Sync.TrashNoteBefore(id, tombstone.DeletedAt)
+		case "folder":
+			_, _, err = stores.Folders.TrashFolder(id, true)
+		case "attachment":
+			err = stores.Attachments.TrashAttachment(id)
+		}
+		if err != nil && err != model.ErrNotFound {
+			return fmt.Errorf("failed to delete %s %d: %v", tombstone.Type, id, err)
 		}
-		folders = append(folders, folder)
+		logging.Debugf("🗑️ Deleted %s %d from sync", tombstone.Type, id)
 	}
-	return folders, nil
+	return nil
 }
 
-// getNotesModifiedSince returns notes modified since the given time
-func getNotesModifiedSince(tx *sql.Tx, since time.Time) ([]model.Note, error) {
-	rows, err := tx.Query(`
-		SELECT id, title, content, folder_id, order_index, created_at, updated_at 
-		FROM notes 
-		WHERE updated_at > ? 
-		ORDER BY updated_at`, since)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var notes []model.Note
-	for rows.Next() {
-		var note model.Note
-		err := rows.Scan(&note.ID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		notes = append(notes, note)
-	}
-	return notes, nil
+// purgedWhileAway reports whether an item the server has no record of was
+// already on the device when it last synced. lastSync is only set for a
+// device behind the tombstone horizon: such an item was deleted and purged,
+// tombstone and all, while the device was away, and must not come back.
+// Items created on the device since are new.
+func purgedWhileAway(createdAt time.Time, lastSync *time.Time) bool {
+	return lastSync != nil && !createdAt.After(*lastSync)
 }
 
-// getAttachmentsModifiedSince returns attachments modified since the given time
-func getAttachmentsModifiedSince(tx *sql.Tx, since time.Time) ([]model.Attachment, error) {
-	rows, err := tx.Query(`
-		SELECT id, note_id, filename, original_name, mime_type, size, created_at 
-		FROM attachments 
-		WHERE created_at > ? 
-		ORDER BY created_at`, since)
-	if err != nil {
-		return nil, err
+// syncFolderID resolves the global ID of a note's folder. Notes whose folder
+// is unknown or deleted end up at the top level.
+func syncFolderID(stores model.Stores, folderUID *string) (*int, error) {
+	if folderUID == nil {
+		return nil, nil
 	}
-	defer rows.Close()
-
-	var attachments []model.Attachment
-	for rows.Next() {
-		var attachment model.Attachment
-		err := rows.Scan(&attachment.ID, &attachment.NoteID, &attachment.Filename,
-			&attachment.OriginalName, &attachment.MimeType, &attachment.Size, &attachment.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		attachments = append(attachments, attachment)
+	id, err := stores.Sync.FindID("folder", *folderUID, 0)
+	if err == nil {
+		_, err = stores.Folders.GetFolder(id)
+	}
+	if err == model.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return attachments, nil
+	return &id, nil
 }
@@ -0,0 +1,520 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter returns a router serving the endpoints under test from an
+// empty MemoryStore, with attachments kept in a temporary directory
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	return newTestRouterFor(t, model.NewMemoryStore().Stores())
+}
+
+// newTestRouterFor returns a router serving the endpoints under test from
+// the given stores
+func newTestRouterFor(t *testing.T, stores model.Stores) *gin.Engine {
+	t.Helper()
+
+	attachmentDir, uploadDir := model.AttachmentDir, model.UploadDir
+	model.AttachmentDir, model.UploadDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() {
+		model.AttachmentDir, model.UploadDir = attachmentDir, uploadDir
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h := New(stores)
+
+	router.GET("/notes", h.HandleGet)
+	router.POST("/notes", h.HandlePost)
+	router.PUT("/update", h.HandleUpdate)
+	router.DELETE("/delete", h.HandleDelete)
+	router.POST("/folders", h.HandleCreateFolder)
+	router.POST("/folders/:id/notes", h.HandleCreateFolderNote)
+	router.POST("/folders/:id/move", h.HandleMoveFolder)
+	router.GET("/folders/tree", h.HandleGetFolderTree)
+	router.GET("/folders/by-path/*path", h.HandleGetFolderByPath)
+	router.GET("/search", h.HandleSearch)
+	router.GET("/notes/:noteId/revisions", h.HandleGetRevisions)
+	router.GET("/tags", h.HandleGetTags)
+	router.PUT("/tags/:name", h.HandleRenameTag)
+	router.POST("/notes/:noteId/tags", h.HandleAddNoteTag)
+	router.GET("/trash", h.HandleGetTrash)
+	router.GET("/usage", h.HandleGetUsage)
+	router.POST("/files/:noteId", h.HandleFileUpload)
+	router.GET("/files/:id", h.HandleServeFile)
+	router.GET("/notes/:noteId/attachments", h.HandleGetAttachments)
+	router.HEAD("/blobs/:sha256", h.HandleHeadBlob)
+	router.POST("/sync", h.HandleSync)
+	router.GET("/conflicts", h.HandleGetConflicts)
+	router.POST("/conflicts/:id/resolve", h.HandleResolveConflict)
+	router.GET("/devices", h.HandleGetDevices)
+	return router
+}
+
+// request sends a JSON request and decodes the JSON response
+func request(t *testing.T, router *gin.Engine, method, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	return serve(t, router, req)
+}
+
+// serve runs a request through the router and decodes the JSON response
+func serve(t *testing.T, router *gin.Engine, req *http.Request) (int, map[string]interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response map[string]interface{}
+	if w.Body.Len() > 0 && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q", req.Method, req.URL, w.Body.String())
+		}
+	}
+	return w.Code, response
+}
+
+// createFolder creates a folder and returns its ID
+func createFolder(t *testing.T, router *gin.Engine, name string, parentID *int) int {
+	t.Helper()
+
+	status, response := request(t, router, "POST", "/folders", gin.H{"name": name, "parent_id": parentID})
+	if status != http.StatusCreated {
+		t.Fatalf("creating folder %s: status %d, %v", name, status, response)
+	}
+	return int(response["folder"].(map[string]interface{})["id"].(float64))
+}
+
+// createNote creates a top-level note and returns its ID
+func createNote(t *testing.T, router *gin.Engine, title, content string) int {
+	t.Helper()
+
+	status, response := request(t, router, "POST", "/notes", gin.H{"title": title, "content": content})
+	if status != http.StatusCreated {
+		t.Fatalf("creating note %s: status %d, %v", title, status, response)
+	}
+	return int(response["note"].(map[string]interface{})["id"].(float64))
+}
+
+func TestNotes(t *testing.T) {
+	router := newTestRouter(t)
+
+	folderID := createFolder(t, router, "Work", nil)
+	status, response := request(t, router, "POST", fmt.Sprintf("/folders/%d/notes", folderID),
+		gin.H{"title": "Plan", "content": "Ship it"})
+	if status != http.StatusCreated {
+		t.Fatalf("create: status %d, %v", status, response)
+	}
+	note := response["note"].(map[string]interface{})
+	id := int(note["id"].(float64))
+	if note["uid"] == "" || note["folder_id"] != float64(folderID) {
+		t.Errorf("create: got %v", note)
+	}
+
+	status, response = request(t, router, "PUT", "/update",
+		gin.H{"id": id, "title": "Plan", "content": "Ship it #release", "folder_id": folderID})
+	if status != http.StatusOK {
+		t.Fatalf("update: status %d, %v", status, response)
+	}
+	tags := response["note"].(map[string]interface{})["tags"].([]interface{})
+	if len(tags) != 1 || tags[0] != "release" {
+		t.Errorf("update: got tags %v, want [release]", tags)
+	}
+
+	status, response = request(t, router, "GET", "/notes", nil)
+	if status != http.StatusOK || response["count"] != float64(1) {
+		t.Fatalf("list: status %d, %v", status, response)
+	}
+
+	status, _ = request(t, router, "POST", "/folders/999/notes", gin.H{"title": "Lost"})
+	if status != http.StatusNotFound {
+		t.Errorf("create in missing folder: status %d, want 404", status)
+	}
+
+	if status, response = request(t, router, "DELETE", "/delete", gin.H{"id": id}); status != http.StatusOK {
+		t.Fatalf("delete: status %d, %v", status, response)
+	}
+	if status, _ = request(t, router, "DELETE", "/delete", gin.H{"id": id}); status != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", status)
+	}
+	if _, response = request(t, router, "GET", "/notes", nil); response["count"] != float64(0) {
+		t.Errorf("list after delete: got %v", response)
+	}
+}
+
+func TestFolderTree(t *testing.T) {
+	router := newTestRouter(t)
+
+	work := createFolder(t, router, "Work", nil)
+	clients := createFolder(t, router, "Clients", &work)
+	archive := createFolder(t, router, "Archive", nil)
+
+	// IDs are the server's to assign
+	status, response := request(t, router, "POST", "/folders", gin.H{"id": 500, "uid": "chosen", "name": "Mine"})
+	if status != http.StatusCreated {
+		t.Fatalf("create: status %d, %v", status, response)
+	}
+	if folder := response["folder"].(map[string]interface{}); folder["id"] == float64(500) || folder["uid"] == "chosen" {
+		t.Errorf("create kept the client's IDs: %v", folder)
+	}
+
+	status, response = request(t, router, "POST", fmt.Sprintf("/folders/%d/move", work), gin.H{"parent_id": clients})
+	if status != http.StatusBadRequest {
+		t.Errorf("move into own subfolder: status %d, %v", status, response)
+	}
+
+	status, response = request(t, router, "POST", fmt.Sprintf("/folders/%d/move", archive), gin.H{"parent_id": work})
+	if status != http.StatusOK {
+		t.Fatalf("move: status %d, %v", status, response)
+	}
+
+	createFolder(t, router, "Archive", nil)
+	status, _ = request(t, router, "POST", fmt.Sprintf("/folders/%d/move", archive), gin.H{"parent_id": nil})
+	if status != http.StatusConflict {
+		t.Errorf("move onto a taken name: status %d, want 409", status)
+	}
+
+	status, _ = request(t, router, "POST", fmt.Sprintf("/folders/%d/move", archive), gin.H{"parent_id": 999})
+	if status != http.StatusNotFound {
+		t.Errorf("move into missing folder: status %d, want 404", status)
+	}
+
+	status, response = request(t, router, "GET", "/folders/tree", nil)
+	if status != http.StatusOK || response["count"] != float64(5) {
+		t.Fatalf("tree: status %d, %v", status, response)
+	}
+	var paths []string
+	var walk func(nodes []interface{})
+	walk = func(nodes []interface{}) {
+		for _, node := range nodes {
+			node := node.(map[string]interface{})
+			paths = append(paths, node["path"].(string))
+			walk(node["children"].([]interface{}))
+		}
+	}
+	walk(response["folders"].([]interface{}))
+	want := "Archive Mine Work Work/Archive Work/Clients"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("tree paths: got %q, want %q", got, want)
+	}
+
+	status, response = request(t, router, "GET", "/folders/by-path/Work/Archive", nil)
+	if status != http.StatusOK || response["folder"].(map[string]interface{})["id"] != float64(archive) {
+		t.Errorf("by path: status %d, %v", status, response)
+	}
+	if status, _ = request(t, router, "GET", "/folders/by-path/Archive/Work", nil); status != http.StatusNotFound {
+		t.Errorf("missing path: status %d, want 404", status)
+	}
+}
+
+func TestTags(t *testing.T) {
+	router := newTestRouter(t)
+
+	first := createNote(t, router, "First", "Read #later")
+	createNote(t, router, "Second", "Also #Later, and `#code`")
+
+	status, response := request(t, router, "POST", fmt.Sprintf("/notes/%d/tags", first), gin.H{"name": "manual"})
+	if status != http.StatusOK {
+		t.Fatalf("add tag: status %d, %v", status, response)
+	}
+
+	status, response = request(t, router, "PUT", "/tags/later", gin.H{"name": "Someday"})
+	if status != http.StatusOK || response["notes_updated"] != float64(2) {
+		t.Fatalf("rename: status %d, %v", status, response)
+	}
+
+	_, response = request(t, router, "GET", "/notes", nil)
+	for _, note := range response["notes"].([]interface{}) {
+		content := note.(map[string]interface{})["content"].(string)
+		if !strings.Contains(content, "#Someday") || strings.Contains(content, "#later") {
+			t.Errorf("renamed content: got %q", content)
+		}
+	}
+
+	status, response = request(t, router, "GET", "/tags?sort=count", nil)
+	if status != http.StatusOK {
+		t.Fatalf("list: status %d, %v", status, response)
+	}
+	var names []string
+	for _, tag := range response["tags"].([]interface{}) {
+		tag := tag.(map[string]interface{})
+		names = append(names, fmt.Sprintf("%s:%v", tag["name"], tag["note_count"]))
+	}
+	if got := strings.Join(names, " "); got != "Someday:2 manual:1" {
+		t.Errorf("tags: got %q", got)
+	}
+
+	if status, _ = request(t, router, "PUT", "/tags/missing", gin.H{"name": "other"}); status != http.StatusNotFound {
+		t.Errorf("rename missing tag: status %d, want 404", status)
+	}
+}
+
+func TestFileUpload(t *testing.T) {
+	router := newTestRouter(t)
+	noteID := createNote(t, router, "Files", "")
+
+	status, response := uploadFile(t, router, noteID, "hello.txt", "hello, world\n")
+	if status != http.StatusCreated {
+		t.Fatalf("upload: status %d, %v", status, response)
+	}
+	attachment := response["attachment"].(map[string]interface{})
+	sum := attachment["sha256"].(string)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/files/%v", attachment["id"]), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "hello, world\n" {
+		t.Errorf("serve: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	// The same content is attached to another note by hash alone
+	otherID := createNote(t, router, "More files", "")
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("sha256", sum)
+	form.WriteField("filename", "again.txt")
+	form.Close()
+	req = httptest.NewRequest("POST", fmt.Sprintf("/files/%d", otherID), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if status, response = serve(t, router, req); status != http.StatusCreated {
+		t.Fatalf("upload by hash: status %d, %v", status, response)
+	}
+
+	req = httptest.NewRequest("HEAD", "/blobs/"+sum, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Ref-Count") != "2" {
+		t.Errorf("head blob: status %d, refs %q", w.Code, w.Header().Get("X-Ref-Count"))
+	}
+
+	status, response = request(t, router, "GET", fmt.Sprintf("/notes/%d/attachments", otherID), nil)
+	if status != http.StatusOK || response["count"] != float64(1) {
+		t.Errorf("attachments: status %d, %v", status, response)
+	}
+
+	status, response = request(t, router, "GET", "/usage", nil)
+	if status != http.StatusOK {
+		t.Fatalf("usage: status %d, %v", status, response)
+	}
+}
+
+// uploadFile attaches a file to a note and returns the response
+func uploadFile(t *testing.T, router *gin.Engine, noteID int, name, content string) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	form.Close()
+	req := httptest.NewRequest("POST", fmt.Sprintf("/files/%d", noteID), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return serve(t, router, req)
+}
+
+// TestUploadDedup checks that the same content uploaded twice is stored
+// once, and how uploads by hash alone are checked
+func TestUploadDedup(t *testing.T) {
+	router := newTestRouter(t)
+	noteID := createNote(t, router, "Files", "")
+
+	var sums []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		status, response := uploadFile(t, router, noteID, name, "same content\n")
+		if status != http.StatusCreated {
+			t.Fatalf("upload %s: status %d, %v", name, status, response)
+		}
+		sums = append(sums, response["attachment"].(map[string]interface{})["sha256"].(string))
+	}
+	want := sha256.Sum256([]byte("same content\n"))
+	if sums[0] != hex.EncodeToString(want[:]) || sums[1] != sums[0] {
+		t.Errorf("uploads got sha256 %q, want %x for both", sums, want)
+	}
+	blobs, _ := filepath.Glob(filepath.Join(model.AttachmentDir, "*", "*"))
+	if len(blobs) != 1 {
+		t.Errorf("got %d files in the blob store, want 1: %q", len(blobs), blobs)
+	}
+
+	headBlob := func(sum string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("HEAD", "/blobs/"+sum, nil))
+		return w.Code, w.Header().Get("X-Ref-Count")
+	}
+	if status, refs := headBlob(sums[0]); status != http.StatusOK || refs != "2" {
+		t.Errorf("head blob: status %d, refs %q; want 200, 2", status, refs)
+	}
+	if status, _ := headBlob(strings.ToUpper(sums[0])); status != http.StatusOK {
+		t.Errorf("head blob in uppercase: status %d, want 200", status)
+	}
+	if status, _ := headBlob(strings.Repeat("0", 64)); status != http.StatusNotFound {
+		t.Errorf("head unknown blob: status %d, want 404", status)
+	}
+	if status, _ := headBlob("abc"); status != http.StatusBadRequest {
+		t.Errorf("head invalid sha256: status %d, want 400", status)
+	}
+
+	tests := []struct {
+		name, sum, filename string
+		want                int
+	}{
+		{"known blob", sums[0], "c.txt", http.StatusCreated},
+		{"unknown blob", strings.Repeat("0", 64), "d.txt", http.StatusNotFound},
+		{"invalid sha256", "abc", "e.txt", http.StatusBadRequest},
+		{"missing filename", sums[0], "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("sha256", tt.sum)
+		form.WriteField("filename", tt.filename)
+		form.Close()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/files/%d", noteID), &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		if status, response := serve(t, router, req); status != tt.want {
+			t.Errorf("%s: status %d, %v; want %d", tt.name, status, response, tt.want)
+		}
+	}
+	if status, refs := headBlob(sums[0]); status != http.StatusOK || refs != "3" {
+		t.Errorf("head blob after an upload by hash: status %d, refs %q; want 200, 3", status, refs)
+	}
+}
+
+// TestServeAttachmentTypes checks that files are typed by their content,
+// not their name, and that only safe types are displayed
+func TestServeAttachmentTypes(t *testing.T) {
+	router := newTestRouter(t)
+	noteID := createNote(t, router, "Files", "")
+
+	tests := []struct {
+		name, content string
+		mimeType      string
+		disposition   string
+	}{
+		{"photo.png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png", "inline"},
+		{"page.png", "<!DOCTYPE html><html><script>alert(1)</script></html>", "text/html", "attachment"},
+		{"notes.txt", "<svg xmlns=\"http://www.w3.org/2000/svg\"><script>alert(1)</script></svg>", "image/svg+xml", "attachment"},
+	}
+	for _, tt := range tests {
+		status, response := uploadFile(t, router, noteID, tt.name, tt.content)
+		if status != http.StatusCreated {
+			t.Fatalf("upload %s: status %d, %v", tt.name, status, response)
+		}
+		attachment := response["attachment"].(map[string]interface{})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/files/%v", attachment["id"]), nil))
+		header := w.Header()
+		if !strings.HasPrefix(header.Get("Content-Type"), tt.mimeType) ||
+			!strings.HasPrefix(header.Get("Content-Disposition"), tt.disposition+";") ||
+			header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s served with Content-Type %q, Content-Disposition %q, X-Content-Type-Options %q; want %s, %s, nosniff",
+				tt.name, header.Get("Content-Type"), header.Get("Content-Disposition"), header.Get("X-Content-Type-Options"),
+				tt.mimeType, tt.disposition)
+		}
+	}
+
+	status, response := uploadFile(t, router, noteID, "tool.txt", "\x7fELF\x02\x01\x01\x00"+strings.Repeat("\x00", 56))
+	if status != http.StatusUnsupportedMediaType {
+		t.Errorf("upload of an executable: status %d, %v; want 415", status, response)
+	}
+}
+
+// TestSpoolUpload checks the rules for uploaded files and that a rejected
+// one leaves no temporary file behind
+func TestSpoolUpload(t *testing.T) {
+	newTestRouter(t)
+	maxSize, stripEXIF := model.MaxAttachmentSize, model.StripEXIF
+	model.MaxAttachmentSize, model.StripEXIF = 64, true
+	t.Cleanup(func() { model.MaxAttachmentSize, model.StripEXIF = maxSize, stripEXIF })
+
+	hello := sha256.Sum256([]byte("hello"))
+	exif := "\xff\xd8\xff\xe1\x00\x08Exif\x00\x00\xff\xda\x00\x02image"
+	tests := []struct {
+		name, content, declared string
+		err                     error
+		stored                  string
+	}{
+		{"plain text", "hello", "", nil, "hello"},
+		{"declared hash", "hello", strings.ToUpper(hex.EncodeToString(hello[:])), nil, "hello"},
+		{"wrong hash", "hello", hex.EncodeToString(hello[1:]) + "00", errChecksumMismatch, ""},
+		{"too large", strings.Repeat("x", 65), "", errors.New("file too large"), ""},
+		{"executable", "\x7fELF\x02\x01\x01\x00" + strings.Repeat("\x00", 56), "", errBlockedType, ""},
+		{"image metadata", exif, "", nil, "\xff\xd8\xff\xda\x00\x02image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := spoolUpload(strings.NewReader(tt.content), tt.declared)
+			if fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			tmp, _ := os.ReadDir(filepath.Join(model.AttachmentDir, "tmp"))
+			if err != nil {
+				if len(tmp) != 0 {
+					t.Errorf("rejected upload left %d temporary files", len(tmp))
+				}
+				return
+			}
+			defer os.Remove(u.path)
+			if len(tmp) != 1 {
+				t.Errorf("got %d temporary files, want 1", len(tmp))
+			}
+
+			data, err := os.ReadFile(u.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(data)
+			if string(data) != tt.stored || u.size != int64(len(data)) || u.sum != hex.EncodeToString(sum[:]) {
+				t.Errorf("got %q of size %d with sha256 %s, want %q", data, u.size, u.sum, tt.stored)
+			}
+		})
+	}
+}
+
+func TestUnavailableFeatures(t *testing.T) {
+	router := newTestRouter(t)
+	noteID := createNote(t, router, "Note", "")
+
+	for _, path := range []string{
+		"/trash",
+		fmt.Sprintf("/notes/%d/revisions", noteID),
+		"/devices",
+		"/search?q=note",
+	} {
+		if status, response := request(t, router, "GET", path, nil); status != http.StatusServiceUnavailable {
+			t.Errorf("GET %s: status %d, %v", path, status, response)
+		}
+	}
+	if status, _ := request(t, router, "POST", "/sync", gin.H{}); status != http.StatusServiceUnavailable {
+		t.Errorf("POST /sync: status %d, want 503", status)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setQuotas sets the quotas for a test and restores them afterwards
+func setQuotas(t *testing.T, quotas model.QuotaLimits) {
+	t.Helper()
+	saved, savedSize := model.Quotas, model.MaxAttachmentSize
+	model.Quotas, model.MaxAttachmentSize = quotas, quotas.MaxAttachmentBytes
+	t.Cleanup(func() { model.Quotas, model.MaxAttachmentSize = saved, savedSize })
+}
+
+// quotaName returns the quota a rejected request exceeded
+func quotaName(response map[string]interface{}) interface{} {
+	quota, _ := response["quota"].(map[string]interface{})
+	return quota["quota"]
+}
+
+func TestNoteSizeQuota(t *testing.T) {
+	setQuotas(t, model.QuotaLimits{MaxNoteBytes: 10, MaxAttachmentBytes: 1 << 20})
+	router := newTestRouter(t)
+
+	status, response := request(t, router, "POST", "/notes", gin.H{"title": "Long", "content": strings.Repeat("x", 11)})
+	if status != http.StatusRequestEntityTooLarge || quotaName(response) != model.QuotaNoteSize {
+		t.Errorf("create over the limit: status %d, %v; want 413 note_size", status, response)
+	}
+
+	id := createNote(t, router, "Short", strings.Repeat("x", 10))
+	status, response = request(t, router, "PUT", "/update", gin.H{"id": id, "title": "Short", "content": strings.Repeat("x", 11)})
+	if status != http.StatusRequestEntityTooLarge || quotaName(response) != model.QuotaNoteSize {
+		t.Errorf("update over the limit: status %d, %v; want 413 note_size", status, response)
+	}
+}
+
+func TestAttachmentQuotas(t *testing.T) {
+	setQuotas(t, model.QuotaLimits{MaxAttachmentBytes: 8, MaxStorageBytes: 12, MaxAttachmentsPerNote: 2})
+	router := newTestRouter(t)
+	noteID := createNote(t, router, "Files", "")
+	otherID := createNote(t, router, "Other files", "")
+
+	tests := []struct {
+		name    string
+		noteID  int
+		content string
+		status  int
+		quota   string // The quota exceeded, if any
+	}{
+		{"too large", noteID, "123456789", http.StatusRequestEntityTooLarge, model.QuotaAttachmentSize},
+		{"first", noteID, "12345678", http.StatusCreated, ""},
+		{"over the storage quota", noteID, "abcdefgh", http.StatusInsufficientStorage, model.QuotaStorage},
+		{"within the storage quota", noteID, "abcd", http.StatusCreated, ""},
+		{"over the attachments per note", noteID, "a", http.StatusInsufficientStorage, model.QuotaAttachmentsPerNote},
+		// Content already stored takes no more space
+		{"stored content", otherID, "12345678", http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		status, response := uploadFile(t, router, tt.noteID, tt.name+".txt", tt.content)
+		if status != tt.status {
+			t.Errorf("%s: status %d, %v; want %d", tt.name, status, response, tt.status)
+		} else if tt.quota != "" && quotaName(response) != tt.quota {
+			t.Errorf("%s: got %v, want quota %s", tt.name, response["quota"], tt.quota)
+		}
+	}
+
+	status, response := request(t, router, "GET", "/usage", nil)
+	if status != http.StatusOK {
+		t.Fatalf("usage: status %d, %v", status, response)
+	}
+	limits := response["limits"].(map[string]interface{})
+	if response["attachments"] != float64(3) || response["attachment_bytes"] != float64(12) ||
+		response["most_attachments_per_note"] != float64(2) || limits["max_storage_bytes"] != float64(12) {
+		t.Errorf("usage: got %v, want 3 attachments in 12 bytes, at most 2 per note, of 12", response)
+	}
+}
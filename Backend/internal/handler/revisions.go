@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"backend/internal/diff"
+	"backend/internal/model"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// REVISION HANDLERS
+// ============================================================================
+
+// HandleGetRevisions lists the saved revisions of a note, newest first.
+// Content is omitted; fetch a single revision to read it.
+func (h *Handler) HandleGetRevisions(c *gin.Context) {
+	if h.stores.Revisions == nil {
+		unavailable(c, "Note history")
+		return
+	}
+
+	noteID, err := strconv.Atoi(c.Param("noteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid note ID",
+		})
+		return
+	}
+
+	if _, err := h.stores.Notes.GetNote(strconv.Itoa(noteID)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Note not found",
+		})
+		return
+	}
+
+	list, err := h.stores.Revisions.ListRevisions(noteID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch revisions",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	revisions := []gin.H{}
+	for _, revision := range list {
+		revisions = append(revisions, gin.H{
+			"revision":   revision.Revision,
+			"title":      revision.Title,
+			"folder_id":  revision.FolderID,
+			"size":       revision.Size,
+			"created_at": revision.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"note_id":   noteID,
+		"revisions": revisions,
+		"count":     len(revisions),
+	})
+}
+
+// HandleGetRevision returns a single revision including its content
+func (h *Handler) HandleGetRevision(c *gin.Context) {
+	noteID, rev, ok := h.parseRevisionParams(c)
+	if !ok {
+		return
+	}
+
+	revision, err := h.stores.Revisions.GetRevision(noteID, rev)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Revision not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch revision",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revision": revision,
+	})
+}
+
+// HandleDiffRevisions returns a line-based diff between two revisions.
+// The ?against= revision is the old side and defaults to the revision
+// before :rev; the first revision is compared against an empty note.
+func (h *Handler) HandleDiffRevisions(c *gin.Context) {
+	noteID, rev, ok := h.parseRevisionParams(c)
+	if !ok {
+		return
+	}
+
+	newRevision, err := h.stores.Revisions.GetRevision(noteID, rev)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Revision not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch revision",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	var oldRevision model.Revision
+	if againstStr := c.Query("against"); againstStr != "" {
+		against, err := strconv.Atoi(againstStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid revision number",
+			})
+			return
+		}
+		oldRevision, err = h.stores.Revisions.GetRevision(noteID, against)
+		if err == model.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Revision not found",
+			})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to fetch revision",
+				"details": err.Error(),
+			})
+			return
+		}
+	} else {
+		// Previous revisions may have been pruned, so take the closest one
+		previous, err := h.stores.Revisions.PreviousRevision(noteID, rev)
+		if err == nil && previous > 0 {
+			oldRevision, err = h.stores.Revisions.GetRevision(noteID, previous)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to fetch previous revision",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
+
+	lines := diff.Lines(oldRevision.Content, newRevision.Content)
+
+	added, removed := 0, 0
+	for _, line := range lines {
+		switch line.Op {
+		case diff.Insert:
+			added++
+		case diff.Delete:
+			removed++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"note_id":       noteID,
+		"from_revision": oldRevision.Revision,
+		"to_revision":   newRevision.Revision,
+		"title_changed": oldRevision.Title != newRevision.Title,
+		"old_title":     oldRevision.Title,
+		"new_title":     newRevision.Title,
+		"added":         added,
+		"removed":       removed,
+		"lines":         lines,
+		"unified": diff.Unified(lines,
+			fmt.Sprintf("revision %d", oldRevision.Revision),
+			fmt.Sprintf("revision %d", newRevision.Revision), 3),
+	})
+}
+
+// HandleRestoreRevision makes an old revision the current note content.
+// Restoring records a new revision, so it can itself be undone.
+func (h *Handler) HandleRestoreRevision(c *gin.Context) {
+	noteID, rev, ok := h.parseRevisionParams(c)
+	if !ok {
+		return
+	}
+
+	revision, err := h.stores.Revisions.GetRevision(noteID, rev)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Revision not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch revision",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	note, err := h.notes.Get(strconv.Itoa(noteID))
+	if err == nil {
+		note.Title = revision.Title
+		note.Content = revision.Content
+		note.Tags = nil // Keep the manual tags
+		note.UpdatedAt = time.Time{}
+		err = h.notes.Update(&note)
+	}
+	if err != nil {
+		noteError(c, err, "Failed to restore revision")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"note":    note,
+		"message": fmt.Sprintf("Restored revision %d", rev),
+	})
+}
+
+// ============================================================================
+// REVISION HELPER FUNCTIONS
+// ============================================================================
+
+// parseRevisionParams reads :noteId and :rev, writing a 400 response on
+// failure, or a 503 if the stores keep no revisions
+func (h *Handler) parseRevisionParams(c *gin.Context) (int, int, bool) {
+	if h.stores.Revisions == nil {
+		unavailable(c, "Note history")
+		return 0, 0, false
+	}
+
+	noteID, err := strconv.Atoi(c.Param("noteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid note ID",
+		})
+		return 0, 0, false
+	}
+
+	rev, err := strconv.Atoi(c.Param("rev"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid revision number",
+		})
+		return 0, 0, false
+	}
+
+	return noteID, rev, true
+}
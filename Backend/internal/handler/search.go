@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// SEARCH HANDLERS
+// ============================================================================
+
+// HandleSearch runs a full-text query against all notes and the text of
+// their attachments. Notes found through an attachment say which one.
+//
+// Query parameters:
+//   - q:         search terms; "quoted text" matches a phrase, term* matches a prefix
+//   - folder_id: only return notes in this folder
+//   - limit:     maximum number of results (default 20, max 100)
+//   - offset:    number of results to skip
+func (h *Handler) HandleSearch(c *gin.Context) {
+	if h.stores.Search == nil {
+		unavailable(c, "Full-text search")
+		return
+	}
+
+	query := model.SearchQuery{
+		Terms: model.ParseSearchTerms(c.Query("q")),
+		Limit: 20,
+	}
+	if len(query.Terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Search query is required",
+		})
+		return
+	}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid limit",
+			})
+			return
+		}
+		query.Limit = min(l, 100)
+	}
+
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		o, err := strconv.Atoi(offsetStr)
+		if err != nil || o < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid offset",
+			})
+			return
+		}
+		query.Offset = o
+	}
+
+	if folderIDStr := c.Query("folder_id"); folderIDStr != "" {
+		folderID, err := strconv.Atoi(folderIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid folder ID",
+			})
+			return
+		}
+		query.FolderID = &folderID
+	}
+
+	results, err := h.stores.Search.SearchNotes(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to search notes",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":   c.Query("q"),
+		"results": results,
+		"count":   len(results),
+	})
+}
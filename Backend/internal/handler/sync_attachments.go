@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"backend/internal/logging"
+	"backend/internal/model"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcomes of an attachment uploaded through sync
+const (
+	AttachmentCreated   = "created"   // Stored as a new attachment
+	AttachmentDuplicate = "duplicate" // The note already had a file with this content
+	AttachmentExists    = "exists"    // Uploaded by an earlier sync
+	AttachmentUpdated   = "updated"   // Uploaded earlier; renamed or moved on the device
+	AttachmentFailed    = "failed"
+)
+
+// AttachmentSyncResult reports what happened to one attachment a device
+// uploaded. ID is the server's attachment, if there is one.
+type AttachmentSyncResult struct {
+	ClientID int    `json:"client_id,omitempty"`
+	UID      string `json:"uid,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Quota    string `json:"quota,omitempty"` // The quota a failed upload would have exceeded
+}
+
+// ============================================================================
+// SYNC ATTACHMENT UPLOAD HELPERS
+// ============================================================================
+
+// attachmentPartName returns the multipart field holding the file of an
+// attachment a device uploads: "file:" followed by its uid, or by its
+// client-side id for attachments without one
+func attachmentPartName(attachment model.Attachment) string {
+	if attachment.UID != "" {
+		return "file:" + attachment.UID
+	}
+	return "file:" + strconv.Itoa(attachment.ID)
+}
+
+// syncAttachments stores the attachments a device created offline. Each one
+// is linked to its note by note_uid, or by note_id for notes without a
+// global ID, so it can belong to a note created earlier in the same sync;
+// clientNoteIDs maps the note IDs of those the server gave new IDs.
+// A file that the note already has is not attached again, and content the
+// server already stores is not written again. Problems with a
+// single file are reported in its result and do not fail the sync; the
+// returned filenames are the blobs created, to remove if the sync is rolled
+// back. lastSync is as for purgedWhileAway.
+func syncAttachments(stores model.Stores, localAttachments []model.Attachment, files map[string][]*multipart.FileHeader, clientNoteIDs map[int]int, lastSync *time.Time) ([]AttachmentSyncResult, []string, error) {
+	results := []AttachmentSyncResult{}
+	var written []string
+
+	for _, attachment := range localAttachments {
+		result := AttachmentSyncResult{UID: attachment.UID}
+		if attachment.UID == "" {
+			result.ClientID = attachment.ID
+		}
+
+		status, id, path, err := syncAttachment(stores, attachment, files[attachmentPartName(attachment)], clientNoteIDs, lastSync)
+		if path != "" {
+			written = append(written, path)
+		}
+		if err != nil {
+			var quotaErr *model.QuotaError
+			if errors.As(err, &quotaErr) {
+				result.Quota = quotaErr.Quota
+			} else if _, ok := err.(attachmentError); !ok {
+				return nil, written, err
+			}
+			result.Status = AttachmentFailed
+			result.Error = err.Error()
+			logging.Warnf("⚠️ Attachment %s from sync rejected: %v", attachmentPartName(attachment), err)
+		} else {
+			result.Status = status
+			result.ID = id
+		}
+		results = append(results, result)
+	}
+	return results, written, nil
+}
+
+// attachmentError is a problem with one uploaded attachment, as opposed to
+// a database error that fails the whole sync
+type attachmentError string
+
+func (e attachmentError) Error() string { return string(e) }
+
+// syncAttachment stores a single uploaded attachment and returns its status,
+// its server ID and the filename of the blob it created, if any
+func syncAttachment(stores model.Stores, attachment model.Attachment, parts []*multipart.FileHeader, clientNoteIDs map[int]int, lastSync *time.Time) (string, int, string, error) {
+	if attachment.UID != "" {
+		existingID, err := stores.Sync.FindID("attachment", attachment.UID, 0)
+		if err == nil {
+			status, err := updateSyncedAttachment(stores, existingID, attachment, clientNoteIDs)
+			return status, existingID, "", err
+		} else if err != model.ErrNotFound {
+			return "", 0, "", err
+		}
+
+		deleted, err := stores.Sync.HasTombstone("attachment", 0, attachment.UID)
+		if err != nil {
+			return "", 0, "", err
+		}
+		if deleted || purgedWhileAway(attachment.CreatedAt, lastSync) {
+			return "", 0, "", attachmentError("attachment was deleted")
+		}
+	}
+
+	noteID, err := syncAttachmentNoteID(stores, attachment, clientNoteIDs)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	// A device that sends the hash need not send a file the server already has
+	sum, size := strings.ToLower(attachment.SHA256), int64(0)
+	var mimeType string
+	if sum != "" {
+		duplicateID, err := findDuplicateAttachment(stores, noteID, sum)
+		if err != nil || duplicateID != 0 {
+			return AttachmentDuplicate, duplicateID, "", err
+		}
+		blob, err := stores.Blobs.FindBlob(sum)
+		if err == model.ErrNotFound || (err == nil && !model.BlobExists(sum)) {
+			sum = ""
+		} else if err != nil {
+			return "", 0, "", err
+		} else if err := model.CheckAttachmentQuota(stores, noteID, sum, blob.Size); err != nil {
+			return "", 0, "", err
+		}
+		size, mimeType = blob.Size, blob.MimeType
+	}
+
+	var path string
+	var ok bool
+	originalName := attachment.OriginalName
+	if sum == "" {
+		if len(parts) == 0 {
+			return "", 0, "", attachmentError("no file uploaded")
+		}
+		header := parts[0]
+		if header.Size > model.MaxAttachmentSize {
+			return "", 0, "", &model.QuotaError{Quota: model.QuotaAttachmentSize, Limit: model.MaxAttachmentSize, Asked: header.Size}
+		}
+		if originalName == "" {
+			originalName = header.Filename
+		}
+		if originalName, ok = cleanFileName(originalName); !ok {
+			return "", 0, "", attachmentError("invalid original_name")
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return "", 0, "", attachmentError("could not read file")
+		}
+		defer file.Close()
+
+		received, err := spoolUpload(file, attachment.SHA256)
+		if err == errChecksumMismatch {
+			return "", 0, "", attachmentError("file does not match its sha256")
+		} else if err == errBlockedType {
+			return "", 0, "", attachmentError("file type not allowed: " + received.mimeType)
+		} else if err != nil {
+			return "", 0, "", attachmentError("could not read file")
+		}
+		defer os.Remove(received.path)
+
+		// The same file may have been attached to the note on another device
+		duplicateID, err := findDuplicateAttachment(stores, noteID, received.sum)
+		if err != nil || duplicateID != 0 {
+			return AttachmentDuplicate, duplicateID, "", err
+		}
+		if err := model.CheckAttachmentQuota(stores, noteID, received.sum, received.size); err != nil {
+			return "", 0, "", err
+		}
+
+		created, err := model.AddBlob(received.path, received.sum)
+		if err != nil {
+			return "", 0, "", fmt.Errorf("failed to save file: %v", err)
+		}
+		if created {
+			// Only a blob this sync created may be removed on rollback
+			path = model.BlobFilename(received.sum)
+		}
+
+		sum, size, mimeType = received.sum, received.size, received.mimeType
+	} else if originalName == "" {
+		return "", 0, "", attachmentError("original_name is required")
+	} else if originalName, ok = cleanFileName(originalName); !ok {
+		return "", 0, "", attachmentError("invalid original_name")
+	}
+
+	stored := model.Attachment{
+		UID:          attachment.UID,
+		NoteID:       noteID,
+		Filename:     model.BlobFilename(sum),
+		OriginalName: originalName,
+		MimeType:     mimeType,
+		Size:         size,
+		SHA256:       sum,
+		CreatedAt:    attachment.CreatedAt.UTC(),
+	}
+	if err := stores.Attachments.CreateAttachment(&stored); err != nil {
+		return "", 0, path, fmt.Errorf("failed to insert attachment: %v", err)
+	}
+	logging.Debugf("📎 Inserted new attachment: %s", originalName)
+	return AttachmentCreated, stored.ID, path, nil
+}
+
+// syncAttachmentNoteID finds the live note an uploaded attachment belongs to
+func syncAttachmentNoteID(stores model.Stores, attachment model.Attachment, clientNoteIDs map[int]int) (int, error) {
+	ref := attachment.NoteUID
+	if ref == "" {
+		noteID, ok := clientNoteIDs[attachment.NoteID]
+		if !ok {
+			noteID = attachment.NoteID
+		}
+		ref = strconv.Itoa(noteID)
+	}
+	note, err := stores.Notes.GetNote(ref)
+	if err == model.ErrNotFound {
+		return 0, attachmentError("note not found")
+	}
+	return note.ID, err
+}
+
+// findDuplicateAttachment returns the ID of a live attachment of the note
+// with the given content hash, or 0 if there is none
+func findDuplicateAttachment(stores model.Stores, noteID int, sum string) (int, error) {
+	attachments, err := stores.Attachments.ListAttachments(noteID)
+	if err != nil {
+		return 0, err
+	}
+	for _, attachment := range attachments {
+		if attachment.SHA256 == sum {
+			return attachment.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// updateSyncedAttachment applies a rename or move made on a device to an
+// attachment the server already has. Trashed attachments are left alone.
+func updateSyncedAttachment(stores model.Stores, id int, attachment model.Attachment, clientNoteIDs map[int]int) (string, error) {
+	stored, err := stores.Attachments.GetAttachment(strconv.Itoa(id))
+	if err == model.ErrNotFound {
+		return AttachmentExists, nil
+	} else if err != nil {
+		return AttachmentExists, err
+	}
+
+	name, noteID := stored.OriginalName, stored.NoteID
+	if attachment.OriginalName != "" {
+		var ok bool
+		if stored.OriginalName, ok = cleanFileName(attachment.OriginalName); !ok {
+			return "", attachmentError("invalid original_name")
+		}
+	}
+	if attachment.NoteUID != "" || attachment.NoteID != 0 {
+		stored.NoteID, err = syncAttachmentNoteID(stores, attachment, clientNoteIDs)
+		if err != nil {
+			return "", err
+		}
+	}
+	if stored.OriginalName == name && stored.NoteID == noteID {
+		return AttachmentExists, nil
+	}
+
+	if err := stores.Attachments.UpdateAttachment(&stored); err != nil {
+		return "", err
+	}
+	return AttachmentUpdated, nil
+}
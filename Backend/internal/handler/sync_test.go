@@ -0,0 +1,301 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSQLiteTestRouter returns a router like newTestRouter's on a new SQLite
+// database, for the features the MemoryStore does not have, and the stores
+// it uses. DB is a global, so tests using it must not run in parallel.
+func newSQLiteTestRouter(t *testing.T) (*gin.Engine, model.Stores) {
+	t.Helper()
+
+	databasePath, attachmentDir := model.DatabasePath, model.AttachmentDir
+	dir := t.TempDir()
+	model.DatabasePath, model.AttachmentDir = filepath.Join(dir, "notes.db"), filepath.Join(dir, "attachments")
+	model.InitDB()
+	t.Cleanup(func() {
+		model.DB.Close()
+		model.DatabasePath, model.AttachmentDir = databasePath, attachmentDir
+	})
+
+	stores := model.NewSQLiteStore(model.DB).Stores()
+	return newTestRouterFor(t, stores), stores
+}
+
+// syncCursor returns the cursor of a successful sync response
+func syncCursor(t *testing.T, status int, response map[string]interface{}) int64 {
+	t.Helper()
+	if status != http.StatusOK {
+		t.Fatalf("sync: status %d, %v", status, response)
+	}
+	return int64(response["cursor"].(float64))
+}
+
+func TestSyncExpiredCursor(t *testing.T) {
+	router, stores := newSQLiteTestRouter(t)
+
+	lastWeek := time.Now().UTC().Add(-7 * 24 * time.Hour)
+	kept := model.Note{UID: model.NewUID(), Title: "Kept", Content: "v1", CreatedAt: lastWeek, UpdatedAt: lastWeek}
+	status, response := request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", LocalNotes: []model.Note{kept}})
+	cursor := syncCursor(t, status, response)
+
+	goneID := createNote(t, router, "Gone", "")
+	gone, err := stores.Notes.GetNote(strconv.Itoa(goneID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", Cursor: cursor})
+	cursor = syncCursor(t, status, response)
+
+	// While the phone is away the note is deleted and purged, and its
+	// tombstone collected
+	if status, response := request(t, router, "DELETE", "/delete", gin.H{"id": goneID}); status != http.StatusOK {
+		t.Fatalf("delete: status %d, %v", status, response)
+	}
+	if _, err := stores.Trash.PurgeTrash(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := stores.Sync.CollectTombstones(time.Now().Add(time.Hour)); err != nil || count != 1 {
+		t.Fatalf("CollectTombstones: got %d, %v; want 1", count, err)
+	}
+
+	// Its offline edits are applied before it is told to sync from scratch
+	now := time.Now().UTC()
+	kept.Content, kept.UpdatedAt = "v2", now
+	added := model.Note{UID: model.NewUID(), Title: "Added offline", Content: "", CreatedAt: now, UpdatedAt: now}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{
+		DeviceID:   "phone",
+		Cursor:     cursor,
+		LocalNotes: []model.Note{kept, added, gone},
+	})
+	if status != http.StatusConflict || response["resync"] != true {
+		t.Fatalf("sync with an expired cursor: status %d, %v; want 409 with resync", status, response)
+	}
+	if note, err := stores.Notes.GetNote(kept.UID); err != nil || note.Content != "v2" {
+		t.Errorf("edited note: got %+v, %v; want content v2", note, err)
+	}
+	if _, err := stores.Notes.GetNote(added.UID); err != nil {
+		t.Errorf("note added offline: %v", err)
+	}
+	if _, err := stores.Sync.FindID("note", gone.UID, 0); err != model.ErrNotFound {
+		t.Errorf("purged note after an expired sync: got %v, want ErrNotFound", err)
+	}
+
+	// A full sync does not bring the purged note back either
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", LocalNotes: []model.Note{gone}})
+	cursor = syncCursor(t, status, response)
+	if _, err := stores.Sync.FindID("note", gone.UID, 0); err != model.ErrNotFound {
+		t.Errorf("purged note after a full sync: got %v, want ErrNotFound", err)
+	}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", Cursor: cursor})
+	syncCursor(t, status, response)
+}
+
+// TestSyncLegacyIDs has two devices that predate global IDs create a folder
+// and a note with the same IDs offline
+func TestSyncLegacyIDs(t *testing.T) {
+	router, stores := newSQLiteTestRouter(t)
+
+	created := make(map[string]map[string]int) // Device, then item type, to server ID
+	for i, device := range []string{"phone", "tablet"} {
+		at := time.Now().UTC().Add(time.Duration(i-2) * time.Hour)
+		folderID := 42
+		status, response := request(t, router, "POST", "/sync", SyncRequest{
+			DeviceID:     device,
+			LocalFolders: []model.Folder{{ID: 42, Name: "From " + device, CreatedAt: at}},
+			LocalNotes:   []model.Note{{ID: 42, Title: "From " + device, FolderID: &folderID, CreatedAt: at, UpdatedAt: at}},
+		})
+		syncCursor(t, status, response)
+
+		created[device] = make(map[string]int)
+		for _, item := range response["ids"].([]interface{}) {
+			id := item.(map[string]interface{})
+			if id["client_id"] != float64(42) || id["uid"] == "" {
+				t.Errorf("%s: got ID %v, want client_id 42 with a uid", device, id)
+			}
+			created[device][id["type"].(string)] = int(id["id"].(float64))
+		}
+		if len(created[device]) != 2 {
+			t.Fatalf("%s: got IDs %v, want a folder and a note", device, response["ids"])
+		}
+	}
+	if created["phone"]["note"] == created["tablet"]["note"] || created["phone"]["folder"] == created["tablet"]["folder"] {
+		t.Fatalf("both devices got the same server IDs: %v", created)
+	}
+
+	for device, ids := range created {
+		note, err := stores.Notes.GetNote(strconv.Itoa(ids["note"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if note.Title != "From "+device || note.FolderID == nil || *note.FolderID != ids["folder"] {
+			t.Errorf("note from %s: got %+v, want it in folder %d", device, note, ids["folder"])
+		}
+	}
+
+	// Once the device uses the server's ID, an edit reaches the same note
+	note, err := stores.Notes.GetNote(strconv.Itoa(created["phone"]["note"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	note.UID, note.Content, note.UpdatedAt = "", "Edited", time.Now().UTC()
+	status, response := request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", LocalNotes: []model.Note{note}})
+	syncCursor(t, status, response)
+	if ids := response["ids"].([]interface{}); len(ids) != 0 {
+		t.Errorf("edit of a known note: got new IDs %v", ids)
+	}
+	if note, err := stores.Notes.GetNote(strconv.Itoa(created["phone"]["note"])); err != nil || note.Content != "Edited" {
+		t.Errorf("edited note: got %+v, %v; want content Edited", note, err)
+	}
+}
+
+// tombstoneTypes returns the type of each tombstone in a sync response, by uid
+func tombstoneTypes(response map[string]interface{}) map[string]string {
+	types := make(map[string]string)
+	tombstones, _ := response["tombstones"].([]interface{})
+	for _, item := range tombstones {
+		tombstone := item.(map[string]interface{})
+		uid, _ := tombstone["uid"].(string)
+		types[uid] = tombstone["type"].(string)
+	}
+	return types
+}
+
+// TestSyncTombstones has one device delete what another holds, and checks
+// that the deletions reach the other device once
+func TestSyncTombstones(t *testing.T) {
+	router, stores := newSQLiteTestRouter(t)
+
+	created := time.Now().UTC().Add(-time.Hour)
+	folder := model.Folder{UID: model.NewUID(), Name: "Projects", CreatedAt: created}
+	inFolder := model.Note{UID: model.NewUID(), Title: "Plan", FolderUID: &folder.UID, CreatedAt: created, UpdatedAt: created}
+	edited := model.Note{UID: model.NewUID(), Title: "Edited", CreatedAt: created, UpdatedAt: created}
+	status, response := request(t, router, "POST", "/sync", SyncRequest{
+		DeviceID:     "phone",
+		LocalFolders: []model.Folder{folder},
+		LocalNotes:   []model.Note{inFolder, edited},
+	})
+	syncCursor(t, status, response)
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "tablet"})
+	tablet := syncCursor(t, status, response)
+
+	// The note is edited after the phone deleted it offline
+	deletedAt := time.Now().UTC().Add(-time.Minute)
+	note, err := stores.Notes.GetNote(edited.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response = request(t, router, "PUT", "/update", gin.H{"id": note.ID, "title": "Edited", "content": "Still needed"})
+	if status != http.StatusOK {
+		t.Fatalf("update: status %d, %v", status, response)
+	}
+
+	unknown := model.NewUID()
+	status, response = request(t, router, "POST", "/sync", SyncRequest{
+		DeviceID: "phone",
+		Tombstones: []model.Tombstone{
+			{Type: "folder", UID: &folder.UID, DeletedAt: deletedAt},
+			{Type: "note", UID: &edited.UID, DeletedAt: deletedAt},
+			{Type: "note", UID: &unknown, DeletedAt: deletedAt},
+		},
+	})
+	syncCursor(t, status, response)
+	if _, err := stores.Notes.GetNote(inFolder.UID); err != model.ErrNotFound {
+		t.Errorf("note in the deleted folder: got %v, want ErrNotFound", err)
+	}
+	if _, err := stores.Notes.GetNote(edited.UID); err != nil {
+		t.Errorf("note edited after it was deleted: %v", err)
+	}
+
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "tablet", Cursor: tablet})
+	tablet = syncCursor(t, status, response)
+	want := map[string]string{folder.UID: "folder", inFolder.UID: "note"}
+	if got := tombstoneTypes(response); !reflect.DeepEqual(got, want) {
+		t.Errorf("tombstones: got %v, want %v", got, want)
+	}
+
+	// Deletions through the REST API are sent too, once
+	if status, response := request(t, router, "DELETE", "/delete", gin.H{"id": note.ID}); status != http.StatusOK {
+		t.Fatalf("delete: status %d, %v", status, response)
+	}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "tablet", Cursor: tablet})
+	tablet = syncCursor(t, status, response)
+	if got, want := tombstoneTypes(response), map[string]string{edited.UID: "note"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tombstones after a REST delete: got %v, want %v", got, want)
+	}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "tablet", Cursor: tablet})
+	syncCursor(t, status, response)
+	if got := tombstoneTypes(response); len(got) != 0 {
+		t.Errorf("tombstones sent again: %v", got)
+	}
+}
+
+// TestSyncDeviceCursors checks that each change reaches each device once
+func TestSyncDeviceCursors(t *testing.T) {
+	router, stores := newSQLiteTestRouter(t)
+	id := createNote(t, router, "Shared", "v1")
+
+	sync := func(device string, cursor int64) (int64, []interface{}) {
+		t.Helper()
+		status, response := request(t, router, "POST", "/sync", SyncRequest{DeviceID: device, DeviceName: "My " + device, Cursor: cursor})
+		notes, _ := response["notes"].([]interface{})
+		return syncCursor(t, status, response), notes
+	}
+
+	phone, notes := sync("phone", 0)
+	if phone == 0 || len(notes) != 1 {
+		t.Fatalf("first sync: got cursor %d and %d notes, want a cursor and the note", phone, len(notes))
+	}
+	if cursor, notes := sync("phone", phone); cursor != phone || len(notes) != 0 {
+		t.Errorf("sync without changes: got cursor %d and %d notes, want %d and none", cursor, len(notes), phone)
+	}
+
+	status, response := request(t, router, "PUT", "/update", gin.H{"id": id, "title": "Shared", "content": "v2"})
+	if status != http.StatusOK {
+		t.Fatalf("update: status %d, %v", status, response)
+	}
+	next, notes := sync("phone", phone)
+	if next <= phone || len(notes) != 1 || notes[0].(map[string]interface{})["content"] != "v2" {
+		t.Errorf("sync after an edit: got cursor %d and notes %v, want a cursor after %d and the edit", next, notes, phone)
+	}
+	if _, notes := sync("phone", next); len(notes) != 0 {
+		t.Errorf("edit sent again: %v", notes)
+	}
+
+	// Another device keeps its own cursor
+	if _, notes := sync("tablet", 0); len(notes) != 1 {
+		t.Errorf("first sync of another device: got %d notes, want 1", len(notes))
+	}
+
+	status, response = request(t, router, "GET", "/devices", nil)
+	if status != http.StatusOK || response["count"] != float64(2) || response["cursor"] != float64(next) {
+		t.Fatalf("devices: status %d, %v; want 2 devices at cursor %d", status, response, next)
+	}
+	device, err := stores.Sync.GetDevice("phone")
+	if err != nil || device.LastAckSeq != next || device.Name == nil || *device.Name != "My phone" {
+		t.Errorf("GetDevice: got %+v, %v; want My phone acknowledging %d", device, err, next)
+	}
+
+	// Acknowledgements never move back
+	sync("phone", phone)
+	if device, err := stores.Sync.GetDevice("phone"); err != nil || device.LastAckSeq != next {
+		t.Errorf("GetDevice after an older cursor: got %+v, %v; want last_ack_seq %d", device, err, next)
+	}
+
+	if err := stores.Sync.RevokeDevice("phone"); err != nil {
+		t.Fatal(err)
+	}
+	status, response = request(t, router, "POST", "/sync", SyncRequest{DeviceID: "phone", Cursor: next})
+	if status != http.StatusForbidden {
+		t.Errorf("sync of a revoked device: status %d, %v; want 403", status, response)
+	}
+}
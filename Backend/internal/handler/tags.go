@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// TAG HANDLERS
+// ============================================================================
+
+// HandleGetTags lists all tags in use with the number of notes carrying each.
+// Use ?sort=count to order by popularity instead of name.
+func (h *Handler) HandleGetTags(c *gin.Context) {
+	tags, err := h.stores.Tags.ListTags(c.Query("sort") == "count")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch tags",
+			"details": err.Error(),
+		})
+		return
+	}
+	if tags == nil {
+		tags = []model.Tag{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tags":  tags,
+		"count": len(tags),
+	})
+}
+
+// HandleRenameTag renames a tag on every note, rewriting inline #hashtags.
+// Renaming to an existing tag merges the two.
+func (h *Handler) HandleRenameTag(c *gin.Context) {
+	from, ok := model.NormalizeTagName(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name",
+		})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	into, ok := model.NormalizeTagName(req.Name)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name. Use letters, digits, _ and -, starting with a letter",
+		})
+		return
+	}
+
+	h.runRetag(c, []string{from}, into, 0, fmt.Sprintf("Renamed tag %s to %s", from, into))
+}
+
+// HandleMergeTags merges several tags into one on every note
+func (h *Handler) HandleMergeTags(c *gin.Context) {
+	var req struct {
+		From []string `json:"from" binding:"required"`
+		Into string   `json:"into" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	into, ok := model.NormalizeTagName(req.Into)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name. Use letters, digits, _ and -, starting with a letter",
+		})
+		return
+	}
+
+	var from []string
+	for _, name := range req.From {
+		normalized, ok := model.NormalizeTagName(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Invalid tag name: %s", name),
+			})
+			return
+		}
+		from = append(from, normalized)
+	}
+
+	h.runRetag(c, from, into, 0, fmt.Sprintf("Merged %d tags into %s", len(from), into))
+}
+
+// HandleDeleteTag removes a tag from every note. Inline #hashtags lose
+// their # but the word stays in the text.
+func (h *Handler) HandleDeleteTag(c *gin.Context) {
+	name, ok := model.NormalizeTagName(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name",
+		})
+		return
+	}
+
+	h.runRetag(c, []string{name}, "", 0, fmt.Sprintf("Deleted tag %s", name))
+}
+
+// HandleAddNoteTag attaches a manual tag to a note
+func (h *Handler) HandleAddNoteTag(c *gin.Context) {
+	noteID, err := strconv.Atoi(c.Param("noteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid note ID",
+		})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	name, ok := model.NormalizeTagName(req.Name)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name. Use letters, digits, _ and -, starting with a letter",
+		})
+		return
+	}
+
+	var note model.Note
+	err = h.stores.InTx(func(stores model.Stores) error {
+		var err error
+		note, err = stores.Notes.GetNote(strconv.Itoa(noteID))
+		if err != nil {
+			return err
+		}
+		note.Tags = append(note.Tags, name)
+		// Bump updated_at so other devices pick up the new tag
+		note.UpdatedAt = time.Now().UTC()
+		return stores.Notes.UpdateNote(&note)
+	})
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Note not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to add tag",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"note_id": noteID,
+		"tags":    note.Tags,
+		"message": "Tag added successfully",
+	})
+}
+
+// HandleRemoveNoteTag removes a tag from a single note, un-tagging its
+// inline #hashtags if it has any
+func (h *Handler) HandleRemoveNoteTag(c *gin.Context) {
+	noteID, err := strconv.Atoi(c.Param("noteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid note ID",
+		})
+		return
+	}
+
+	name, ok := model.NormalizeTagName(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid tag name",
+		})
+		return
+	}
+
+	h.runRetag(c, []string{name}, "", noteID, fmt.Sprintf("Removed tag %s from note %d", name, noteID))
+}
+
+// ============================================================================
+// TAG HELPER FUNCTIONS
+// ============================================================================
+
+// runRetag runs retagNotes in a transaction and writes the response
+func (h *Handler) runRetag(c *gin.Context, from []string, into string, noteID int, message string) {
+	var affected int
+	err := h.stores.InTx(func(stores model.Stores) error {
+		var err error
+		affected, err = retagNotes(stores, from, into, noteID)
+		if err == nil && affected == 0 {
+			err = model.ErrNotFound
+		}
+		return err
+	})
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Tag not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to update tags",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notes_updated": affected,
+		"message":       message,
+	})
+}
+
+// retagNotes replaces the tags in from with into on every note carrying one
+// of them (or only on noteID if it is not 0), rewriting inline hashtags.
+// An empty into removes the tags. Returns the number of notes changed.
+func retagNotes(stores model.Stores, from []string, into string, noteID int) (int, error) {
+	noteIDs, err := stores.Tags.TaggedNotes(from)
+	if err != nil {
+		return 0, err
+	}
+
+	isFrom := func(name string) bool {
+		for _, f := range from {
+			if strings.EqualFold(f, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	changed := 0
+	now := time.Now().UTC()
+	for _, id := range noteIDs {
+		if noteID != 0 && id != noteID {
+			continue
+		}
+		note, err := stores.Notes.GetNote(strconv.Itoa(id))
+		if err != nil {
+			return 0, err
+		}
+
+		for _, f := range from {
+			note.Content = model.RewriteHashtag(note.Content, f, into)
+		}
+
+		// Non-nil so manual tags are replaced, not kept
+		requested := []string{}
+		for _, tag := range note.Tags {
+			if !isFrom(tag) {
+				requested = append(requested, tag)
+			} else if into != "" {
+				requested = append(requested, into)
+			}
+		}
+		note.Tags = requested
+		note.UpdatedAt = now
+
+		// Content changes record a revision where the store keeps them
+		if err := stores.Notes.UpdateNote(&note); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	// Adopt the new spelling when only the case changed or tags were merged
+	if into != "" && changed > 0 {
+		if err := stores.Tags.SpellTag(into); err != nil {
+			return 0, err
+		}
+	}
+
+	return changed, nil
+}
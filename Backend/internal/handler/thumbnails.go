@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"backend/internal/logging"
+	"backend/internal/media"
+	"backend/internal/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// THUMBNAIL HANDLERS
+// ============================================================================
+
+// HandleGetThumbnail serves a thumbnail of an image attachment (JPEG, PNG,
+// GIF or WebP). ?size= picks the smallest configured size that is at least
+// as large, defaulting to the smallest. Thumbnails are generated on first
+// request and cached next to the original.
+func (h *Handler) HandleGetThumbnail(c *gin.Context) {
+	size := model.ThumbnailSizes[0]
+	if sizeParam := c.Query("size"); sizeParam != "" {
+		requested, err := strconv.Atoi(sizeParam)
+		if err != nil || requested <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid size",
+				"sizes": model.ThumbnailSizes,
+			})
+			return
+		}
+		size = thumbnailSize(requested)
+	}
+
+	attachment, err := h.stores.Attachments.GetAttachment(c.Param("id"))
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Attachment not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch attachment",
+			"details": err.Error(),
+		})
+		return
+	}
+	filename := attachment.Filename
+
+	thumbPath := filepath.Join(model.AttachmentDir, model.ThumbnailFilename(filename, size))
+	thumb, err := os.ReadFile(thumbPath)
+	if err != nil {
+		data, err := os.ReadFile(filepath.Join(model.AttachmentDir, filename))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "File not found on disk",
+			})
+			return
+		}
+
+		// Go by the content rather than the recorded MIME type
+		if !media.IsImage(http.DetectContentType(data)) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error": "Thumbnails are only available for JPEG, PNG, GIF and WebP images",
+			})
+			return
+		}
+
+		thumb, err = media.Thumbnail(data, size)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Failed to create thumbnail",
+				"details": err.Error(),
+			})
+			return
+		}
+		if err := writeFileAtomic(thumbPath, thumb); err != nil {
+			logging.Errorf("Error caching thumbnail %s: %v", thumbPath, err)
+		}
+	}
+
+	// An attachment's content never changes, so neither does its thumbnail
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, http.DetectContentType(thumb), thumb)
+}
+
+// thumbnailSize returns the smallest configured thumbnail size that is at
+// least requested, or the largest one
+func thumbnailSize(requested int) int {
+	for _, size := range model.ThumbnailSizes {
+		if size >= requested {
+			return size
+		}
+	}
+	return model.ThumbnailSizes[len(model.ThumbnailSizes)-1]
+}
+
+// writeFileAtomic writes a file under a temporary name and renames it into
+// place, so readers never see it half-written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"backend/internal/model"
+	"backend/internal/service"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// TRASH HANDLERS
+// ============================================================================
+
+// HandleGetTrash lists all deleted notes, folders and attachments, most
+// recently deleted first. Attachments of a deleted note are not listed
+// separately; they are restored or purged together with the note.
+func (h *Handler) HandleGetTrash(c *gin.Context) {
+	if h.stores.Trash == nil {
+		unavailable(c, "The trash")
+		return
+	}
+
+	items, err := h.stores.Trash.ListTrash()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch trash",
+			"details": err.Error(),
+		})
+		return
+	}
+	if items == nil {
+		items = []model.TrashItem{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items":     items,
+		"count":     len(items),
+		"retention": model.TrashRetention.String(),
+	})
+}
+
+// HandleRestoreTrash restores a deleted note, folder or attachment.
+// Restoring a note also restores its folder, and restoring an attachment
+// also restores its note, so nothing comes back orphaned. Restoring a folder
+// brings back the subfolders and notes that were deleted along with it.
+func (h *Handler) HandleRestoreTrash(c *gin.Context) {
+	if h.stores.Trash == nil {
+		unavailable(c, "The trash")
+		return
+	}
+
+	itemType := c.Param("type")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid ID",
+		})
+		return
+	}
+
+	switch itemType {
+	case "note", "notes":
+		if _, err = h.notes.Restore(id); err == service.ErrNoteNotFound {
+			err = model.ErrNotFound
+		}
+	case "folder", "folders":
+		err = h.stores.Trash.RestoreFolder(id)
+	case "attachment", "attachments":
+		err = h.stores.Trash.RestoreAttachment(id)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid type. Must be note, folder or attachment",
+		})
+		return
+	}
+
+	if quotaExceeded(c, err) {
+		return
+	} else if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Item not found in trash",
+		})
+		return
+	} else if err == model.ErrNameTaken {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Cannot restore folder",
+			"message": "A folder with the same name already exists. Rename it first.",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to restore item",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("Restored %s %d", itemType, id),
+	})
+}
+
+// HandleEmptyTrash permanently deletes everything in the trash
+func (h *Handler) HandleEmptyTrash(c *gin.Context) {
+	if h.stores.Trash == nil {
+		unavailable(c, "The trash")
+		return
+	}
+
+	result, err := h.stores.Trash.PurgeTrash(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to empty trash",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"purged":  result,
+		"message": "Trash emptied successfully",
+	})
+}
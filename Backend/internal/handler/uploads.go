@@ -0,0 +1,443 @@
+package handler
+
+import (
+	"backend/internal/logging"
+	"backend/internal/media"
+	"backend/internal/model"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ============================================================================
+// RESUMABLE UPLOAD HANDLERS
+// ============================================================================
+
+// Resumable uploads follow the shape of the tus protocol: an upload is
+// created with the file's size and SHA-256, its bytes are appended with
+// PATCH requests carrying the Upload-Offset they start at, and after a
+// dropped connection HEAD tells the client where to resume. Completing the
+// upload verifies the checksum and creates the attachment.
+
+// uploadLocks keeps two requests from writing to the same upload at once
+var uploadLocks sync.Map
+
+// lockUpload takes the lock of an upload, reporting false if another
+// request holds it
+func lockUpload(id string) (func(), bool) {
+	value, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// HandleCreateUpload starts a resumable upload for a note, given by note_id
+// or note_uid
+func (h *Handler) HandleCreateUpload(c *gin.Context) {
+	var req struct {
+		NoteID   int    `json:"note_id"`
+		NoteUID  string `json:"note_uid"`
+		Filename string `json:"filename" binding:"required"`
+		Size     int64  `json:"size" binding:"required"`
+		SHA256   string `json:"sha256" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request body",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	name, ok := cleanFileName(req.Filename)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid file name",
+		})
+		return
+	}
+	sum := strings.ToLower(req.SHA256)
+	if !model.ValidSHA256(sum) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid sha256",
+		})
+		return
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid size",
+		})
+		return
+	}
+
+	ref := req.NoteUID
+	if ref == "" {
+		ref = strconv.Itoa(req.NoteID)
+	}
+	note, err := h.stores.Notes.GetNote(ref)
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Note not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch note",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Refuse uploads that could not be completed anyway
+	err = model.CheckAttachmentQuota(h.stores, note.ID, sum, req.Size)
+	if quotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to check quota",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// The row comes first so the cleaner never takes the file for a leftover
+	upload := model.Upload{
+		ID:           model.NewUID(),
+		NoteID:       note.ID,
+		OriginalName: name,
+		Size:         req.Size,
+		SHA256:       sum,
+	}
+	if err := h.stores.Uploads.CreateUpload(&upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to create upload",
+			"details": err.Error(),
+		})
+		return
+	}
+	if err := createUploadFile(upload.ID); err != nil {
+		model.RemoveUpload(h.stores.Uploads, upload.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to create upload",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Location", "/uploads/"+upload.ID)
+	setUploadHeaders(c, upload)
+	c.JSON(http.StatusCreated, gin.H{
+		"upload":  upload,
+		"message": "Upload created",
+	})
+}
+
+// HandleGetUpload reports how much of an upload the server has received,
+// both in the body and, for HEAD requests, in the Upload-Offset header
+func (h *Handler) HandleGetUpload(c *gin.Context) {
+	upload, ok := h.fetchUpload(c)
+	if !ok {
+		return
+	}
+	setUploadHeaders(c, upload)
+	c.JSON(http.StatusOK, gin.H{
+		"upload": upload,
+	})
+}
+
+// HandlePatchUpload appends the request body to an upload. Upload-Offset
+// must match the bytes received so far; on a mismatch the server's offset
+// is returned with a 409 so the client can resume from there.
+func (h *Handler) HandlePatchUpload(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing or invalid Upload-Offset header",
+		})
+		return
+	}
+
+	unlock, ok := lockUpload(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is busy with another request",
+		})
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.fetchUpload(c)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		setUploadHeaders(c, upload)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Upload-Offset does not match the bytes received",
+			"offset": upload.Offset,
+		})
+		return
+	}
+
+	// Keep the upload alive while a slow chunk arrives
+	h.stores.Uploads.TouchUpload(upload.ID)
+
+	file, err := os.OpenFile(model.UploadPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to open upload",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	// Whatever arrives before a dropped connection is kept, so the client
+	// can resume after it
+	remaining := upload.Size - upload.Offset
+	written, copyErr := io.Copy(file, io.LimitReader(c.Request.Body, remaining+1))
+	if written > remaining {
+		// The chunk is rejected as a whole
+		file.Truncate(upload.Offset)
+		file.Close()
+		setUploadHeaders(c, upload)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":  "Chunk goes past the size of the upload",
+			"offset": upload.Offset,
+		})
+		return
+	}
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += written
+	h.stores.Uploads.TouchUpload(upload.ID)
+
+	setUploadHeaders(c, upload)
+	if copyErr != nil {
+		logging.Warnf("Upload %s interrupted at %d of %d bytes: %v", upload.ID, upload.Offset, upload.Size, copyErr)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to read chunk",
+			"details": copyErr.Error(),
+			"offset":  upload.Offset,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":     upload.ID,
+		"offset": upload.Offset,
+		"size":   upload.Size,
+	})
+}
+
+// HandleCompleteUpload turns a fully received upload into an attachment,
+// exactly as if it had been sent to POST /files/:noteId. An upload whose
+// content does not match its sha256, or is of a type that is not allowed,
+// is discarded.
+func (h *Handler) HandleCompleteUpload(c *gin.Context) {
+	unlock, ok := lockUpload(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is busy with another request",
+		})
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.fetchUpload(c)
+	if !ok {
+		return
+	}
+	if upload.Offset != upload.Size {
+		setUploadHeaders(c, upload)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Upload is not complete",
+			"offset": upload.Offset,
+			"size":   upload.Size,
+		})
+		return
+	}
+
+	if _, err := h.notes.Get(strconv.Itoa(upload.NoteID)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Note not found",
+		})
+		return
+	}
+
+	path := model.UploadPath(upload.ID)
+	sum, err := model.HashFile(path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to read upload",
+			"details": err.Error(),
+		})
+		return
+	}
+	if sum != upload.SHA256 {
+		h.discardUpload(upload.ID)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Upload does not match its sha256 and was discarded",
+		})
+		return
+	}
+
+	// Other uploads may have used up the quota in the meantime
+	err = model.CheckAttachmentQuota(h.stores, upload.NoteID, sum, upload.Size)
+	if quotaExceeded(c, err) {
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to check quota",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	unlockBlobs := model.LockBlobs()
+	defer unlockBlobs()
+	sum, size, mimeType, err := storeUpload(path)
+	if err == errBlockedType {
+		h.discardUpload(upload.ID)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":     "File type not allowed",
+			"mime_type": mimeType,
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to save file",
+		})
+		return
+	}
+
+	attachment, err := h.insertAttachment(unlockBlobs, upload.NoteID, sum, upload.OriginalName, mimeType, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to store file info",
+		})
+		return
+	}
+	h.discardUpload(upload.ID)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"attachment": attachment,
+		"message":    "File uploaded successfully",
+	})
+}
+
+// HandleCancelUpload abandons an upload and deletes what was received
+func (h *Handler) HandleCancelUpload(c *gin.Context) {
+	unlock, ok := lockUpload(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Upload is busy with another request",
+		})
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.fetchUpload(c)
+	if !ok {
+		return
+	}
+	h.discardUpload(upload.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      upload.ID,
+		"message": "Upload cancelled",
+	})
+}
+
+// ============================================================================
+// RESUMABLE UPLOAD HELPERS
+// ============================================================================
+
+// fetchUpload loads the upload named in the URL, responding with an error
+// and returning false if it cannot
+func (h *Handler) fetchUpload(c *gin.Context) (model.Upload, bool) {
+	upload, err := h.stores.Uploads.GetUpload(c.Param("id"))
+	if err == model.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Upload not found",
+		})
+		return upload, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to fetch upload",
+			"details": err.Error(),
+		})
+		return upload, false
+	}
+	return upload, true
+}
+
+// setUploadHeaders reports an upload's progress in tus-style headers
+func setUploadHeaders(c *gin.Context, upload model.Upload) {
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "no-store")
+}
+
+// createUploadFile creates the empty file an upload's chunks are appended to
+func createUploadFile(id string) error {
+	if err := os.MkdirAll(model.UploadDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(model.UploadPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// storeUpload moves a received file into the blob store and returns its
+// hash, size and detected MIME type, applying the same rules as spoolUpload.
+// Only images are read into memory, to strip their metadata.
+func storeUpload(path string) (string, int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer file.Close()
+
+	mimeType, err := detectFileMIME(path)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if media.Blocked(mimeType) {
+		return "", 0, mimeType, errBlockedType
+	}
+
+	var r io.Reader = file
+	if model.StripEXIF && media.IsImage(mimeType) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return "", 0, "", err
+		}
+		if data, err = media.StripMetadata(data); err != nil {
+			return "", 0, "", err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	sum, size, _, err := model.StoreBlob(r)
+	return sum, size, mimeType, err
+}
+
+// discardUpload removes an upload and its lock
+func (h *Handler) discardUpload(id string) {
+	if err := model.RemoveUpload(h.stores.Uploads, id); err != nil {
+		logging.Errorf("Error removing upload %s: %v", id, err)
+	}
+	uploadLocks.Delete(id)
+}
@@ -0,0 +1,56 @@
+// Package logging writes to the standard logger at levels, so the
+// log_level setting can quieten the server
+package logging
+
+import "log"
+
+// Level is how much is logged, from most to least verbose
+type Level int
+
+const (
+	Debug Level = iota // Every item a sync changes
+	Info               // Startup, background jobs and each sync
+	Warn               // Problems the server works around
+	Error              // Failures
+)
+
+// current is the least severe level that is logged
+var current = Info
+
+// SetLevel logs messages at level and above from now on
+func SetLevel(level Level) {
+	current = level
+}
+
+// Enabled reports whether messages at level are logged
+func Enabled(level Level) bool {
+	return level >= current
+}
+
+// Debugf logs at the debug level, in the manner of log.Printf
+func Debugf(format string, v ...interface{}) {
+	if Enabled(Debug) {
+		log.Printf(format, v...)
+	}
+}
+
+// Infof logs at the info level, in the manner of log.Printf
+func Infof(format string, v ...interface{}) {
+	if Enabled(Info) {
+		log.Printf(format, v...)
+	}
+}
+
+// Warnf logs at the warn level, in the manner of log.Printf
+func Warnf(format string, v ...interface{}) {
+	if Enabled(Warn) {
+		log.Printf(format, v...)
+	}
+}
+
+// Errorf logs at the error level, in the manner of log.Printf
+func Errorf(format string, v ...interface{}) {
+	if Enabled(Error) {
+		log.Printf(format, v...)
+	}
+}
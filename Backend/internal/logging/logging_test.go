@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+		SetLevel(Info)
+	})
+
+	tests := []struct {
+		level Level
+		want  string
+	}{
+		{Debug, "debug info warn error "},
+		{Info, "info warn error "},
+		{Warn, "warn error "},
+		{Error, "error "},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		SetLevel(tt.level)
+		Debugf("debug")
+		Infof("info")
+		Warnf("warn")
+		Errorf("%s", "error")
+		if got := strings.ReplaceAll(out.String(), "\n", " "); got != tt.want {
+			t.Errorf("level %d: logged %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package media
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// blockedTypes are never accepted as attachments: programs that could be
+// run by whoever downloads them
+var blockedTypes = []string{
+	"application/vnd.microsoft.portable-executable",
+	"application/x-msdownload",
+	"application/x-dosexec",
+	"application/x-executable",
+	"application/x-elf",
+	"application/x-sharedlib",
+	"application/x-mach-binary",
+	"application/x-ms-shortcut",
+}
+
+// inlineTypes are shown in the browser. Everything else, in particular
+// HTML, SVG, XML and JavaScript that would run in the app's origin, is
+// only ever downloaded.
+var inlineTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/bmp",
+	"image/avif",
+	"image/heic",
+	"image/heif",
+	"application/pdf",
+	"text/plain",
+	"text/csv",
+	"text/markdown",
+}
+
+// DetectMIME returns the MIME type of a file from its content. What the
+// client claims is ignored, since it decides how the file is served.
+func DetectMIME(data []byte) string {
+	return mimetype.Detect(data).String()
+}
+
+// Blocked reports whether files of the MIME type are refused
+func Blocked(mimeType string) bool {
+	return contains(blockedTypes, baseType(mimeType))
+}
+
+// Inline reports whether files of the MIME type may be displayed in the
+// browser rather than downloaded
+func Inline(mimeType string) bool {
+	base := baseType(mimeType)
+	if strings.HasPrefix(base, "audio/") || strings.HasPrefix(base, "video/") {
+		return true
+	}
+	return contains(inlineTypes, base)
+}
+
+// ContentDisposition formats a Content-Disposition header for a file. The
+// name is given as an ASCII fallback and, if it has other characters, as an
+// RFC 5987 encoded filename* parameter.
+func ContentDisposition(disposition, name string) string {
+	fallback := asciiFilename(name)
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback)
+	if fallback != name {
+		header += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return header
+}
+
+// baseType strips parameters such as charset from a MIME type
+func baseType(mimeType string) string {
+	base, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		base, _, _ = strings.Cut(mimeType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// asciiFilename replaces characters that cannot appear in a quoted header
+// parameter, including quotes, backslashes and anything outside ASCII
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7E || r == '"' || r == '\\' {
+			b.WriteByte('_')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes a UTF-8 string for an ext-value, leaving
+// only the attr-chars of RFC 5987 as they are
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package media
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectMIME(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"text", "just some notes\n", "text/plain"},
+		{"HTML", "<!DOCTYPE html><html><script>alert(1)</script></html>", "text/html"},
+		{"SVG", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, "image/svg+xml"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"JPEG", "\xff\xd8\xff\xe0\x00\x10JFIF\x00", "image/jpeg"},
+		{"PDF", "%PDF-1.7\n", "application/pdf"},
+		{"empty", "", "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := DetectMIME([]byte(tt.data)); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: DetectMIME = %q, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if got := DetectMIME([]byte("\x7fELF\x02\x01\x01\x00" + strings.Repeat("\x00", 56))); !Blocked(got) {
+		t.Errorf("ELF binary detected as %q, which is not blocked", got)
+	}
+	if got := DetectMIME([]byte("MZ\x90\x00" + strings.Repeat("\x00", 60))); !Blocked(got) {
+		t.Errorf("DOS executable detected as %q, which is not blocked", got)
+	}
+}
+
+func TestMIMEPolicy(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		blocked  bool
+		inline   bool
+	}{
+		{"image/png", false, true},
+		{"IMAGE/JPEG", false, true},
+		{"text/plain; charset=utf-8", false, true},
+		{"application/pdf", false, true},
+		{"video/mp4", false, true},
+		{"audio/mpeg", false, true},
+		{"text/html; charset=utf-8", false, false},
+		{"image/svg+xml", false, false},
+		{"text/xml", false, false},
+		{"application/javascript", false, false},
+		{"application/zip", false, false},
+		{"application/x-elf", true, false},
+		{"application/vnd.microsoft.portable-executable", true, false},
+		{"application/x-msdownload; format=pe32", true, false},
+	}
+	for _, tt := range tests {
+		if got := Blocked(tt.mimeType); got != tt.blocked {
+			t.Errorf("Blocked(%q) = %v, want %v", tt.mimeType, got, tt.blocked)
+		}
+		if got := Inline(tt.mimeType); got != tt.inline {
+			t.Errorf("Inline(%q) = %v, want %v", tt.mimeType, got, tt.inline)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition, name, want string
+	}{
+		{"inline", "photo.jpg", `inline; filename="photo.jpg"`},
+		{"attachment", `a "quoted" \ name.txt`, `attachment; filename="a _quoted_ _ name.txt"; filename*=UTF-8''a%20%22quoted%22%20%5C%20name.txt`},
+		{"attachment", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "line\r\nbreak.txt", `attachment; filename="line__break.txt"; filename*=UTF-8''line%0D%0Abreak.txt`},
+	}
+	for _, tt := range tests {
+		if got := ContentDisposition(tt.disposition, tt.name); got != tt.want {
+			t.Errorf("ContentDisposition(%q, %q) = %s, want %s", tt.disposition, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+)
+
+// StripMetadata removes EXIF, XMP and other embedded metadata, including
+// GPS positions, from JPEG and PNG images. Other files are returned as-is.
+// JPEGs are rewritten without re-encoding unless their EXIF orientation has
+// to be applied to the pixels, since it is lost with the metadata.
+func StripMetadata(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		if Orientation(data) != 1 {
+			img, err := decode(data)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, orient(toRGBA(img), Orientation(data)), &jpeg.Options{Quality: 92})
+			return buf.Bytes(), err
+		}
+		return stripJPEG(data), nil
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG(data), nil
+	}
+	return data, nil
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP) and APP13 (IPTC) segments that
+// precede the image data. Malformed files are returned unchanged.
+func stripJPEG(data []byte) []byte {
+	out := []byte{0xFF, 0xD8}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return data
+		}
+		marker := data[pos+1]
+		if marker == 0xDA {
+			// Start of scan; the rest is image data
+			return append(out, data[pos:]...)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return data
+		}
+		if marker != 0xE1 && marker != 0xED {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return data
+}
+
+// stripPNG drops the eXIf and text chunks. Malformed files are returned
+// unchanged.
+func stripPNG(data []byte) []byte {
+	out := append([]byte{}, data[:8]...)
+	pos := 8
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return data
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	if pos != len(data) {
+		return data
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// maxTextLength caps the text kept from one file, so a huge log or book
+// does not dominate the search index
+const maxTextLength = 1 << 20
+
+// Extractable reports whether ExtractText can read text from files of the
+// MIME type: plain text (including Markdown), CSV, HTML and PDF
+func Extractable(mimeType string) bool {
+	switch baseType(mimeType) {
+	case "text/plain", "text/markdown", "text/csv", "text/tab-separated-values", "text/html", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// ExtractText returns the text of a file for the search index. HTML is
+// reduced to its visible text and PDFs to the text of their pages; scanned
+// PDFs without a text layer yield nothing.
+func ExtractText(data []byte, mimeType string) (string, error) {
+	var text string
+	var err error
+	switch baseType(mimeType) {
+	case "text/html":
+		text, err = htmlText(data)
+	case "application/pdf":
+		text, err = pdfText(data)
+	default:
+		if !Extractable(mimeType) {
+			return "", fmt.Errorf("cannot extract text from %s", mimeType)
+		}
+		text = string(data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.ToValidUTF8(text, "")
+	if len(text) > maxTextLength {
+		text = text[:maxTextLength]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// htmlText returns the text of an HTML document, leaving out scripts and
+// styles
+func htmlText(data []byte) (string, error) {
+	var b strings.Builder
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	skip := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return "", tokenizer.Err()
+			}
+			return b.String(), nil
+		case html.StartTagToken:
+			if name, _ := tokenizer.TagName(); isHiddenElement(string(name)) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); isHiddenElement(string(name)) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(tokenizer.Text())
+				b.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// isHiddenElement reports whether an element's content is not shown as text
+func isHiddenElement(name string) bool {
+	return name == "script" || name == "style" || name == "noscript" || name == "template"
+}
+
+// pdfText returns the text layer of a PDF, one page after the other. The
+// parser panics on some malformed files, which is turned into an error.
+func pdfText(data []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= reader.NumPage() && b.Len() < maxTextLength; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(pageText)
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
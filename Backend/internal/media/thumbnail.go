@@ -0,0 +1,142 @@
+// Package media generates image thumbnails and removes metadata from
+// uploaded images, using only pure Go decoders.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxPixels guards against images that would use too much memory to decode
+const maxPixels = 50_000_000
+
+// ErrUnsupported is returned for files that are not a supported image
+var ErrUnsupported = errors.New("not a supported image")
+
+// IsImage reports whether the MIME type is one thumbnails can be made for
+func IsImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Thumbnail scales an image down to fit in a size×size square, turned
+// upright according to its EXIF orientation. Images that are already small
+// enough are not enlarged. Opaque images are encoded as JPEG, others as PNG.
+func Thumbnail(data []byte, size int) ([]byte, error) {
+	img, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width > height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	thumb := orient(scaled, Orientation(data))
+
+	var buf bytes.Buffer
+	if thumb.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	return buf.Bytes(), err
+}
+
+// Orientation returns the EXIF orientation (1-8) of an image, or 1 if it
+// has none
+func Orientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	value, err := tag.Int(0)
+	if err != nil || value < 1 || value > 8 {
+		return 1
+	}
+	return value
+}
+
+// decode decodes an image after checking that its size is reasonable
+func decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, errors.New("image is too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// orient turns an image upright according to an EXIF orientation
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation == 1 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Source pixel shown at (x, y) once the image is upright
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // Mirrored, rotated
+				sx, sy = y, x
+			case 6: // Rotated 90° clockwise to display
+				sx, sy = y, h-1-x
+			case 7: // Mirrored, rotated the other way
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotated 90° counter-clockwise to display
+				sx, sy = w-1-y, x
+			}
+			out.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return out
+}
+
+// toRGBA copies any image into an RGBA image
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+	return out
+}
@@ -0,0 +1,341 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"backend/internal/media"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Attachment files are stored once per distinct content, as blobs named by
+// their SHA-256 under AttachmentDir. An attachment's filename is the path of
+// its blob relative to AttachmentDir, e.g. "ab/ab12...". A blob is removed
+// when the last attachment referencing it, including those in the trash, is
+// purged.
+
+// ThumbnailSizes are the sizes, in pixels, of the thumbnails served for
+// image attachments, smallest first
+var ThumbnailSizes = []int{128, 256, 512}
+
+// StripEXIF removes EXIF, XMP and GPS metadata from uploaded JPEG and PNG
+// images before they are stored
+var StripEXIF bool
+
+// ThumbnailFilename returns the filename, relative to AttachmentDir, of a
+// cached thumbnail of an attachment file. Thumbnails are kept next to the
+// file they were made from.
+func ThumbnailFilename(filename string, size int) string {
+	return fmt.Sprintf("%s.thumb-%d", filename, size)
+}
+
+// ThumbnailSource returns the file a cached thumbnail was made from, or
+// false if filename is not a thumbnail
+func ThumbnailSource(filename string) (string, bool) {
+	i := strings.LastIndex(filename, ".thumb-")
+	if i < 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(filename[i+len(".thumb-"):]); err != nil {
+		return "", false
+	}
+	return filename[:i], true
+}
+
+// ValidSHA256 reports whether sum is a hex-encoded SHA-256 digest
+func ValidSHA256(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// BlobFilename returns the filename, relative to AttachmentDir, of the blob
+// with the given lowercase hex SHA-256
+func BlobFilename(sum string) string {
+	return sum[:2] + "/" + sum
+}
+
+// blobLock keeps a blob from being removed as unused between the time an
+// upload stores or finds it and the time its attachment row is committed.
+// Uploads share it; RemoveUnusedFiles and integrity repairs take it alone.
+// It is taken before any database transaction that uses it.
+var blobLock sync.RWMutex
+
+// LockBlobs stops unused blobs from being removed until the returned
+// function is called, which may be more than once. Take it before StoreBlob
+// or BlobExists, and before beginning the transaction that inserts the
+// attachment, and hold it until that transaction has committed or rolled
+// back. Calls must not be nested.
+func LockBlobs() (unlock func()) {
+	blobLock.RLock()
+	var once sync.Once
+	return func() { once.Do(blobLock.RUnlock) }
+}
+
+// BlobExists reports whether a blob with the given SHA-256 is stored
+func BlobExists(sum string) bool {
+	_, err := os.Stat(filepath.Join(AttachmentDir, BlobFilename(sum)))
+	return err == nil
+}
+
+// StoreBlob writes r to the blob store and returns its SHA-256 and size.
+// created is false if an identical blob was already stored, in which case
+// nothing is written.
+func StoreBlob(r io.Reader) (sum string, size int64, created bool, err error) {
+	path, sum, size, err := SpoolBlob(r)
+	if err != nil {
+		return "", 0, false, err
+	}
+	created, err = AddBlob(path, sum)
+	if err != nil {
+		os.Remove(path)
+		return "", 0, false, err
+	}
+	return sum, size, created, nil
+}
+
+// SpoolBlob writes r to a temporary file next to the blob store and returns
+// its path, SHA-256 and size, so a file can be checked before it is stored.
+// The caller adds the file with AddBlob or removes it.
+func SpoolBlob(r io.Reader) (path, sum string, size int64, err error) {
+	tmpDir := filepath.Join(AttachmentDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", "", 0, err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", 0, err
+	}
+	return tmp.Name(), hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// AddBlob moves a file written by SpoolBlob, whose SHA-256 is sum, into the
+// blob store. created is false if an identical blob was already stored, in
+// which case the file is removed.
+func AddBlob(path, sum string) (created bool, err error) {
+	if BlobExists(sum) {
+		return false, os.Remove(path)
+	}
+	blobPath := filepath.Join(AttachmentDir, BlobFilename(sum))
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Rename(path, blobPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindBlob returns what the attachments using a blob record about it
+func (s *sqlStore) FindBlob(sum string) (Blob, error) {
+	blob := Blob{SHA256: sum}
+	err := s.q.QueryRow(
+		"SELECT COUNT(*), COALESCE(MAX(size), 0), COALESCE(MAX(mime_type), '') FROM attachments WHERE sha256 = ?",
+		sum,
+	).Scan(&blob.Refs, &blob.Size, &blob.MimeType)
+	if err == nil && blob.Refs == 0 {
+		err = ErrNotFound
+	}
+	return blob, err
+}
+
+// FileInUse reports whether an attachment, live or trashed, uses a file
+func (s *sqlStore) FileInUse(filename string) (bool, error) {
+	var used bool
+	err := s.q.QueryRow("SELECT EXISTS(SELECT 1 FROM attachments WHERE filename = ?)", filename).Scan(&used)
+	return used, err
+}
+
+// RemoveUnusedFiles deletes the given attachment files that no attachment
+// refers to any more, with their thumbnails. Blobs shared with other
+// attachments are kept. It waits for uploads holding LockBlobs, so it must
+// not be called while holding it.
+func RemoveUnusedFiles(blobs BlobStore, filenames []string) {
+	if len(filenames) == 0 {
+		return
+	}
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	for _, filename := range filenames {
+		used, err := blobs.FileInUse(filename)
+		if err != nil {
+			logging.Errorf("Error checking attachment file %s: %v", filename, err)
+			continue
+		}
+		if used {
+			continue
+		}
+		if err := os.Remove(filepath.Join(AttachmentDir, filename)); err != nil && !os.IsNotExist(err) {
+			logging.Errorf("Error removing attachment file %s: %v", filename, err)
+		}
+		thumbnails, _ := filepath.Glob(filepath.Join(AttachmentDir, filename) + ".thumb-*")
+		for _, thumbnail := range thumbnails {
+			os.Remove(thumbnail)
+		}
+	}
+}
+
+// HashFile returns the hex-encoded SHA-256 of a file's content
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// backfillAttachmentHashes hashes attachments uploaded before hashes were
+// recorded. Attachments whose file is missing are left without a hash.
+func backfillAttachmentHashes(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, filename FROM attachments WHERE sha256 IS NULL")
+	if err != nil {
+		return err
+	}
+	files := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			rows.Close()
+			return err
+		}
+		files[id] = filename
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, filename := range files {
+		sum, err := HashFile(filepath.Join(AttachmentDir, filename))
+		if err != nil {
+			logging.Warnf("Could not hash attachment %d: %v", id, err)
+			continue
+		}
+		if _, err := tx.Exec("UPDATE attachments SET sha256 = ? WHERE id = ?", sum, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detectAttachmentTypes replaces the MIME type clients reported for
+// existing attachments with the one detected from their content
+func detectAttachmentTypes(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT DISTINCT filename FROM attachments")
+	if err != nil {
+		return err
+	}
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			return err
+		}
+		filenames = append(filenames, filename)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filepath.Join(AttachmentDir, filename))
+		if err != nil {
+			logging.Warnf("Could not detect the type of %s: %v", filename, err)
+			continue
+		}
+		mimeType := media.DetectMIME(data)
+		_, err = tx.Exec(
+			"UPDATE attachments SET mime_type = ? WHERE filename = ? AND mime_type IS NOT ?",
+			mimeType, filename, mimeType,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveAttachmentsToBlobs moves files stored under their upload name into the
+// blob store, so attachments with the same content share one file. The old
+// files are removed once every attachment has been moved.
+func moveAttachmentsToBlobs(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, filename, sha256 FROM attachments WHERE sha256 IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	type legacyFile struct {
+		id       int
+		filename string
+		sum      string
+	}
+	var files []legacyFile
+	for rows.Next() {
+		var file legacyFile
+		if err := rows.Scan(&file.id, &file.filename, &file.sum); err != nil {
+			rows.Close()
+			return err
+		}
+		if file.filename != BlobFilename(file.sum) {
+			files = append(files, file)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var moved []string
+	for _, file := range files {
+		oldPath := filepath.Join(AttachmentDir, file.filename)
+		if !BlobExists(file.sum) {
+			newPath := filepath.Join(AttachmentDir, BlobFilename(file.sum))
+			if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+				return err
+			}
+			// Link rather than rename so the old file stays valid until
+			// every attachment has been updated
+			if err := os.Link(oldPath, newPath); err != nil {
+				logging.Warnf("Could not move attachment %d to the blob store: %v", file.id, err)
+				continue
+			}
+		}
+		if _, err := tx.Exec("UPDATE attachments SET filename = ? WHERE id = ?", BlobFilename(file.sum), file.id); err != nil {
+			return err
+		}
+		moved = append(moved, oldPath)
+	}
+
+	for _, path := range moved {
+		os.Remove(path)
+	}
+	return nil
+}
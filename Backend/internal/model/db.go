@@ -1,97 +1,55 @@
 package model
 
 import (
+	"backend/internal/logging"
 	"database/sql"
 	"log"
 	"os"
-
-	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
 )
 
 var DB *sql.DB
 
-func InitDB() {
+// DatabasePath is the SQLite database file
+var DatabasePath = "data/notes.db"
+
+// OpenDB opens the database without touching the schema
+func OpenDB() {
 	var err error
 
 	// Create data directory if it doesn't exist
-	if _, err := os.Stat("data"); os.IsNotExist(err) {
-		os.Mkdir("data", 0755)
+	if err := os.MkdirAll(filepath.Dir(DatabasePath), 0755); err != nil {
+		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
-	DB, err = sql.Open("sqlite3", "./data/notes.db")
+	// The driver depends on the build; see SQLiteDriver
+	DB, err = sql.Open(sqliteDriverName, DatabasePath+sqliteOptions)
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
+}
 
-	// Create folders table if it doesn't exist
-	createFoldersTable := `
-    CREATE TABLE IF NOT EXISTS folders (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        name TEXT NOT NULL UNIQUE,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    );`
-	_, err = DB.Exec(createFoldersTable)
-	if err != nil {
-		log.Fatalf("Failed to create folders table: %v", err)
-	}
-
-	// Create notes table if it doesn't exist
-	createNotesTable := `
-    CREATE TABLE IF NOT EXISTS notes (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        title TEXT NOT NULL,
-        content TEXT NOT NULL,
-        created_at DATETIME NOT NULL,
-        updated_at DATETIME NOT NULL,
-        folder_id INTEGER,
-        order_index INTEGER DEFAULT 0,
-        FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE SET NULL
-    );`
-	_, err = DB.Exec(createNotesTable)
-	if err != nil {
-		log.Fatalf("Failed to create notes table: %v", err)
-	}
-
-	// Migration: Add order_index column to existing notes table if it doesn't exist
-	// This is safe to run multiple times - SQLite will ignore if column already exists
-	_, err = DB.Exec("ALTER TABLE notes ADD COLUMN order_index INTEGER DEFAULT 0")
-	if err != nil {
-		// Ignore error if column already exists
-		log.Printf("Note: order_index column may already exist: %v", err)
-	}
+// InitDB opens the database and brings its schema up to date
+func InitDB() {
+	OpenDB()
 
-	// Set initial order for existing notes that don't have order_index set
-	_, err = DB.Exec("UPDATE notes SET order_index = id WHERE order_index = 0 OR order_index IS NULL")
-	if err != nil {
-		log.Printf("Note: failed to set initial order for existing notes: %v", err)
+	// Apply pending schema migrations
+	if err := Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
-	// Create attachments table if it doesn't exist
-	createAttachmentsTable := `
-    CREATE TABLE IF NOT EXISTS attachments (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        note_id INTEGER NOT NULL,
-        filename TEXT NOT NULL,
-        original_name TEXT NOT NULL,
-        mime_type TEXT NOT NULL,
-        size INTEGER NOT NULL,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
-    );`
-	_, err = DB.Exec(createAttachmentsTable)
-	if err != nil {
-		log.Fatalf("Failed to create attachments table: %v", err)
-	}
+	// Create full-text search index and keep it in sync with notes
+	initSearchIndex()
 
 	// Create default folders if none exist
 	createDefaultFolders()
 
 	// Create attachments directory if it doesn't exist
-	if _, err := os.Stat("data/attachments"); os.IsNotExist(err) {
-		os.Mkdir("data/attachments", 0755)
+	if err := os.MkdirAll(AttachmentDir, 0755); err != nil {
+		log.Fatalf("Failed to create attachments directory: %v", err)
 	}
 
-	log.Println("Database initialized successfully")
+	logging.Infof("Database initialized successfully")
 }
 
 func createDefaultFolders() {
@@ -99,7 +57,7 @@ func createDefaultFolders() {
 	var count int
 	err := DB.QueryRow("SELECT COUNT(*) FROM folders").Scan(&count)
 	if err != nil {
-		log.Printf("Error checking folders count: %v", err)
+		logging.Errorf("Error checking folders count: %v", err)
 		return
 	}
 
@@ -107,11 +65,110 @@ func createDefaultFolders() {
 	if count == 0 {
 		defaultFolders := []string{"Notes", "Work", "Personal"}
 		for _, folderName := range defaultFolders {
-			_, err := DB.Exec("INSERT INTO folders (name) VALUES (?)", folderName)
+			_, err := DB.Exec("INSERT INTO folders (uid, name) VALUES (?, ?)", NewUID(), folderName)
 			if err != nil {
-				log.Printf("Error creating default folder %s: %v", folderName, err)
+				logging.Errorf("Error creating default folder %s: %v", folderName, err)
 			}
 		}
-		log.Println("Created default folders")
+		logging.Infof("Created default folders")
+	}
+}
+
+// initSearchIndex is kept out of the numbered migrations because FTS5
+// availability depends on how the binary was built, not on the schema version
+func initSearchIndex() {
+	// CREATE VIRTUAL TABLE IF NOT EXISTS succeeds on an existing table even
+	// when the module is missing, so check for FTS5 itself first. Without it
+	// every write to notes would fail in the index triggers.
+	if _, err := DB.Exec("CREATE VIRTUAL TABLE temp.fts5_check USING fts5(x); DROP TABLE temp.fts5_check"); err != nil {
+		log.Fatalf("SQLite driver %s has no FTS5 support (%v); build with -tags sqlite_fts5, or with CGO_ENABLED=0", SQLiteDriver, err)
+	}
+
+	// Remember whether the index already existed so we only rebuild once
+	var existing int
+	err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'notes_fts'").Scan(&existing)
+	if err != nil {
+		log.Fatalf("Error checking search index: %v", err)
+	}
+
+	// External-content table: the text lives in notes, the index only stores tokens
+	createNotesFTS := `
+    CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(
+        title,
+        content,
+        content='notes',
+        content_rowid='id',
+        tokenize='unicode61 remove_diacritics 2',
+        prefix='2 3'
+    );`
+	_, err = DB.Exec(createNotesFTS)
+	if err != nil {
+		log.Fatalf("Failed to create search index: %v", err)
+	}
+
+	// Triggers keep the index consistent for every write path, including sync
+	createTriggers := `
+    CREATE TRIGGER IF NOT EXISTS notes_fts_ai AFTER INSERT ON notes BEGIN
+        INSERT INTO notes_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS notes_fts_ad AFTER DELETE ON notes BEGIN
+        INSERT INTO notes_fts(notes_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS notes_fts_au AFTER UPDATE OF title, content ON notes BEGIN
+        INSERT INTO notes_fts(notes_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+        INSERT INTO notes_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+    END;`
+	_, err = DB.Exec(createTriggers)
+	if err != nil {
+		log.Fatalf("Failed to create search index triggers: %v", err)
+	}
+
+	// Index notes that were written before the search index existed
+	if existing == 0 {
+		_, err = DB.Exec("INSERT INTO notes_fts(notes_fts) VALUES ('rebuild')")
+		if err != nil {
+			log.Fatalf("Failed to build search index: %v", err)
+		}
+		logging.Infof("Built full-text search index")
+	}
+
+	initAttachmentSearchIndex()
+}
+
+// initAttachmentSearchIndex indexes the text extracted from attachments
+// alongside notes, so a search can find a note by its attachments
+func initAttachmentSearchIndex() {
+	var existing int
+	err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'attachments_fts'").Scan(&existing)
+	if err != nil {
+		log.Fatalf("Error checking attachment search index: %v", err)
+	}
+
+	createIndex := `
+    CREATE VIRTUAL TABLE IF NOT EXISTS attachments_fts USING fts5(
+        content,
+        content='attachment_text',
+        content_rowid='attachment_id',
+        tokenize='unicode61 remove_diacritics 2',
+        prefix='2 3'
+    );
+    CREATE TRIGGER IF NOT EXISTS attachments_fts_ai AFTER INSERT ON attachment_text BEGIN
+        INSERT INTO attachments_fts(rowid, content) VALUES (new.attachment_id, new.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS attachments_fts_ad AFTER DELETE ON attachment_text BEGIN
+        INSERT INTO attachments_fts(attachments_fts, rowid, content) VALUES ('delete', old.attachment_id, old.content);
+    END;
+    CREATE TRIGGER IF NOT EXISTS attachments_fts_au AFTER UPDATE OF content ON attachment_text BEGIN
+        INSERT INTO attachments_fts(attachments_fts, rowid, content) VALUES ('delete', old.attachment_id, old.content);
+        INSERT INTO attachments_fts(rowid, content) VALUES (new.attachment_id, new.content);
+    END;`
+	if _, err := DB.Exec(createIndex); err != nil {
+		log.Fatalf("Failed to create attachment search index: %v", err)
+	}
+
+	if existing == 0 {
+		if _, err := DB.Exec("INSERT INTO attachments_fts(attachments_fts) VALUES ('rebuild')"); err != nil {
+			log.Fatalf("Failed to build attachment search index: %v", err)
+		}
 	}
 }
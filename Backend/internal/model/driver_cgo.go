@@ -0,0 +1,19 @@
+//go:build cgo && sqlite_fts5 && !purego
+
+package model
+
+import _ "github.com/mattn/go-sqlite3"
+
+// SQLiteDriver names the SQLite driver the binary was built with. It is
+// mattn/go-sqlite3 only with cgo and -tags sqlite_fts5, because without that
+// tag it has no FTS5 and could not write to a database that has a search
+// index. Every other build uses the pure-Go driver.
+const SQLiteDriver = "mattn/go-sqlite3"
+
+const (
+	sqliteDriverName = "sqlite3"
+
+	// Background jobs write alongside requests; wait for the lock rather
+	// than failing with "database is locked"
+	sqliteOptions = "?_busy_timeout=5000"
+)
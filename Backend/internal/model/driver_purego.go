@@ -0,0 +1,19 @@
+//go:build !cgo || !sqlite_fts5 || purego
+
+package model
+
+import _ "modernc.org/sqlite"
+
+// SQLiteDriver names the SQLite driver the binary was built with. Unless
+// the build has cgo and -tags sqlite_fts5, or has -tags purego, it is
+// modernc.org/sqlite, which is written in Go and always has FTS5.
+const SQLiteDriver = "modernc.org/sqlite"
+
+const (
+	sqliteDriverName = "sqlite"
+
+	// Wait for the lock like the cgo build does, and write times in the
+	// format mattn/go-sqlite3 uses, so a data directory works with either
+	// build
+	sqliteOptions = "?_pragma=busy_timeout(5000)&_time_format=sqlite"
+)
@@ -0,0 +1,130 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"backend/internal/media"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// textQueue holds attachments waiting for their text to be extracted
+var textQueue = make(chan int, 256)
+
+// QueueTextExtraction asks the background extractor to index the text of
+// a new attachment. If the queue is full the attachment is picked up on the
+// next start instead.
+func QueueTextExtraction(attachmentID int) {
+	select {
+	case textQueue <- attachmentID:
+	default:
+	}
+}
+
+// StartTextExtractor extracts the text of queued attachments in the
+// background, after first catching up on attachments that have none yet
+func StartTextExtractor(index TextIndex) {
+	go func() {
+		pending, err := index.PendingTextExtractions()
+		if err != nil {
+			logging.Errorf("Error listing attachments for text extraction: %v", err)
+		}
+		for _, id := range pending {
+			extractText(index, id)
+		}
+		if len(pending) > 0 {
+			logging.Infof("📄 Extracted text from %d attachments", len(pending))
+		}
+
+		for id := range textQueue {
+			extractText(index, id)
+		}
+	}()
+}
+
+func extractText(index TextIndex, attachmentID int) {
+	if err := index.ExtractAttachmentText(attachmentID); err != nil {
+		logging.Errorf("Error extracting text of attachment %d: %v", attachmentID, err)
+	}
+}
+
+// ExtractAttachmentText stores the text of a text-based attachment in
+// attachment_text, where the search index picks it up. Attachments that
+// already have text, or cannot have any, are left alone. A file that yields
+// no text is recorded with the reason, so it is not tried again.
+func (s *sqlStore) ExtractAttachmentText(attachmentID int) error {
+	var filename, mimeType string
+	var sum *string
+	var done bool
+	err := s.q.QueryRow(`
+		SELECT a.filename, a.mime_type, a.sha256,
+			EXISTS(SELECT 1 FROM attachment_text t WHERE t.attachment_id = a.id)
+		FROM attachments a WHERE a.id = ?`, attachmentID,
+	).Scan(&filename, &mimeType, &sum, &done)
+	if err != nil || done || !media.Extractable(mimeType) {
+		return err
+	}
+
+	// Attachments with the same content share their text
+	if sum != nil {
+		res, err := s.q.Exec(`
+			INSERT INTO attachment_text (attachment_id, content, error, extracted_at)
+			SELECT ?, t.content, t.error, ?
+			FROM attachment_text t
+			JOIN attachments a ON a.id = t.attachment_id
+			WHERE a.sha256 = ?
+			LIMIT 1
+			ON CONFLICT DO NOTHING`,
+			attachmentID, time.Now().UTC(), *sum)
+		if err != nil {
+			return err
+		}
+		if count, _ := res.RowsAffected(); count > 0 {
+			return nil
+		}
+	}
+
+	var content string
+	var extractErr *string
+	data, err := os.ReadFile(filepath.Join(AttachmentDir, filename))
+	if err == nil {
+		content, err = media.ExtractText(data, mimeType)
+	}
+	if err != nil {
+		message := err.Error()
+		extractErr = &message
+	}
+
+	_, err = s.q.Exec(
+		"INSERT INTO attachment_text (attachment_id, content, error, extracted_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		attachmentID, content, extractErr, time.Now().UTC(),
+	)
+	return err
+}
+
+// PendingTextExtractions lists live attachments whose text has not been
+// extracted yet
+func (s *sqlStore) PendingTextExtractions() ([]int, error) {
+	rows, err := s.q.Query(`
+		SELECT a.id, a.mime_type FROM attachments a
+		WHERE a.deleted_at IS NULL
+			AND NOT EXISTS(SELECT 1 FROM attachment_text t WHERE t.attachment_id = a.id)
+		ORDER BY a.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		var mimeType string
+		if err := rows.Scan(&id, &mimeType); err != nil {
+			return nil, err
+		}
+		if media.Extractable(mimeType) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
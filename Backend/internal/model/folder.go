@@ -0,0 +1,101 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// FolderSubtree returns folderID and the IDs of all its live descendants.
+// PostgresStore uses it too; the cast lets PostgreSQL type the parameter.
+func FolderSubtree(q Queryer, folderID int) ([]int, error) {
+	rows, err := q.Query(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT CAST(? AS BIGINT)
+			UNION
+			SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+			WHERE f.deleted_at IS NULL
+		)
+		SELECT id FROM subtree`, folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// FolderNameTaken reports whether a live folder other than excludeID already
+// uses name under parentID
+func FolderNameTaken(q Queryer, name string, parentID *int, excludeID int) (bool, error) {
+	var taken bool
+	err := q.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM folders WHERE name = ? AND parent_id IS NOT DISTINCT FROM ? AND id != ? AND deleted_at IS NULL)",
+		name, parentID, excludeID,
+	).Scan(&taken)
+	return taken, err
+}
+
+// FolderInSubtree reports whether folderID is rootID or one of its
+// descendants, by walking up from folderID
+func FolderInSubtree(q Queryer, folderID, rootID int) (bool, error) {
+	var found bool
+	err := q.QueryRow(`
+		WITH RECURSIVE ancestors(id, parent_id) AS (
+			SELECT id, parent_id FROM folders WHERE id = ?
+			UNION
+			SELECT f.id, f.parent_id FROM folders f JOIN ancestors a ON f.id = a.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = ?)`, folderID, rootID).Scan(&found)
+	return found, err
+}
+
+// countFolderNotes returns the number of live notes in each folder that
+// has any
+func countFolderNotes(q Queryer) (map[int]int, error) {
+	rows, err := q.Query("SELECT folder_id, COUNT(*) FROM notes WHERE folder_id IS NOT NULL AND deleted_at IS NULL GROUP BY folder_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var folderID, count int
+		if err := rows.Scan(&folderID, &count); err != nil {
+			return nil, err
+		}
+		counts[folderID] = count
+	}
+	return counts, rows.Err()
+}
+
+// TrashFolders moves the given folders and their notes to the trash. They all
+// get the same deleted_at so they can be restored together.
+func TrashFolders(q Queryer, folderIDs []int, deletedAt time.Time) error {
+	inClause, args := intsInClause(folderIDs)
+	args = append([]interface{}{deletedAt}, args...)
+
+	_, err := q.Exec("UPDATE notes SET deleted_at = ? WHERE folder_id IN "+inClause+" AND deleted_at IS NULL", args...)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE folders SET deleted_at = ? WHERE id IN "+inClause+" AND deleted_at IS NULL", args...)
+	return err
+}
+
+// intsInClause builds "(?, ?, ...)" and its arguments for an IN condition
+func intsInClause(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")", args
+}
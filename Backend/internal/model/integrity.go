@@ -0,0 +1,317 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Kinds of problems found by CheckIntegrity
+const (
+	IssueDatabase     = "database"      // PRAGMA integrity_check reported a problem
+	IssueOrphanedFile = "orphaned_file" // File on disk that no attachment uses
+	IssueOrphanedRow  = "orphaned_row"  // Attachment whose note no longer exists
+	IssueMissingFile  = "missing_file"  // Attachment whose file is not on disk
+	IssueSizeMismatch = "size_mismatch" // File size differs from attachments.size
+	IssueCorruptFile  = "corrupt_file"  // File content does not match its SHA-256
+)
+
+// orphanGracePeriod keeps CheckIntegrity away from files an upload in
+// progress has written but not yet recorded
+const orphanGracePeriod = time.Hour
+
+// IntegrityIssue is one problem found by CheckIntegrity
+type IntegrityIssue struct {
+	Kind         string `json:"kind"`
+	Filename     string `json:"filename,omitempty"` // Relative to AttachmentDir
+	AttachmentID *int   `json:"attachment_id,omitempty"`
+	Details      string `json:"details"`
+	Repairable   bool   `json:"repairable"`
+	Repaired     bool   `json:"repaired"`
+}
+
+// IntegrityReport is the result of CheckIntegrity
+type IntegrityReport struct {
+	Repair      bool             `json:"repair"` // false for a dry run
+	DatabaseOK  bool             `json:"database_ok"`
+	Attachments int              `json:"attachments_checked"`
+	Files       int              `json:"files_checked"`
+	Issues      []IntegrityIssue `json:"issues"`
+	Repaired    int              `json:"repaired"`
+	FreedBytes  int64            `json:"freed_bytes"`
+	CheckedAt   time.Time        `json:"checked_at"`
+}
+
+// CheckIntegrity checks an SQLite database with PRAGMA integrity_check and
+// compares the attachments table with the files in AttachmentDir. With
+// repair set it also fixes what it can:
+//   - orphaned files, including partial uploads, are deleted
+//   - attachments of notes that no longer exist are deleted
+//   - attachments whose file is missing or corrupt are deleted, as their
+//     content cannot be recovered
+//   - a wrong size is corrected when the file still matches its hash
+//
+// Database corruption is only reported.
+func (s *sqlStore) CheckIntegrity(repair bool) (IntegrityReport, error) {
+	report := IntegrityReport{Repair: repair, Issues: []IntegrityIssue{}, CheckedAt: time.Now()}
+
+	// PostgreSQL checks its pages itself; there is no integrity_check
+	if !s.postgres {
+		if err := s.checkDatabase(&report); err != nil {
+			return report, err
+		}
+	}
+	report.DatabaseOK = len(report.Issues) == 0
+
+	files, err := attachmentFiles()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+
+	// Files are only removed once no upload can be about to use them
+	if repair {
+		blobLock.Lock()
+		defer blobLock.Unlock()
+	}
+
+	var remove []string
+	err = s.inTx(func(tx *sqlStore) error {
+		var err error
+		remove, err = tx.checkAttachments(&report, files)
+		return err
+	})
+	if err != nil || !repair {
+		return report, err
+	}
+
+	for _, filename := range remove {
+		if err := os.Remove(filepath.Join(AttachmentDir, filename)); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		report.FreedBytes += files[filename].Size()
+	}
+	report.Repaired = len(report.Issues) - databaseIssues(report)
+	return report, nil
+}
+
+// checkDatabase adds what PRAGMA integrity_check reports to the report
+func (s *sqlStore) checkDatabase(report *IntegrityReport) error {
+	rows, err := s.q.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return err
+		}
+		if message != "ok" {
+			report.Issues = append(report.Issues, IntegrityIssue{Kind: IssueDatabase, Details: message})
+		}
+	}
+	return rows.Err()
+}
+
+// checkAttachments compares the attachments table with the files on disk,
+// repairing rows if report.Repair is set, and returns the files to remove
+// once the repairs are committed
+func (s *sqlStore) checkAttachments(report *IntegrityReport, files map[string]fs.FileInfo) ([]string, error) {
+	repair := report.Repair
+	rows, err := s.q.Query(`
+		SELECT a.id, a.filename, a.size, a.sha256, n.id IS NOT NULL
+		FROM attachments a
+		LEFT JOIN notes n ON n.id = a.note_id
+		ORDER BY a.id`)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []integrityRow
+	for rows.Next() {
+		var row integrityRow
+		if err := rows.Scan(&row.id, &row.filename, &row.size, &row.sum, &row.hasNote); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		attachments = append(attachments, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report.Attachments = len(attachments)
+
+	// Blobs are shared, so each file is hashed at most once
+	hashes := make(map[string]string)
+	var deleteIDs []int
+	for _, row := range attachments {
+		id := row.id
+		issue := IntegrityIssue{Filename: row.filename, AttachmentID: &id, Repairable: true, Repaired: repair}
+
+		info, onDisk := files[row.filename]
+		switch {
+		case !row.hasNote:
+			issue.Kind = IssueOrphanedRow
+			issue.Details = "attachment belongs to a note that no longer exists"
+		case !onDisk:
+			issue.Kind = IssueMissingFile
+			issue.Details = "file not found on disk"
+		case info.Size() != row.size:
+			issue.Kind = IssueSizeMismatch
+			issue.Details = fmt.Sprintf("file is %d bytes, attachment records %d", info.Size(), row.size)
+
+			sum, ok := hashes[row.filename]
+			if !ok {
+				sum, err = HashFile(filepath.Join(AttachmentDir, row.filename))
+				if err != nil {
+					return nil, err
+				}
+				hashes[row.filename] = sum
+			}
+			if row.sum.Valid && row.sum.String != sum {
+				issue.Kind = IssueCorruptFile
+				issue.Details += ", and its content does not match the sha256"
+			} else if repair {
+				// The file is intact; the recorded size is wrong
+				_, err := s.q.Exec("UPDATE attachments SET size = ?, sha256 = ? WHERE id = ?", info.Size(), sum, id)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			continue
+		}
+
+		if issue.Kind != IssueSizeMismatch {
+			deleteIDs = append(deleteIDs, id)
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	if repair {
+		for _, id := range deleteIDs {
+			if _, err := s.q.Exec("DELETE FROM attachments WHERE id = ?", id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Files of the remaining attachments are kept
+	used := make(map[string]bool)
+	for _, row := range attachments {
+		if !containsInt(deleteIDs, row.id) {
+			used[row.filename] = true
+		}
+	}
+
+	// Corrupt files go with their attachments; other unused files are
+	// reported once they are older than an upload could take
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var remove []string
+	cutoff := time.Now().Add(-orphanGracePeriod)
+	for _, filename := range filenames {
+		info := files[filename]
+		source := filename
+		if thumbnailOf, ok := ThumbnailSource(filename); ok {
+			// Thumbnails live and die with the file they were made from
+			source = thumbnailOf
+		}
+		if used[source] {
+			continue
+		}
+		if referencedBy(attachments, source) {
+			remove = append(remove, filename)
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		remove = append(remove, filename)
+		report.Issues = append(report.Issues, IntegrityIssue{
+			Kind:       IssueOrphanedFile,
+			Filename:   filename,
+			Details:    fmt.Sprintf("%d bytes not used by any attachment", info.Size()),
+			Repairable: true,
+			Repaired:   repair,
+		})
+	}
+	return remove, nil
+}
+
+// integrityRow is an attachment as seen by CheckIntegrity
+type integrityRow struct {
+	id       int
+	filename string
+	size     int64
+	sum      sql.NullString
+	hasNote  bool
+}
+
+// referencedBy reports whether any of the attachments uses the file
+func referencedBy(attachments []integrityRow, filename string) bool {
+	for _, row := range attachments {
+		if row.filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseIssues counts the issues reported by PRAGMA integrity_check
+func databaseIssues(report IntegrityReport) int {
+	count := 0
+	for _, issue := range report.Issues {
+		if issue.Kind == IssueDatabase {
+			count++
+		}
+	}
+	return count
+}
+
+// attachmentFiles lists the files under AttachmentDir by their path
+// relative to it, using forward slashes like attachments.filename
+func attachmentFiles() (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(AttachmentDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == AttachmentDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(AttachmentDir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return files, err
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
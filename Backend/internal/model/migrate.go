@@ -0,0 +1,280 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a numbered schema change embedded in the binary
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrationHooks run Go code inside a migration's transaction, after its
+// SQL, for data changes that cannot be expressed in SQL
+var migrationHooks = map[int]func(tx *sql.Tx) error{
+	4:  backfillNoteTags,
+	7:  backfillUIDs,
+	10: backfillAttachmentHashes,
+	11: moveAttachmentsToBlobs,
+	12: detectAttachmentTypes,
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if pending
+}
+
+// Migrations returns all embedded migrations ordered by version.
+// Files are named NNNN_description.sql.
+func Migrations() ([]Migration, error) {
+	return readMigrations(migrationFiles, "migrations")
+}
+
+// readMigrations reads the migrations in dir of fsys
+func readMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		versionStr, description, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration filename: %s", name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %s", name)
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, other, name)
+		}
+		seen[version] = name
+
+		content, err := fs.ReadFile(fsys, dir+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    description,
+			SQL:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction.
+// It refuses to run if the database was migrated by a newer binary.
+func Migrate() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade the backend", current, latest)
+	}
+
+	if current == 0 {
+		if err := adoptLegacySchema(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %v", m.Version, m.Name, err)
+		}
+		logging.Infof("Applied migration %04d_%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// SchemaVersion returns the highest applied migration version, or 0
+func SchemaVersion() (int, error) {
+	var version int
+	err := DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// GetMigrationStatus lists every known migration along with when it was
+// applied. Versions recorded in the database but unknown to this binary
+// are included with an empty name.
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	return migrationStatus(DB, migrations)
+}
+
+// migrationStatus matches migrations against those recorded in the
+// schema_migrations table of q
+func migrationStatus(q Queryer, migrations []Migration) ([]MigrationStatus, error) {
+	rows, err := q.Query("SELECT version, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if appliedAt, ok := applied[m.Version]; ok {
+			status.AppliedAt = &appliedAt
+			delete(applied, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for version, appliedAt := range applied {
+		statuses = append(statuses, MigrationStatus{Version: version, AppliedAt: &appliedAt})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// ensureMigrationsTable creates the bookkeeping table if needed
+func ensureMigrationsTable() error {
+	_, err := DB.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME NOT NULL
+    );`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// applyMigration runs a single migration and records it atomically
+func applyMigration(m Migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+
+	if hook, ok := migrationHooks[m.Version]; ok {
+		if err := hook(tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// adoptLegacySchema prepares databases created before migrations existed.
+// Very old databases have a notes table without order_index, which the
+// baseline migration expects.
+func adoptLegacySchema() error {
+	hasNotes, err := tableExists("notes")
+	if err != nil || !hasNotes {
+		return err
+	}
+
+	hasOrderIndex, err := columnExists("notes", "order_index")
+	if err != nil || hasOrderIndex {
+		return err
+	}
+
+	_, err = DB.Exec("ALTER TABLE notes ADD COLUMN order_index INTEGER DEFAULT 0")
+	if err != nil {
+		return fmt.Errorf("failed to add order_index to legacy notes table: %v", err)
+	}
+	logging.Infof("Added order_index column to legacy notes table")
+	return nil
+}
+
+// tableExists reports whether a table with the given name exists
+func tableExists(name string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", name).Scan(&exists)
+	return exists, err
+}
+
+// columnExists reports whether table has a column with the given name
+func columnExists(table, column string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	return exists, err
+}
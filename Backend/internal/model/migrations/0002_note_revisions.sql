@@ -0,0 +1,42 @@
+-- Every change to a note's title or content is kept as a numbered revision.
+-- Triggers record revisions so REST handlers and sync are covered alike.
+
+CREATE TABLE IF NOT EXISTS note_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    folder_id INTEGER,
+    created_at DATETIME NOT NULL,
+    UNIQUE (note_id, revision),
+    FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+);
+
+-- Existing notes start their history at revision 1
+INSERT INTO note_revisions (note_id, revision, title, content, folder_id, created_at)
+SELECT id, 1, title, content, folder_id, updated_at FROM notes;
+
+CREATE TRIGGER IF NOT EXISTS note_revisions_ai AFTER INSERT ON notes BEGIN
+    INSERT INTO note_revisions (note_id, revision, title, content, folder_id, created_at)
+    VALUES (
+        new.id,
+        COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = new.id), 0) + 1,
+        new.title, new.content, new.folder_id, new.updated_at
+    );
+END;
+
+CREATE TRIGGER IF NOT EXISTS note_revisions_au AFTER UPDATE OF title, content ON notes
+WHEN old.title IS NOT new.title OR old.content IS NOT new.content BEGIN
+    INSERT INTO note_revisions (note_id, revision, title, content, folder_id, created_at)
+    VALUES (
+        new.id,
+        COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = new.id), 0) + 1,
+        new.title, new.content, new.folder_id, new.updated_at
+    );
+END;
+
+-- Foreign keys are not enforced by default, so clean up explicitly
+CREATE TRIGGER IF NOT EXISTS note_revisions_ad AFTER DELETE ON notes BEGIN
+    DELETE FROM note_revisions WHERE note_id = old.id;
+END;
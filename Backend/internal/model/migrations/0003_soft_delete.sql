@@ -0,0 +1,21 @@
+-- Deleting moves notes, folders and attachments to the trash by setting
+-- deleted_at. Rows are removed for good when the trash is emptied or purged.
+
+ALTER TABLE notes ADD COLUMN deleted_at DATETIME;
+ALTER TABLE attachments ADD COLUMN deleted_at DATETIME;
+
+-- Rebuild folders so a trashed folder does not block reusing its name:
+-- the UNIQUE constraint becomes a unique index over live folders only.
+CREATE TABLE folders_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    deleted_at DATETIME
+);
+INSERT INTO folders_new (id, name, created_at) SELECT id, name, created_at FROM folders;
+DROP TABLE folders;
+ALTER TABLE folders_new RENAME TO folders;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_name_live ON folders(name) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_notes_deleted_at ON notes(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_attachments_deleted_at ON attachments(deleted_at);
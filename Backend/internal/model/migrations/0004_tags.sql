@@ -0,0 +1,23 @@
+-- Tags are attached to notes either inline, as #hashtags in the content,
+-- or manually. Hashtags in existing notes are extracted after this runs.
+
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS note_tags (
+    note_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    inline BOOLEAN NOT NULL DEFAULT 0,
+    PRIMARY KEY (note_id, tag_id),
+    FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_tags_tag ON note_tags(tag_id);
+
+CREATE TRIGGER IF NOT EXISTS note_tags_ad AFTER DELETE ON notes BEGIN
+    DELETE FROM note_tags WHERE note_id = old.id;
+END;
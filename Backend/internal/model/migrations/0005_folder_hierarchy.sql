@@ -0,0 +1,8 @@
+-- Folders can be nested. Names only need to be unique among siblings.
+
+ALTER TABLE folders ADD COLUMN parent_id INTEGER REFERENCES folders(id);
+
+DROP INDEX IF EXISTS idx_folders_name_live;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_parent_name_live
+    ON folders(COALESCE(parent_id, 0), name) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(parent_id);
@@ -0,0 +1,62 @@
+-- Tombstones record deletions so sync can pass them on to other devices.
+-- They are written by triggers whenever a note, folder or attachment moves
+-- to the trash or is removed, and dropped again when it is restored.
+
+CREATE TABLE IF NOT EXISTS tombstones (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    deleted_at DATETIME NOT NULL,
+    UNIQUE (entity_type, entity_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tombstones_deleted_at ON tombstones(deleted_at);
+
+-- Devices that have synced, with the server time up to which they have
+-- received every change
+CREATE TABLE IF NOT EXISTS devices (
+    id TEXT PRIMARY KEY,
+    first_seen_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    last_sync_at DATETIME
+);
+
+INSERT OR IGNORE INTO tombstones (entity_type, entity_id, deleted_at)
+    SELECT 'note', id, deleted_at FROM notes WHERE deleted_at IS NOT NULL;
+INSERT OR IGNORE INTO tombstones (entity_type, entity_id, deleted_at)
+    SELECT 'folder', id, deleted_at FROM folders WHERE deleted_at IS NOT NULL;
+INSERT OR IGNORE INTO tombstones (entity_type, entity_id, deleted_at)
+    SELECT 'attachment', id, deleted_at FROM attachments WHERE deleted_at IS NOT NULL;
+
+CREATE TRIGGER IF NOT EXISTS notes_tombstone_au AFTER UPDATE OF deleted_at ON notes BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'note' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        SELECT 'note', new.id, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_tombstone_ad AFTER DELETE ON notes WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        VALUES ('note', old.id, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_tombstone_au AFTER UPDATE OF deleted_at ON folders BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'folder' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        SELECT 'folder', new.id, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_tombstone_ad AFTER DELETE ON folders WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        VALUES ('folder', old.id, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_tombstone_au AFTER UPDATE OF deleted_at ON attachments BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'attachment' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        SELECT 'attachment', new.id, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_tombstone_ad AFTER DELETE ON attachments WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, deleted_at)
+        VALUES ('attachment', old.id, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
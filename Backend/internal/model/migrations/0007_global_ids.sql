@@ -0,0 +1,54 @@
+-- Notes, folders and attachments get a globally unique ID next to their
+-- integer key, so devices can create items offline without clashing.
+-- IDs for existing rows are generated after this runs.
+
+ALTER TABLE notes ADD COLUMN uid TEXT;
+ALTER TABLE folders ADD COLUMN uid TEXT;
+ALTER TABLE attachments ADD COLUMN uid TEXT;
+ALTER TABLE tombstones ADD COLUMN entity_uid TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_uid ON notes(uid);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_uid ON folders(uid);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_attachments_uid ON attachments(uid);
+CREATE INDEX IF NOT EXISTS idx_tombstones_uid ON tombstones(entity_type, entity_uid);
+
+-- Recreate the tombstone triggers so they record the global ID
+DROP TRIGGER IF EXISTS notes_tombstone_au;
+DROP TRIGGER IF EXISTS notes_tombstone_ad;
+DROP TRIGGER IF EXISTS folders_tombstone_au;
+DROP TRIGGER IF EXISTS folders_tombstone_ad;
+DROP TRIGGER IF EXISTS attachments_tombstone_au;
+DROP TRIGGER IF EXISTS attachments_tombstone_ad;
+
+CREATE TRIGGER IF NOT EXISTS notes_tombstone_au AFTER UPDATE OF deleted_at ON notes BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'note' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        SELECT 'note', new.id, new.uid, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_tombstone_ad AFTER DELETE ON notes WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        VALUES ('note', old.id, old.uid, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_tombstone_au AFTER UPDATE OF deleted_at ON folders BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'folder' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        SELECT 'folder', new.id, new.uid, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_tombstone_ad AFTER DELETE ON folders WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        VALUES ('folder', old.id, old.uid, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_tombstone_au AFTER UPDATE OF deleted_at ON attachments BEGIN
+    DELETE FROM tombstones WHERE entity_type = 'attachment' AND entity_id = new.id AND new.deleted_at IS NULL;
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        SELECT 'attachment', new.id, new.uid, new.deleted_at WHERE new.deleted_at IS NOT NULL AND old.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_tombstone_ad AFTER DELETE ON attachments WHEN old.deleted_at IS NULL BEGIN
+    INSERT OR REPLACE INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        VALUES ('attachment', old.id, old.uid, strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'));
+END;
@@ -0,0 +1,22 @@
+-- When two devices edit the same note concurrently and the edits cannot be
+-- merged, the incoming version is saved as a conflicted copy and recorded
+-- here until the user resolves it.
+
+CREATE TABLE IF NOT EXISTS note_conflicts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL,
+    copy_note_id INTEGER NOT NULL,
+    device_id TEXT,
+    base_revision INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME,
+    FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE,
+    FOREIGN KEY (copy_note_id) REFERENCES notes(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_conflicts_unresolved ON note_conflicts(resolved_at, created_at);
+
+-- Foreign keys are not enforced by default, so clean up explicitly
+CREATE TRIGGER IF NOT EXISTS note_conflicts_ad AFTER DELETE ON notes BEGIN
+    DELETE FROM note_conflicts WHERE note_id = old.id OR copy_note_id = old.id;
+END;
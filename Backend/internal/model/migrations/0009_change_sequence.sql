@@ -0,0 +1,63 @@
+-- Sync cursors: every insert or update of a note, folder, attachment or
+-- tombstone stamps the row with the next value of a server-wide change
+-- sequence. Devices ask for everything after the last sequence they saw,
+-- which unlike client timestamps is immune to clock drift.
+
+CREATE TABLE IF NOT EXISTS sync_sequence (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    value INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO sync_sequence (id, value) VALUES (1, 1);
+
+-- Existing rows all belong to the first change
+ALTER TABLE notes ADD COLUMN seq INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE folders ADD COLUMN seq INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE attachments ADD COLUMN seq INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE tombstones ADD COLUMN seq INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_notes_seq ON notes(seq);
+CREATE INDEX IF NOT EXISTS idx_folders_seq ON folders(seq);
+CREATE INDEX IF NOT EXISTS idx_attachments_seq ON attachments(seq);
+CREATE INDEX IF NOT EXISTS idx_tombstones_seq ON tombstones(seq);
+
+CREATE TRIGGER IF NOT EXISTS notes_seq_ai AFTER INSERT ON notes BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE notes SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_seq_au AFTER UPDATE ON notes WHEN new.seq IS old.seq BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE notes SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_seq_ai AFTER INSERT ON folders BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE folders SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS folders_seq_au AFTER UPDATE ON folders WHEN new.seq IS old.seq BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE folders SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_seq_ai AFTER INSERT ON attachments BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE attachments SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS attachments_seq_au AFTER UPDATE ON attachments WHEN new.seq IS old.seq BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE attachments SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS tombstones_seq_ai AFTER INSERT ON tombstones BEGIN
+    UPDATE sync_sequence SET value = value + 1;
+    UPDATE tombstones SET seq = (SELECT value FROM sync_sequence) WHERE id = new.id;
+END;
+
+-- Devices are tracked by the last change sequence they acknowledged rather
+-- than a timestamp, can be given a name, and can be revoked
+ALTER TABLE devices ADD COLUMN name TEXT;
+ALTER TABLE devices ADD COLUMN last_ack_seq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE devices ADD COLUMN revoked_at DATETIME;
+ALTER TABLE devices DROP COLUMN last_sync_at;
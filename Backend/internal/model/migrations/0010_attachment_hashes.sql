@@ -0,0 +1,7 @@
+-- Attachments record the SHA-256 of their content so a file that a device
+-- uploads twice is stored once. Hashes of existing files are computed after
+-- this runs.
+
+ALTER TABLE attachments ADD COLUMN sha256 TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_attachments_note_sha256 ON attachments(note_id, sha256);
@@ -0,0 +1,6 @@
+-- Attachment files move to a content-addressed store: one file per distinct
+-- SHA-256, shared by every attachment with that content. Existing files are
+-- moved after this runs.
+
+CREATE INDEX IF NOT EXISTS idx_attachments_sha256 ON attachments(sha256);
+CREATE INDEX IF NOT EXISTS idx_attachments_filename ON attachments(filename);
@@ -0,0 +1,2 @@
+-- Attachments used to record whatever Content-Type the client sent. Their
+-- MIME types are detected from the stored content after this runs.
@@ -0,0 +1,15 @@
+-- Resumable uploads: a large attachment is sent in chunks, each appended to
+-- a file under data/uploads/, and becomes an attachment once complete. An
+-- upload that sees no chunk for UPLOAD_EXPIRY is abandoned and removed.
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT PRIMARY KEY,
+    note_id INTEGER NOT NULL,
+    original_name TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    sha256 TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_uploads_updated_at ON uploads(updated_at);
@@ -0,0 +1,16 @@
+-- Text extracted from text-based attachments (plain text, Markdown, CSV,
+-- HTML and PDF) so search can find notes by what their attachments say.
+-- Extraction runs in the background after upload; error records why an
+-- attachment yielded no text, so it is not tried again.
+
+CREATE TABLE IF NOT EXISTS attachment_text (
+    attachment_id INTEGER PRIMARY KEY,
+    content TEXT NOT NULL DEFAULT '',
+    error TEXT,
+    extracted_at DATETIME NOT NULL,
+    FOREIGN KEY (attachment_id) REFERENCES attachments(id) ON DELETE CASCADE
+);
+
+CREATE TRIGGER IF NOT EXISTS attachment_text_ad AFTER DELETE ON attachments BEGIN
+    DELETE FROM attachment_text WHERE attachment_id = old.id;
+END;
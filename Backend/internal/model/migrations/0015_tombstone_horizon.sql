@@ -0,0 +1,10 @@
+-- Tombstones are collected once every device has acknowledged them, or
+-- once they are older than the trash retention if a device stays away. The
+-- horizon is the change sequence of the newest tombstone collected so far;
+-- devices whose cursor is older may have missed a deletion and must sync
+-- from scratch.
+
+CREATE TABLE IF NOT EXISTS tombstone_horizon (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    seq INTEGER NOT NULL
+);
@@ -0,0 +1,229 @@
+-- The schema of SQLite migrations 0001-0014 in one step. A change to the
+-- SQLite schema needs a matching migration here.
+--
+-- Triggers do what their SQLite counterparts do. Foreign keys are enforced,
+-- so cascades replace the SQLite triggers that clean up after deleted notes.
+
+CREATE SEQUENCE sync_sequence;
+
+CREATE TABLE folders (
+    id BIGSERIAL PRIMARY KEY,
+    uid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    parent_id BIGINT REFERENCES folders(id) DEFERRABLE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMPTZ,
+    seq BIGINT NOT NULL DEFAULT nextval('sync_sequence')
+);
+
+CREATE UNIQUE INDEX idx_folders_uid ON folders(uid);
+CREATE UNIQUE INDEX idx_folders_parent_name_live
+    ON folders(COALESCE(parent_id, 0), name) WHERE deleted_at IS NULL;
+CREATE INDEX idx_folders_parent ON folders(parent_id);
+CREATE INDEX idx_folders_seq ON folders(seq);
+
+CREATE TABLE notes (
+    id BIGSERIAL PRIMARY KEY,
+    uid TEXT NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    folder_id BIGINT REFERENCES folders(id) ON DELETE SET NULL,
+    order_index INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    deleted_at TIMESTAMPTZ,
+    seq BIGINT NOT NULL DEFAULT nextval('sync_sequence')
+);
+
+CREATE UNIQUE INDEX idx_notes_uid ON notes(uid);
+CREATE INDEX idx_notes_folder ON notes(folder_id);
+CREATE INDEX idx_notes_deleted_at ON notes(deleted_at);
+CREATE INDEX idx_notes_seq ON notes(seq);
+
+CREATE TABLE attachments (
+    id BIGSERIAL PRIMARY KEY,
+    uid TEXT NOT NULL,
+    note_id BIGINT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    original_name TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted_at TIMESTAMPTZ,
+    seq BIGINT NOT NULL DEFAULT nextval('sync_sequence')
+);
+
+CREATE UNIQUE INDEX idx_attachments_uid ON attachments(uid);
+CREATE INDEX idx_attachments_deleted_at ON attachments(deleted_at);
+CREATE INDEX idx_attachments_seq ON attachments(seq);
+CREATE INDEX idx_attachments_note_sha256 ON attachments(note_id, sha256);
+CREATE INDEX idx_attachments_sha256 ON attachments(sha256);
+CREATE INDEX idx_attachments_filename ON attachments(filename);
+
+CREATE TABLE note_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    note_id BIGINT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    folder_id BIGINT,
+    created_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (note_id, revision)
+);
+
+-- Tag names are unique ignoring case, like COLLATE NOCASE in SQLite;
+-- compare them with lower()
+CREATE TABLE tags (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX idx_tags_name ON tags(lower(name));
+
+CREATE TABLE note_tags (
+    note_id BIGINT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    tag_id BIGINT NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    inline BOOLEAN NOT NULL DEFAULT false,
+    PRIMARY KEY (note_id, tag_id)
+);
+
+CREATE INDEX idx_note_tags_tag ON note_tags(tag_id);
+
+CREATE TABLE tombstones (
+    id BIGSERIAL PRIMARY KEY,
+    entity_type TEXT NOT NULL,
+    entity_id BIGINT NOT NULL,
+    entity_uid TEXT,
+    deleted_at TIMESTAMPTZ NOT NULL,
+    seq BIGINT NOT NULL DEFAULT nextval('sync_sequence'),
+    UNIQUE (entity_type, entity_id)
+);
+
+CREATE INDEX idx_tombstones_deleted_at ON tombstones(deleted_at);
+CREATE INDEX idx_tombstones_uid ON tombstones(entity_type, entity_uid);
+CREATE INDEX idx_tombstones_seq ON tombstones(seq);
+
+CREATE TABLE devices (
+    id TEXT PRIMARY KEY,
+    name TEXT,
+    first_seen_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    last_ack_seq BIGINT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE note_conflicts (
+    id BIGSERIAL PRIMARY KEY,
+    note_id BIGINT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    copy_note_id BIGINT NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    device_id TEXT,
+    base_revision INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_note_conflicts_unresolved ON note_conflicts(resolved_at, created_at);
+
+CREATE TABLE uploads (
+    id TEXT PRIMARY KEY,
+    note_id BIGINT NOT NULL,
+    original_name TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_uploads_updated_at ON uploads(updated_at);
+
+CREATE TABLE attachment_text (
+    attachment_id BIGINT PRIMARY KEY REFERENCES attachments(id) ON DELETE CASCADE,
+    content TEXT NOT NULL DEFAULT '',
+    error TEXT,
+    extracted_at TIMESTAMPTZ NOT NULL
+);
+
+-- Every version of a note's title and content is kept as a revision. The
+-- copy tool brings revisions along, so it turns this off for its session.
+CREATE FUNCTION record_note_revision() RETURNS trigger AS $$
+BEGIN
+    IF current_setting('astronotes.copying', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'UPDATE' AND OLD.title IS NOT DISTINCT FROM NEW.title
+        AND OLD.content IS NOT DISTINCT FROM NEW.content THEN
+        RETURN NULL;
+    END IF;
+    INSERT INTO note_revisions (note_id, revision, title, content, folder_id, created_at)
+    VALUES (
+        NEW.id,
+        COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = NEW.id), 0) + 1,
+        NEW.title, NEW.content, NEW.folder_id, NEW.updated_at
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER note_revisions_ai AFTER INSERT ON notes
+    FOR EACH ROW EXECUTE FUNCTION record_note_revision();
+CREATE TRIGGER note_revisions_au AFTER UPDATE OF title, content ON notes
+    FOR EACH ROW EXECUTE FUNCTION record_note_revision();
+
+-- Rows get a new change sequence whenever they change, unless the update
+-- sets seq itself
+CREATE FUNCTION bump_seq() RETURNS trigger AS $$
+BEGIN
+    IF NEW.seq IS NOT DISTINCT FROM OLD.seq THEN
+        NEW.seq := nextval('sync_sequence');
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER notes_seq_bu BEFORE UPDATE ON notes
+    FOR EACH ROW EXECUTE FUNCTION bump_seq();
+CREATE TRIGGER folders_seq_bu BEFORE UPDATE ON folders
+    FOR EACH ROW EXECUTE FUNCTION bump_seq();
+CREATE TRIGGER attachments_seq_bu BEFORE UPDATE ON attachments
+    FOR EACH ROW EXECUTE FUNCTION bump_seq();
+
+-- Trashing or deleting a row leaves a tombstone for sync; restoring it
+-- removes the tombstone. TG_ARGV[0] is the entity type.
+CREATE FUNCTION record_tombstone() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.deleted_at IS NULL THEN
+            INSERT INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+            VALUES (TG_ARGV[0], OLD.id, OLD.uid, now())
+            ON CONFLICT (entity_type, entity_id) DO UPDATE
+                SET entity_uid = excluded.entity_uid, deleted_at = excluded.deleted_at, seq = nextval('sync_sequence');
+        END IF;
+        RETURN NULL;
+    END IF;
+
+    IF NEW.deleted_at IS NULL THEN
+        DELETE FROM tombstones WHERE entity_type = TG_ARGV[0] AND entity_id = NEW.id;
+    ELSIF OLD.deleted_at IS NULL THEN
+        INSERT INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        VALUES (TG_ARGV[0], NEW.id, NEW.uid, NEW.deleted_at)
+        ON CONFLICT (entity_type, entity_id) DO UPDATE
+            SET entity_uid = excluded.entity_uid, deleted_at = excluded.deleted_at, seq = nextval('sync_sequence');
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER notes_tombstone_au AFTER UPDATE OF deleted_at ON notes
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('note');
+CREATE TRIGGER notes_tombstone_ad AFTER DELETE ON notes
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('note');
+CREATE TRIGGER folders_tombstone_au AFTER UPDATE OF deleted_at ON folders
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('folder');
+CREATE TRIGGER folders_tombstone_ad AFTER DELETE ON folders
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('folder');
+CREATE TRIGGER attachments_tombstone_au AFTER UPDATE OF deleted_at ON attachments
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('attachment');
+CREATE TRIGGER attachments_tombstone_ad AFTER DELETE ON attachments
+    FOR EACH ROW EXECUTE FUNCTION record_tombstone('attachment');
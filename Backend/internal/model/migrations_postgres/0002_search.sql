@@ -0,0 +1,15 @@
+-- Full-text search over notes and the text of attachments. The 'simple'
+-- configuration does no stemming, like the unicode61 tokenizer used by
+-- SQLite's FTS5 index. Titles are weight A, content weight B.
+
+ALTER TABLE notes ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', content), 'B')
+) STORED;
+
+CREATE INDEX idx_notes_search ON notes USING GIN (search);
+
+ALTER TABLE attachment_text ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    to_tsvector('simple', content)
+) STORED;
+
+CREATE INDEX idx_attachment_text_search ON attachment_text USING GIN (search);
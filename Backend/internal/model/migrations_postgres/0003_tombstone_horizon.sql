@@ -0,0 +1,8 @@
+-- The change sequence of the newest tombstone collected so far; devices
+-- whose cursor is older may have missed a deletion and must sync from
+-- scratch
+
+CREATE TABLE tombstone_horizon (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    seq BIGINT NOT NULL
+);
@@ -0,0 +1,64 @@
+-- Change sequence numbers come from a counter row, like SQLite's, rather
+-- than a sequence. nextval() does not wait for other transactions, so a
+-- slow one could commit a change numbered below a cursor a device had
+-- already been given, and that device would never receive it. Updating the
+-- row locks it until the transaction ends, so writers take numbers one at a
+-- time and commit them in order, and the committed value is a cursor no
+-- pending change can fall behind.
+
+ALTER TABLE folders ALTER COLUMN seq DROP DEFAULT;
+ALTER TABLE notes ALTER COLUMN seq DROP DEFAULT;
+ALTER TABLE attachments ALTER COLUMN seq DROP DEFAULT;
+ALTER TABLE tombstones ALTER COLUMN seq DROP DEFAULT;
+
+CREATE TABLE sync_counter (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    value BIGINT NOT NULL
+);
+INSERT INTO sync_counter (id, value)
+    SELECT 1, CASE WHEN is_called THEN last_value ELSE 0 END FROM sync_sequence;
+
+DROP SEQUENCE sync_sequence;
+ALTER TABLE sync_counter RENAME TO sync_sequence;
+
+CREATE FUNCTION next_sync_seq() RETURNS BIGINT AS $$
+    UPDATE sync_sequence SET value = value + 1 WHERE id = 1 RETURNING value;
+$$ LANGUAGE sql;
+
+ALTER TABLE folders ALTER COLUMN seq SET DEFAULT next_sync_seq();
+ALTER TABLE notes ALTER COLUMN seq SET DEFAULT next_sync_seq();
+ALTER TABLE attachments ALTER COLUMN seq SET DEFAULT next_sync_seq();
+ALTER TABLE tombstones ALTER COLUMN seq SET DEFAULT next_sync_seq();
+
+CREATE OR REPLACE FUNCTION bump_seq() RETURNS trigger AS $$
+BEGIN
+    IF NEW.seq IS NOT DISTINCT FROM OLD.seq THEN
+        NEW.seq := next_sync_seq();
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION record_tombstone() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        IF OLD.deleted_at IS NULL THEN
+            INSERT INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+            VALUES (TG_ARGV[0], OLD.id, OLD.uid, now())
+            ON CONFLICT (entity_type, entity_id) DO UPDATE
+                SET entity_uid = excluded.entity_uid, deleted_at = excluded.deleted_at, seq = next_sync_seq();
+        END IF;
+        RETURN NULL;
+    END IF;
+
+    IF NEW.deleted_at IS NULL THEN
+        DELETE FROM tombstones WHERE entity_type = TG_ARGV[0] AND entity_id = NEW.id;
+    ELSIF OLD.deleted_at IS NULL THEN
+        INSERT INTO tombstones (entity_type, entity_id, entity_uid, deleted_at)
+        VALUES (TG_ARGV[0], NEW.id, NEW.uid, NEW.deleted_at)
+        ON CONFLICT (entity_type, entity_id) DO UPDATE
+            SET entity_uid = excluded.entity_uid, deleted_at = excluded.deleted_at, seq = next_sync_seq();
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
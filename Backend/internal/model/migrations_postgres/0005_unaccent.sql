@@ -0,0 +1,42 @@
+-- Search folds accents, as SQLite's FTS5 index does with remove_diacritics,
+-- through the astronotes configuration: 'simple' with the unaccent
+-- dictionary in front of it. unaccent ships with PostgreSQL as an
+-- extension; where it cannot be installed the configuration is plain
+-- 'simple' and accents are not folded.
+
+CREATE TEXT SEARCH CONFIGURATION astronotes (COPY = simple);
+
+DO $$
+DECLARE
+    dictionary_schema TEXT;
+BEGIN
+    BEGIN
+        CREATE EXTENSION IF NOT EXISTS unaccent;
+    EXCEPTION WHEN OTHERS THEN
+        RAISE WARNING 'search will not fold accents, unaccent is not available: %', SQLERRM;
+    END;
+
+    -- The extension may live in another schema if it was installed before
+    SELECT extnamespace::regnamespace::text INTO dictionary_schema
+    FROM pg_extension WHERE extname = 'unaccent';
+    IF dictionary_schema IS NOT NULL THEN
+        EXECUTE format(
+            'ALTER TEXT SEARCH CONFIGURATION astronotes ALTER MAPPING FOR hword, hword_part, word WITH %s.unaccent, simple',
+            dictionary_schema);
+    END IF;
+END
+$$;
+
+ALTER TABLE notes DROP COLUMN search;
+ALTER TABLE notes ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('astronotes', title), 'A') || setweight(to_tsvector('astronotes', content), 'B')
+) STORED;
+
+CREATE INDEX idx_notes_search ON notes USING GIN (search);
+
+ALTER TABLE attachment_text DROP COLUMN search;
+ALTER TABLE attachment_text ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    to_tsvector('astronotes', content)
+) STORED;
+
+CREATE INDEX idx_attachment_text_search ON attachment_text USING GIN (search);
@@ -5,10 +5,36 @@ import "time"
 // Attachment represents a file attached to a note
 type Attachment struct {
 	ID           int       `json:"id"`
+	UID          string    `json:"uid"` // Global ID, stable across devices
 	NoteID       int       `json:"note_id"`
+	NoteUID      string    `json:"note_uid,omitempty"` // Global ID of the note; used by sync
 	Filename     string    `json:"filename"`
 	OriginalName string    `json:"original_name"`
 	MimeType     string    `json:"mime_type"`
 	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"` // Hex-encoded hash of the content
 	CreatedAt    time.Time `json:"created_at"`
 }
+
+// SearchResult represents a note matched by a full-text search
+type SearchResult struct {
+	NoteID     int       `json:"note_id"`
+	Title      string    `json:"title"`
+	FolderID   *int      `json:"folder_id"`
+	FolderName *string   `json:"folder_name"`
+	Highlight  string    `json:"highlight"` // HTML-escaped title with matches in <mark>
+	Snippet    string    `json:"snippet"`   // HTML-escaped excerpt of content around the matches
+	Rank       float64   `json:"rank"`      // bm25 score, lower is better
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// The best matching attachment, if the query matched attachment text
+	Attachment *AttachmentMatch `json:"attachment,omitempty"`
+}
+
+// AttachmentMatch is an attachment whose text matched a search
+type AttachmentMatch struct {
+	ID           int    `json:"id"`
+	UID          string `json:"uid"`
+	OriginalName string `json:"original_name"`
+	Snippet      string `json:"snippet"` // HTML-escaped excerpt of the text around the matches
+}
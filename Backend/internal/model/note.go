@@ -5,19 +5,35 @@ import "time"
 // Folder represents a folder in the system
 type Folder struct {
 	ID        int       `json:"id"`
+	UID       string    `json:"uid"` // Global ID, stable across devices
 	Name      string    `json:"name"`
+	ParentID  *int      `json:"parent_id"`            // nil for top-level folders
+	ParentUID *string   `json:"parent_uid,omitempty"` // Global ID of the parent; used by sync
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// FolderNode represents a folder and its subfolders in the folder tree
+type FolderNode struct {
+	Folder
+	Path      string        `json:"path"` // Slash-separated names from the root
+	NoteCount int           `json:"note_count"`
+	Children  []*FolderNode `json:"children"`
+}
+
 // Note represents a note in the system
 type Note struct {
-	ID         int       `json:"id"`
-	Title      string    `json:"title"`
-	Content    string    `json:"content"`
-	FolderID   *int      `json:"folder_id"` // Pointer to int for nullable foreign key
-	OrderIndex int       `json:"order_index" db:"order_index"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID           int       `json:"id"`
+	UID          string    `json:"uid"` // Global ID, stable across devices
+	Title        string    `json:"title"`
+	Content      string    `json:"content"`
+	FolderID     *int      `json:"folder_id"`            // Pointer to int for nullable foreign key
+	FolderUID    *string   `json:"folder_uid,omitempty"` // Global ID of the folder; used by sync
+	OrderIndex   int       `json:"order_index" db:"order_index"`
+	Tags         []string  `json:"tags"`                    // Hashtags in content plus manual tags; nil on input keeps manual tags
+	Revision     int       `json:"revision,omitempty"`      // Current revision number; sent to sync clients
+	BaseRevision *int      `json:"base_revision,omitempty"` // Revision a sync client's edit started from
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // NoteWithFolder represents a note with its folder information
@@ -0,0 +1,237 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+//go:embed migrations_postgres/*.sql
+var postgresMigrationFiles embed.FS
+
+// Storage backends, selected by the storage setting
+const (
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// StorageConfig selects the database the stores work on
+type StorageConfig struct {
+	Backend     string // sqlite (default) or postgres
+	PostgresURL string // e.g. postgres://notes:secret@db/notes?sslmode=disable
+}
+
+// Storage is the configured storage backend
+var Storage = StorageConfig{Backend: StorageSQLite}
+
+// OpenPostgres connects to the PostgreSQL database at url and brings its
+// schema up to date
+func OpenPostgres(url string) (*sql.DB, error) {
+	db, err := ConnectPostgres(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := MigratePostgres(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ConnectPostgres connects to the PostgreSQL database at url without
+// touching the schema
+func ConnectPostgres(url string) (*sql.DB, error) {
+	if url == "" {
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	return db, nil
+}
+
+// PostgresMigrations returns the embedded PostgreSQL migrations ordered by
+// version. They are numbered on their own: 0001 creates the schema SQLite
+// reaches at its migration 0014.
+func PostgresMigrations() ([]Migration, error) {
+	return readMigrations(postgresMigrationFiles, "migrations_postgres")
+}
+
+// MigratePostgres applies all pending PostgreSQL migrations, each in its
+// own transaction. Data from an existing SQLite database is brought over by
+// CopyToPostgres, so there are no Go hooks.
+func MigratePostgres(db *sql.DB) error {
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := ensurePostgresMigrationsTable(db); err != nil {
+		return err
+	}
+	current, err := PostgresSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade the backend", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyPostgresMigration(db, m); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %v", m.Version, m.Name, err)
+		}
+		logging.Infof("Applied PostgreSQL migration %04d_%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// PostgresSchemaVersion returns the highest applied PostgreSQL migration
+// version, or 0
+func PostgresSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// GetPostgresMigrationStatus lists every PostgreSQL migration along with
+// when it was applied, like GetMigrationStatus
+func GetPostgresMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensurePostgresMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	return migrationStatus(db, migrations)
+}
+
+// ensurePostgresMigrationsTable creates the bookkeeping table if needed
+func ensurePostgresMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL
+    );`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// applyPostgresMigration runs a single migration and records it atomically
+func applyPostgresMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Without arguments the whole file is sent as one multi-statement query
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		m.Version, m.Name, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateDefaultPostgresFolders creates the folders a new SQLite database
+// starts with, if the database has no folders yet
+func CreateDefaultPostgresFolders(db *sql.DB) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM folders").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, name := range []string{"Notes", "Work", "Personal"} {
+		if _, err := db.Exec("INSERT INTO folders (uid, name) VALUES ($1, $2)", NewUID(), name); err != nil {
+			return err
+		}
+	}
+	logging.Infof("Created default folders")
+	return nil
+}
+
+// postgresQueryer runs queries written with ? placeholders, as the SQLite
+// code is, on PostgreSQL. It lets PostgresStore share helpers whose SQL is
+// otherwise the same in both databases.
+type postgresQueryer struct {
+	q Queryer
+}
+
+func (p postgresQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return p.q.Exec(rebind(query), args...)
+}
+
+func (p postgresQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return p.q.Query(rebind(query), args...)
+}
+
+func (p postgresQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return p.q.QueryRow(rebind(query), args...)
+}
+
+// rebind numbers the ? placeholders in query as $1, $2, ... A ? inside a
+// quoted string or identifier is left alone. A quote doubled to escape it
+// closes the string and opens it again, so it needs no special case.
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	var quote rune // The quote character of the string being copied, or 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CopiedTable counts the rows CopyToPostgres copied from one table. Rows
+// that refer to something that no longer exists, which SQLite does not
+// prevent, are skipped.
+type CopiedTable struct {
+	Table   string
+	Rows    int
+	Skipped int
+}
+
+// postgresCopyTable describes how one table is copied. Tables are listed
+// parents first, so foreign keys can be checked as rows go in.
+type postgresCopyTable struct {
+	table   string
+	columns string // Columns in PostgreSQL
+	selects string // Expressions for columns in SQLite; columns if empty
+	where   string // Condition leaving out orphaned rows
+}
+
+var postgresCopyTables = []postgresCopyTable{
+	{
+		table:   "folders",
+		columns: "id, uid, name, parent_id, created_at, deleted_at, seq",
+		selects: "id, uid, name, CASE WHEN parent_id IN (SELECT id FROM folders) THEN parent_id END, created_at, deleted_at, seq",
+	},
+	{
+		table:   "notes",
+		columns: "id, uid, title, content, folder_id, order_index, created_at, updated_at, deleted_at, seq",
+		selects: "id, uid, title, content, CASE WHEN folder_id IN (SELECT id FROM folders) THEN folder_id END, COALESCE(order_index, 0), created_at, updated_at, deleted_at, seq",
+	},
+	{
+		table:   "attachments",
+		columns: "id, uid, note_id, filename, original_name, mime_type, size, sha256, created_at, deleted_at, seq",
+		where:   "note_id IN (SELECT id FROM notes)",
+	},
+	{
+		table:   "note_revisions",
+		columns: "id, note_id, revision, title, content, folder_id, created_at",
+		where:   "note_id IN (SELECT id FROM notes)",
+	},
+	{
+		table:   "tags",
+		columns: "id, name, created_at",
+	},
+	{
+		table:   "note_tags",
+		columns: "note_id, tag_id, inline",
+		where:   "note_id IN (SELECT id FROM notes) AND tag_id IN (SELECT id FROM tags)",
+	},
+	{
+		table:   "tombstones",
+		columns: "id, entity_type, entity_id, entity_uid, deleted_at, seq",
+	},
+	{
+		table:   "tombstone_horizon",
+		columns: "id, seq",
+	},
+	{
+		table:   "devices",
+		columns: "id, name, first_seen_at, last_seen_at, last_ack_seq, revoked_at",
+	},
+	{
+		table:   "note_conflicts",
+		columns: "id, note_id, copy_note_id, device_id, base_revision, created_at, resolved_at",
+		where:   "note_id IN (SELECT id FROM notes) AND copy_note_id IN (SELECT id FROM notes)",
+	},
+	{
+		table:   "uploads",
+		columns: "id, note_id, original_name, size, sha256, created_at, updated_at",
+	},
+	{
+		table:   "attachment_text",
+		columns: "attachment_id, content, error, extracted_at",
+		where:   "attachment_id IN (SELECT id FROM attachments)",
+	},
+}
+
+// postgresSerialTables are the tables whose ID sequences are moved past
+// the copied IDs
+var postgresSerialTables = []string{"folders", "notes", "attachments", "note_revisions", "tags", "tombstones", "note_conflicts"}
+
+// CopyToPostgres copies everything in the SQLite database src, which must
+// be migrated to the latest version, into the PostgreSQL database dst,
+// which must be migrated and empty. IDs, global IDs, revisions and change
+// sequences are kept, so synced devices carry on where they were. It all
+// happens in one transaction on dst. Attachment files stay where they are.
+func CopyToPostgres(src Queryer, dst *sql.DB) ([]CopiedTable, error) {
+	var used bool
+	err := dst.QueryRow("SELECT EXISTS(SELECT 1 FROM notes) OR EXISTS(SELECT 1 FROM folders)").Scan(&used)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, errors.New("the PostgreSQL database already has notes or folders; copy into a new database before starting the server on it")
+	}
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Revisions are copied, so the trigger must not make new ones; a folder
+	// may be copied before its parent
+	if _, err := tx.Exec("SET LOCAL astronotes.copying = 'on'"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("SET CONSTRAINTS ALL DEFERRED"); err != nil {
+		return nil, err
+	}
+
+	var copied []CopiedTable
+	for _, t := range postgresCopyTables {
+		result, err := copyPostgresTable(src, tx, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %v", t.table, err)
+		}
+		copied = append(copied, result)
+	}
+
+	for _, table := range postgresSerialTables {
+		if err := resetPostgresSequence(tx, table); err != nil {
+			return nil, err
+		}
+	}
+
+	var seq int64
+	err = src.QueryRow("SELECT value FROM sync_sequence").Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if seq > 0 {
+		if _, err := tx.Exec("UPDATE sync_sequence SET value = $1 WHERE id = 1", seq); err != nil {
+			return nil, err
+		}
+	}
+
+	return copied, tx.Commit()
+}
+
+// copyPostgresTable copies the rows of one table
+func copyPostgresTable(src Queryer, tx *sql.Tx, t postgresCopyTable) (CopiedTable, error) {
+	result := CopiedTable{Table: t.table}
+
+	var total int
+	if err := src.QueryRow("SELECT COUNT(*) FROM " + t.table).Scan(&total); err != nil {
+		return result, err
+	}
+
+	selects := t.selects
+	if selects == "" {
+		selects = t.columns
+	}
+	query := "SELECT " + selects + " FROM " + t.table
+	if t.where != "" {
+		query += " WHERE " + t.where
+	}
+
+	rows, err := src.Query(query)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	count := len(strings.Split(t.columns, ","))
+	placeholders := make([]string, count)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	insert, err := tx.Prepare("INSERT INTO " + t.table + " (" + t.columns + ") VALUES (" + strings.Join(placeholders, ", ") + ")")
+	if err != nil {
+		return result, err
+	}
+	defer insert.Close()
+
+	values := make([]interface{}, count)
+	pointers := make([]interface{}, count)
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return result, err
+		}
+		if _, err := insert.Exec(values...); err != nil {
+			return result, err
+		}
+		result.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Skipped = total - result.Rows
+	return result, nil
+}
@@ -0,0 +1,449 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The PostgreSQL tests run against the server at ASTRONOTES_TEST_POSTGRES_URL,
+// or against a throwaway server started with initdb and pg_ctl if those are
+// on the PATH. Otherwise they are skipped. Each test gets its own schema.
+var testPostgres struct {
+	once sync.Once
+	url  string
+	dir  string // Data directory of a server the tests started
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testPostgres.dir != "" {
+		exec.Command("pg_ctl", "-D", testPostgres.dir, "-m", "immediate", "stop").Run()
+		os.RemoveAll(testPostgres.dir)
+	}
+	os.Exit(code)
+}
+
+// openTestPostgres returns a connection to an empty schema of its own,
+// dropped when the test ends
+func openTestPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	testPostgres.once.Do(func() {
+		if testPostgres.url = os.Getenv("ASTRONOTES_TEST_POSTGRES_URL"); testPostgres.url == "" {
+			testPostgres.url, testPostgres.err = startTestPostgres()
+		}
+	})
+	if testPostgres.err != nil {
+		t.Skip(testPostgres.err)
+	}
+
+	admin, err := sql.Open("postgres", testPostgres.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", withSearchPath(testPostgres.url, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if admin, err := sql.Open("postgres", testPostgres.url); err == nil {
+			admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			admin.Close()
+		}
+	})
+	return db
+}
+
+// startTestPostgres starts a server in a temporary directory, listening
+// only on a Unix socket there, and returns its connection string
+func startTestPostgres() (string, error) {
+	for _, tool := range []string{"initdb", "pg_ctl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", fmt.Errorf("set ASTRONOTES_TEST_POSTGRES_URL or put initdb and pg_ctl on the PATH to run the PostgreSQL tests")
+		}
+	}
+	current, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	// Socket paths are limited in length, so the directory is kept short
+	dir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		return "", err
+	}
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command("initdb", "-D", data, "-U", current.Username, "-A", "trust").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("initdb failed: %v\n%s", err, out)
+	}
+	options := fmt.Sprintf("-k %s -c listen_addresses=''", dir)
+	if out, err := exec.Command("pg_ctl", "-D", data, "-o", options, "-l", filepath.Join(dir, "log"), "-w", "start").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("pg_ctl start failed: %v\n%s", err, out)
+	}
+	testPostgres.dir = data
+	return fmt.Sprintf("host=%s user=%s dbname=postgres sslmode=disable", dir, current.Username), nil
+}
+
+// withSearchPath adds a search_path setting to a connection string in
+// either URL or key=value form
+func withSearchPath(conn, schema string) string {
+	if strings.HasPrefix(conn, "postgres://") || strings.HasPrefix(conn, "postgresql://") {
+		u, err := url.Parse(conn)
+		if err == nil {
+			query := u.Query()
+			query.Set("search_path", schema)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	}
+	return conn + " search_path=" + schema
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT id FROM notes WHERE id = ? AND folder_id = ?", "SELECT id FROM notes WHERE id = $1 AND folder_id = $2"},
+		{"SELECT '?' WHERE a = ?", "SELECT '?' WHERE a = $1"},
+		{"SELECT 'it''s ?', ? FROM t", "SELECT 'it''s ?', $1 FROM t"},
+		{`SELECT "odd?name" FROM t WHERE x = ?`, `SELECT "odd?name" FROM t WHERE x = $1`},
+		{"UPDATE t SET a = ?, b = 'x' WHERE c = ?", "UPDATE t SET a = $1, b = 'x' WHERE c = $2"},
+	}
+	for _, test := range tests {
+		if got := rebind(test.query); got != test.want {
+			t.Errorf("rebind(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestMigratePostgres(t *testing.T) {
+	db := openTestPostgres(t)
+
+	migrations, err := PostgresMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	statuses, err := GetPostgresMigrationStatus(db)
+	if err != nil || len(statuses) != len(migrations) || statuses[0].AppliedAt != nil {
+		t.Fatalf("GetPostgresMigrationStatus on a new database: got %+v, %v; want every migration pending", statuses, err)
+	}
+
+	// A second run finds nothing to do
+	for i := 0; i < 2; i++ {
+		if err := MigratePostgres(db); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	var version, applied int
+	if err := db.QueryRow("SELECT MAX(version), COUNT(*) FROM schema_migrations").Scan(&version, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if version != latest || applied != len(migrations) {
+		t.Errorf("schema_migrations: version %d with %d rows, want %d with %d", version, applied, latest, len(migrations))
+	}
+	if version, err := PostgresSchemaVersion(db); err != nil || version != latest {
+		t.Errorf("PostgresSchemaVersion: got %d, %v; want %d", version, err, latest)
+	}
+	statuses, err = GetPostgresMigrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("migration %04d_%s not applied", status.Version, status.Name)
+		}
+	}
+
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, 'future', now())", latest+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigratePostgres(db); err == nil {
+		t.Error("MigratePostgres on a newer schema: want an error")
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := openTestPostgres(t)
+	if err := MigratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+	AttachmentDir = t.TempDir()
+	stores := NewPostgresStore(db).Stores()
+	for name, store := range map[string]interface{}{
+		"Trash": stores.Trash, "Revisions": stores.Revisions, "Sync": stores.Sync,
+		"Text": stores.Text, "Integrity": stores.Integrity,
+	} {
+		if store == nil {
+			t.Errorf("Stores().%s is nil", name)
+		}
+	}
+
+	seq, err := stores.Sync.ChangeSeq()
+	if err != nil || seq != 0 {
+		t.Fatalf("ChangeSeq on a new database: got %d, %v; want 0", seq, err)
+	}
+
+	folder := Folder{Name: "Work"}
+	if err := stores.Folders.CreateFolder(&folder); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Folders.CreateFolder(&Folder{Name: "Work"}); err != ErrNameTaken {
+		t.Errorf("CreateFolder with a taken name: got %v, want ErrNameTaken", err)
+	}
+
+	now := time.Now().UTC()
+	note := Note{Title: "Plan", Content: "Ship it #release", FolderID: &folder.ID, CreatedAt: now, UpdatedAt: now}
+	if err := stores.Notes.CreateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	if len(note.Tags) != 1 || note.Tags[0] != "release" {
+		t.Errorf("tags after CreateNote: got %v, want [release]", note.Tags)
+	}
+	note.Content = "Ship it soon #release"
+	note.UpdatedAt = time.Now().UTC()
+	if err := stores.Notes.UpdateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stores.Notes.GetNote(note.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != note.ID || got.Content != note.Content || got.FolderID == nil || *got.FolderID != folder.ID {
+		t.Errorf("GetNote: got %+v, want %+v", got, note)
+	}
+
+	revisions, err := stores.Revisions.ListRevisions(note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision != 2 || revisions[0].Size != len(note.Content) {
+		t.Errorf("ListRevisions: got %+v, want revisions 2 and 1", revisions)
+	}
+	first, err := stores.Revisions.GetRevision(note.ID, 1)
+	if err != nil || first.Content != "Ship it #release" {
+		t.Errorf("GetRevision(1): got %q, %v", first.Content, err)
+	}
+
+	attachment := Attachment{NoteID: note.ID, Filename: "ab/abcd", OriginalName: "plan.txt", MimeType: "text/plain", Size: 4, SHA256: "abcd"}
+	if err := stores.Attachments.CreateAttachment(&attachment); err != nil {
+		t.Fatal(err)
+	}
+	attachments, err := stores.Attachments.ListAttachments(note.ID)
+	if err != nil || len(attachments) != 1 || attachments[0].UID != attachment.UID {
+		t.Errorf("ListAttachments: got %+v, %v", attachments, err)
+	}
+
+	results, err := stores.Search.SearchNotes(SearchQuery{Terms: []SearchTerm{{Text: "soon"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].NoteID != note.ID {
+		t.Errorf("SearchNotes(soon): got %+v", results)
+	}
+
+	// Accents fold as in SQLite wherever the unaccent extension is available
+	var unaccent bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'unaccent')`).Scan(&unaccent); err != nil {
+		t.Fatal(err)
+	}
+	cafe := Note{Title: "Café", CreatedAt: now, UpdatedAt: now}
+	if err := stores.Notes.CreateNote(&cafe); err != nil {
+		t.Fatal(err)
+	}
+	results, err = stores.Search.SearchNotes(SearchQuery{Terms: []SearchTerm{{Text: "cafe"}}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unaccent {
+		t.Log("unaccent is not installed; accents are not folded")
+	} else if len(results) != 1 || results[0].NoteID != cafe.ID {
+		t.Errorf("SearchNotes(cafe): got %+v, want Café with its accent folded", results)
+	}
+
+	// Trashing leaves a tombstone for devices; restoring takes it back
+	before, err := stores.Sync.ChangeSeq()
+	if err != nil || before == 0 {
+		t.Fatalf("ChangeSeq after changes: got %d, %v", before, err)
+	}
+	if _, _, err := stores.Folders.TrashFolder(folder.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := stores.Sync.ChangesSince(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Tombstones) != 2 {
+		t.Errorf("tombstones after trashing a folder with a note: got %+v, want 2", changes.Tombstones)
+	}
+	deleted, err := stores.Sync.HasTombstone("note", 0, note.UID)
+	if err != nil || !deleted {
+		t.Errorf("HasTombstone(note): got %v, %v; want true", deleted, err)
+	}
+	trash, err := stores.Trash.ListTrash()
+	if err != nil || len(trash) != 2 {
+		t.Errorf("ListTrash: got %+v, %v; want the folder and the note", trash, err)
+	}
+
+	if err := stores.Trash.RestoreNote(note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Folders.GetFolder(folder.ID); err != nil {
+		t.Errorf("folder of a restored note: %v", err)
+	}
+	if deleted, _ := stores.Sync.HasTombstone("note", 0, note.UID); deleted {
+		t.Error("restored note still has a tombstone")
+	}
+
+	if err := stores.Sync.RecordDeviceSync("phone", "Phone", 1); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := stores.Sync.ListDevices()
+	if err != nil || len(devices) != 1 || devices[0].Name == nil || *devices[0].Name != "Phone" {
+		t.Errorf("ListDevices: got %+v, %v", devices, err)
+	}
+
+	if _, err := stores.Notes.GetNote("0"); err != ErrNotFound {
+		t.Errorf("GetNote of a missing note: got %v, want ErrNotFound", err)
+	}
+	if err := stores.Notes.TrashNote(note.ID); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := stores.Trash.PurgeTrash(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged.Notes != 1 || purged.Attachments != 1 {
+		t.Errorf("PurgeTrash: got %+v, want the note and its attachment", purged)
+	}
+}
+
+// TestPostgresChangeSeq checks that a change does not count towards the
+// cursor until it commits, and that writers wait for each other, so none
+// commits a change below a cursor already handed out
+func TestPostgresChangeSeq(t *testing.T) {
+	db := openTestPostgres(t)
+	if err := MigratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+	stores := NewPostgresStore(db).Stores()
+
+	folder := Folder{Name: "Work"}
+	if err := stores.Folders.CreateFolder(&folder); err != nil {
+		t.Fatal(err)
+	}
+	before, err := stores.Sync.ChangeSeq()
+	if err != nil || before == 0 {
+		t.Fatalf("ChangeSeq: got %d, %v", before, err)
+	}
+
+	slow, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Rollback()
+	if _, err := slow.Exec("UPDATE folders SET name = 'Slow' WHERE id = $1", folder.ID); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := stores.Sync.ChangeSeq(); err != nil || seq != before {
+		t.Errorf("ChangeSeq with a change pending: got %d, %v; want %d", seq, err, before)
+	}
+
+	fast, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Rollback()
+	if _, err := fast.Exec("SET LOCAL lock_timeout = '200ms'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fast.Exec("INSERT INTO folders (uid, name) VALUES ($1, 'Fast')", NewUID()); err == nil {
+		t.Error("a second writer took a change number while the first had not committed")
+	}
+	fast.Rollback()
+
+	if err := slow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := stores.Sync.ChangeSeq(); err != nil || seq != before+1 {
+		t.Errorf("ChangeSeq after commit: got %d, %v; want %d", seq, err, before+1)
+	}
+}
+
+func TestCopyToPostgres(t *testing.T) {
+	db := openTestPostgres(t)
+	if err := MigratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+
+	source := openTestSQLite(t)
+	now := time.Now().UTC()
+	note := Note{Title: "Copied", Content: "Moves house #move", CreatedAt: now, UpdatedAt: now}
+	if err := source.Notes.CreateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	note.Content = "Moved house #move"
+	if err := source.Notes.UpdateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	seq, err := source.Sync.ChangeSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := CopyToPostgres(DB, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != len(postgresCopyTables) {
+		t.Errorf("CopyToPostgres copied %d tables, want %d", len(copied), len(postgresCopyTables))
+	}
+
+	stores := NewPostgresStore(db).Stores()
+	got, err := stores.Notes.GetNote(note.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != note.ID || got.Content != note.Content || len(got.Tags) != 1 {
+		t.Errorf("copied note: got %+v, want %+v", got, note)
+	}
+	revisions, err := stores.Revisions.ListRevisions(note.ID)
+	if err != nil || len(revisions) != 2 {
+		t.Errorf("copied revisions: got %+v, %v; want 2", revisions, err)
+	}
+	if copiedSeq, err := stores.Sync.ChangeSeq(); err != nil || copiedSeq != seq {
+		t.Errorf("ChangeSeq after copy: got %d, %v; want %d", copiedSeq, err, seq)
+	}
+
+	// New rows get IDs after the copied ones
+	folder := Folder{Name: "After the copy"}
+	if err := stores.Folders.CreateFolder(&folder); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CopyToPostgres(DB, db); err == nil {
+		t.Error("CopyToPostgres into a used database: want an error")
+	}
+}
@@ -0,0 +1,145 @@
+package model
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Quotas limit how much a vault may store. A zero limit means unlimited.
+// MaxAttachmentSize, the limit on a single file, is set separately. Both
+// are set from the configuration at startup.
+var Quotas = QuotaLimits{MaxAttachmentBytes: MaxAttachmentSize}
+
+// QuotaLimits are the configured quotas, in bytes where they are sizes
+type QuotaLimits struct {
+	MaxNoteBytes          int64 `json:"max_note_bytes"`           // MAX_NOTE_KB
+	MaxAttachmentBytes    int64 `json:"max_attachment_bytes"`     // MAX_ATTACHMENT_MB
+	MaxStorageBytes       int64 `json:"max_storage_bytes"`        // MAX_STORAGE_MB, all attachment files together
+	MaxAttachmentsPerNote int64 `json:"max_attachments_per_note"` // MAX_ATTACHMENTS_PER_NOTE
+}
+
+// Usage is how much of each quota is in use. Attachment bytes count every
+// stored file once, however many attachments share it, and include files
+// of attachments in the trash.
+type Usage struct {
+	Notes           int64       `json:"notes"`
+	NoteBytes       int64       `json:"note_bytes"`
+	LargestNote     int64       `json:"largest_note_bytes"`
+	Attachments     int64       `json:"attachments"`
+	AttachmentBytes int64       `json:"attachment_bytes"`
+	MostAttachments int64       `json:"most_attachments_per_note"`
+	Limits          QuotaLimits `json:"limits"`
+}
+
+// Quota names reported in a QuotaError
+const (
+	QuotaNoteSize           = "note_size"
+	QuotaAttachmentSize     = "attachment_size"
+	QuotaStorage            = "storage"
+	QuotaAttachmentsPerNote = "attachments_per_note"
+)
+
+// QuotaError is returned when a write would exceed a quota
+type QuotaError struct {
+	Quota string `json:"quota"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`  // In use before the write
+	Asked int64  `json:"asked"` // What the write needed
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Quota {
+	case QuotaNoteSize:
+		return fmt.Sprintf("note content is %d bytes, the limit is %d", e.Asked, e.Limit)
+	case QuotaAttachmentSize:
+		return fmt.Sprintf("file is %d bytes, the limit is %d", e.Asked, e.Limit)
+	case QuotaStorage:
+		return fmt.Sprintf("storage quota exceeded: %d of %d bytes used, %d more needed", e.Used, e.Limit, e.Asked)
+	default:
+		return fmt.Sprintf("note already has %d of %d attachments", e.Used, e.Limit)
+	}
+}
+
+// Status is the HTTP status for the error: 413 when the item itself is too
+// large, 507 when the vault has no room left for it
+func (e *QuotaError) Status() int {
+	if e.Quota == QuotaNoteSize || e.Quota == QuotaAttachmentSize {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInsufficientStorage
+}
+
+// CheckNoteSize returns a QuotaError if note content is over MAX_NOTE_KB
+func CheckNoteSize(content string) error {
+	if Quotas.MaxNoteBytes > 0 && int64(len(content)) > Quotas.MaxNoteBytes {
+		return &QuotaError{Quota: QuotaNoteSize, Limit: Quotas.MaxNoteBytes, Asked: int64(len(content))}
+	}
+	return nil
+}
+
+// CheckAttachmentQuota returns a QuotaError if attaching a file with the
+// given hash and size to a note would exceed a quota. Content the server
+// already stores takes no extra space; sum may be empty if it is not known.
+func CheckAttachmentQuota(stores Stores, noteID int, sum string, size int64) error {
+	if size > MaxAttachmentSize {
+		return &QuotaError{Quota: QuotaAttachmentSize, Limit: MaxAttachmentSize, Asked: size}
+	}
+
+	if Quotas.MaxAttachmentsPerNote > 0 {
+		attachments, err := stores.Attachments.ListAttachments(noteID)
+		if err != nil {
+			return err
+		}
+		if count := int64(len(attachments)); count >= Quotas.MaxAttachmentsPerNote {
+			return &QuotaError{Quota: QuotaAttachmentsPerNote, Limit: Quotas.MaxAttachmentsPerNote, Used: count, Asked: 1}
+		}
+	}
+
+	if Quotas.MaxStorageBytes > 0 && (sum == "" || !BlobExists(sum)) {
+		used, err := stores.Usage.StorageUsed()
+		if err != nil {
+			return err
+		}
+		if used+size > Quotas.MaxStorageBytes {
+			return &QuotaError{Quota: QuotaStorage, Limit: Quotas.MaxStorageBytes, Used: used, Asked: size}
+		}
+	}
+	return nil
+}
+
+// StorageUsed returns the bytes taken by attachment files, counting each
+// stored file once
+func (s *sqlStore) StorageUsed() (int64, error) {
+	var used int64
+	err := s.q.QueryRow(`
+		SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT MAX(size) AS size FROM attachments GROUP BY filename
+		) AS files`).Scan(&used)
+	return used, err
+}
+
+// Usage reports how much the vault stores against its quotas
+func (s *sqlStore) Usage() (Usage, error) {
+	usage := Usage{Limits: Quotas}
+	err := s.q.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(octet_length(content)), 0),
+			COALESCE(MAX(octet_length(content)), 0)
+		FROM notes WHERE deleted_at IS NULL`,
+	).Scan(&usage.Notes, &usage.NoteBytes, &usage.LargestNote)
+	if err != nil {
+		return usage, err
+	}
+
+	err = s.q.QueryRow(`
+		SELECT COALESCE(SUM(per_note), 0), COALESCE(MAX(per_note), 0) FROM (
+			SELECT COUNT(*) AS per_note FROM attachments
+			WHERE deleted_at IS NULL
+			GROUP BY note_id
+		) AS notes`).Scan(&usage.Attachments, &usage.MostAttachments)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.AttachmentBytes, err = s.StorageUsed()
+	return usage, err
+}
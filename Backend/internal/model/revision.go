@@ -0,0 +1,168 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Revision represents a saved version of a note
+type Revision struct {
+	ID        int       `json:"id"`
+	NoteID    int       `json:"note_id"`
+	Revision  int       `json:"revision"` // Sequential per note, starting at 1
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	FolderID  *int      `json:"folder_id"`
+	Size      int       `json:"size,omitempty"` // Length of Content, in listings without it
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevisionPolicy controls how many revisions are kept per note.
+// The zero value keeps every revision.
+type RevisionPolicy struct {
+	KeepLast  int           // Keep at most this many revisions per note (0 = no limit)
+	ThinAfter time.Duration // Older revisions are reduced to one per day (0 = never)
+}
+
+// Revisions is the retention policy applied after every note change
+var Revisions RevisionPolicy
+
+// Queryer is implemented by both *sql.DB and *sql.Tx
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// PruneRevisions applies the retention policy to one note's history.
+// The newest revision is always kept.
+func PruneRevisions(q Queryer, noteID int, policy RevisionPolicy) error {
+	if policy.KeepLast == 0 && policy.ThinAfter == 0 {
+		return nil
+	}
+
+	rows, err := q.Query("SELECT revision, created_at FROM note_revisions WHERE note_id = ? ORDER BY revision DESC", noteID)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-policy.ThinAfter)
+	keptDays := make(map[string]bool)
+	var drop []interface{}
+
+	for i := 0; rows.Next(); i++ {
+		var revision int
+		var createdAt time.Time
+		if err := rows.Scan(&revision, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if i == 0 {
+			continue
+		}
+		if policy.KeepLast > 0 && i >= policy.KeepLast {
+			drop = append(drop, revision)
+			continue
+		}
+		if policy.ThinAfter > 0 && createdAt.Before(cutoff) {
+			// Rows are newest first, so the first one seen per day is kept
+			day := createdAt.Format("2006-01-02")
+			if keptDays[day] {
+				drop = append(drop, revision)
+			} else {
+				keptDays[day] = true
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(drop) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(drop)), ",")
+	args := append([]interface{}{noteID}, drop...)
+	_, err = q.Exec("DELETE FROM note_revisions WHERE note_id = ? AND revision IN ("+placeholders+")", args...)
+	return err
+}
+
+// ListRevisions returns a note's revisions, newest first, with their Size
+// instead of their Content
+func (s *sqlStore) ListRevisions(noteID int) ([]Revision, error) {
+	rows, err := s.q.Query(
+		"SELECT id, note_id, revision, title, folder_id, LENGTH(content), created_at FROM note_revisions WHERE note_id = ? ORDER BY revision DESC",
+		noteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var r Revision
+		if err := rows.Scan(&r.ID, &r.NoteID, &r.Revision, &r.Title, &r.FolderID, &r.Size, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// GetRevision loads a single revision of a note
+func (s *sqlStore) GetRevision(noteID, revision int) (Revision, error) {
+	var r Revision
+	err := s.q.QueryRow(
+		"SELECT id, note_id, revision, title, content, folder_id, created_at FROM note_revisions WHERE note_id = ? AND revision = ?",
+		noteID, revision,
+	).Scan(&r.ID, &r.NoteID, &r.Revision, &r.Title, &r.Content, &r.FolderID, &r.CreatedAt)
+	return r, notFound(err)
+}
+
+// PreviousRevision returns the newest revision before the given one that
+// is still kept, or 0
+func (s *sqlStore) PreviousRevision(noteID, revision int) (int, error) {
+	var previous int
+	err := s.q.QueryRow(
+		"SELECT COALESCE(MAX(revision), 0) FROM note_revisions WHERE note_id = ? AND revision < ?",
+		noteID, revision,
+	).Scan(&previous)
+	return previous, err
+}
+
+// PruneAllRevisions applies the retention policy to every note. Thinning
+// depends on age, so this also needs to run for notes that are not edited.
+func (s *sqlStore) PruneAllRevisions(policy RevisionPolicy) error {
+	if policy.KeepLast == 0 && policy.ThinAfter == 0 {
+		return nil
+	}
+
+	noteIDs, err := scanInts(s.q.Query("SELECT DISTINCT note_id FROM note_revisions"))
+	if err != nil {
+		return err
+	}
+	for _, noteID := range noteIDs {
+		if err := PruneRevisions(s.q, noteID, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRevisionPruner periodically applies the retention policy in the background
+func StartRevisionPruner(revisions RevisionStore, interval time.Duration) {
+	go func() {
+		for {
+			if err := revisions.PruneAllRevisions(Revisions); err != nil {
+				logging.Errorf("Error pruning note revisions: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,187 @@
+package model
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Search queries mark matches with these control characters rather than
+// HTML, so the surrounding text can be escaped before the marks are added
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// SearchTerm is one term of a search: a word or a quoted phrase, all of
+// which must match
+type SearchTerm struct {
+	Text   string
+	Prefix bool // Term ended in *; its last word may be the start of a longer one
+}
+
+// SearchQuery is a full-text search over notes and the text of their
+// attachments
+type SearchQuery struct {
+	Terms    []SearchTerm
+	FolderID *int // Only notes in this folder
+	Limit    int
+	Offset   int
+}
+
+// NoteSearcher runs full-text searches. Results are best first; a note is
+// returned once, with its best matching attachment.
+type NoteSearcher interface {
+	SearchNotes(query SearchQuery) ([]SearchResult, error)
+}
+
+// ParseSearchTerms splits user input into terms. "quoted text" is a phrase
+// and a trailing * makes a prefix term. Terms without a letter or digit are
+// dropped, so an empty result means there is nothing to search for.
+func ParseSearchTerms(input string) []SearchTerm {
+	var terms []SearchTerm
+	var current strings.Builder
+	inPhrase := false
+
+	flush := func(prefix bool) {
+		term := strings.TrimSpace(current.String())
+		current.Reset()
+		if hasSearchableRune(term) {
+			terms = append(terms, SearchTerm{Text: term, Prefix: prefix})
+		}
+	}
+
+	for _, r := range input {
+		switch {
+		case r == '"':
+			flush(false)
+			inPhrase = !inPhrase
+		case unicode.IsSpace(r) && !inPhrase:
+			flush(false)
+		case r == '*' && !inPhrase:
+			flush(true)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush(false)
+
+	return terms
+}
+
+// hasSearchableRune reports whether s contains a letter or digit
+func hasSearchableRune(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================
+// SQLITE
+// ============================================================================
+
+// SearchNotes searches the FTS5 index. Title matches weigh more than content
+// matches, which weigh more than matches in attachments.
+func (s *SQLiteStore) SearchNotes(query SearchQuery) ([]SearchResult, error) {
+	match := ftsMatchQuery(query.Terms)
+	sqlQuery := `
+		WITH note_matches AS (
+			SELECT rowid AS note_id,
+				highlight(notes_fts, 0, char(2), char(3)) AS highlight,
+				snippet(notes_fts, 1, char(2), char(3), '…', 16) AS snippet,
+				bm25(notes_fts, 10.0, 1.0) AS rank
+			FROM notes_fts
+			WHERE notes_fts MATCH ?
+		),
+		attachment_matches AS (
+			SELECT a.note_id, a.id, a.uid, a.original_name,
+				snippet(attachments_fts, 0, char(2), char(3), '…', 16) AS snippet,
+				bm25(attachments_fts) * 0.5 AS rank
+			FROM attachments_fts
+			JOIN attachments a ON a.id = attachments_fts.rowid
+			WHERE attachments_fts MATCH ? AND a.deleted_at IS NULL
+		),
+		best_attachments AS (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY note_id ORDER BY rank, id) AS position
+			FROM attachment_matches
+		)
+		SELECT n.id, n.title, n.folder_id, f.name, n.updated_at,
+			COALESCE(nm.highlight, n.title), COALESCE(nm.snippet, ''),
+			MIN(COALESCE(nm.rank, 0), COALESCE(ba.rank, 0)) AS rank,
+			ba.id, ba.uid, ba.original_name, ba.snippet
+		FROM notes n
+		LEFT JOIN note_matches nm ON nm.note_id = n.id
+		LEFT JOIN best_attachments ba ON ba.note_id = n.id AND ba.position = 1
+		LEFT JOIN folders f ON f.id = n.folder_id
+		WHERE (nm.note_id IS NOT NULL OR ba.note_id IS NOT NULL) AND n.deleted_at IS NULL`
+	args := []interface{}{match, match}
+
+	if query.FolderID != nil {
+		sqlQuery += " AND n.folder_id = ?"
+		args = append(args, *query.FolderID)
+	}
+
+	sqlQuery += " ORDER BY rank LIMIT ? OFFSET ?"
+	args = append(args, query.Limit, query.Offset)
+
+	return scanSearchResults(s.q, sqlQuery, args...)
+}
+
+// ftsMatchQuery turns terms into a safe FTS5 MATCH expression. Every term
+// is quoted so FTS5 operators in the input are treated as text.
+func ftsMatchQuery(terms []SearchTerm) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term.Text, `"`, `""`) + `"`
+		if term.Prefix {
+			quoted[i] += "*"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// scanSearchResults runs a search query returning note and attachment
+// columns in the order SearchNotes selects them
+func scanSearchResults(q Queryer, query string, args ...interface{}) ([]SearchResult, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		var attachmentID *int
+		var attachmentUID, attachmentName, attachmentSnippet *string
+		err := rows.Scan(&result.NoteID, &result.Title, &result.FolderID, &result.FolderName, &result.UpdatedAt,
+			&result.Highlight, &result.Snippet, &result.Rank,
+			&attachmentID, &attachmentUID, &attachmentName, &attachmentSnippet)
+		if err != nil {
+			return nil, err
+		}
+		result.Highlight = markMatches(result.Highlight)
+		result.Snippet = markMatches(result.Snippet)
+		if attachmentID != nil {
+			result.Attachment = &AttachmentMatch{
+				ID:           *attachmentID,
+				UID:          *attachmentUID,
+				OriginalName: *attachmentName,
+				Snippet:      markMatches(*attachmentSnippet),
+			}
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// markMatches HTML-escapes text from a search query and turns its match
+// markers into <mark> tags
+func markMatches(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, matchStart, "<mark>")
+	return strings.ReplaceAll(text, matchEnd, "</mark>")
+}
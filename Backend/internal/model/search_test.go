@@ -0,0 +1,64 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchTerms(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []SearchTerm
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"report", []SearchTerm{{Text: "report"}}},
+		{"quarterly  report", []SearchTerm{{Text: "quarterly"}, {Text: "report"}}},
+		{"gro*", []SearchTerm{{Text: "gro", Prefix: true}}},
+		{`"every region" sales`, []SearchTerm{{Text: "every region"}, {Text: "sales"}}},
+		{`"unclosed phrase`, []SearchTerm{{Text: "unclosed phrase"}}},
+		{`"a*b"`, []SearchTerm{{Text: "a*b"}}},
+		{"café 2024", []SearchTerm{{Text: "café"}, {Text: "2024"}}},
+		{`- * "" AND( ) OR`, []SearchTerm{{Text: "AND("}, {Text: "OR"}}},
+		{`title:x NEAR(a b)`, []SearchTerm{{Text: "title:x"}, {Text: "NEAR(a"}, {Text: "b)"}}},
+	}
+	for _, tt := range tests {
+		if got := ParseSearchTerms(tt.input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSearchTerms(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+// TestFTSMatchQuery checks that FTS5 syntax in the input stays text
+func TestFTSMatchQuery(t *testing.T) {
+	tests := []struct {
+		terms []SearchTerm
+		want  string
+	}{
+		{[]SearchTerm{{Text: "report"}}, `"report"`},
+		{[]SearchTerm{{Text: "every region"}, {Text: "gro", Prefix: true}}, `"every region" "gro"*`},
+		{[]SearchTerm{{Text: `say "hi"`}}, `"say ""hi"""`},
+		{[]SearchTerm{{Text: "NEAR(a"}, {Text: "title:x"}, {Text: "OR"}}, `"NEAR(a" "title:x" "OR"`},
+	}
+	for _, tt := range tests {
+		if got := ftsMatchQuery(tt.terms); got != tt.want {
+			t.Errorf("ftsMatchQuery(%+v) = %s, want %s", tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestMarkMatches(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"plain", "plain"},
+		{"a " + matchStart + "match" + matchEnd + " here", "a <mark>match</mark> here"},
+		{matchStart + "<script>" + matchEnd + `alert("x")&`, "<mark>&lt;script&gt;</mark>alert(&#34;x&#34;)&amp;"},
+		{"<mark>not ours</mark>", "&lt;mark&gt;not ours&lt;/mark&gt;"},
+	}
+	for _, tt := range tests {
+		if got := markMatches(tt.text); got != tt.want {
+			t.Errorf("markMatches(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The stores are the storage layer behind every endpoint. SQLiteStore keeps
+// everything in the database opened by InitDB and PostgresStore in one
+// opened by OpenPostgres; MemoryStore keeps it in memory, for tests and for
+// embedding the backend without a data directory. The note, folder and
+// attachment stores only deal with live rows: anything in the trash is
+// reported as ErrNotFound.
+
+// ErrNotFound is returned for notes, folders and attachments that do not
+// exist or are in the trash
+var ErrNotFound = errors.New("not found")
+
+// ErrNameTaken is returned when a folder would get the name of a sibling
+var ErrNameTaken = errors.New("a folder with this name already exists here")
+
+// ErrFolderCycle is returned when a folder would be moved into itself or
+// one of its subfolders
+var ErrFolderCycle = errors.New("a folder cannot be moved into its own subtree")
+
+// FolderNotEmptyError is returned by TrashFolder for a folder that still
+// has notes or subfolders and was not trashed recursively
+type FolderNotEmptyError struct {
+	Notes      int
+	Subfolders int
+}
+
+func (e *FolderNotEmptyError) Error() string {
+	return fmt.Sprintf("folder contains %d notes and %d subfolders", e.Notes, e.Subfolders)
+}
+
+// NoteFilter selects the notes returned by ListNotes
+type NoteFilter struct {
+	FolderID *int     // Only notes in this folder, listed in folder order
+	Tags     []string // Only notes carrying all of these tags
+}
+
+// NoteStore stores notes and their tags
+type NoteStore interface {
+	// ListNotes returns the notes matching filter, with their tags. Notes
+	// of a folder come highest order_index first, all notes lowest first.
+	ListNotes(filter NoteFilter) ([]Note, error)
+
+	// GetNote returns a note by its integer or global ID, with its tags
+	GetNote(ref string) (Note, error)
+
+	// CreateNote inserts a note as given, with the ID, order and timestamps
+	// it carries; a zero ID is assigned by the store and an empty UID gets a
+	// new one. It fills in the ID, UID and tags. The rules for what those
+	// should be are in service.NotesService.
+	CreateNote(note *Note) error
+
+	// UpdateNote saves a note's title, content, folder, order and
+	// UpdatedAt, and fills in its tags. Tags follow SetNoteTags.
+	UpdateNote(note *Note) error
+
+	// MaxOrderIndex returns the highest order_index in a folder, or at the
+	// top level for a nil folderID, and 0 for an empty folder
+	MaxOrderIndex(folderID *int) (int, error)
+
+	// TrashNote moves a note to the trash
+	TrashNote(id int) error
+
+	// ReorderNotes sets the order_index of notes in a folder; notes that
+	// are not in the folder are left alone
+	ReorderNotes(folderID int, order map[int]int) error
+}
+
+// FolderStore stores folders
+type FolderStore interface {
+	// ListFolders returns all folders, oldest first
+	ListFolders() ([]Folder, error)
+
+	// GetFolder returns a folder by its ID
+	GetFolder(id int) (Folder, error)
+
+	// CreateFolder adds a folder with the ID, UID and CreatedAt it
+	// carries; zero ones are filled in by the store
+	CreateFolder(folder *Folder) error
+
+	// RenameFolder changes a folder's name and returns the folder
+	RenameFolder(id int, name string) (Folder, error)
+
+	// MoveFolder puts a folder under parentID, or at the top level for a
+	// nil parentID, with the given name, and returns the folder. It
+	// returns ErrFolderCycle if parentID is the folder or inside it.
+	MoveFolder(id int, parentID *int, name string) (Folder, error)
+
+	// CountFolderNotes returns the number of live notes in each folder
+	// that has any
+	CountFolderNotes() (map[int]int, error)
+
+	// TrashFolder moves a folder to the trash and returns how many folders
+	// and notes went with it. Unless recursive is set, the folder must be
+	// empty.
+	TrashFolder(id int, recursive bool) (folders, notes int, err error)
+}
+
+// AttachmentStore stores the records of attachments. Their content is in
+// the blob store either way.
+type AttachmentStore interface {
+	// ListAttachments returns the attachments of a note, newest first
+	ListAttachments(noteID int) ([]Attachment, error)
+
+	// GetAttachment returns an attachment by its integer or global ID,
+	// with the global ID of its note
+	GetAttachment(ref string) (Attachment, error)
+
+	// CreateAttachment records an attachment, filling in its ID, and its
+	// UID and CreatedAt unless it carries them
+	CreateAttachment(attachment *Attachment) error
+
+	// UpdateAttachment saves an attachment's name and note
+	UpdateAttachment(attachment *Attachment) error
+
+	// TrashAttachment moves an attachment to the trash
+	TrashAttachment(id int) error
+}
+
+// Blob is what the attachments using a blob record about it
+type Blob struct {
+	SHA256   string
+	Size     int64
+	MimeType string
+	Refs     int // Attachments using it, live or trashed
+}
+
+// BlobStore tells which attachments use the files in the blob store
+type BlobStore interface {
+	// FindBlob returns the blob with the given SHA-256, or ErrNotFound if
+	// no attachment uses it
+	FindBlob(sum string) (Blob, error)
+
+	// FileInUse reports whether an attachment, live or trashed, uses a file
+	FileInUse(filename string) (bool, error)
+}
+
+// UsageStore reports how much the vault stores, for the quotas
+type UsageStore interface {
+	// Usage reports the use of every quota; see Usage
+	Usage() (Usage, error)
+
+	// StorageUsed returns the bytes taken by attachment files, counting
+	// each stored file once
+	StorageUsed() (int64, error)
+}
+
+// TagStore lists and respells tags. Tags are set on notes through the
+// NoteStore.
+type TagStore interface {
+	// ListTags returns the tags of live notes with how many notes carry
+	// each, by name or, with byCount, most used first
+	ListTags(byCount bool) ([]Tag, error)
+
+	// TaggedNotes returns the IDs of live notes carrying any of the tags
+	TaggedNotes(names []string) ([]int, error)
+
+	// SpellTag makes name the spelling of the tag it names, ignoring case
+	SpellTag(name string) error
+}
+
+// UploadStore keeps track of resumable uploads. The data received is in
+// UploadDir either way.
+type UploadStore interface {
+	// CreateUpload records an upload, setting its CreatedAt and UpdatedAt
+	CreateUpload(upload *Upload) error
+
+	// GetUpload returns an upload with the bytes received so far, or
+	// ErrNotFound
+	GetUpload(id string) (Upload, error)
+
+	// TouchUpload keeps an upload from expiring
+	TouchUpload(id string) error
+
+	// DeleteUpload forgets an upload; see RemoveUpload
+	DeleteUpload(id string) error
+
+	// ExpiredUploads returns the uploads that received nothing since before
+	ExpiredUploads(before time.Time) ([]string, error)
+}
+
+// TrashStore lists, restores and purges what is in the trash
+type TrashStore interface {
+	// ListTrash returns the trashed notes, folders and attachments, most
+	// recently deleted first
+	ListTrash() ([]TrashItem, error)
+
+	// RestoreNote takes a note out of the trash, and its folder if needed.
+	// It returns ErrNotFound if the note is not in the trash.
+	RestoreNote(id int) error
+
+	// RestoreFolder takes a folder out of the trash with the subfolders
+	// and notes trashed along with it, and its parents if needed. It
+	// returns ErrNameTaken if a live sibling has its name.
+	RestoreFolder(id int) error
+
+	// RestoreAttachment takes an attachment out of the trash, and its note
+	// if needed
+	RestoreAttachment(id int) error
+
+	// PurgeTrash permanently removes what was trashed at or before the
+	// given time; see PurgeResult
+	PurgeTrash(before time.Time) (PurgeResult, error)
+}
+
+// RevisionStore reads the revisions kept of every note
+type RevisionStore interface {
+	// ListRevisions returns a note's revisions, newest first, with their
+	// Size instead of their Content
+	ListRevisions(noteID int) ([]Revision, error)
+
+	// GetRevision returns one revision, or ErrNotFound
+	GetRevision(noteID, revision int) (Revision, error)
+
+	// PreviousRevision returns the newest revision before the given one
+	// that is still kept, or 0 if there is none
+	PreviousRevision(noteID, revision int) (int, error)
+
+	// PruneAllRevisions applies a retention policy to every note
+	PruneAllRevisions(policy RevisionPolicy) error
+}
+
+// Changes are what a device is sent by a sync: everything live that
+// changed after its cursor, and the deletions recorded after it
+type Changes struct {
+	Folders     []Folder
+	Notes       []Note
+	Attachments []Attachment
+	Tombstones  []Tombstone
+}
+
+// SyncStore keeps what device sync needs besides the other stores: the
+// change sequence, tombstones, conflicts and the devices themselves. Items
+// are told apart by kind, "note", "folder" or "attachment".
+type SyncStore interface {
+	// ChangeSeq returns the sequence number of the latest change
+	ChangeSeq() (int64, error)
+
+	// ChangesSince returns the changes recorded after cursor, oldest first
+	ChangesSince(cursor int64) (Changes, error)
+
+	// FindID returns the ID of an item, live or trashed, by its global ID,
+	// or checks an integer ID if uid is empty. It returns ErrNotFound if
+	// there is no such item.
+	FindID(kind, uid string, id int) (int, error)
+
+	// FindLegacyID returns id if the server has an item with that integer
+	// ID created at createdAt, to the second, and ErrNotFound otherwise.
+	// It matches items sent by clients without global IDs: a device may
+	// have created an item offline under an ID the server gave another.
+	FindLegacyID(kind string, id int, createdAt time.Time) (int, error)
+
+	// SyncedNote returns a note whether or not it is in the trash, with
+	// its current revision number, and whether it is in the trash
+	SyncedNote(id int) (Note, bool, error)
+
+	// HasTombstone reports whether an item has been deleted, by global ID
+	// if uid is set and by integer ID otherwise
+	HasTombstone(kind string, id int, uid string) (bool, error)
+
+	// HasLegacyTombstone reports whether an item with this integer ID was
+	// deleted after createdAt, so may be the one a client without global
+	// IDs sent
+	HasLegacyTombstone(kind string, id int, createdAt time.Time) (bool, error)
+
+	// TrashNoteBefore moves a note to the trash unless it was changed
+	// after deletedAt
+	TrashNoteBefore(id int, deletedAt time.Time) error
+
+	// TombstoneHorizon returns the change sequence up to which tombstones
+	// have been collected; see TombstoneHorizon
+	TombstoneHorizon() (int64, error)
+
+	// CollectTombstones removes tombstones every device has received, and
+	// those of deletions made at or before the given time; see
+	// CollectTombstones
+	CollectTombstones(before time.Time) (int, error)
+
+	// ListConflicts returns the unresolved conflicts whose notes are both
+	// live, newest first
+	ListConflicts() ([]NoteConflict, error)
+
+	// GetConflict returns an unresolved conflict, or ErrNotFound
+	GetConflict(id int) (NoteConflict, error)
+
+	// CreateConflict records a conflict, filling in its ID
+	CreateConflict(conflict *NoteConflict) error
+
+	// ResolveConflict marks a conflict as resolved
+	ResolveConflict(id int) error
+
+	// GetDevice returns a device that has synced, or ErrNotFound
+	GetDevice(id string) (Device, error)
+
+	// ListDevices returns every device that has synced, most recently
+	// seen first
+	ListDevices() ([]Device, error)
+
+	// RecordDeviceSync registers a sync by a device; see RecordDeviceSync
+	RecordDeviceSync(id, name string, ackSeq int64) error
+
+	// CheckDevice returns ErrDeviceRevoked for a revoked device
+	CheckDevice(id string) error
+
+	// RenameDevice sets a device's name, or returns ErrNotFound
+	RenameDevice(id, name string) error
+
+	// RevokeDevice revokes a device, or returns ErrNotFound if it is
+	// unknown or already revoked
+	RevokeDevice(id string) error
+}
+
+// TextIndex extracts the text of attachments for search
+type TextIndex interface {
+	// PendingTextExtractions returns the live attachments whose text has
+	// not been extracted yet
+	PendingTextExtractions() ([]int, error)
+
+	// ExtractAttachmentText stores the text of an attachment; see
+	// ExtractAttachmentText
+	ExtractAttachmentText(attachmentID int) error
+}
+
+// IntegrityChecker checks the database and attachment files
+type IntegrityChecker interface {
+	// CheckIntegrity checks and, with repair set, repairs; see
+	// IntegrityReport
+	CheckIntegrity(repair bool) (IntegrityReport, error)
+}
+
+// Transactor runs fn on stores whose changes are kept together: if fn
+// returns an error, none of them are
+type Transactor interface {
+	InTx(fn func(Stores) error) error
+}
+
+// Stores bundles the stores a handler works with. The ones that may be nil
+// are features a store does without; their endpoints answer 503.
+type Stores struct {
+	Notes       NoteStore
+	Folders     FolderStore
+	Attachments AttachmentStore
+	Blobs       BlobStore
+	Usage       UsageStore
+	Tags        TagStore
+	Uploads     UploadStore
+	Trash       TrashStore       // nil if trashed items are not kept
+	Revisions   RevisionStore    // nil if revisions are not kept
+	Sync        SyncStore        // nil if devices cannot sync
+	Search      NoteSearcher     // nil if the store has no full-text index
+	Text        TextIndex        // nil if attachment text is not indexed
+	Integrity   IntegrityChecker // nil if there is nothing to check
+	Tx          Transactor       // nil if changes cannot be grouped
+}
+
+// InTx runs fn in a transaction of s.Tx, or directly if there is none
+func (s Stores) InTx(fn func(Stores) error) error {
+	if s.Tx == nil {
+		return fn(s)
+	}
+	return s.Tx.InTx(fn)
+}
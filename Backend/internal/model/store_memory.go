@@ -0,0 +1,862 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements the stores in memory, for tests and for embedding
+// the backend without a database. It follows the same rules as SQLiteStore
+// but keeps no revisions, and trashed items are dropped rather than kept
+// for restoring. A transaction holds the store for as long as it runs, so
+// other calls wait for it and a rollback cannot undo their changes.
+type MemoryStore struct {
+	*memoryState
+	inTx bool // Set on the store passed to a transaction, which holds mu
+}
+
+// memoryState is a MemoryStore's content and the lock guarding it
+type memoryState struct {
+	mu sync.Mutex
+	memoryData
+}
+
+// memoryData is the content of a MemoryStore
+type memoryData struct {
+	lastID      int
+	notes       map[int]*Note
+	manualTags  map[int][]string // Tags of each note that are not hashtags in its content
+	tags        map[string]*Tag  // By lowercase name, with the spelling in use
+	folders     map[int]*Folder
+	attachments map[int]*Attachment
+	uploads     map[string]*Upload
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{memoryState: &memoryState{memoryData: memoryData{
+		notes:       make(map[int]*Note),
+		manualTags:  make(map[int][]string),
+		tags:        make(map[string]*Tag),
+		folders:     make(map[int]*Folder),
+		attachments: make(map[int]*Attachment),
+		uploads:     make(map[string]*Upload),
+	}}}
+}
+
+// Stores returns the store as each of the stores it implements
+func (s *MemoryStore) Stores() Stores {
+	return Stores{
+		Notes:       s,
+		Folders:     s,
+		Attachments: s,
+		Blobs:       s,
+		Usage:       s,
+		Tags:        s,
+		Uploads:     s,
+		Tx:          s,
+	}
+}
+
+// InTx runs fn on the store, and puts everything back as it was if fn
+// returns an error. The stores passed to fn must be the only ones it uses:
+// calls on the store itself wait for the transaction to end.
+func (s *MemoryStore) InTx(fn func(Stores) error) error {
+	if s.inTx {
+		return fn(s.Stores())
+	}
+
+	defer s.lock()()
+
+	saved := s.snapshot()
+	err := fn((&MemoryStore{memoryState: s.memoryState, inTx: true}).Stores())
+	if err != nil {
+		s.memoryData = saved
+	}
+	return err
+}
+
+// lock takes the store's lock and returns the function releasing it. Inside
+// a transaction the lock is already held and nothing is done.
+func (s *MemoryStore) lock() (unlock func()) {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// snapshot returns a deep copy of the store's contents
+func (s *MemoryStore) snapshot() memoryData {
+	saved := memoryData{
+		lastID:      s.lastID,
+		notes:       make(map[int]*Note, len(s.notes)),
+		manualTags:  make(map[int][]string, len(s.manualTags)),
+		tags:        make(map[string]*Tag, len(s.tags)),
+		folders:     make(map[int]*Folder, len(s.folders)),
+		attachments: make(map[int]*Attachment, len(s.attachments)),
+		uploads:     make(map[string]*Upload, len(s.uploads)),
+	}
+	for id, note := range s.notes {
+		copied := s.copyNote(note)
+		saved.notes[id] = &copied
+	}
+	for id, tags := range s.manualTags {
+		saved.manualTags[id] = append([]string{}, tags...)
+	}
+	for key, tag := range s.tags {
+		copied := *tag
+		saved.tags[key] = &copied
+	}
+	for id, folder := range s.folders {
+		copied := copyFolder(folder)
+		saved.folders[id] = &copied
+	}
+	for id, a := range s.attachments {
+		copied := *a
+		saved.attachments[id] = &copied
+	}
+	for id, upload := range s.uploads {
+		copied := *upload
+		saved.uploads[id] = &copied
+	}
+	return saved
+}
+
+// nextID returns a new ID. IDs are unique across all kinds of items, which
+// tests may not rely on.
+func (s *MemoryStore) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// ============================================================================
+// NOTES
+// ============================================================================
+
+func (s *MemoryStore) ListNotes(filter NoteFilter) ([]Note, error) {
+	defer s.lock()()
+
+	var notes []Note
+	for _, note := range s.notes {
+		if filter.FolderID != nil && (note.FolderID == nil || *note.FolderID != *filter.FolderID) {
+			continue
+		}
+		if !hasTags(note.Tags, filter.Tags) {
+			continue
+		}
+		notes = append(notes, s.copyNote(note))
+	}
+
+	sort.Slice(notes, func(i, j int) bool {
+		a, b := notes[i], notes[j]
+		if filter.FolderID != nil {
+			a, b = b, a
+		}
+		if a.OrderIndex != b.OrderIndex {
+			return a.OrderIndex < b.OrderIndex
+		}
+		return a.CreatedAt.After(b.CreatedAt)
+	})
+	return notes, nil
+}
+
+func (s *MemoryStore) GetNote(ref string) (Note, error) {
+	defer s.lock()()
+
+	note, ok := s.findNote(ref)
+	if !ok {
+		return Note{}, ErrNotFound
+	}
+	return s.copyNote(note), nil
+}
+
+func (s *MemoryStore) CreateNote(note *Note) error {
+	defer s.lock()()
+
+	if note.ID == 0 {
+		note.ID = s.nextID()
+	} else if _, taken := s.notes[note.ID]; taken {
+		return fmt.Errorf("note %d already exists", note.ID)
+	} else if note.ID > s.lastID {
+		s.lastID = note.ID
+	}
+	if note.UID == "" {
+		note.UID = NewUID()
+	}
+
+	stored := s.copyNote(note)
+	s.notes[note.ID] = &stored
+	s.setNoteTags(&stored, "", note.Tags)
+	note.Tags = stored.Tags
+	return nil
+}
+
+func (s *MemoryStore) UpdateNote(note *Note) error {
+	defer s.lock()()
+
+	stored, ok := s.notes[note.ID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	previous := stored.Content
+	stored.Title = note.Title
+	stored.Content = note.Content
+	stored.FolderID = copyInt(note.FolderID)
+	stored.OrderIndex = note.OrderIndex
+	stored.UpdatedAt = note.UpdatedAt
+	s.setNoteTags(stored, previous, note.Tags)
+
+	note.Tags = stored.Tags
+	return nil
+}
+
+func (s *MemoryStore) MaxOrderIndex(folderID *int) (int, error) {
+	defer s.lock()()
+
+	maxOrder := 0
+	for _, note := range s.notes {
+		if sameFolder(note.FolderID, folderID) && note.OrderIndex > maxOrder {
+			maxOrder = note.OrderIndex
+		}
+	}
+	return maxOrder, nil
+}
+
+func (s *MemoryStore) TrashNote(id int) error {
+	defer s.lock()()
+
+	if _, ok := s.notes[id]; !ok {
+		return ErrNotFound
+	}
+	s.deleteNote(id)
+	return nil
+}
+
+func (s *MemoryStore) ReorderNotes(folderID int, order map[int]int) error {
+	defer s.lock()()
+
+	for noteID, index := range order {
+		if note, ok := s.notes[noteID]; ok && note.FolderID != nil && *note.FolderID == folderID {
+			note.OrderIndex = index
+		}
+	}
+	return nil
+}
+
+// findNote returns a note by its integer or global ID
+func (s *MemoryStore) findNote(ref string) (*Note, bool) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		note, ok := s.notes[id]
+		return note, ok
+	}
+	for _, note := range s.notes {
+		if note.UID == ref {
+			return note, true
+		}
+	}
+	return nil, false
+}
+
+// setNoteTags applies the rules of SetNoteTags to a stored note, given the
+// content it had before
+func (s *MemoryStore) setNoteTags(note *Note, previousContent string, requested []string) {
+	inline := ExtractHashtags(note.Content)
+	seen := make(map[string]bool)
+	for _, tag := range inline {
+		seen[strings.ToLower(tag)] = true
+	}
+
+	candidates := s.manualTags[note.ID]
+	if requested != nil {
+		prevInline := make(map[string]bool)
+		for _, tag := range ExtractHashtags(previousContent) {
+			prevInline[strings.ToLower(tag)] = true
+		}
+		candidates = nil
+		for _, name := range requested {
+			if normalized, ok := NormalizeTagName(name); ok && !prevInline[strings.ToLower(normalized)] {
+				candidates = append(candidates, normalized)
+			}
+		}
+	}
+
+	var manual []string
+	for _, tag := range candidates {
+		if key := strings.ToLower(tag); !seen[key] {
+			seen[key] = true
+			manual = append(manual, tag)
+		}
+	}
+
+	s.manualTags[note.ID] = manual
+	note.Tags = append(append([]string{}, inline...), manual...)
+
+	// Tags are spelled the same on every note, like rows of the tags table
+	for i, tag := range note.Tags {
+		key := strings.ToLower(tag)
+		if s.tags[key] == nil {
+			s.tags[key] = &Tag{ID: s.nextID(), Name: tag, CreatedAt: time.Now()}
+		}
+		note.Tags[i] = s.tags[key].Name
+	}
+	s.deleteUnusedTags()
+}
+
+// deleteUnusedTags drops tags that no note carries any more
+func (s *MemoryStore) deleteUnusedTags() {
+	used := make(map[string]bool)
+	for _, note := range s.notes {
+		for _, tag := range note.Tags {
+			used[strings.ToLower(tag)] = true
+		}
+	}
+	for key := range s.tags {
+		if !used[key] {
+			delete(s.tags, key)
+		}
+	}
+}
+
+// copyNote returns a copy of a stored note that callers may change
+func (s *MemoryStore) copyNote(note *Note) Note {
+	copied := *note
+	copied.FolderID = copyInt(note.FolderID)
+	copied.Tags = append([]string{}, note.Tags...)
+	return copied
+}
+
+// deleteNote drops a note with its manual tags and attachments
+func (s *MemoryStore) deleteNote(id int) {
+	delete(s.notes, id)
+	delete(s.manualTags, id)
+	for attachmentID, a := range s.attachments {
+		if a.NoteID == id {
+			delete(s.attachments, attachmentID)
+		}
+	}
+	s.deleteUnusedTags()
+}
+
+// ============================================================================
+// FOLDERS
+// ============================================================================
+
+func (s *MemoryStore) ListFolders() ([]Folder, error) {
+	defer s.lock()()
+
+	var folders []Folder
+	for _, folder := range s.folders {
+		folders = append(folders, copyFolder(folder))
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		if !folders[i].CreatedAt.Equal(folders[j].CreatedAt) {
+			return folders[i].CreatedAt.Before(folders[j].CreatedAt)
+		}
+		return folders[i].ID < folders[j].ID
+	})
+	return folders, nil
+}
+
+func (s *MemoryStore) GetFolder(id int) (Folder, error) {
+	defer s.lock()()
+
+	folder, ok := s.folders[id]
+	if !ok {
+		return Folder{}, ErrNotFound
+	}
+	return copyFolder(folder), nil
+}
+
+func (s *MemoryStore) CreateFolder(folder *Folder) error {
+	defer s.lock()()
+
+	if folder.ParentID != nil && s.folders[*folder.ParentID] == nil {
+		return ErrNotFound
+	}
+	if s.folderNameTaken(folder.Name, folder.ParentID, 0) {
+		return ErrNameTaken
+	}
+
+	if folder.ID == 0 {
+		folder.ID = s.nextID()
+	} else if _, taken := s.folders[folder.ID]; taken {
+		return fmt.Errorf("folder %d already exists", folder.ID)
+	} else if folder.ID > s.lastID {
+		s.lastID = folder.ID
+	}
+	if folder.UID == "" {
+		folder.UID = NewUID()
+	}
+	if folder.CreatedAt.IsZero() {
+		folder.CreatedAt = time.Now()
+	}
+
+	stored := copyFolder(folder)
+	s.folders[folder.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStore) RenameFolder(id int, name string) (Folder, error) {
+	defer s.lock()()
+
+	folder, ok := s.folders[id]
+	if !ok {
+		return Folder{}, ErrNotFound
+	}
+	if s.folderNameTaken(name, folder.ParentID, id) {
+		return copyFolder(folder), ErrNameTaken
+	}
+	folder.Name = name
+	return copyFolder(folder), nil
+}
+
+func (s *MemoryStore) MoveFolder(id int, parentID *int, name string) (Folder, error) {
+	defer s.lock()()
+
+	folder, ok := s.folders[id]
+	if !ok {
+		return Folder{}, ErrNotFound
+	}
+	if parentID != nil {
+		if s.folders[*parentID] == nil {
+			return copyFolder(folder), ErrNotFound
+		}
+		// Walk up from the new parent; finding the folder means a cycle
+		for ancestor := s.folders[*parentID]; ancestor != nil; {
+			if ancestor.ID == id {
+				return copyFolder(folder), ErrFolderCycle
+			}
+			if ancestor.ParentID == nil {
+				break
+			}
+			ancestor = s.folders[*ancestor.ParentID]
+		}
+	}
+	if s.folderNameTaken(name, parentID, id) {
+		return copyFolder(folder), ErrNameTaken
+	}
+
+	folder.Name = name
+	folder.ParentID = copyInt(parentID)
+	return copyFolder(folder), nil
+}
+
+func (s *MemoryStore) CountFolderNotes() (map[int]int, error) {
+	defer s.lock()()
+
+	counts := make(map[int]int)
+	for _, note := range s.notes {
+		if note.FolderID != nil {
+			counts[*note.FolderID]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) TrashFolder(id int, recursive bool) (int, int, error) {
+	defer s.lock()()
+
+	if _, ok := s.folders[id]; !ok {
+		return 0, 0, ErrNotFound
+	}
+
+	// Collect the subtree breadth first
+	subtree := map[int]bool{id: true}
+	queue := []int{id}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, folder := range s.folders {
+			if folder.ParentID != nil && *folder.ParentID == parent && !subtree[folder.ID] {
+				subtree[folder.ID] = true
+				queue = append(queue, folder.ID)
+			}
+		}
+	}
+
+	var noteIDs []int
+	for _, note := range s.notes {
+		if note.FolderID != nil && subtree[*note.FolderID] {
+			noteIDs = append(noteIDs, note.ID)
+		}
+	}
+
+	if !recursive && (len(noteIDs) > 0 || len(subtree) > 1) {
+		return 0, 0, &FolderNotEmptyError{Notes: len(noteIDs), Subfolders: len(subtree) - 1}
+	}
+
+	for _, noteID := range noteIDs {
+		s.deleteNote(noteID)
+	}
+	for folderID := range subtree {
+		delete(s.folders, folderID)
+	}
+	return len(subtree), len(noteIDs), nil
+}
+
+// folderNameTaken reports whether a folder other than excludeID already
+// uses name under parentID
+func (s *MemoryStore) folderNameTaken(name string, parentID *int, excludeID int) bool {
+	for _, folder := range s.folders {
+		if folder.ID != excludeID && folder.Name == name && sameFolder(folder.ParentID, parentID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================
+// ATTACHMENTS
+// ============================================================================
+
+func (s *MemoryStore) ListAttachments(noteID int) ([]Attachment, error) {
+	defer s.lock()()
+
+	var attachments []Attachment
+	for _, a := range s.attachments {
+		if a.NoteID == noteID {
+			attachments = append(attachments, *a)
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		if !attachments[i].CreatedAt.Equal(attachments[j].CreatedAt) {
+			return attachments[i].CreatedAt.After(attachments[j].CreatedAt)
+		}
+		return attachments[i].ID > attachments[j].ID
+	})
+	return attachments, nil
+}
+
+func (s *MemoryStore) GetAttachment(ref string) (Attachment, error) {
+	defer s.lock()()
+
+	var found *Attachment
+	if id, err := strconv.Atoi(ref); err == nil {
+		found = s.attachments[id]
+	} else {
+		for _, a := range s.attachments {
+			if a.UID == ref {
+				found = a
+				break
+			}
+		}
+	}
+	if found == nil {
+		return Attachment{}, ErrNotFound
+	}
+
+	attachment := *found
+	if note, ok := s.notes[attachment.NoteID]; ok {
+		attachment.NoteUID = note.UID
+	}
+	return attachment, nil
+}
+
+func (s *MemoryStore) CreateAttachment(attachment *Attachment) error {
+	defer s.lock()()
+
+	if _, ok := s.notes[attachment.NoteID]; !ok {
+		return ErrNotFound
+	}
+
+	attachment.ID = s.nextID()
+	if attachment.UID == "" {
+		attachment.UID = NewUID()
+	}
+	if attachment.CreatedAt.IsZero() {
+		attachment.CreatedAt = time.Now()
+	}
+
+	stored := *attachment
+	s.attachments[attachment.ID] = &stored
+	return nil
+}
+
+func (s *MemoryStore) UpdateAttachment(attachment *Attachment) error {
+	defer s.lock()()
+
+	stored, ok := s.attachments[attachment.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.notes[attachment.NoteID]; !ok {
+		return ErrNotFound
+	}
+	stored.OriginalName = attachment.OriginalName
+	stored.NoteID = attachment.NoteID
+	return nil
+}
+
+func (s *MemoryStore) TrashAttachment(id int) error {
+	defer s.lock()()
+
+	if _, ok := s.attachments[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.attachments, id)
+	return nil
+}
+
+// ============================================================================
+// BLOBS AND USAGE
+// ============================================================================
+
+func (s *MemoryStore) FindBlob(sum string) (Blob, error) {
+	defer s.lock()()
+
+	blob := Blob{SHA256: sum}
+	for _, a := range s.attachments {
+		if a.SHA256 == sum {
+			blob.Refs++
+			blob.Size, blob.MimeType = a.Size, a.MimeType
+		}
+	}
+	if blob.Refs == 0 {
+		return blob, ErrNotFound
+	}
+	return blob, nil
+}
+
+func (s *MemoryStore) FileInUse(filename string) (bool, error) {
+	defer s.lock()()
+
+	for _, a := range s.attachments {
+		if a.Filename == filename {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) Usage() (Usage, error) {
+	defer s.lock()()
+
+	usage := Usage{Limits: Quotas}
+	for _, note := range s.notes {
+		size := int64(len(note.Content))
+		usage.Notes++
+		usage.NoteBytes += size
+		if size > usage.LargestNote {
+			usage.LargestNote = size
+		}
+	}
+
+	perNote := make(map[int]int64)
+	for _, a := range s.attachments {
+		perNote[a.NoteID]++
+		usage.Attachments++
+	}
+	for _, count := range perNote {
+		if count > usage.MostAttachments {
+			usage.MostAttachments = count
+		}
+	}
+
+	usage.AttachmentBytes = s.storageUsed()
+	return usage, nil
+}
+
+func (s *MemoryStore) StorageUsed() (int64, error) {
+	defer s.lock()()
+	return s.storageUsed(), nil
+}
+
+// storageUsed counts the size of each attachment file once
+func (s *MemoryStore) storageUsed() int64 {
+	sizes := make(map[string]int64)
+	for _, a := range s.attachments {
+		if a.Size > sizes[a.Filename] {
+			sizes[a.Filename] = a.Size
+		}
+	}
+	var used int64
+	for _, size := range sizes {
+		used += size
+	}
+	return used
+}
+
+// ============================================================================
+// TAGS
+// ============================================================================
+
+func (s *MemoryStore) ListTags(byCount bool) ([]Tag, error) {
+	defer s.lock()()
+
+	counts := make(map[string]int)
+	for _, note := range s.notes {
+		for _, tag := range note.Tags {
+			counts[strings.ToLower(tag)]++
+		}
+	}
+
+	var tags []Tag
+	for key, tag := range s.tags {
+		listed := *tag
+		listed.NoteCount = counts[key]
+		tags = append(tags, listed)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if byCount && tags[i].NoteCount != tags[j].NoteCount {
+			return tags[i].NoteCount > tags[j].NoteCount
+		}
+		return strings.ToLower(tags[i].Name) < strings.ToLower(tags[j].Name)
+	})
+	return tags, nil
+}
+
+func (s *MemoryStore) TaggedNotes(names []string) ([]int, error) {
+	defer s.lock()()
+
+	var ids []int
+	for _, note := range s.notes {
+		for _, tag := range note.Tags {
+			if containsFold(names, tag) {
+				ids = append(ids, note.ID)
+				break
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (s *MemoryStore) SpellTag(name string) error {
+	defer s.lock()()
+
+	tag, ok := s.tags[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	tag.Name = name
+	for id, note := range s.notes {
+		for i, t := range note.Tags {
+			if strings.EqualFold(t, name) {
+				note.Tags[i] = name
+			}
+		}
+		for i, t := range s.manualTags[id] {
+			if strings.EqualFold(t, name) {
+				s.manualTags[id][i] = name
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// UPLOADS
+// ============================================================================
+
+func (s *MemoryStore) CreateUpload(upload *Upload) error {
+	defer s.lock()()
+
+	if _, taken := s.uploads[upload.ID]; taken {
+		return fmt.Errorf("upload %s already exists", upload.ID)
+	}
+	now := time.Now().UTC()
+	upload.CreatedAt, upload.UpdatedAt = now, now
+	stored := *upload
+	s.uploads[upload.ID] = &stored
+	return fillUploadProgress(upload)
+}
+
+func (s *MemoryStore) GetUpload(id string) (Upload, error) {
+	defer s.lock()()
+
+	stored, ok := s.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+	upload := *stored
+	return upload, fillUploadProgress(&upload)
+}
+
+func (s *MemoryStore) TouchUpload(id string) error {
+	defer s.lock()()
+
+	if upload, ok := s.uploads[id]; ok {
+		upload.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUpload(id string) error {
+	defer s.lock()()
+
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *MemoryStore) ExpiredUploads(before time.Time) ([]string, error) {
+	defer s.lock()()
+
+	var expired []string
+	for id, upload := range s.uploads {
+		if !upload.UpdatedAt.After(before) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// ============================================================================
+// HELPERS
+// ============================================================================
+
+// hasTags reports whether tags include every one of wanted, ignoring case
+func hasTags(tags, wanted []string) bool {
+	for _, want := range wanted {
+		name, _ := NormalizeTagName(want)
+		found := false
+		for _, tag := range tags {
+			if strings.EqualFold(tag, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether names include name, ignoring case
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFolder reports whether two nullable folder IDs are equal
+func sameFolder(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func copyInt(value *int) *int {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	return &copied
+}
+
+func copyFolder(folder *Folder) Folder {
+	copied := *folder
+	copied.ParentID = copyInt(folder.ParentID)
+	return copied
+}
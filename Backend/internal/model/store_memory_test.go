@@ -0,0 +1,47 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRollbackKeepsOtherWrites(t *testing.T) {
+	store := NewMemoryStore()
+	stores := store.Stores()
+
+	started := make(chan struct{})
+	written := make(chan error)
+	err := stores.InTx(func(tx Stores) error {
+		if err := tx.Folders.CreateFolder(&Folder{Name: "Rolled back"}); err != nil {
+			return err
+		}
+
+		// A write from outside the transaction waits for it to end
+		go func() {
+			close(started)
+			written <- stores.Folders.CreateFolder(&Folder{Name: "Kept"})
+		}()
+		<-started
+		select {
+		case err := <-written:
+			t.Errorf("write did not wait for the transaction: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return errors.New("roll back")
+	})
+	if err == nil {
+		t.Fatal("InTx: want the closure's error")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	folders, err := stores.Folders.ListFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 1 || folders[0].Name != "Kept" {
+		t.Errorf("folders after rollback: got %+v, want only Kept", folders)
+	}
+}
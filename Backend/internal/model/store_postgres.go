@@ -0,0 +1,618 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PostgresStore implements the stores on a PostgreSQL database opened by
+// OpenPostgres. Triggers record revisions, tombstones and change sequences
+// as they do in SQLite, and search uses tsvector columns. Helpers whose SQL
+// is the same in both databases, such as GetNoteTags and PruneRevisions,
+// are shared with SQLiteStore.
+type PostgresStore struct {
+	q  Queryer
+	db *sql.DB // nil for a store inside a transaction
+}
+
+// NewPostgresStore returns a store on db
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{q: db, db: db}
+}
+
+// Stores returns the store as each of the stores
+func (s *PostgresStore) Stores() Stores {
+	shared := &sqlStore{q: s.shared(), db: s.db, postgres: true}
+	return Stores{
+		Notes:       s,
+		Folders:     s,
+		Attachments: s,
+		Blobs:       shared,
+		Usage:       shared,
+		Tags:        shared,
+		Uploads:     shared,
+		Trash:       shared,
+		Revisions:   shared,
+		Sync:        shared,
+		Search:      s,
+		Text:        shared,
+		Integrity:   shared,
+		Tx:          s,
+	}
+}
+
+// InTx runs fn on a store inside a database transaction
+func (s *PostgresStore) InTx(fn func(Stores) error) error {
+	return s.inTx(func(q Queryer) error {
+		return fn((&PostgresStore{q: q}).Stores())
+	})
+}
+
+// inTx runs fn in a new transaction, or in the store's own
+func (s *PostgresStore) inTx(fn func(q Queryer) error) error {
+	if s.db == nil {
+		return fn(s.q)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// shared returns the store's queryer for helpers written for SQLite
+func (s *PostgresStore) shared() Queryer {
+	return postgresQueryer{q: s.q}
+}
+
+// ============================================================================
+// NOTES
+// ============================================================================
+
+func (s *PostgresStore) ListNotes(filter NoteFilter) ([]Note, error) {
+	query := "SELECT id, uid, title, content, folder_id, order_index, created_at, updated_at FROM notes WHERE deleted_at IS NULL"
+	var args []interface{}
+	if filter.FolderID != nil {
+		args = append(args, *filter.FolderID)
+		query += " AND folder_id = $" + strconv.Itoa(len(args))
+	}
+	for _, tag := range filter.Tags {
+		name, _ := NormalizeTagName(tag)
+		args = append(args, name)
+		query += " AND id IN (SELECT nt.note_id FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE lower(t.name) = lower($" + strconv.Itoa(len(args)) + "))"
+	}
+	if filter.FolderID != nil {
+		query += " ORDER BY order_index DESC, created_at ASC"
+	} else {
+		query += " ORDER BY order_index ASC, created_at DESC"
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		err := rows.Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := FillNoteTags(s.shared(), notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (s *PostgresStore) GetNote(ref string) (Note, error) {
+	var note Note
+	id, err := LookupID(s.shared(), "notes", ref)
+	if err != nil {
+		return note, notFound(err)
+	}
+
+	err = s.q.QueryRow(
+		"SELECT id, uid, title, content, folder_id, order_index, created_at, updated_at FROM notes WHERE id = $1 AND deleted_at IS NULL",
+		id,
+	).Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		return note, notFound(err)
+	}
+
+	tags, err := GetNoteTags(s.shared(), []int{note.ID})
+	if err != nil {
+		return note, err
+	}
+	note.Tags = tags[note.ID]
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	return note, nil
+}
+
+func (s *PostgresStore) CreateNote(note *Note) error {
+	if note.UID == "" {
+		note.UID = NewUID()
+	}
+
+	return s.inTx(func(q Queryer) error {
+		if note.ID == 0 {
+			err := q.QueryRow(
+				"INSERT INTO notes (uid, title, content, folder_id, order_index, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+				note.UID, note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
+			).Scan(&note.ID)
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err := q.Exec(
+				"INSERT INTO notes (id, uid, title, content, folder_id, order_index, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+				note.ID, note.UID, note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
+			)
+			if err != nil {
+				return err
+			}
+			// Keep the ID sequence ahead of IDs chosen by the caller
+			if err := resetPostgresSequence(q, "notes"); err != nil {
+				return err
+			}
+		}
+		return (&PostgresStore{q: q}).saveNoteTags(note)
+	})
+}
+
+func (s *PostgresStore) UpdateNote(note *Note) error {
+	return s.inTx(func(q Queryer) error {
+		result, err := q.Exec(
+			"UPDATE notes SET title = $1, content = $2, folder_id = $3, order_index = $4, updated_at = $5 WHERE id = $6 AND deleted_at IS NULL",
+			note.Title, note.Content, note.FolderID, note.OrderIndex, note.UpdatedAt, note.ID,
+		)
+		if err != nil {
+			return err
+		}
+		if count, _ := result.RowsAffected(); count == 0 {
+			return ErrNotFound
+		}
+
+		tx := &PostgresStore{q: q}
+		// The previous content is kept as a revision; apply retention
+		if err := PruneRevisions(tx.shared(), note.ID, Revisions); err != nil {
+			return err
+		}
+		return tx.saveNoteTags(note)
+	})
+}
+
+func (s *PostgresStore) MaxOrderIndex(folderID *int) (int, error) {
+	var maxOrder int
+	err := s.q.QueryRow("SELECT COALESCE(MAX(order_index), 0) FROM notes WHERE folder_id IS NOT DISTINCT FROM $1 AND deleted_at IS NULL", folderID).Scan(&maxOrder)
+	return maxOrder, err
+}
+
+func (s *PostgresStore) TrashNote(id int) error {
+	// The note is permanently removed when the trash is purged
+	result, err := s.q.Exec("UPDATE notes SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) ReorderNotes(folderID int, order map[int]int) error {
+	return s.inTx(func(q Queryer) error {
+		for noteID, index := range order {
+			_, err := q.Exec(
+				"UPDATE notes SET order_index = $1 WHERE id = $2 AND folder_id = $3 AND deleted_at IS NULL",
+				index, noteID, folderID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveNoteTags stores the tags of a just-saved note and fills note.Tags
+func (s *PostgresStore) saveNoteTags(note *Note) error {
+	if err := setNoteTags(s.shared(), note.ID, note.Content, note.Tags, ensurePostgresTag); err != nil {
+		return err
+	}
+
+	tags, err := GetNoteTags(s.shared(), []int{note.ID})
+	if err != nil {
+		return err
+	}
+	note.Tags = tags[note.ID]
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	return nil
+}
+
+// ensurePostgresTag returns the ID of the named tag, creating it if needed.
+// Names are compared case-insensitively.
+func ensurePostgresTag(q Queryer, name string) (int, error) {
+	_, err := q.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT ((lower(name))) DO NOTHING", name)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = q.QueryRow("SELECT id FROM tags WHERE lower(name) = lower(?)", name).Scan(&id)
+	return id, err
+}
+
+// ============================================================================
+// FOLDERS
+// ============================================================================
+
+func (s *PostgresStore) ListFolders() ([]Folder, error) {
+	rows, err := s.q.Query("SELECT id, uid, name, parent_id, created_at FROM folders WHERE deleted_at IS NULL ORDER BY created_at ASC, id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.ID, &folder.UID, &folder.Name, &folder.ParentID, &folder.CreatedAt); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+func (s *PostgresStore) GetFolder(id int) (Folder, error) {
+	var folder Folder
+	err := s.q.QueryRow(
+		"SELECT id, uid, name, parent_id, created_at FROM folders WHERE id = $1 AND deleted_at IS NULL",
+		id,
+	).Scan(&folder.ID, &folder.UID, &folder.Name, &folder.ParentID, &folder.CreatedAt)
+	return folder, notFound(err)
+}
+
+func (s *PostgresStore) CreateFolder(folder *Folder) error {
+	if folder.ParentID != nil {
+		if _, err := s.GetFolder(*folder.ParentID); err != nil {
+			return err
+		}
+	}
+
+	taken, err := s.folderNameTaken(folder.Name, folder.ParentID, 0)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNameTaken
+	}
+
+	if folder.UID == "" {
+		folder.UID = NewUID()
+	}
+	if folder.CreatedAt.IsZero() {
+		folder.CreatedAt = time.Now()
+	}
+
+	if folder.ID == 0 {
+		return s.q.QueryRow(
+			"INSERT INTO folders (uid, name, parent_id, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+			folder.UID, folder.Name, folder.ParentID, folder.CreatedAt,
+		).Scan(&folder.ID)
+	}
+	return s.inTx(func(q Queryer) error {
+		_, err := q.Exec(
+			"INSERT INTO folders (id, uid, name, parent_id, created_at) VALUES ($1, $2, $3, $4, $5)",
+			folder.ID, folder.UID, folder.Name, folder.ParentID, folder.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		// Keep the ID sequence ahead of IDs chosen by the caller
+		return resetPostgresSequence(q, "folders")
+	})
+}
+
+func (s *PostgresStore) RenameFolder(id int, name string) (Folder, error) {
+	// The parent is not changed here; look it up for the name check
+	folder, err := s.GetFolder(id)
+	if err != nil {
+		return folder, err
+	}
+
+	taken, err := s.folderNameTaken(name, folder.ParentID, id)
+	if err != nil {
+		return folder, err
+	}
+	if taken {
+		return folder, ErrNameTaken
+	}
+
+	result, err := s.q.Exec("UPDATE folders SET name = $1 WHERE id = $2 AND deleted_at IS NULL", name, id)
+	if err != nil {
+		return folder, err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return folder, ErrNotFound
+	}
+
+	folder.Name = name
+	return folder, nil
+}
+
+func (s *PostgresStore) MoveFolder(id int, parentID *int, name string) (Folder, error) {
+	folder, err := s.GetFolder(id)
+	if err != nil {
+		return folder, err
+	}
+
+	if parentID != nil {
+		if _, err := s.GetFolder(*parentID); err != nil {
+			return folder, err
+		}
+		cycle, err := FolderInSubtree(s.shared(), *parentID, id)
+		if err != nil {
+			return folder, err
+		}
+		if cycle {
+			return folder, ErrFolderCycle
+		}
+	}
+
+	taken, err := s.folderNameTaken(name, parentID, id)
+	if err != nil {
+		return folder, err
+	}
+	if taken {
+		return folder, ErrNameTaken
+	}
+
+	if _, err := s.q.Exec("UPDATE folders SET name = $1, parent_id = $2 WHERE id = $3", name, parentID, id); err != nil {
+		return folder, err
+	}
+	folder.Name, folder.ParentID = name, parentID
+	return folder, nil
+}
+
+func (s *PostgresStore) CountFolderNotes() (map[int]int, error) {
+	return countFolderNotes(s.q)
+}
+
+func (s *PostgresStore) TrashFolder(id int, recursive bool) (int, int, error) {
+	var folders, notes int
+	err := s.inTx(func(q Queryer) error {
+		var exists bool
+		err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+
+		shared := postgresQueryer{q: q}
+		folderIDs, err := FolderSubtree(shared, id)
+		if err != nil {
+			return err
+		}
+
+		inClause, args := intsInClause(folderIDs)
+		var noteCount int
+		err = shared.QueryRow("SELECT COUNT(*) FROM notes WHERE folder_id IN "+inClause+" AND deleted_at IS NULL", args...).Scan(&noteCount)
+		if err != nil {
+			return err
+		}
+
+		if !recursive && (noteCount > 0 || len(folderIDs) > 1) {
+			return &FolderNotEmptyError{Notes: noteCount, Subfolders: len(folderIDs) - 1}
+		}
+
+		if err := TrashFolders(shared, folderIDs, time.Now().UTC()); err != nil {
+			return err
+		}
+		folders, notes = len(folderIDs), noteCount
+		return nil
+	})
+	return folders, notes, err
+}
+
+// folderNameTaken reports whether a live folder other than excludeID
+// already uses name under parentID
+func (s *PostgresStore) folderNameTaken(name string, parentID *int, excludeID int) (bool, error) {
+	var taken bool
+	err := s.q.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM folders WHERE name = $1 AND parent_id IS NOT DISTINCT FROM $2 AND id != $3 AND deleted_at IS NULL)",
+		name, parentID, excludeID,
+	).Scan(&taken)
+	return taken, err
+}
+
+// ============================================================================
+// ATTACHMENTS
+// ============================================================================
+
+func (s *PostgresStore) ListAttachments(noteID int) ([]Attachment, error) {
+	rows, err := s.q.Query(
+		"SELECT id, uid, note_id, filename, original_name, mime_type, size, COALESCE(sha256, ''), created_at FROM attachments WHERE note_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC, id DESC",
+		noteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.UID, &a.NoteID, &a.Filename, &a.OriginalName, &a.MimeType, &a.Size, &a.SHA256, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (s *PostgresStore) GetAttachment(ref string) (Attachment, error) {
+	var a Attachment
+	id, err := LookupID(s.shared(), "attachments", ref)
+	if err != nil {
+		return a, notFound(err)
+	}
+
+	err = s.q.QueryRow(`
+		SELECT a.id, a.uid, a.note_id, n.uid, a.filename, a.original_name, a.mime_type, a.size,
+			COALESCE(a.sha256, ''), a.created_at
+		FROM attachments a
+		JOIN notes n ON n.id = a.note_id
+		WHERE a.id = $1 AND a.deleted_at IS NULL`, id,
+	).Scan(&a.ID, &a.UID, &a.NoteID, &a.NoteUID, &a.Filename, &a.OriginalName, &a.MimeType, &a.Size, &a.SHA256, &a.CreatedAt)
+	return a, notFound(err)
+}
+
+func (s *PostgresStore) CreateAttachment(a *Attachment) error {
+	if a.UID == "" {
+		a.UID = NewUID()
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+
+	return s.q.QueryRow(
+		"INSERT INTO attachments (uid, note_id, filename, original_name, mime_type, size, sha256, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		a.UID, a.NoteID, a.Filename, a.OriginalName, a.MimeType, a.Size, a.SHA256, a.CreatedAt,
+	).Scan(&a.ID)
+}
+
+func (s *PostgresStore) UpdateAttachment(a *Attachment) error {
+	result, err := s.q.Exec(
+		"UPDATE attachments SET original_name = $1, note_id = $2 WHERE id = $3 AND deleted_at IS NULL",
+		a.OriginalName, a.NoteID, a.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) TrashAttachment(id int) error {
+	result, err := s.q.Exec(
+		"UPDATE attachments SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL",
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ============================================================================
+// SEARCH
+// ============================================================================
+
+// SearchNotes searches the tsvector columns. As with SQLite, title matches
+// weigh more than content matches, which weigh more than matches in
+// attachments, and rank is lower for better matches.
+func (s *PostgresStore) SearchNotes(query SearchQuery) ([]SearchResult, error) {
+	sqlQuery := `
+		WITH query AS (
+			SELECT to_tsquery('astronotes', $1) AS q
+		),
+		note_matches AS (
+			SELECT n.id AS note_id,
+				ts_headline('astronotes', n.title, query.q, 'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', HighlightAll=true') AS highlight,
+				ts_headline('astronotes', n.content, query.q, 'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxWords=16, MinWords=8, MaxFragments=1') AS snippet,
+				-ts_rank('{0.1, 0.1, 0.1, 1.0}', n.search, query.q) AS rank
+			FROM notes n, query
+			WHERE n.search @@ query.q AND n.deleted_at IS NULL
+		),
+		attachment_matches AS (
+			SELECT a.note_id, a.id, a.uid, a.original_name,
+				ts_headline('astronotes', t.content, query.q, 'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxWords=16, MinWords=8, MaxFragments=1') AS snippet,
+				-ts_rank(t.search, query.q) * 0.5 AS rank
+			FROM attachment_text t
+			JOIN attachments a ON a.id = t.attachment_id, query
+			WHERE t.search @@ query.q AND a.deleted_at IS NULL
+		),
+		best_attachments AS (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY note_id ORDER BY rank, id) AS position
+			FROM attachment_matches
+		)
+		SELECT n.id, n.title, n.folder_id, f.name, n.updated_at,
+			COALESCE(nm.highlight, n.title), COALESCE(nm.snippet, ''),
+			LEAST(COALESCE(nm.rank, 0), COALESCE(ba.rank, 0)) AS rank,
+			ba.id, ba.uid, ba.original_name, ba.snippet
+		FROM notes n
+		LEFT JOIN note_matches nm ON nm.note_id = n.id
+		LEFT JOIN best_attachments ba ON ba.note_id = n.id AND ba.position = 1
+		LEFT JOIN folders f ON f.id = n.folder_id
+		WHERE (nm.note_id IS NOT NULL OR ba.note_id IS NOT NULL) AND n.deleted_at IS NULL`
+	args := []interface{}{tsQuery(query.Terms)}
+
+	if query.FolderID != nil {
+		args = append(args, *query.FolderID)
+		sqlQuery += " AND n.folder_id = $" + strconv.Itoa(len(args))
+	}
+
+	args = append(args, query.Limit, query.Offset)
+	sqlQuery += " ORDER BY rank, n.id LIMIT $" + strconv.Itoa(len(args)-1) + " OFFSET $" + strconv.Itoa(len(args))
+
+	return scanSearchResults(s.q, sqlQuery, args...)
+}
+
+// tsQuery turns terms into a to_tsquery expression that all must match.
+// Terms are split into words of letters and digits, which need no escaping
+// once quoted; the words of a term must appear in order, and a prefix term
+// matches longer forms of its last word.
+func tsQuery(terms []SearchTerm) string {
+	var parts []string
+	for _, term := range terms {
+		words := strings.FieldsFunc(term.Text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if len(words) == 0 {
+			continue
+		}
+		for i, word := range words {
+			words[i] = "'" + word + "'"
+		}
+		if term.Prefix {
+			words[len(words)-1] += ":*"
+		}
+		parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+	}
+	return strings.Join(parts, " & ")
+}
+
+// resetPostgresSequence moves the ID sequence of table past its highest ID
+func resetPostgresSequence(q Queryer, table string) error {
+	_, err := q.Exec("SELECT setval(pg_get_serial_sequence($1, 'id'), COALESCE((SELECT MAX(id) FROM "+table+"), 0) + 1, false)", table)
+	return err
+}
@@ -0,0 +1,53 @@
+package model
+
+import "database/sql"
+
+// sqlStore implements the stores whose SQL is the same in SQLite and
+// PostgreSQL: blobs, usage, tags, uploads, the trash, revisions, sync,
+// attachment text and integrity checks. Queries are written with ?
+// placeholders; on PostgreSQL q is a postgresQueryer, which numbers them.
+// The methods are in the files of their topic.
+type sqlStore struct {
+	q        Queryer
+	db       *sql.DB // nil for a store inside a transaction
+	postgres bool
+}
+
+// inTx runs fn on a store inside a new transaction, or inside the store's own
+func (s *sqlStore) inTx(fn func(tx *sqlStore) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var q Queryer = tx
+	if s.postgres {
+		q = postgresQueryer{q: tx}
+	}
+	if err := fn(&sqlStore{q: q, postgres: s.postgres}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanInts reads a single column of integer IDs
+func scanInts(rows *sql.Rows, err error) ([]int, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,506 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQLiteStore implements the stores on the SQLite database. Changes go
+// through the same tables as sync, so triggers record revisions and
+// change sequences for them.
+type SQLiteStore struct {
+	q  Queryer
+	db *sql.DB // nil for a store inside a transaction
+}
+
+// NewSQLiteStore returns a store on db, normally DB after InitDB
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{q: db, db: db}
+}
+
+// NewSQLiteTxStore returns a store whose changes are part of tx. InTx runs
+// directly in tx.
+func NewSQLiteTxStore(tx *sql.Tx) *SQLiteStore {
+	return &SQLiteStore{q: tx}
+}
+
+// Stores returns the store as each of the stores
+func (s *SQLiteStore) Stores() Stores {
+	shared := &sqlStore{q: s.q, db: s.db}
+	return Stores{
+		Notes:       s,
+		Folders:     s,
+		Attachments: s,
+		Blobs:       shared,
+		Usage:       shared,
+		Tags:        shared,
+		Uploads:     shared,
+		Trash:       shared,
+		Revisions:   shared,
+		Sync:        shared,
+		Search:      s,
+		Text:        shared,
+		Integrity:   shared,
+		Tx:          s,
+	}
+}
+
+// InTx runs fn on a store inside a database transaction
+func (s *SQLiteStore) InTx(fn func(Stores) error) error {
+	return s.inTx(func(q Queryer) error {
+		return fn((&SQLiteStore{q: q}).Stores())
+	})
+}
+
+// inTx runs fn in a new transaction, or in the store's own
+func (s *SQLiteStore) inTx(fn func(q Queryer) error) error {
+	if s.db == nil {
+		return fn(s.q)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ============================================================================
+// NOTES
+// ============================================================================
+
+func (s *SQLiteStore) ListNotes(filter NoteFilter) ([]Note, error) {
+	query := "SELECT id, uid, title, content, folder_id, order_index, created_at, updated_at FROM notes WHERE deleted_at IS NULL"
+	var args []interface{}
+	if filter.FolderID != nil {
+		query += " AND folder_id = ?"
+		args = append(args, *filter.FolderID)
+	}
+	for _, tag := range filter.Tags {
+		name, _ := NormalizeTagName(tag)
+		query += " AND id IN (SELECT nt.note_id FROM note_tags nt JOIN tags t ON t.id = nt.tag_id WHERE t.name = ?)"
+		args = append(args, name)
+	}
+	if filter.FolderID != nil {
+		query += " ORDER BY order_index DESC, created_at ASC"
+	} else {
+		query += " ORDER BY order_index ASC, created_at DESC"
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		err := rows.Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := FillNoteTags(s.q, notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (s *SQLiteStore) GetNote(ref string) (Note, error) {
+	var note Note
+	id, err := LookupID(s.q, "notes", ref)
+	if err != nil {
+		return note, notFound(err)
+	}
+
+	err = s.q.QueryRow(
+		"SELECT id, uid, title, content, folder_id, order_index, created_at, updated_at FROM notes WHERE id = ? AND deleted_at IS NULL",
+		id,
+	).Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex, &note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		return note, notFound(err)
+	}
+
+	tags, err := GetNoteTags(s.q, []int{note.ID})
+	if err != nil {
+		return note, err
+	}
+	note.Tags = tags[note.ID]
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	return note, nil
+}
+
+func (s *SQLiteStore) CreateNote(note *Note) error {
+	if note.UID == "" {
+		note.UID = NewUID()
+	}
+
+	var id interface{} // nil lets the database assign the ID
+	if note.ID != 0 {
+		id = note.ID
+	}
+	res, err := s.q.Exec(
+		"INSERT INTO notes (id, uid, title, content, folder_id, order_index, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		id, note.UID, note.Title, note.Content, note.FolderID, note.OrderIndex, note.CreatedAt, note.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	insertID, _ := res.LastInsertId()
+	note.ID = int(insertID)
+	return s.saveNoteTags(note)
+}
+
+func (s *SQLiteStore) UpdateNote(note *Note) error {
+	result, err := s.q.Exec(
+		"UPDATE notes SET title = ?, content = ?, folder_id = ?, order_index = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL",
+		note.Title, note.Content, note.FolderID, note.OrderIndex, note.UpdatedAt, note.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+
+	// The previous content is kept as a revision; apply retention
+	if err := PruneRevisions(s.q, note.ID, Revisions); err != nil {
+		return err
+	}
+	return s.saveNoteTags(note)
+}
+
+func (s *SQLiteStore) MaxOrderIndex(folderID *int) (int, error) {
+	var maxOrder int
+	err := s.q.QueryRow("SELECT COALESCE(MAX(order_index), 0) FROM notes WHERE folder_id IS ? AND deleted_at IS NULL", folderID).Scan(&maxOrder)
+	return maxOrder, err
+}
+
+func (s *SQLiteStore) TrashNote(id int) error {
+	// The note is permanently removed when the trash is purged
+	result, err := s.q.Exec("UPDATE notes SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ReorderNotes(folderID int, order map[int]int) error {
+	return s.inTx(func(q Queryer) error {
+		for noteID, index := range order {
+			_, err := q.Exec(
+				"UPDATE notes SET order_index = ? WHERE id = ? AND folder_id = ? AND deleted_at IS NULL",
+				index, noteID, folderID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveNoteTags stores the tags of a just-saved note and fills note.Tags
+func (s *SQLiteStore) saveNoteTags(note *Note) error {
+	if err := SetNoteTags(s.q, note.ID, note.Content, note.Tags); err != nil {
+		return err
+	}
+
+	tags, err := GetNoteTags(s.q, []int{note.ID})
+	if err != nil {
+		return err
+	}
+	note.Tags = tags[note.ID]
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	return nil
+}
+
+// ============================================================================
+// FOLDERS
+// ============================================================================
+
+func (s *SQLiteStore) ListFolders() ([]Folder, error) {
+	rows, err := s.q.Query("SELECT id, uid, name, parent_id, created_at FROM folders WHERE deleted_at IS NULL ORDER BY created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		var folder Folder
+		if err := rows.Scan(&folder.ID, &folder.UID, &folder.Name, &folder.ParentID, &folder.CreatedAt); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+func (s *SQLiteStore) GetFolder(id int) (Folder, error) {
+	var folder Folder
+	err := s.q.QueryRow(
+		"SELECT id, uid, name, parent_id, created_at FROM folders WHERE id = ? AND deleted_at IS NULL",
+		id,
+	).Scan(&folder.ID, &folder.UID, &folder.Name, &folder.ParentID, &folder.CreatedAt)
+	return folder, notFound(err)
+}
+
+func (s *SQLiteStore) CreateFolder(folder *Folder) error {
+	if folder.ParentID != nil {
+		if _, err := s.GetFolder(*folder.ParentID); err != nil {
+			return err
+		}
+	}
+
+	taken, err := FolderNameTaken(s.q, folder.Name, folder.ParentID, 0)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNameTaken
+	}
+
+	if folder.UID == "" {
+		folder.UID = NewUID()
+	}
+	if folder.CreatedAt.IsZero() {
+		folder.CreatedAt = time.Now()
+	}
+
+	var id interface{} // nil lets the database assign the ID
+	if folder.ID != 0 {
+		id = folder.ID
+	}
+	res, err := s.q.Exec(
+		"INSERT INTO folders (id, uid, name, parent_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, folder.UID, folder.Name, folder.ParentID, folder.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	insertID, _ := res.LastInsertId()
+	folder.ID = int(insertID)
+	return nil
+}
+
+func (s *SQLiteStore) RenameFolder(id int, name string) (Folder, error) {
+	// The parent is not changed here; look it up for the name check
+	folder, err := s.GetFolder(id)
+	if err != nil {
+		return folder, err
+	}
+
+	taken, err := FolderNameTaken(s.q, name, folder.ParentID, id)
+	if err != nil {
+		return folder, err
+	}
+	if taken {
+		return folder, ErrNameTaken
+	}
+
+	result, err := s.q.Exec("UPDATE folders SET name = ? WHERE id = ? AND deleted_at IS NULL", name, id)
+	if err != nil {
+		return folder, err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return folder, ErrNotFound
+	}
+
+	folder.Name = name
+	return folder, nil
+}
+
+func (s *SQLiteStore) MoveFolder(id int, parentID *int, name string) (Folder, error) {
+	folder, err := s.GetFolder(id)
+	if err != nil {
+		return folder, err
+	}
+
+	if parentID != nil {
+		if _, err := s.GetFolder(*parentID); err != nil {
+			return folder, err
+		}
+		cycle, err := FolderInSubtree(s.q, *parentID, id)
+		if err != nil {
+			return folder, err
+		}
+		if cycle {
+			return folder, ErrFolderCycle
+		}
+	}
+
+	taken, err := FolderNameTaken(s.q, name, parentID, id)
+	if err != nil {
+		return folder, err
+	}
+	if taken {
+		return folder, ErrNameTaken
+	}
+
+	if _, err := s.q.Exec("UPDATE folders SET name = ?, parent_id = ? WHERE id = ?", name, parentID, id); err != nil {
+		return folder, err
+	}
+	folder.Name, folder.ParentID = name, parentID
+	return folder, nil
+}
+
+func (s *SQLiteStore) CountFolderNotes() (map[int]int, error) {
+	return countFolderNotes(s.q)
+}
+
+func (s *SQLiteStore) TrashFolder(id int, recursive bool) (int, int, error) {
+	var folders, notes int
+	err := s.inTx(func(q Queryer) error {
+		var exists bool
+		err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE id = ? AND deleted_at IS NULL)", id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+
+		folderIDs, err := FolderSubtree(q, id)
+		if err != nil {
+			return err
+		}
+
+		inClause, args := intsInClause(folderIDs)
+		var noteCount int
+		err = q.QueryRow("SELECT COUNT(*) FROM notes WHERE folder_id IN "+inClause+" AND deleted_at IS NULL", args...).Scan(&noteCount)
+		if err != nil {
+			return err
+		}
+
+		if !recursive && (noteCount > 0 || len(folderIDs) > 1) {
+			return &FolderNotEmptyError{Notes: noteCount, Subfolders: len(folderIDs) - 1}
+		}
+
+		if err := TrashFolders(q, folderIDs, time.Now().UTC()); err != nil {
+			return err
+		}
+		folders, notes = len(folderIDs), noteCount
+		return nil
+	})
+	return folders, notes, err
+}
+
+// ============================================================================
+// ATTACHMENTS
+// ============================================================================
+
+func (s *SQLiteStore) ListAttachments(noteID int) ([]Attachment, error) {
+	rows, err := s.q.Query(
+		"SELECT id, uid, note_id, filename, original_name, mime_type, size, COALESCE(sha256, ''), created_at FROM attachments WHERE note_id = ? AND deleted_at IS NULL ORDER BY created_at DESC",
+		noteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.UID, &a.NoteID, &a.Filename, &a.OriginalName, &a.MimeType, &a.Size, &a.SHA256, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (s *SQLiteStore) GetAttachment(ref string) (Attachment, error) {
+	var a Attachment
+	id, err := LookupID(s.q, "attachments", ref)
+	if err != nil {
+		return a, notFound(err)
+	}
+
+	err = s.q.QueryRow(`
+		SELECT a.id, a.uid, a.note_id, n.uid, a.filename, a.original_name, a.mime_type, a.size,
+			COALESCE(a.sha256, ''), a.created_at
+		FROM attachments a
+		JOIN notes n ON n.id = a.note_id
+		WHERE a.id = ? AND a.deleted_at IS NULL`, id,
+	).Scan(&a.ID, &a.UID, &a.NoteID, &a.NoteUID, &a.Filename, &a.OriginalName, &a.MimeType, &a.Size, &a.SHA256, &a.CreatedAt)
+	return a, notFound(err)
+}
+
+func (s *SQLiteStore) CreateAttachment(a *Attachment) error {
+	if a.UID == "" {
+		a.UID = NewUID()
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+
+	result, err := s.q.Exec(
+		"INSERT INTO attachments (uid, note_id, filename, original_name, mime_type, size, sha256, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.UID, a.NoteID, a.Filename, a.OriginalName, a.MimeType, a.Size, a.SHA256, a.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, _ := result.LastInsertId()
+	a.ID = int(id)
+	return nil
+}
+
+func (s *SQLiteStore) UpdateAttachment(a *Attachment) error {
+	result, err := s.q.Exec(
+		"UPDATE attachments SET original_name = ?, note_id = ? WHERE id = ? AND deleted_at IS NULL",
+		a.OriginalName, a.NoteID, a.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) TrashAttachment(id int) error {
+	result, err := s.q.Exec(
+		"UPDATE attachments SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// notFound turns sql.ErrNoRows into ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,461 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestSQLite initializes a new database in a temporary directory, as
+// the server does at startup, and returns the stores on it. DB and the
+// paths are globals, so tests using it must not run in parallel.
+func openTestSQLite(t *testing.T) Stores {
+	t.Helper()
+	dir := t.TempDir()
+	DatabasePath, AttachmentDir = filepath.Join(dir, "notes.db"), filepath.Join(dir, "attachments")
+	InitDB()
+	t.Cleanup(func() { DB.Close() })
+	return NewSQLiteStore(DB).Stores()
+}
+
+func TestInitDB(t *testing.T) {
+	openTestSQLite(t)
+	t.Logf("driver %s", SQLiteDriver)
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrations[len(migrations)-1].Version; version != latest {
+		t.Errorf("SchemaVersion after InitDB: got %d, want %d", version, latest)
+	}
+	statuses, err := GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("migration %04d_%s not applied", status.Version, status.Name)
+		}
+	}
+
+	// Opening the database again changes nothing
+	if err := Migrate(); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+	DB.Close()
+	InitDB()
+	folders, err := NewSQLiteStore(DB).ListFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 3 {
+		t.Errorf("folders after opening twice: got %d, want the 3 default folders", len(folders))
+	}
+}
+
+func TestSQLiteNotes(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	folder := Folder{Name: "Projects"}
+	if err := stores.Folders.CreateFolder(&folder); err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	note := Note{
+		Title:      "Launch",
+		Content:    "Ship it #release",
+		FolderID:   &folder.ID,
+		OrderIndex: 1,
+		Tags:       []string{"work"},
+		CreatedAt:  created,
+		UpdatedAt:  created,
+	}
+	if err := stores.Notes.CreateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	if note.ID == 0 || !ValidUID(note.UID) {
+		t.Fatalf("CreateNote: got ID %d and UID %q", note.ID, note.UID)
+	}
+
+	for _, ref := range []string{note.UID, strconv.Itoa(note.ID)} {
+		got, err := stores.Notes.GetNote(ref)
+		if err != nil {
+			t.Fatalf("GetNote(%s): %v", ref, err)
+		}
+		if got.Title != note.Title || got.Content != note.Content || got.FolderID == nil || *got.FolderID != folder.ID ||
+			!got.CreatedAt.Equal(created) || strings.Join(got.Tags, ",") != "release,work" {
+			t.Errorf("GetNote(%s): got %+v, want %+v with tags release and work", ref, got, note)
+		}
+	}
+
+	// Manual tags stay when the tags are left out; hashtags follow the content
+	note.Content = "Shipped"
+	note.Tags = nil
+	note.UpdatedAt = created.Add(time.Hour)
+	if err := stores.Notes.UpdateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(note.Tags, ",") != "work" {
+		t.Errorf("tags after UpdateNote: got %v, want [work]", note.Tags)
+	}
+
+	other := Note{Title: "Other", Content: "Unrelated", FolderID: &folder.ID, OrderIndex: 2, CreatedAt: created, UpdatedAt: created}
+	if err := stores.Notes.CreateNote(&other); err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := stores.Notes.ListNotes(NoteFilter{FolderID: &folder.ID, Tags: []string{"WORK"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 1 || tagged[0].ID != note.ID {
+		t.Errorf("ListNotes tagged work: got %+v, want the first note", tagged)
+	}
+	if max, err := stores.Notes.MaxOrderIndex(&folder.ID); err != nil || max != 2 {
+		t.Errorf("MaxOrderIndex: got %d, %v; want 2", max, err)
+	}
+
+	if err := stores.Notes.TrashNote(note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores.Notes.GetNote(note.UID); err != ErrNotFound {
+		t.Errorf("GetNote of a trashed note: got %v, want ErrNotFound", err)
+	}
+	if err := stores.Notes.TrashNote(note.ID); err != ErrNotFound {
+		t.Errorf("TrashNote twice: got %v, want ErrNotFound", err)
+	}
+	notes, err := stores.Notes.ListNotes(NoteFilter{FolderID: &folder.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].ID != other.ID {
+		t.Errorf("ListNotes after trashing: got %+v, want only the other note", notes)
+	}
+}
+
+func TestSQLiteFolders(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	parent := Folder{Name: "Parent"}
+	if err := stores.Folders.CreateFolder(&parent); err != nil {
+		t.Fatal(err)
+	}
+	child := Folder{Name: "Child", ParentID: &parent.ID}
+	if err := stores.Folders.CreateFolder(&child); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Folders.CreateFolder(&Folder{Name: "Child", ParentID: &parent.ID}); err != ErrNameTaken {
+		t.Errorf("CreateFolder with a taken name: got %v, want ErrNameTaken", err)
+	}
+
+	got, err := stores.Folders.GetFolder(child.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UID != child.UID || got.ParentID == nil || *got.ParentID != parent.ID {
+		t.Errorf("GetFolder: got %+v, want %+v", got, child)
+	}
+
+	if _, err := stores.Folders.MoveFolder(parent.ID, &child.ID, parent.Name); err != ErrFolderCycle {
+		t.Errorf("moving a folder into its child: got %v, want ErrFolderCycle", err)
+	}
+	renamed, err := stores.Folders.RenameFolder(child.ID, "Renamed")
+	if err != nil || renamed.Name != "Renamed" {
+		t.Errorf("RenameFolder: got %+v, %v", renamed, err)
+	}
+
+	now := time.Now().UTC()
+	note := Note{Title: "Inside", Content: "", FolderID: &child.ID, CreatedAt: now, UpdatedAt: now}
+	if err := stores.Notes.CreateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := stores.Folders.CountFolderNotes()
+	if err != nil || counts[child.ID] != 1 {
+		t.Errorf("CountFolderNotes: got %v, %v; want 1 note in the child", counts, err)
+	}
+
+	var notEmpty *FolderNotEmptyError
+	if _, _, err := stores.Folders.TrashFolder(parent.ID, false); !errors.As(err, &notEmpty) || notEmpty.Subfolders != 1 {
+		t.Errorf("TrashFolder of a non-empty folder: got %v, want FolderNotEmptyError", err)
+	}
+	folders, notes, err := stores.Folders.TrashFolder(parent.ID, true)
+	if err != nil || folders != 2 || notes != 1 {
+		t.Errorf("recursive TrashFolder: got %d folders and %d notes, %v; want 2 and 1", folders, notes, err)
+	}
+	if _, err := stores.Folders.GetFolder(child.ID); err != ErrNotFound {
+		t.Errorf("GetFolder of a trashed folder: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSQLiteAttachments(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	now := time.Now().UTC()
+	note := Note{Title: "With files", Content: "", CreatedAt: now, UpdatedAt: now}
+	if err := stores.Notes.CreateNote(&note); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := strings.Repeat("ab", 32)
+	attachment := Attachment{
+		NoteID:       note.ID,
+		Filename:     BlobFilename(sum),
+		OriginalName: "report.pdf",
+		MimeType:     "application/pdf",
+		Size:         1024,
+		SHA256:       sum,
+	}
+	if err := stores.Attachments.CreateAttachment(&attachment); err != nil {
+		t.Fatal(err)
+	}
+	second := attachment
+	second.ID, second.UID, second.OriginalName = 0, "", "copy.pdf"
+	if err := stores.Attachments.CreateAttachment(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stores.Attachments.GetAttachment(attachment.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != attachment.ID || got.NoteUID != note.UID || got.SHA256 != sum || got.Size != 1024 {
+		t.Errorf("GetAttachment: got %+v, want %+v on note %s", got, attachment, note.UID)
+	}
+	blob, err := stores.Blobs.FindBlob(sum)
+	if err != nil || blob.Refs != 2 || blob.Size != 1024 {
+		t.Errorf("FindBlob: got %+v, %v; want 2 refs", blob, err)
+	}
+
+	attachment.OriginalName = "final.pdf"
+	if err := stores.Attachments.UpdateAttachment(&attachment); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Attachments.TrashAttachment(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	attachments, err := stores.Attachments.ListAttachments(note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 || attachments[0].OriginalName != "final.pdf" {
+		t.Errorf("ListAttachments: got %+v, want only final.pdf", attachments)
+	}
+	if _, err := stores.Attachments.GetAttachment(strconv.Itoa(second.ID)); err != ErrNotFound {
+		t.Errorf("GetAttachment of a trashed attachment: got %v, want ErrNotFound", err)
+	}
+}
+
+// TestSQLiteBlobRefs checks that identical content is stored once and that
+// its blob is removed only when the last attachment using it is purged
+func TestSQLiteBlobRefs(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	sum, size, created, err := StoreBlob(strings.NewReader("hello, world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256([]byte("hello, world\n")); sum != hex.EncodeToString(want[:]) || size != 13 || !created {
+		t.Errorf("StoreBlob: got %s of size %d, created %v; want the content's SHA-256, 13, true", sum, size, created)
+	}
+	if again, _, created, err := StoreBlob(strings.NewReader("hello, world\n")); err != nil || again != sum || created {
+		t.Errorf("StoreBlob of the same content: got %s, created %v, %v; want %s, false", again, created, err, sum)
+	}
+	blobPath := filepath.Join(AttachmentDir, BlobFilename(sum))
+	thumbnail := filepath.Join(AttachmentDir, ThumbnailFilename(BlobFilename(sum), 128))
+	if err := os.WriteFile(thumbnail, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(AttachmentDir, "tmp")); len(tmp) != 0 {
+		t.Errorf("StoreBlob left %d temporary files", len(tmp))
+	}
+
+	now := time.Now().UTC()
+	attach := func(title string) (Note, Attachment) {
+		t.Helper()
+		note := Note{Title: title, Content: "", CreatedAt: now, UpdatedAt: now}
+		if err := stores.Notes.CreateNote(&note); err != nil {
+			t.Fatal(err)
+		}
+		attachment := Attachment{NoteID: note.ID, Filename: BlobFilename(sum), OriginalName: title + ".txt", MimeType: "text/plain", Size: size, SHA256: sum}
+		if err := stores.Attachments.CreateAttachment(&attachment); err != nil {
+			t.Fatal(err)
+		}
+		return note, attachment
+	}
+	refs := func(want int) {
+		t.Helper()
+		blob, err := stores.Blobs.FindBlob(sum)
+		if want == 0 && err != ErrNotFound || want > 0 && (err != nil || blob.Refs != want) {
+			t.Errorf("FindBlob: got %d refs, %v; want %d", blob.Refs, err, want)
+		}
+	}
+	purge := func() {
+		t.Helper()
+		if _, err := stores.Trash.PurgeTrash(time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, _ := attach("first")
+	_, second := attach("second")
+	refs(2)
+
+	// A trashed attachment still holds its blob
+	if err := stores.Notes.TrashNote(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	refs(2)
+	purge()
+	refs(1)
+	if !BlobExists(sum) {
+		t.Error("the blob was removed while an attachment still uses it")
+	}
+
+	if err := stores.Attachments.TrashAttachment(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	purge()
+	refs(0)
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("the blob was kept after its last attachment was purged: %v", err)
+	}
+	if _, err := os.Stat(thumbnail); !os.IsNotExist(err) {
+		t.Errorf("the blob's thumbnail was kept: %v", err)
+	}
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	now := time.Now().UTC()
+	for _, note := range []Note{
+		{Title: "Quarterly <report>", Content: "Revenue grew in every region"},
+		{Title: "Groceries", Content: "Café au lait, bread and a report card"},
+		{Title: "Unrelated", Content: "Nothing to see"},
+	} {
+		note.CreatedAt, note.UpdatedAt = now, now
+		if err := stores.Notes.CreateNote(&note); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(terms ...SearchTerm) []SearchResult {
+		t.Helper()
+		results, err := stores.Search.SearchNotes(SearchQuery{Terms: terms, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	// A title match ranks above a content match
+	results := search(SearchTerm{Text: "report"})
+	if len(results) != 2 || results[0].Title != "Quarterly <report>" {
+		t.Fatalf("search report: got %+v, want the title match first", results)
+	}
+	if results[0].Highlight != "Quarterly &lt;<mark>report</mark>&gt;" {
+		t.Errorf("highlight: got %q", results[0].Highlight)
+	}
+
+	if results := search(SearchTerm{Text: "gro", Prefix: true}); len(results) != 1 || results[0].Title != "Groceries" {
+		t.Errorf("search gro*: got %+v, want Groceries", results)
+	}
+	if results := search(SearchTerm{Text: "cafe"}); len(results) != 1 || results[0].Title != "Groceries" {
+		t.Errorf("search cafe: got %+v, want Groceries with its accent folded", results)
+	}
+	if results := search(SearchTerm{Text: "every region"}); len(results) != 1 {
+		t.Errorf("search for a phrase: got %d results, want 1", len(results))
+	}
+	if results := search(SearchTerm{Text: "missing"}); len(results) != 0 {
+		t.Errorf("search missing: got %+v, want none", results)
+	}
+}
+
+func TestSQLiteTombstones(t *testing.T) {
+	stores := openTestSQLite(t)
+
+	now := time.Now().UTC()
+	trashNote := func(title string) int64 {
+		t.Helper()
+		note := Note{Title: title, Content: "", CreatedAt: now, UpdatedAt: now}
+		if err := stores.Notes.CreateNote(&note); err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Notes.TrashNote(note.ID); err != nil {
+			t.Fatal(err)
+		}
+		seq, err := stores.Sync.ChangeSeq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seq
+	}
+	collect := func(before time.Time, want int) {
+		t.Helper()
+		if count, err := stores.Sync.CollectTombstones(before); err != nil || count != want {
+			t.Errorf("CollectTombstones: got %d, %v; want %d", count, err, want)
+		}
+	}
+	ack := func(device string, seq int64) {
+		t.Helper()
+		if err := stores.Sync.RecordDeviceSync(device, "", seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := trashNote("First")
+	changes, err := stores.Sync.ChangesSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Tombstones) != 1 || changes.Tombstones[0].Type != "note" {
+		t.Fatalf("ChangesSince(0) tombstones: got %+v, want the trashed note", changes.Tombstones)
+	}
+	if changes, err := stores.Sync.ChangesSince(first); err != nil || len(changes.Tombstones) != 0 {
+		t.Errorf("ChangesSince(%d) tombstones: got %+v, %v; want none", first, changes.Tombstones, err)
+	}
+
+	// Kept until every device has received them
+	collect(time.Time{}, 0)
+	ack("phone", first)
+	ack("laptop", 0)
+	collect(time.Time{}, 0)
+	ack("laptop", first)
+	collect(time.Time{}, 1)
+	if horizon, err := stores.Sync.TombstoneHorizon(); err != nil || horizon == 0 || horizon > first {
+		t.Errorf("TombstoneHorizon: got %d, %v; want the collected tombstone's sequence", horizon, err)
+	}
+
+	// Revoked devices are not waited for
+	second := trashNote("Second")
+	ack("phone", second)
+	collect(time.Time{}, 0)
+	if err := stores.Sync.RevokeDevice("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	collect(time.Time{}, 1)
+
+	// Nor are devices that have been away longer than the time cap
+	trashNote("Third")
+	collect(time.Time{}, 0)
+	collect(now.Add(-time.Hour), 0)
+	collect(now.Add(time.Hour), 1)
+
+	if device, err := stores.Sync.GetDevice("phone"); err != nil || device.LastAckSeq != second {
+		t.Errorf("GetDevice: got %+v, %v; want last_ack_seq %d", device, err, second)
+	}
+	if _, err := stores.Sync.GetDevice("tablet"); err != ErrNotFound {
+		t.Errorf("GetDevice of an unknown device: got %v, want ErrNotFound", err)
+	}
+}
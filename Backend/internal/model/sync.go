@@ -0,0 +1,516 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tombstone records that a note, folder or attachment was deleted, so the
+// deletion can be passed on to devices that still have a copy
+type Tombstone struct {
+	Type      string    `json:"type"` // "note", "folder" or "attachment"
+	ID        int       `json:"id"`
+	UID       *string   `json:"uid"` // nil for items purged before global IDs existed
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// NoteConflict records a sync edit that could not be merged into a note.
+// The device's version was saved as a separate copy note.
+type NoteConflict struct {
+	ID           int        `json:"id"`
+	NoteID       int        `json:"note_id"`
+	NoteUID      string     `json:"note_uid"`
+	NoteTitle    string     `json:"note_title"`
+	CopyNoteID   int        `json:"copy_note_id"`
+	CopyNoteUID  string     `json:"copy_note_uid"`
+	DeviceID     *string    `json:"device_id"`
+	BaseRevision int        `json:"base_revision"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Device is a client that has synced with the server
+type Device struct {
+	ID          string     `json:"id"`
+	Name        *string    `json:"name"`
+	FirstSeenAt time.Time  `json:"first_seen_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at"`
+	LastAckSeq  int64      `json:"last_ack_seq"` // Every change up to this sequence has reached the device
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// ErrDeviceRevoked is returned when a revoked device tries to sync
+var ErrDeviceRevoked = errors.New("device has been revoked")
+
+// ValidTombstoneType reports whether t is an entity type that can be deleted through sync
+func ValidTombstoneType(t string) bool {
+	return t == "note" || t == "folder" || t == "attachment"
+}
+
+// ChangeSeq returns the sequence number of the latest committed change.
+// Writers hold the counter row until they commit, so no change still to be
+// committed can get a lower number.
+func (s *sqlStore) ChangeSeq() (int64, error) {
+	var seq int64
+	err := s.q.QueryRow("SELECT value FROM sync_sequence WHERE id = 1").Scan(&seq)
+	return seq, err
+}
+
+// ChangesSince returns what changed after the given change sequence
+func (s *sqlStore) ChangesSince(cursor int64) (Changes, error) {
+	var changes Changes
+	var err error
+	if changes.Folders, err = s.foldersSince(cursor); err != nil {
+		return changes, err
+	}
+	if changes.Notes, err = s.notesSince(cursor); err != nil {
+		return changes, err
+	}
+	if changes.Attachments, err = s.attachmentsSince(cursor); err != nil {
+		return changes, err
+	}
+	changes.Tombstones, err = s.tombstonesSince(cursor)
+	return changes, err
+}
+
+// foldersSince returns folders changed after the given change sequence
+func (s *sqlStore) foldersSince(cursor int64) ([]Folder, error) {
+	rows, err := s.q.Query(`
+		SELECT f.id, f.uid, f.name, f.parent_id, p.uid, f.created_at
+		FROM folders f
+		LEFT JOIN folders p ON p.id = f.parent_id
+		WHERE f.seq > ? AND f.deleted_at IS NULL
+		ORDER BY f.seq`, cursor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		var folder Folder
+		err := rows.Scan(&folder.ID, &folder.UID, &folder.Name, &folder.ParentID, &folder.ParentUID, &folder.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// notesSince returns notes changed after the given change sequence, with
+// their current revision number
+func (s *sqlStore) notesSince(cursor int64) ([]Note, error) {
+	rows, err := s.q.Query(`
+		SELECT n.id, n.uid, n.title, n.content, n.folder_id, f.uid, n.order_index, n.created_at, n.updated_at,
+			(SELECT COALESCE(MAX(revision), 0) FROM note_revisions WHERE note_id = n.id)
+		FROM notes n
+		LEFT JOIN folders f ON f.id = n.folder_id
+		WHERE n.seq > ? AND n.deleted_at IS NULL
+		ORDER BY n.seq`, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	for rows.Next() {
+		var note Note
+		err := rows.Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.FolderUID,
+			&note.OrderIndex, &note.CreatedAt, &note.UpdatedAt, &note.Revision)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := FillNoteTags(s.q, notes); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// attachmentsSince returns attachments changed after the given change
+// sequence
+func (s *sqlStore) attachmentsSince(cursor int64) ([]Attachment, error) {
+	rows, err := s.q.Query(`
+		SELECT a.id, a.uid, a.note_id, n.uid, a.filename, a.original_name, a.mime_type, a.size,
+			COALESCE(a.sha256, ''), a.created_at
+		FROM attachments a
+		JOIN notes n ON n.id = a.note_id
+		WHERE a.seq > ? AND a.deleted_at IS NULL
+		ORDER BY a.seq`, cursor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.UID, &a.NoteID, &a.NoteUID, &a.Filename,
+			&a.OriginalName, &a.MimeType, &a.Size, &a.SHA256, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// tombstonesSince returns deletions recorded after the given change
+// sequence, oldest first
+func (s *sqlStore) tombstonesSince(cursor int64) ([]Tombstone, error) {
+	rows, err := s.q.Query(
+		"SELECT entity_type, entity_id, entity_uid, deleted_at FROM tombstones WHERE seq > ? ORDER BY seq",
+		cursor,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tombstones := []Tombstone{}
+	for rows.Next() {
+		var tombstone Tombstone
+		if err := rows.Scan(&tombstone.Type, &tombstone.ID, &tombstone.UID, &tombstone.DeletedAt); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, rows.Err()
+}
+
+// FindID returns the ID of a note, folder or attachment, live or trashed,
+// by its global ID, or checks its integer ID if uid is empty
+func (s *sqlStore) FindID(kind, uid string, id int) (int, error) {
+	if !ValidTombstoneType(kind) {
+		return 0, fmt.Errorf("unknown item type %q", kind)
+	}
+	var found int
+	var err error
+	if uid != "" {
+		err = s.q.QueryRow("SELECT id FROM "+kind+"s WHERE uid = ?", uid).Scan(&found)
+	} else {
+		err = s.q.QueryRow("SELECT id FROM "+kind+"s WHERE id = ?", id).Scan(&found)
+	}
+	return found, notFound(err)
+}
+
+// FindLegacyID returns id if that note, folder or attachment was created at
+// createdAt. Times are compared to the second, as devices may keep less
+// precision than the database.
+func (s *sqlStore) FindLegacyID(kind string, id int, createdAt time.Time) (int, error) {
+	if !ValidTombstoneType(kind) {
+		return 0, fmt.Errorf("unknown item type %q", kind)
+	}
+	var stored time.Time
+	err := s.q.QueryRow("SELECT created_at FROM "+kind+"s WHERE id = ?", id).Scan(&stored)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	if d := stored.Sub(createdAt); d <= -time.Second || d >= time.Second {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+// SyncedNote returns a note whether or not it is in the trash, with its
+// current revision number but without its tags
+func (s *sqlStore) SyncedNote(id int) (Note, bool, error) {
+	var note Note
+	var deleted bool
+	err := s.q.QueryRow(`
+		SELECT n.id, n.uid, n.title, n.content, n.folder_id, n.order_index, n.created_at, n.updated_at,
+			n.deleted_at IS NOT NULL,
+			(SELECT COALESCE(MAX(revision), 0) FROM note_revisions WHERE note_id = n.id)
+		FROM notes n WHERE n.id = ?`, id,
+	).Scan(&note.ID, &note.UID, &note.Title, &note.Content, &note.FolderID, &note.OrderIndex,
+		&note.CreatedAt, &note.UpdatedAt, &deleted, &note.Revision)
+	return note, deleted, notFound(err)
+}
+
+// HasTombstone reports whether the given entity has been deleted. It is
+// looked up by global ID when uid is set, otherwise by integer ID.
+func (s *sqlStore) HasTombstone(kind string, id int, uid string) (bool, error) {
+	var exists bool
+	var err error
+	if uid != "" {
+		err = s.q.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tombstones WHERE entity_type = ? AND entity_uid = ?)",
+			kind, uid,
+		).Scan(&exists)
+	} else {
+		err = s.q.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tombstones WHERE entity_type = ? AND entity_id = ?)",
+			kind, id,
+		).Scan(&exists)
+	}
+	return exists, err
+}
+
+// HasLegacyTombstone reports whether an item with the given integer ID was
+// deleted after createdAt
+func (s *sqlStore) HasLegacyTombstone(kind string, id int, createdAt time.Time) (bool, error) {
+	var exists bool
+	err := s.q.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM tombstones WHERE entity_type = ? AND entity_id = ? AND deleted_at >= ?)",
+		kind, id, createdAt.UTC(),
+	).Scan(&exists)
+	return exists, err
+}
+
+// TrashNoteBefore moves a note to the trash unless it was changed after
+// deletedAt, when a device deleted it
+func (s *sqlStore) TrashNoteBefore(id int, deletedAt time.Time) error {
+	_, err := s.q.Exec(
+		"UPDATE notes SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL AND updated_at <= ?",
+		time.Now().UTC(), id, deletedAt.UTC(),
+	)
+	return err
+}
+
+// RecordDeviceSync registers a device and notes that it has received every
+// change up to ackSeq, the cursor it sent, which cannot be ahead of the
+// server. A non-empty name replaces the
+// device's name. Returns ErrDeviceRevoked for revoked devices.
+func (s *sqlStore) RecordDeviceSync(deviceID, name string, ackSeq int64) error {
+	if err := s.CheckDevice(deviceID); err != nil {
+		return err
+	}
+	seq, err := s.ChangeSeq()
+	if err != nil {
+		return err
+	}
+	if ackSeq > seq {
+		ackSeq = seq
+	}
+
+	now := time.Now().UTC()
+	_, err = s.q.Exec(`
+		INSERT INTO devices (id, name, first_seen_at, last_seen_at, last_ack_seq)
+		VALUES (?, NULLIF(?, ''), ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = COALESCE(excluded.name, devices.name),
+			last_seen_at = excluded.last_seen_at,
+			last_ack_seq = CASE WHEN excluded.last_ack_seq > devices.last_ack_seq
+				THEN excluded.last_ack_seq ELSE devices.last_ack_seq END`,
+		deviceID, name, now, now, ackSeq,
+	)
+	return err
+}
+
+// CheckDevice returns ErrDeviceRevoked if the device has been revoked.
+// Unknown devices are allowed.
+func (s *sqlStore) CheckDevice(deviceID string) error {
+	var revoked bool
+	err := s.q.QueryRow("SELECT revoked_at IS NOT NULL FROM devices WHERE id = ?", deviceID).Scan(&revoked)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrDeviceRevoked
+	}
+	return nil
+}
+
+// GetDevice returns a device that has synced, or ErrNotFound
+func (s *sqlStore) GetDevice(deviceID string) (Device, error) {
+	device := Device{ID: deviceID}
+	err := s.q.QueryRow(
+		"SELECT name, first_seen_at, last_seen_at, last_ack_seq, revoked_at FROM devices WHERE id = ?", deviceID,
+	).Scan(&device.Name, &device.FirstSeenAt, &device.LastSeenAt, &device.LastAckSeq, &device.RevokedAt)
+	return device, notFound(err)
+}
+
+// ListDevices returns every device that has synced, most recently seen first
+func (s *sqlStore) ListDevices() ([]Device, error) {
+	rows, err := s.q.Query(`
+		SELECT id, name, first_seen_at, last_seen_at, last_ack_seq, revoked_at
+		FROM devices
+		ORDER BY last_seen_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var device Device
+		err := rows.Scan(&device.ID, &device.Name, &device.FirstSeenAt, &device.LastSeenAt,
+			&device.LastAckSeq, &device.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// RenameDevice sets a device's friendly name
+func (s *sqlStore) RenameDevice(deviceID, name string) error {
+	res, err := s.q.Exec("UPDATE devices SET name = ? WHERE id = ?", name, deviceID)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeDevice revokes a device. Its sync requests are refused from then
+// on, and tombstones are no longer kept around for it.
+func (s *sqlStore) RevokeDevice(deviceID string) error {
+	res, err := s.q.Exec(
+		"UPDATE devices SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), deviceID,
+	)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListConflicts returns the unresolved conflicts, newest first. A conflict
+// is left out once either of its notes is deleted.
+func (s *sqlStore) ListConflicts() ([]NoteConflict, error) {
+	rows, err := s.q.Query(`
+		SELECT c.id, c.note_id, n.uid, n.title, c.copy_note_id, cn.uid, c.device_id, c.base_revision, c.created_at
+		FROM note_conflicts c
+		JOIN notes n ON n.id = c.note_id AND n.deleted_at IS NULL
+		JOIN notes cn ON cn.id = c.copy_note_id AND cn.deleted_at IS NULL
+		WHERE c.resolved_at IS NULL
+		ORDER BY c.created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []NoteConflict
+	for rows.Next() {
+		var conflict NoteConflict
+		err := rows.Scan(&conflict.ID, &conflict.NoteID, &conflict.NoteUID, &conflict.NoteTitle,
+			&conflict.CopyNoteID, &conflict.CopyNoteUID, &conflict.DeviceID, &conflict.BaseRevision, &conflict.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// GetConflict returns an unresolved conflict, whether or not its notes are
+// live
+func (s *sqlStore) GetConflict(id int) (NoteConflict, error) {
+	conflict := NoteConflict{ID: id}
+	err := s.q.QueryRow(`
+		SELECT c.note_id, n.uid, n.title, c.copy_note_id, cn.uid, c.device_id, c.base_revision, c.created_at
+		FROM note_conflicts c
+		JOIN notes n ON n.id = c.note_id
+		JOIN notes cn ON cn.id = c.copy_note_id
+		WHERE c.id = ? AND c.resolved_at IS NULL`, id,
+	).Scan(&conflict.NoteID, &conflict.NoteUID, &conflict.NoteTitle, &conflict.CopyNoteID, &conflict.CopyNoteUID,
+		&conflict.DeviceID, &conflict.BaseRevision, &conflict.CreatedAt)
+	return conflict, notFound(err)
+}
+
+// CreateConflict records a conflict, filling in its ID
+func (s *sqlStore) CreateConflict(conflict *NoteConflict) error {
+	return s.q.QueryRow(
+		"INSERT INTO note_conflicts (note_id, copy_note_id, device_id, base_revision, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		conflict.NoteID, conflict.CopyNoteID, conflict.DeviceID, conflict.BaseRevision, conflict.CreatedAt,
+	).Scan(&conflict.ID)
+}
+
+// ResolveConflict marks a conflict as resolved
+func (s *sqlStore) ResolveConflict(id int) error {
+	_, err := s.q.Exec("UPDATE note_conflicts SET resolved_at = ? WHERE id = ?", time.Now().UTC(), id)
+	return err
+}
+
+// TombstoneHorizon returns the change sequence up to which tombstones have
+// been collected. A device whose cursor is older may have missed deletions
+// and must sync again from scratch.
+func (s *sqlStore) TombstoneHorizon() (int64, error) {
+	var horizon int64
+	err := s.q.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM tombstone_horizon").Scan(&horizon)
+	return horizon, err
+}
+
+// CollectTombstones removes the tombstones every device that has synced and
+// is not revoked has received, and moves the tombstone horizon past them, in
+// one transaction. Nothing is removed until a device has synced. So that a
+// device that never comes back cannot keep tombstones forever, deletions
+// made at or before the given time are removed as well; pass the zero time
+// to wait for every device.
+func (s *sqlStore) CollectTombstones(before time.Time) (int, error) {
+	// deleted_at is always written in UTC so it compares correctly as text
+	before = before.UTC()
+
+	var count int
+	err := s.inTx(func(tx *sqlStore) error {
+		var horizon sql.NullInt64
+		err := tx.q.QueryRow(`
+			SELECT MAX(seq) FROM tombstones
+			WHERE seq <= (SELECT COALESCE(MIN(last_ack_seq), 0) FROM devices WHERE revoked_at IS NULL)
+				OR deleted_at <= ?`, before,
+		).Scan(&horizon)
+		if err != nil || !horizon.Valid {
+			return err
+		}
+
+		_, err = tx.q.Exec(`
+			INSERT INTO tombstone_horizon (id, seq) VALUES (1, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				seq = CASE WHEN excluded.seq > tombstone_horizon.seq THEN excluded.seq ELSE tombstone_horizon.seq END`,
+			horizon.Int64,
+		)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.q.Exec("DELETE FROM tombstones WHERE seq <= ?", horizon.Int64)
+		if err != nil {
+			return err
+		}
+		deleted, _ := res.RowsAffected()
+		count = int(deleted)
+		return nil
+	})
+	return count, err
+}
+
+// StartTombstoneCollector periodically removes tombstones every device has
+// received. Those older than the trash retention are removed even if a
+// device has not synced since; with automatic purging disabled they wait
+// for every device.
+func StartTombstoneCollector(sync SyncStore, interval time.Duration) {
+	go func() {
+		for {
+			var before time.Time
+			if TrashRetention > 0 {
+				before = time.Now().Add(-TrashRetention)
+			}
+			count, err := sync.CollectTombstones(before)
+			if err != nil {
+				logging.Errorf("Error collecting tombstones: %v", err)
+			} else if count > 0 {
+				logging.Infof("🪦 Removed %d tombstones", count)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,383 @@
+package model
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Tag represents a label that can be attached to any number of notes
+type Tag struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	NoteCount int       `json:"note_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MaxTagLength is the longest tag name accepted, in characters
+const MaxTagLength = 64
+
+// tagPattern matches a tag name: a letter, then letters, digits, _ or -,
+// not ending in -
+const tagPattern = `\p{L}(?:[\p{L}\p{N}_-]*[\p{L}\p{N}_])?`
+
+// hashtagRegex finds #tags in prose. The character before # must not be part
+// of a word, an HTML entity, a URL fragment or a link target.
+var hashtagRegex = regexp.MustCompile(`(^|[^\p{L}\p{N}_&#/(])#(` + tagPattern + `)`)
+
+var tagNameRegex = regexp.MustCompile(`^` + tagPattern + `$`)
+
+// NormalizeTagName trims whitespace and a leading # and reports whether the
+// result is a valid tag name
+func NormalizeTagName(name string) (string, bool) {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+	if utf8.RuneCountInString(name) > MaxTagLength || !tagNameRegex.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// ExtractHashtags returns the distinct #tags in Markdown content, in order of
+// first appearance. Tags inside code blocks and inline code are ignored.
+// Tags are case-insensitive; the first spelling wins.
+func ExtractHashtags(content string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+
+	mapProse(content, func(text string) string {
+		for _, match := range hashtagRegex.FindAllStringSubmatch(text, -1) {
+			tag := match[2]
+			if utf8.RuneCountInString(tag) > MaxTagLength {
+				continue
+			}
+			if key := strings.ToLower(tag); !seen[key] {
+				seen[key] = true
+				tags = append(tags, tag)
+			}
+		}
+		return text
+	})
+
+	return tags
+}
+
+// RewriteHashtag replaces #from with #to in Markdown content, ignoring case
+// and leaving code untouched. An empty to removes the # and keeps the word.
+func RewriteHashtag(content, from, to string) string {
+	return mapProse(content, func(text string) string {
+		return hashtagRegex.ReplaceAllStringFunc(text, func(match string) string {
+			groups := hashtagRegex.FindStringSubmatch(match)
+			if !strings.EqualFold(groups[2], from) {
+				return match
+			}
+			if to == "" {
+				return groups[1] + groups[2]
+			}
+			return groups[1] + "#" + to
+		})
+	})
+}
+
+// SetNoteTags stores a note's tags: every #hashtag in content, plus manual
+// tags. requested is the full tag list sent by a client; names that are not
+// hashtags in content become manual tags. Tags that were inline before are
+// not turned into manual tags just because a client echoed them back.
+// A nil requested keeps the note's existing manual tags.
+func SetNoteTags(q Queryer, noteID int, content string, requested []string) error {
+	return setNoteTags(q, noteID, content, requested, ensureTag)
+}
+
+// setNoteTags is SetNoteTags with a database-specific way of finding or
+// creating a tag
+func setNoteTags(q Queryer, noteID int, content string, requested []string, ensure func(Queryer, string) (int, error)) error {
+	inline := ExtractHashtags(content)
+	inlineSet := make(map[string]bool)
+	for _, tag := range inline {
+		inlineSet[strings.ToLower(tag)] = true
+	}
+
+	rows, err := q.Query(`
+		SELECT t.name, nt.inline FROM note_tags nt
+		JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id = ?`, noteID)
+	if err != nil {
+		return err
+	}
+	prevInline := make(map[string]bool)
+	var prevManual []string
+	for rows.Next() {
+		var name string
+		var wasInline bool
+		if err := rows.Scan(&name, &wasInline); err != nil {
+			rows.Close()
+			return err
+		}
+		if wasInline {
+			prevInline[strings.ToLower(name)] = true
+		} else {
+			prevManual = append(prevManual, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	candidates := prevManual
+	if requested != nil {
+		candidates = nil
+		for _, name := range requested {
+			if normalized, ok := NormalizeTagName(name); ok && !prevInline[strings.ToLower(normalized)] {
+				candidates = append(candidates, normalized)
+			}
+		}
+	}
+
+	var manual []string
+	for _, tag := range candidates {
+		key := strings.ToLower(tag)
+		if !inlineSet[key] {
+			inlineSet[key] = true // Also dedupes manual tags
+			manual = append(manual, tag)
+		}
+	}
+
+	if _, err := q.Exec("DELETE FROM note_tags WHERE note_id = ?", noteID); err != nil {
+		return err
+	}
+
+	for i, tag := range append(inline, manual...) {
+		tagID, err := ensure(q, tag)
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec("INSERT INTO note_tags (note_id, tag_id, inline) VALUES (?, ?, ?)", noteID, tagID, i < len(inline))
+		if err != nil {
+			return err
+		}
+	}
+
+	return DeleteUnusedTags(q)
+}
+
+// GetNoteTags returns the tag names of each note in noteIDs
+func GetNoteTags(q Queryer, noteIDs []int) (map[int][]string, error) {
+	tags := make(map[int][]string)
+	if len(noteIDs) == 0 {
+		return tags, nil
+	}
+
+	args := make([]interface{}, len(noteIDs))
+	for i, id := range noteIDs {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(noteIDs)), ",")
+
+	rows, err := q.Query(`
+		SELECT nt.note_id, t.name FROM note_tags nt
+		JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id IN (`+placeholders+`)
+		ORDER BY nt.inline DESC, t.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID int
+		var name string
+		if err := rows.Scan(&noteID, &name); err != nil {
+			return nil, err
+		}
+		tags[noteID] = append(tags[noteID], name)
+	}
+	return tags, rows.Err()
+}
+
+// FillNoteTags sets the Tags field of every note in the slice
+func FillNoteTags(q Queryer, notes []Note) error {
+	noteIDs := make([]int, len(notes))
+	for i, note := range notes {
+		noteIDs[i] = note.ID
+	}
+
+	tags, err := GetNoteTags(q, noteIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range notes {
+		notes[i].Tags = tags[notes[i].ID]
+		if notes[i].Tags == nil {
+			notes[i].Tags = []string{}
+		}
+	}
+	return nil
+}
+
+// DeleteUnusedTags removes tags that are no longer attached to any note
+func DeleteUnusedTags(q Queryer) error {
+	_, err := q.Exec("DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM note_tags)")
+	return err
+}
+
+// ListTags returns the tags of live notes with how many notes carry each
+func (s *sqlStore) ListTags(byCount bool) ([]Tag, error) {
+	order := "lower(t.name) ASC"
+	if byCount {
+		order = "note_count DESC, lower(t.name) ASC"
+	}
+
+	rows, err := s.q.Query(`
+		SELECT t.id, t.name, t.created_at, COUNT(n.id) AS note_count
+		FROM tags t
+		JOIN note_tags nt ON nt.tag_id = t.id
+		JOIN notes n ON n.id = nt.note_id AND n.deleted_at IS NULL
+		GROUP BY t.id, t.name, t.created_at
+		ORDER BY ` + order)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.CreatedAt, &tag.NoteCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TaggedNotes returns the IDs of live notes carrying any of the tags
+func (s *sqlStore) TaggedNotes(names []string) ([]int, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	return scanInts(s.q.Query(`
+		SELECT DISTINCT n.id FROM notes n
+		JOIN note_tags nt ON nt.note_id = n.id
+		JOIN tags t ON t.id = nt.tag_id
+		WHERE n.deleted_at IS NULL
+		AND lower(t.name) IN (`+strings.TrimSuffix(strings.Repeat("lower(?),", len(names)), ",")+`)
+		ORDER BY n.id`, args...))
+}
+
+// SpellTag makes name the spelling of the tag it names, ignoring case
+func (s *sqlStore) SpellTag(name string) error {
+	_, err := s.q.Exec("UPDATE tags SET name = ? WHERE lower(name) = lower(?)", name, name)
+	return err
+}
+
+// ensureTag returns the ID of the named tag, creating it if needed.
+// Names are compared case-insensitively.
+func ensureTag(q Queryer, name string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		res, err := q.Exec("INSERT INTO tags (name, created_at) VALUES (?, ?)", name, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		newID, _ := res.LastInsertId()
+		return int(newID), nil
+	}
+	return id, err
+}
+
+// backfillNoteTags extracts hashtags from notes written before tags existed
+func backfillNoteTags(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, content FROM notes")
+	if err != nil {
+		return err
+	}
+
+	contents := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		contents[id] = content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, content := range contents {
+		if err := SetNoteTags(tx, id, content, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapProse applies fn to the parts of Markdown content outside fenced code
+// blocks and inline code spans, leaving code unchanged
+func mapProse(content string, fn func(string) string) string {
+	var out, prose strings.Builder
+	flush := func() {
+		out.WriteString(mapOutsideInlineCode(prose.String(), fn))
+		prose.Reset()
+	}
+
+	fence := ""
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if fence == "" {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				flush()
+				fence = trimmed[:3]
+				out.WriteString(line)
+				continue
+			}
+			prose.WriteString(line)
+		} else {
+			out.WriteString(line)
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		}
+	}
+	flush()
+
+	return out.String()
+}
+
+// mapOutsideInlineCode applies fn to text outside `code` spans
+func mapOutsideInlineCode(text string, fn func(string) string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(text, '`')
+		if start < 0 {
+			break
+		}
+
+		ticks := 1
+		for start+ticks < len(text) && text[start+ticks] == '`' {
+			ticks++
+		}
+		closing := strings.Index(text[start+ticks:], strings.Repeat("`", ticks))
+		if closing < 0 {
+			break
+		}
+		end := start + ticks + closing + ticks
+
+		out.WriteString(fn(text[:start]))
+		out.WriteString(text[start:end])
+		text = text[end:]
+	}
+	out.WriteString(fn(text))
+	return out.String()
+}
@@ -0,0 +1,80 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractHashtags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"none", "no tags here", nil},
+		{"start and middle", "#plan for the #release.", []string{"plan", "release"}},
+		{"first spelling wins", "#Work and #work and #WORK", []string{"Work"}},
+		{"unicode", "#café #日本語 #naïve_2", []string{"café", "日本語", "naïve_2"}},
+		{"dashes", "#to-do #trailing- #-lead", []string{"to-do", "trailing"}},
+		{"must start with a letter", "#2024 #_x", nil},
+		{"inside a word", "a#b c_#d", nil},
+		{"headings", "# Title\n## Section", nil},
+		{"entity", "it&#39;s", nil},
+		{"URL fragment", "see http://example.com/#anchor", nil},
+		{"link target, or anything after (", "[up](#top) [x](/page#part) (#aside)", nil},
+		{"after punctuation", "[#one] \"#two\" #three, *#four*", []string{"one", "two", "three", "four"}},
+		{"inline code", "`#code` but #prose and ``#double `tick` ``", []string{"prose"}},
+		{"fenced code", "#before\n```go\n#inside\n```\n~~~\n#tilde\n~~~\n#after", []string{"before", "after"}},
+		{"unclosed fence", "#before\n```\n#inside", []string{"before"}},
+		{"too long", "#" + strings.Repeat("a", MaxTagLength+1) + " #ok", []string{"ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExtractHashtags(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractHashtags(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTagName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"work", "work", true},
+		{"  #Work ", "Work", true},
+		{"to-do", "to-do", true},
+		{"", "", false},
+		{"#", "", false},
+		{"two words", "", false},
+		{"2024", "", false},
+		{"trailing-", "", false},
+		{strings.Repeat("a", MaxTagLength), strings.Repeat("a", MaxTagLength), true},
+		{strings.Repeat("a", MaxTagLength+1), "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := NormalizeTagName(tt.name); got != tt.want || ok != tt.ok {
+			t.Errorf("NormalizeTagName(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRewriteHashtag(t *testing.T) {
+	tests := []struct {
+		content, from, to, want string
+	}{
+		{"#todo and #ToDo", "todo", "tasks", "#tasks and #tasks"},
+		{"#todo-later #todo", "todo", "tasks", "#todo-later #tasks"},
+		{"drop #todo here", "todo", "", "drop todo here"},
+		{"`#todo` #todo", "todo", "done", "`#todo` #done"},
+		{"```\n#todo\n```\n#todo", "todo", "done", "```\n#todo\n```\n#done"},
+	}
+	for _, tt := range tests {
+		if got := RewriteHashtag(tt.content, tt.from, tt.to); got != tt.want {
+			t.Errorf("RewriteHashtag(%q, %q, %q) = %q, want %q", tt.content, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
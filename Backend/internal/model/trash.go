@@ -0,0 +1,309 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// AttachmentDir is where uploaded files are stored
+var AttachmentDir = "data/attachments"
+
+// TrashRetention is how long items stay in the trash before the purger
+// removes them for good. Zero disables automatic purging.
+var TrashRetention = 30 * 24 * time.Hour
+
+// TrashItem represents a deleted note, folder or attachment
+type TrashItem struct {
+	Type      string     `json:"type"` // "note", "folder" or "attachment"
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`                // Note title, folder name or file name
+	ParentID  *int       `json:"parent_id,omitempty"` // Folder of a note, note of an attachment
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at"` // nil if automatic purging is disabled
+}
+
+// PurgeResult counts what a purge permanently removed
+type PurgeResult struct {
+	Notes       int `json:"notes"`
+	Folders     int `json:"folders"`
+	Attachments int `json:"attachments"`
+}
+
+// ListTrash returns the trashed notes, folders and attachments, most
+// recently deleted first
+func (s *sqlStore) ListTrash() ([]TrashItem, error) {
+	queries := []struct {
+		itemType string
+		query    string
+	}{
+		{"note", "SELECT id, title, folder_id, deleted_at FROM notes WHERE deleted_at IS NOT NULL"},
+		{"folder", "SELECT id, name, parent_id, deleted_at FROM folders WHERE deleted_at IS NOT NULL"},
+		{"attachment", "SELECT id, original_name, note_id, deleted_at FROM attachments WHERE deleted_at IS NOT NULL"},
+	}
+
+	var items []TrashItem
+	for _, q := range queries {
+		rows, err := s.q.Query(q.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			item := TrashItem{Type: q.itemType}
+			if err := rows.Scan(&item.ID, &item.Name, &item.ParentID, &item.DeletedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if TrashRetention > 0 {
+				purgeAt := item.DeletedAt.Add(TrashRetention)
+				item.PurgeAt = &purgeAt
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// RestoreNote clears deleted_at on a note and restores its folder if needed
+func (s *sqlStore) RestoreNote(id int) error {
+	return s.inTx(func(tx *sqlStore) error {
+		return tx.restoreNote(id)
+	})
+}
+
+// RestoreFolder clears deleted_at on a folder and its contents
+func (s *sqlStore) RestoreFolder(id int) error {
+	return s.inTx(func(tx *sqlStore) error {
+		return tx.restoreFolder(id, true)
+	})
+}
+
+// RestoreAttachment clears deleted_at on an attachment and restores its
+// note if needed
+func (s *sqlStore) RestoreAttachment(id int) error {
+	return s.inTx(func(tx *sqlStore) error {
+		var noteID int
+		err := tx.q.QueryRow("SELECT note_id FROM attachments WHERE id = ? AND deleted_at IS NOT NULL", id).Scan(&noteID)
+		if err != nil {
+			return notFound(err)
+		}
+
+		var noteDeleted bool
+		err = tx.q.QueryRow("SELECT deleted_at IS NOT NULL FROM notes WHERE id = ?", noteID).Scan(&noteDeleted)
+		if err != nil {
+			return err
+		}
+		if noteDeleted {
+			if err := tx.restoreNote(noteID); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.q.Exec("UPDATE attachments SET deleted_at = NULL WHERE id = ?", id)
+		return err
+	})
+}
+
+// restoreNote clears deleted_at on a note and restores its folder if needed
+func (s *sqlStore) restoreNote(noteID int) error {
+	var folderID *int
+	err := s.q.QueryRow("SELECT folder_id FROM notes WHERE id = ? AND deleted_at IS NOT NULL", noteID).Scan(&folderID)
+	if err != nil {
+		return notFound(err)
+	}
+
+	if folderID != nil {
+		var folderDeleted bool
+		err := s.q.QueryRow("SELECT deleted_at IS NOT NULL FROM folders WHERE id = ?", *folderID).Scan(&folderDeleted)
+		if err == sql.ErrNoRows {
+			// Folder was purged in the meantime
+			folderID = nil
+		} else if err != nil {
+			return err
+		} else if folderDeleted {
+			if err := s.restoreFolder(*folderID, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Bump updated_at so devices that applied the deletion fetch it again
+	_, err = s.q.Exec("UPDATE notes SET deleted_at = NULL, folder_id = ?, updated_at = ? WHERE id = ?", folderID, time.Now().UTC(), noteID)
+	return err
+}
+
+// restoreFolder clears deleted_at on a folder unless its name is now taken.
+// Deleted parent folders are restored first. With contents, subfolders and
+// notes deleted at the same moment (a recursive delete) are restored too.
+func (s *sqlStore) restoreFolder(folderID int, contents bool) error {
+	var name string
+	var parentID *int
+	var deletedAt time.Time
+	err := s.q.QueryRow(
+		"SELECT name, parent_id, deleted_at FROM folders WHERE id = ? AND deleted_at IS NOT NULL",
+		folderID,
+	).Scan(&name, &parentID, &deletedAt)
+	if err != nil {
+		return notFound(err)
+	}
+
+	if parentID != nil {
+		var parentDeleted bool
+		err := s.q.QueryRow("SELECT deleted_at IS NOT NULL FROM folders WHERE id = ?", *parentID).Scan(&parentDeleted)
+		if err == sql.ErrNoRows {
+			// Parent was purged in the meantime
+			parentID = nil
+		} else if err != nil {
+			return err
+		} else if parentDeleted {
+			if err := s.restoreFolder(*parentID, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	taken, err := FolderNameTaken(s.q, name, parentID, folderID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrNameTaken
+	}
+
+	_, err = s.q.Exec("UPDATE folders SET deleted_at = NULL, parent_id = ? WHERE id = ?", parentID, folderID)
+	if err != nil || !contents {
+		return err
+	}
+
+	_, err = s.q.Exec("UPDATE notes SET deleted_at = NULL, updated_at = ? WHERE folder_id = ? AND deleted_at = ?", time.Now().UTC(), folderID, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	childIDs, err := scanInts(s.q.Query("SELECT id FROM folders WHERE parent_id = ? AND deleted_at = ?", folderID, deletedAt))
+	if err != nil {
+		return err
+	}
+	for _, childID := range childIDs {
+		if err := s.restoreFolder(childID, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeTrash permanently removes trashed items deleted at or before the
+// given time, including attachments of purged notes and files on disk that
+// no other attachment uses.
+// Notes and subfolders left in a purged folder are moved to the top level.
+func (s *sqlStore) PurgeTrash(before time.Time) (PurgeResult, error) {
+	var result PurgeResult
+	// deleted_at is always written in UTC so it compares correctly as text
+	before = before.UTC()
+
+	// Collect files first; they are removed only after the commit succeeds
+	var filenames []string
+	err := s.inTx(func(tx *sqlStore) error {
+		result = PurgeResult{}
+		rows, err := tx.q.Query(`
+			SELECT DISTINCT filename FROM attachments
+			WHERE (deleted_at IS NOT NULL AND deleted_at <= ?)
+				OR note_id IN (SELECT id FROM notes WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+			before, before)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var filename string
+			if err := rows.Scan(&filename); err != nil {
+				rows.Close()
+				return err
+			}
+			filenames = append(filenames, filename)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		res, err := tx.q.Exec(`
+			DELETE FROM attachments
+			WHERE (deleted_at IS NOT NULL AND deleted_at <= ?)
+				OR note_id IN (SELECT id FROM notes WHERE deleted_at IS NOT NULL AND deleted_at <= ?)`,
+			before, before)
+		if err != nil {
+			return err
+		}
+		count, _ := res.RowsAffected()
+		result.Attachments = int(count)
+
+		res, err = tx.q.Exec("DELETE FROM notes WHERE deleted_at IS NOT NULL AND deleted_at <= ?", before)
+		if err != nil {
+			return err
+		}
+		count, _ = res.RowsAffected()
+		result.Notes = int(count)
+
+		_, err = tx.q.Exec(
+			"UPDATE notes SET folder_id = NULL WHERE folder_id IN (SELECT id FROM folders WHERE deleted_at IS NOT NULL AND deleted_at <= ?)",
+			before,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.q.Exec(
+			"UPDATE folders SET parent_id = NULL WHERE parent_id IN (SELECT id FROM folders WHERE deleted_at IS NOT NULL AND deleted_at <= ?)",
+			before,
+		)
+		if err != nil {
+			return err
+		}
+
+		res, err = tx.q.Exec("DELETE FROM folders WHERE deleted_at IS NOT NULL AND deleted_at <= ?", before)
+		if err != nil {
+			return err
+		}
+		count, _ = res.RowsAffected()
+		result.Folders = int(count)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Blobs still used by other attachments are kept
+	RemoveUnusedFiles(s, filenames)
+
+	return result, nil
+}
+
+// StartTrashPurger periodically removes items older than TrashRetention
+func StartTrashPurger(trash TrashStore, interval time.Duration) {
+	if TrashRetention == 0 {
+		logging.Infof("Automatic trash purging is disabled")
+		return
+	}
+
+	go func() {
+		for {
+			result, err := trash.PurgeTrash(time.Now().Add(-TrashRetention))
+			if err != nil {
+				logging.Errorf("Error purging trash: %v", err)
+			} else if result.Notes+result.Folders+result.Attachments > 0 {
+				logging.Infof("🗑️ Purged %d notes, %d folders, %d attachments from trash",
+					result.Notes, result.Folders, result.Attachments)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// NewUID returns a new global ID for a note, folder or attachment.
+// UUIDv7 IDs sort by creation time, which keeps the uid indexes compact.
+func NewUID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// ValidUID reports whether uid is a well-formed global ID
+func ValidUID(uid string) bool {
+	_, err := uuid.Parse(uid)
+	return err == nil && len(uid) == 36
+}
+
+// LookupID resolves a reference to a row of table ("notes", "folders" or
+// "attachments") that is either its integer ID or its global ID. Integer IDs
+// are returned as-is; an unknown global ID returns sql.ErrNoRows.
+func LookupID(q Queryer, table, ref string) (int, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return id, nil
+	}
+	if !ValidUID(ref) {
+		return 0, sql.ErrNoRows
+	}
+
+	var id int
+	err := q.QueryRow("SELECT id FROM "+table+" WHERE uid = ?", ref).Scan(&id)
+	return id, err
+}
+
+// LookupUID returns the global ID of a row, or nil if id is nil
+func LookupUID(q Queryer, table string, id *int) (*string, error) {
+	if id == nil {
+		return nil, nil
+	}
+	var uid string
+	err := q.QueryRow("SELECT uid FROM "+table+" WHERE id = ?", *id).Scan(&uid)
+	if err != nil {
+		return nil, err
+	}
+	return &uid, nil
+}
+
+// backfillUIDs assigns global IDs to rows created before they existed
+func backfillUIDs(tx *sql.Tx) error {
+	for _, table := range []string{"notes", "folders", "attachments"} {
+		rows, err := tx.Query("SELECT id FROM " + table + " WHERE uid IS NULL")
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if _, err := tx.Exec("UPDATE "+table+" SET uid = ? WHERE id = ?", NewUID(), id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Tombstones of items that are still in the trash can be matched up;
+	// purged items never had a global ID
+	_, err := tx.Exec(`
+		UPDATE tombstones SET entity_uid = CASE entity_type
+			WHEN 'note' THEN (SELECT uid FROM notes WHERE id = entity_id)
+			WHEN 'folder' THEN (SELECT uid FROM folders WHERE id = entity_id)
+			WHEN 'attachment' THEN (SELECT uid FROM attachments WHERE id = entity_id)
+		END
+		WHERE entity_uid IS NULL`)
+	return err
+}
@@ -0,0 +1,171 @@
+package model
+
+import (
+	"backend/internal/logging"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UploadDir holds the partial files of resumable uploads. It is kept apart
+// from AttachmentDir so the integrity check never sees them.
+var UploadDir = "data/uploads"
+
+// MaxAttachmentSize is the largest attachment accepted, in bytes
+var MaxAttachmentSize int64 = 10 << 20
+
+// UploadExpiry is how long a resumable upload may go without receiving a
+// chunk before it is abandoned and removed
+var UploadExpiry = 24 * time.Hour
+
+// Upload is a resumable upload in progress. Offset is the number of bytes
+// received so far.
+type Upload struct {
+	ID           string    `json:"id"`
+	NoteID       int       `json:"note_id"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	Offset       int64     `json:"offset"`
+	SHA256       string    `json:"sha256"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// UploadPath returns the file holding the data received for an upload
+func UploadPath(id string) string {
+	return filepath.Join(UploadDir, id)
+}
+
+// CreateUpload records an upload, setting its CreatedAt and UpdatedAt
+func (s *sqlStore) CreateUpload(upload *Upload) error {
+	now := time.Now().UTC()
+	_, err := s.q.Exec(
+		"INSERT INTO uploads (id, note_id, original_name, size, sha256, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		upload.ID, upload.NoteID, upload.OriginalName, upload.Size, upload.SHA256, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	upload.CreatedAt, upload.UpdatedAt = now, now
+	return fillUploadProgress(upload)
+}
+
+// GetUpload returns an upload with the number of bytes received so far
+func (s *sqlStore) GetUpload(id string) (Upload, error) {
+	var upload Upload
+	err := s.q.QueryRow(
+		"SELECT id, note_id, original_name, size, sha256, created_at, updated_at FROM uploads WHERE id = ?", id,
+	).Scan(&upload.ID, &upload.NoteID, &upload.OriginalName, &upload.Size, &upload.SHA256,
+		&upload.CreatedAt, &upload.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return upload, ErrNotFound
+	}
+	if err != nil {
+		return upload, err
+	}
+	return upload, fillUploadProgress(&upload)
+}
+
+// TouchUpload keeps an upload from expiring
+func (s *sqlStore) TouchUpload(id string) error {
+	_, err := s.q.Exec("UPDATE uploads SET updated_at = ? WHERE id = ?", time.Now().UTC(), id)
+	return err
+}
+
+// DeleteUpload forgets an upload
+func (s *sqlStore) DeleteUpload(id string) error {
+	_, err := s.q.Exec("DELETE FROM uploads WHERE id = ?", id)
+	return err
+}
+
+// ExpiredUploads returns the uploads that received nothing since before
+func (s *sqlStore) ExpiredUploads(before time.Time) ([]string, error) {
+	// updated_at is always written in UTC so it compares correctly as text
+	rows, err := s.q.Query("SELECT id FROM uploads WHERE updated_at <= ?", before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		expired = append(expired, id)
+	}
+	return expired, rows.Err()
+}
+
+// fillUploadProgress sets an upload's Offset from the data received for it
+// and its ExpiresAt from UpdatedAt
+func fillUploadProgress(upload *Upload) error {
+	info, err := os.Stat(UploadPath(upload.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		upload.Offset = info.Size()
+	}
+	upload.ExpiresAt = upload.UpdatedAt.Add(UploadExpiry)
+	return nil
+}
+
+// RemoveUpload forgets an upload and deletes the data received for it
+func RemoveUpload(uploads UploadStore, id string) error {
+	if err := uploads.DeleteUpload(id); err != nil {
+		return err
+	}
+	if err := os.Remove(UploadPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CleanupUploads removes uploads that have received nothing since before
+// the given time, and files in UploadDir that belong to no upload, and
+// returns how many uploads it removed
+func CleanupUploads(uploads UploadStore, before time.Time) (int, error) {
+	expired, err := uploads.ExpiredUploads(before)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range expired {
+		if err := RemoveUpload(uploads, id); err != nil {
+			return 0, err
+		}
+	}
+
+	// Files of uploads whose row is gone, e.g. after a crash mid-completion
+	entries, err := os.ReadDir(UploadDir)
+	if err != nil && !os.IsNotExist(err) {
+		return len(expired), err
+	}
+	for _, entry := range entries {
+		_, err := uploads.GetUpload(entry.Name())
+		if err == ErrNotFound {
+			os.Remove(filepath.Join(UploadDir, entry.Name()))
+		} else if err != nil {
+			return len(expired), err
+		}
+	}
+	return len(expired), nil
+}
+
+// StartUploadCleaner periodically removes abandoned uploads
+func StartUploadCleaner(uploads UploadStore, interval time.Duration) {
+	go func() {
+		for {
+			count, err := CleanupUploads(uploads, time.Now().Add(-UploadExpiry))
+			if err != nil {
+				logging.Errorf("Error cleaning up uploads: %v", err)
+			} else if count > 0 {
+				logging.Infof("🧹 Removed %d abandoned uploads", count)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
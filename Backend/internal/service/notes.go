@@ -0,0 +1,231 @@
+package service
+
+import (
+	"backend/internal/model"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrNoteNotFound is returned for notes that do not exist or are in the trash
+var ErrNoteNotFound = errors.New("note not found")
+
+// ErrFolderNotFound is returned when a note is put in a folder that does
+// not exist or is in the trash
+var ErrFolderNotFound = errors.New("folder not found")
+
+// Origin tells NotesService where changes come from, since sync clients
+// get a say in some things the REST API decides by itself
+type Origin int
+
+const (
+	FromAPI  Origin = iota // REST handlers, tools and importers
+	FromSync               // Notes sent by a device in POST /sync
+)
+
+// NotesService owns the rules for creating, changing, moving and deleting
+// notes, so the REST API, sync and any other caller apply them the same
+// way:
+//   - a note's content must fit model.Quotas
+//   - a note can only be put in a folder that exists; from sync, which
+//     cannot refuse a device's note, it goes to the top level instead
+//   - a note created without an order_index, or moved to another folder,
+//     goes after the notes already there; otherwise a positive
+//     order_index is kept
+//   - the API stamps created_at and updated_at with the current time; sync
+//     keeps the device's, which last-write-wins depends on
+//   - the server assigns integer IDs, even to notes from sync, where two
+//     devices may have picked the same one offline; sync keeps the global
+//     ID a device gave a note
+//
+// Each change runs in one transaction of the stores.
+type NotesService struct {
+	stores model.Stores
+	origin Origin
+}
+
+// NewNotesService returns a service working on stores for changes from origin
+func NewNotesService(stores model.Stores, origin Origin) *NotesService {
+	return &NotesService{stores: stores, origin: origin}
+}
+
+// ValidateNote checks a note against the rules that do not depend on what
+// is stored, so a batch of notes can be checked before any is saved
+func ValidateNote(note model.Note) error {
+	return model.CheckNoteSize(note.Content)
+}
+
+// List returns the notes matching filter
+func (s *NotesService) List(filter model.NoteFilter) ([]model.Note, error) {
+	if filter.FolderID != nil {
+		if _, err := s.stores.Folders.GetFolder(*filter.FolderID); err == model.ErrNotFound {
+			return nil, ErrFolderNotFound
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return s.stores.Notes.ListNotes(filter)
+}
+
+// Get returns a note by its integer or global ID
+func (s *NotesService) Get(ref string) (model.Note, error) {
+	note, err := s.stores.Notes.GetNote(ref)
+	if err == model.ErrNotFound {
+		return note, ErrNoteNotFound
+	}
+	return note, err
+}
+
+// Create adds a note, filling in its ID, UID, order, timestamps and tags
+func (s *NotesService) Create(note *model.Note) error {
+	if err := ValidateNote(*note); err != nil {
+		return err
+	}
+	note.ID = 0
+	if s.origin == FromAPI {
+		note.UID = ""
+	}
+
+	return s.stores.InTx(func(stores model.Stores) error {
+		folderID, err := s.folder(stores, note.FolderID)
+		if err != nil {
+			return err
+		}
+		note.FolderID = folderID
+
+		if note.OrderIndex <= 0 {
+			if note.OrderIndex, err = endOfFolder(stores, folderID); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now().UTC()
+		note.CreatedAt = s.stamp(note.CreatedAt, now)
+		note.UpdatedAt = s.stamp(note.UpdatedAt, now)
+		return stores.Notes.CreateNote(note)
+	})
+}
+
+// Update saves a note's title, content, folder, order and tags, filling in
+// the fields it does not change
+func (s *NotesService) Update(note *model.Note) error {
+	if err := ValidateNote(*note); err != nil {
+		return err
+	}
+
+	return s.stores.InTx(func(stores model.Stores) error {
+		current, err := stores.Notes.GetNote(strconv.Itoa(note.ID))
+		if err == model.ErrNotFound {
+			return ErrNoteNotFound
+		} else if err != nil {
+			return err
+		}
+
+		folderID, err := s.folder(stores, note.FolderID)
+		if err != nil {
+			return err
+		}
+		note.FolderID = folderID
+
+		if !sameFolder(current.FolderID, folderID) {
+			if note.OrderIndex, err = endOfFolder(stores, folderID); err != nil {
+				return err
+			}
+		} else if note.OrderIndex <= 0 {
+			note.OrderIndex = current.OrderIndex
+		}
+
+		note.UID = current.UID
+		note.CreatedAt = current.CreatedAt
+		note.UpdatedAt = s.stamp(note.UpdatedAt, time.Now().UTC())
+		return stores.Notes.UpdateNote(note)
+	})
+}
+
+// Restore takes a note out of the trash, with its folder if that is in the
+// trash too, and puts it after the notes now in its folder. A note whose
+// folder has been purged goes to the top level. It returns ErrNoteNotFound
+// if the note is not in the trash.
+func (s *NotesService) Restore(id int) (model.Note, error) {
+	var note model.Note
+	err := s.stores.InTx(func(stores model.Stores) error {
+		if stores.Trash == nil {
+			return ErrNoteNotFound
+		}
+		err := stores.Trash.RestoreNote(id)
+		if err == model.ErrNotFound {
+			return ErrNoteNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if note, err = stores.Notes.GetNote(strconv.Itoa(id)); err != nil {
+			return err
+		}
+		if note.OrderIndex, err = endOfFolder(stores, note.FolderID); err != nil {
+			return err
+		}
+		note.Tags = nil
+		note.UpdatedAt = time.Time{}
+		return NewNotesService(stores, s.origin).Update(&note)
+	})
+	return note, err
+}
+
+// Delete moves a note to the trash
+func (s *NotesService) Delete(id int) error {
+	err := s.stores.Notes.TrashNote(id)
+	if err == model.ErrNotFound {
+		return ErrNoteNotFound
+	}
+	return err
+}
+
+// Reorder sets the order_index of notes in a folder
+func (s *NotesService) Reorder(folderID int, order map[int]int) error {
+	if _, err := s.stores.Folders.GetFolder(folderID); err == model.ErrNotFound {
+		return ErrFolderNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.stores.Notes.ReorderNotes(folderID, order)
+}
+
+// folder checks the folder a note is put in and returns the one to use
+func (s *NotesService) folder(stores model.Stores, folderID *int) (*int, error) {
+	if folderID == nil {
+		return nil, nil
+	}
+	_, err := stores.Folders.GetFolder(*folderID)
+	if err == model.ErrNotFound {
+		if s.origin == FromSync {
+			return nil, nil
+		}
+		return nil, ErrFolderNotFound
+	}
+	return folderID, err
+}
+
+// stamp returns the timestamp to record: the current time from the API, or
+// the device's own from sync if it sent one
+func (s *NotesService) stamp(sent, now time.Time) time.Time {
+	if s.origin == FromSync && !sent.IsZero() {
+		return sent.UTC()
+	}
+	return now
+}
+
+// endOfFolder returns the order_index that puts a note after the others
+// in a folder
+func endOfFolder(stores model.Stores, folderID *int) (int, error) {
+	maxOrder, err := stores.Notes.MaxOrderIndex(folderID)
+	return maxOrder + 1, err
+}
+
+// sameFolder reports whether two nullable folder IDs are equal
+func sameFolder(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
@@ -1,8 +0,0 @@
-package service
-
-type Service struct{}
-
-func (s *Service) ProcessData(data interface{}) error {
-    // Implement data processing logic here
-    return nil
-}
\ No newline at end of file